@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/passwd"
+	"github.com/knadh/niltalk/internal/totp"
+	"github.com/knadh/niltalk/store"
+)
+
+// handleGetFeatures returns the feature rollouts configured on the hub.
+func handleGetFeatures(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+	respondJSON(w, app.hub.GetRollouts(), nil, http.StatusOK)
+}
+
+// handleUpdateFeature sets the rollout of a feature. The change applies to
+// rooms activated after it.
+func handleUpdateFeature(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx     = r.Context().Value("ctx").(*reqCtx)
+		app     = ctx.app
+		feature = chi.URLParam(r, "feature")
+	)
+
+	var req hub.Rollout
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	if !hub.KnownFeature(feature) {
+		respondJSON(w, nil, errors.New("unknown feature"), http.StatusNotFound)
+		return
+	}
+	if req.Percent < 0 || req.Percent > 100 {
+		respondJSON(w, nil, errors.New("invalid percent (0 - 100)"), http.StatusBadRequest)
+		return
+	}
+
+	app.hub.SetRollout(feature, req)
+	app.logger.Printf("feature rollout updated: %s: %d%% %v", feature, req.Percent, req.Rooms)
+	respondJSON(w, app.hub.GetRollouts(), nil, http.StatusOK)
+}
+
+// tenantInfo represents a tenant (vhost) and the defaults of its rooms.
+type tenantInfo struct {
+	ID           string     `json:"id"`
+	Hosts        []string   `json:"hosts"`
+	Name         string     `json:"name"`
+	RootURL      string     `json:"root_url"`
+	MaxRooms     int        `json:"max_rooms"`
+	Presets      []string   `json:"presets"`
+	Features     []string   `json:"features"`
+	RoomDefaults roomPreset `json:"room_defaults"`
+}
+
+// tenantInfo returns the tenant info of a vhost.
+func (app *App) tenantInfo(vh *vhost) tenantInfo {
+	return tenantInfo{
+		ID:           vh.ID,
+		Hosts:        vh.Hosts,
+		Name:         vh.cfg.Name,
+		RootURL:      vh.cfg.RootURL,
+		MaxRooms:     vh.maxRooms,
+		Presets:      vh.presetNames(app.presets),
+		Features:     vh.features,
+		RoomDefaults: app.roomDefaults(vh),
+	}
+}
+
+// handleGetTenants returns the tenants (vhosts) and the defaults of their
+// rooms.
+func handleGetTenants(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	// Vhosts are mapped by each of their hosts.
+	seen := make(map[*vhost]bool)
+	out := []tenantInfo{}
+	for _, vh := range app.vhosts {
+		if seen[vh] {
+			continue
+		}
+		seen[vh] = true
+		out = append(out, app.tenantInfo(vh))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// handleUpdateTenantDefaults sets the defaults of the options of a tenant's
+// rooms. They apply to rooms created after the change and last until the
+// next restart.
+func handleUpdateTenantDefaults(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		tenant = chi.URLParam(r, "tenant")
+	)
+
+	vh := app.tenantVhost(tenant)
+	if vh == nil {
+		respondJSON(w, nil, errors.New("unknown tenant"), http.StatusNotFound)
+		return
+	}
+
+	var req roomPreset
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(vh.cfg); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	app.setRoomDefaults(vh, req)
+	app.hub.Audit.Record("tenant.defaults", "admin", "", map[string]interface{}{
+		"tenant": vh.ID,
+	})
+	respondJSON(w, app.tenantInfo(vh), nil, http.StatusOK)
+}
+
+// handleVerifyRoomChain verifies the message hash chain of a room.
+func handleVerifyRoomChain(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		roomID = chi.URLParam(r, "roomID")
+	)
+
+	if app.hub.MsgCache == nil || !app.cfg.HistoryHashChain {
+		respondJSON(w, nil, errors.New("history hash chain is disabled"), http.StatusNotFound)
+		return
+	}
+
+	// The chain starts from the room's anchor once its head is pruned.
+	room, err := app.hub.ActivateRoom(roomID)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusNotFound)
+		return
+	}
+
+	msgs, err := app.hub.MsgCache.GetMessageCache(roomID)
+	if err != nil {
+		app.logger.Printf("error fetching message cache: %v", err)
+		respondJSON(w, nil, errors.New("error fetching history"), http.StatusInternalServerError)
+		return
+	}
+
+	res := hub.VerifyChain(room.ChainAnchor(), msgs)
+	if !res.Valid {
+		app.logger.Printf("message hash chain broken in room %s at %s", roomID, res.BrokenAt)
+	}
+	respondJSON(w, res, nil, http.StatusOK)
+}
+
+// handleGetRoomDebug returns a snapshot of an active room's internals for
+// troubleshooting.
+func handleGetRoomDebug(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		roomID = chi.URLParam(r, "roomID")
+	)
+
+	room := app.hub.GetRoom(roomID)
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is not active"), http.StatusNotFound)
+		return
+	}
+
+	respondJSON(w, room.Debug(time.Second), nil, http.StatusOK)
+}
+
+// handleGetMetrics returns the instance's load and capacity metrics in the
+// Prometheus text format, eg: for autoscaling.
+func handleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx      = r.Context().Value("ctx").(*reqCtx)
+		app      = ctx.app
+		rooms, _ = app.hub.Stats()
+		c        = app.hub.Capacity()
+	)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP niltalk_rooms Number of active rooms.\n# TYPE niltalk_rooms gauge\nniltalk_rooms %d\n", rooms)
+	fmt.Fprintf(w, "# HELP niltalk_peers Number of connected peers.\n# TYPE niltalk_peers gauge\nniltalk_peers %d\n", c.Peers)
+	fmt.Fprintf(w, "# HELP niltalk_peers_max Peer capacity of the instance (0 = unlimited).\n# TYPE niltalk_peers_max gauge\nniltalk_peers_max %d\n", c.MaxPeers)
+	fmt.Fprintf(w, "# HELP niltalk_peers_reserved Peers reserved by active reservations.\n# TYPE niltalk_peers_reserved gauge\nniltalk_peers_reserved %d\n", c.Reserved)
+	fmt.Fprintf(w, "# HELP niltalk_peers_reserved_upcoming Peak peers reserved in the next hour.\n# TYPE niltalk_peers_reserved_upcoming gauge\nniltalk_peers_reserved_upcoming %d\n", c.ReservedUpcoming)
+}
+
+// importEntry is a message in an imported NDJSON transcript.
+type importEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Handle    string    `json:"handle"`
+	Message   string    `json:"message"`
+}
+
+// handleImportTranscript imports an external NDJSON transcript, one message
+// per line, into a room's history, eg: when migrating a room from another
+// chat tool.
+func handleImportTranscript(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		roomID = chi.URLParam(r, "roomID")
+	)
+
+	room, err := app.hub.ActivateRoom(roomID)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusNotFound)
+		return
+	}
+
+	var (
+		msgs []store.Message
+		now  = time.Now()
+		dec  = json.NewDecoder(r.Body)
+	)
+	defer r.Body.Close()
+	for n := 1; ; n++ {
+		var e importEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			respondJSON(w, nil, fmt.Errorf("error parsing line %d", n), http.StatusBadRequest)
+			return
+		}
+
+		if e.Timestamp.IsZero() || e.Timestamp.After(now) || e.Handle == "" ||
+			e.Message == "" || len(e.Message) > app.cfg.MaxMessageLen {
+			respondJSON(w, nil, fmt.Errorf("invalid message on line %d", n), http.StatusBadRequest)
+			return
+		}
+
+		if len(msgs) >= app.cfg.MaxImportMessages {
+			respondJSON(w, nil, fmt.Errorf("too many messages (max %d)", app.cfg.MaxImportMessages),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		msgs = append(msgs, store.Message{
+			PeerHandle: e.Handle,
+			Message:    e.Message,
+			Timestamp:  e.Timestamp,
+		})
+	}
+
+	if len(msgs) == 0 {
+		respondJSON(w, nil, errors.New("no messages to import"), http.StatusBadRequest)
+		return
+	}
+
+	num, err := room.ImportMessages(msgs)
+	if err == hub.ErrHistoryDisabled {
+		respondJSON(w, nil, err, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		app.logger.Printf("error importing transcript into %s: %v", roomID, err)
+		respondJSON(w, nil, fmt.Errorf("error importing transcript: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	app.logger.Printf("imported %d messages into %s", num, roomID)
+	respondJSON(w, struct {
+		Imported int `json:"imported"`
+	}{num}, nil, http.StatusOK)
+}
+
+// reqOperator is a request to join a room as an operator.
+type reqOperator struct {
+	// One-time password from the authenticator app.
+	OTP      string `json:"otp"`
+	Handle   string `json:"handle"`
+	Duration string `json:"duration"`
+}
+
+// handleJoinAsOperator starts an operator session in any room for support.
+// It requires the admin token and a one-time password. The session cookie
+// is set so that the operator can connect to the room, where they are
+// announced and labeled as an operator. Their actions and messages are
+// recorded in the audit log.
+func handleJoinAsOperator(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	// Operator mode requires 2FA.
+	if app.cfg.AdminTOTPSecret == "" || app.cfg.OperatorMaxDuration <= 0 {
+		respondJSON(w, nil, errors.New("operator mode is disabled"), http.StatusForbidden)
+		return
+	}
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+
+	var req reqOperator
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	if ok, err := totp.Validate(app.cfg.AdminTOTPSecret, req.OTP, time.Now()); !ok {
+		if err != nil {
+			app.logger.Printf("error validating one-time password: %v", err)
+		}
+		app.hub.Audit.Record("operator.denied", req.Handle, room.ID, map[string]interface{}{
+			"ip": clientIP(r, app),
+		})
+		respondJSON(w, nil, errors.New("invalid one-time password"), http.StatusForbidden)
+		return
+	}
+
+	if req.Handle == "" {
+		req.Handle = "Operator"
+	}
+	if len(req.Handle) > 100 {
+		respondJSON(w, nil, errors.New("invalid handle"), http.StatusBadRequest)
+		return
+	}
+
+	dur := app.cfg.OperatorMaxDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			respondJSON(w, nil, errors.New("invalid duration"), http.StatusBadRequest)
+			return
+		}
+		if d < dur {
+			dur = d
+		}
+	}
+
+	sessID, err := hub.GenerateGUID(32)
+	if err != nil {
+		app.logger.Printf("error generating session ID: %v", err)
+		respondJSON(w, nil, errors.New("error generating session ID"), http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		now   = time.Now()
+		until = now.Add(dur)
+	)
+	s := store.Sess{
+		ID:            sessID,
+		Handle:        req.Handle,
+		Device:        "operator",
+		CreatedAt:     now,
+		OperatorUntil: &until,
+	}
+	if err := app.hub.Store.AddSession(s, room.ID, room.TTL()); err != nil {
+		app.logger.Printf("error creating session: %v", err)
+		respondJSON(w, nil, errors.New("error creating session"), http.StatusInternalServerError)
+		return
+	}
+
+	app.hub.Audit.Record("operator.start", req.Handle, room.ID, map[string]interface{}{
+		"session":  hub.SessionKey(sessID),
+		"duration": dur.String(),
+		"until":    until,
+		"ip":       clientIP(r, app),
+	})
+
+	http.SetCookie(w, newCookie(app, app.cfg.SessionCookie, sessID, 0))
+	respondJSON(w, struct {
+		Handle string    `json:"handle"`
+		Until  time.Time `json:"until"`
+	}{req.Handle, until}, nil, http.StatusOK)
+}
+
+// weakRoom represents a room whose password falls below the policy.
+type weakRoom struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	SetAt     *time.Time `json:"password_set_at"`
+
+	// Reasons the password is weak. "none" if the room's owner has removed
+	// its password and "unknown" if the room predates the recording of
+	// password metadata.
+	Weaknesses []string `json:"weaknesses"`
+
+	// Action the weak password policy takes on the room if it's due.
+	Action string `json:"action,omitempty"`
+}
+
+// handleGetWeakPasswords lists the rooms whose passwords fall below the
+// configured password policy. Passwords are audited with the metadata
+// recorded when they were set and their hashes.
+func handleGetWeakPasswords(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	rooms, err := app.hub.Store.GetRooms()
+	if err != nil {
+		app.logger.Printf("error fetching rooms: %v", err)
+		respondJSON(w, nil, errors.New("error fetching rooms"), http.StatusInternalServerError)
+		return
+	}
+
+	out := []weakRoom{}
+	for _, rm := range rooms {
+		// Rooms without passwords are listed, but the policy doesn't apply to
+		// them as there's no password to rotate or expire.
+		if len(rm.Password) == 0 {
+			out = append(out, weakRoom{ID: rm.ID, Name: rm.Name, CreatedAt: rm.CreatedAt,
+				Weaknesses: []string{"none"}})
+			continue
+		}
+
+		meta := rm.Opts.PasswordMeta
+		if meta == nil {
+			out = append(out, weakRoom{ID: rm.ID, Name: rm.Name, CreatedAt: rm.CreatedAt,
+				Weaknesses: []string{"unknown"}})
+			continue
+		}
+
+		weak := app.passwd.Audit(meta.Length, meta.Entropy, rm.Password)
+		if len(weak) == 0 {
+			continue
+		}
+		wr := weakRoom{ID: rm.ID, Name: rm.Name, CreatedAt: rm.CreatedAt, SetAt: &meta.SetAt, Weaknesses: weak}
+		if app.hub.WeakPasswordDue(meta) {
+			wr.Action = app.cfg.WeakPasswordPolicy
+		}
+		out = append(out, wr)
+	}
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// weakPasswordAction returns the action of the weak password policy that's
+// due on a room, if any. Rooms without passwords are exempt.
+func weakPasswordAction(app *App, room *hub.Room) string {
+	if app.cfg.WeakPasswordPolicy == "" || !room.HasPassword() {
+		return ""
+	}
+
+	meta := room.PasswordMeta()
+	if !app.hub.WeakPasswordDue(meta) ||
+		len(app.passwd.Audit(meta.Length, meta.Entropy, room.PasswordHash())) == 0 {
+		return ""
+	}
+	return app.cfg.WeakPasswordPolicy
+}
+
+// handleSetRoomPassword sets a new password for a room, eg: to rotate a
+// weak password.
+func handleSetRoomPassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		roomID = chi.URLParam(r, "roomID")
+	)
+
+	var req reqRoom
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if err := app.passwd.Validate(req.Password); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	room, err := app.hub.ActivateRoom(roomID)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusNotFound)
+		return
+	}
+
+	hash, err := app.passwd.Hash(req.Password)
+	if err != nil {
+		app.logger.Printf("error hashing password: %v", err)
+		respondJSON(w, nil, errors.New("error hashing password"), http.StatusInternalServerError)
+		return
+	}
+	if err := room.SetPassword(hash, passwordMeta(req.Password)); err != nil {
+		app.logger.Printf("error updating room password: %v", err)
+		respondJSON(w, nil, errors.New("error updating password"), http.StatusInternalServerError)
+		return
+	}
+
+	app.hub.Audit.Record("room.password", "admin", roomID, nil)
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// passwordMeta returns the metadata of a password that's being set.
+func passwordMeta(pwd string) store.PasswordMeta {
+	return store.PasswordMeta{
+		Length:  len(pwd),
+		Entropy: passwd.Entropy(pwd),
+		SetAt:   time.Now(),
+	}
+}
+
+// reqAnnouncement is a server announcement to all rooms.
+type reqAnnouncement struct {
+	Message string `json:"message"`
+}
+
+// handleAnnounce broadcasts a server announcement to all the active rooms.
+func handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	var req reqAnnouncement
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" || len(req.Message) > app.cfg.MaxMessageLen {
+		respondJSON(w, nil, errors.New("message is empty or too long"), http.StatusBadRequest)
+		return
+	}
+
+	n := app.hub.Announce(req.Message)
+	app.hub.Audit.Record("admin.announce", "admin", "", map[string]interface{}{
+		"message": req.Message,
+		"rooms":   n,
+	})
+	respondJSON(w, struct {
+		Rooms int `json:"rooms"`
+	}{n}, nil, http.StatusOK)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// anonymizer replaces the handles and peer IDs in exported messages with
+// pseudonyms (Participant 1, 2 ...) so that transcripts can be shared
+// without exposing the identities of participants. Pseudonyms are assigned
+// in the order in which participants first appear in a room's history so
+// that they're stable across exports of different windows of the history.
+type anonymizer struct {
+	names map[string]string
+
+	// Handles, longest first, to replace in message text, eg: in mentions
+	// and system messages.
+	handles []string
+}
+
+// newAnonymizer assigns pseudonyms to the participants in a room's history.
+func newAnonymizer(msgs []store.Message) *anonymizer {
+	a := &anonymizer{names: make(map[string]string)}
+	for _, m := range msgs {
+		if m.PeerHandle == "" {
+			continue
+		}
+		if _, ok := a.names[m.PeerHandle]; ok {
+			continue
+		}
+		a.names[m.PeerHandle] = fmt.Sprintf("Participant %d", len(a.names)+1)
+		a.handles = append(a.handles, m.PeerHandle)
+	}
+
+	// Longer handles are matched first so that handles that are prefixes of
+	// other handles don't break them up.
+	sort.SliceStable(a.handles, func(i, j int) bool {
+		return len(a.handles[i]) > len(a.handles[j])
+	})
+	return a
+}
+
+// apply returns anonymized copies of messages. Message IDs, hashes, and the
+// times delayed messages were composed at are stripped as well.
+func (a *anonymizer) apply(msgs []store.Message) []store.Message {
+	out := make([]store.Message, 0, len(msgs))
+	for _, m := range msgs {
+		o := store.Message{
+			Type:      m.Type,
+			Message:   a.replace(m.Message),
+			Seq:       m.Seq,
+			Timestamp: m.Timestamp,
+			Imported:  m.Imported,
+			Delayed:   m.Delayed,
+		}
+		if m.Poll != nil {
+			p := *m.Poll
+			p.Question = a.replace(p.Question)
+			p.Options = make([]string, len(m.Poll.Options))
+			for i, opt := range m.Poll.Options {
+				p.Options[i] = a.replace(opt)
+			}
+			o.Poll = &p
+		}
+		if name, ok := a.names[m.PeerHandle]; ok {
+			o.PeerHandle = name
+			o.PeerID = strings.ToLower(strings.Replace(name, " ", "-", 1))
+		}
+		// Mentions of handles that never posted are dropped.
+		for _, h := range m.Mentions {
+			if name := a.name(h); name != "" {
+				o.Mentions = append(o.Mentions, name)
+			}
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// name returns the pseudonym of a mentioned handle, which is matched
+// case-insensitively.
+func (a *anonymizer) name(handle string) string {
+	if name, ok := a.names[handle]; ok {
+		return name
+	}
+	for h, name := range a.names {
+		if strings.EqualFold(h, handle) {
+			return name
+		}
+	}
+	return ""
+}
+
+// replace replaces whole word occurrences of handles in a message's text
+// with pseudonyms.
+func (a *anonymizer) replace(s string) string {
+	if len(a.handles) == 0 {
+		return s
+	}
+
+	var (
+		b    strings.Builder
+		prev rune = -1
+	)
+	for i := 0; i < len(s); {
+		if !isWordRune(prev) {
+			if h := a.match(s[i:]); h != "" {
+				b.WriteString(a.names[h])
+				i += len(h)
+				prev, _ = utf8.DecodeLastRuneInString(h)
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(s[i : i+size])
+		prev = r
+		i += size
+	}
+	return b.String()
+}
+
+// match returns the longest handle that s starts with as a whole word.
+func (a *anonymizer) match(s string) string {
+	for _, h := range a.handles {
+		if !strings.HasPrefix(s, h) {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(s[len(h):]); len(s) > len(h) && isWordRune(r) {
+			continue
+		}
+		return h
+	}
+	return ""
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knadh/niltalk/internal/audit"
+)
+
+const (
+	auditPerPage    = 50
+	auditMaxPerPage = 500
+)
+
+// auditResp is a page of audit events.
+type auditResp struct {
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	Results []audit.Event `json:"results"`
+}
+
+// handleGetAuditLog queries the audit log. Results are sorted newest first.
+//
+// Query params: action (an action or a prefix ending in ".", eg: "room."),
+// actor, room (room ID), from and to (YYYY-MM-DD, UTC) or preset, page, and
+// per_page.
+func handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+		q   = r.URL.Query()
+	)
+
+	_, from, to, err := historyWindow(r, time.UTC)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		respondJSON(w, nil, errors.New("invalid page"), http.StatusBadRequest)
+		return
+	}
+	perPage, err := queryInt(q.Get("per_page"), auditPerPage)
+	if err != nil || perPage < 1 || perPage > auditMaxPerPage {
+		respondJSON(w, nil, errors.New("invalid per_page (1 - 500)"), http.StatusBadRequest)
+		return
+	}
+
+	f := audit.Filter{
+		Action: q.Get("action"),
+		Actor:  q.Get("actor"),
+		RoomID: q.Get("room"),
+		From:   from,
+		To:     to,
+	}
+	events, total, err := app.hub.Audit.Query(f, (page-1)*perPage, perPage)
+	if err != nil {
+		app.logger.Printf("error querying audit log: %v", err)
+		respondJSON(w, nil, errors.New("error querying audit log"), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, auditResp{
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+		Results: events,
+	}, nil, http.StatusOK)
+}
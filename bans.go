@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/store"
+)
+
+// Maximum length of a ban's reason.
+const maxBanReason = 200
+
+// handleGetBans returns a room's bans to its owner.
+func handleGetBans(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if _, ok := roomOwner(r, ctx); !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	bans := room.Bans()
+	for i := range bans {
+		bans[i] = ownerBan(bans[i])
+	}
+	respondJSON(w, bans, nil, http.StatusOK)
+}
+
+// handleBanPeer bans a peer from a room. The ban is persisted with the room
+// and the peer's sessions are removed.
+func handleBanPeer(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	actor, ok := roomOwner(r, ctx)
+	if !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		PeerID string `json:"peer_id"`
+		Reason string `json:"reason"`
+	}
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.PeerID == "" {
+		respondJSON(w, nil, errors.New("invalid peer_id"), http.StatusBadRequest)
+		return
+	}
+	if len(req.Reason) > maxBanReason {
+		respondJSON(w, nil, errors.New("reason is too long"), http.StatusBadRequest)
+		return
+	}
+
+	b, err := room.BanPeer(req.PeerID, req.Reason, actor)
+	if err != nil {
+		switch err {
+		case hub.ErrPeerNotFound:
+			respondJSON(w, nil, err, http.StatusNotFound)
+			return
+		case hub.ErrBanOwner, hub.ErrTooManyBans:
+			respondJSON(w, nil, err, http.StatusBadRequest)
+			return
+		}
+		app.logger.Printf("error banning peer: %v", err)
+		respondJSON(w, nil, errors.New("error banning peer"), http.StatusInternalServerError)
+		return
+	}
+
+	app.hub.Audit.Record("peer.ban", actor, room.ID, map[string]interface{}{
+		"ban":    b.ID,
+		"peer":   b.SessionKey,
+		"reason": b.Reason,
+	})
+	respondJSON(w, ownerBan(b), nil, http.StatusOK)
+}
+
+// ownerBan returns a ban as it's shown to the room's owner. The IP hash is
+// persisted with the ban to match the peer's IP, but it isn't shown as it
+// identifies the IP.
+func ownerBan(b store.Ban) store.Ban {
+	b.IPHash = ""
+	return b
+}
+
+// handleUnbanPeer removes a ban from a room.
+func handleUnbanPeer(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx   = r.Context().Value("ctx").(*reqCtx)
+		app   = ctx.app
+		room  = ctx.room
+		banID = chi.URLParam(r, "banID")
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	actor, ok := roomOwner(r, ctx)
+	if !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	if err := room.Unban(banID); err != nil {
+		if err == hub.ErrBanNotFound {
+			respondJSON(w, nil, err, http.StatusNotFound)
+			return
+		}
+		app.logger.Printf("error removing ban: %v", err)
+		respondJSON(w, nil, errors.New("error removing ban"), http.StatusInternalServerError)
+		return
+	}
+
+	app.hub.Audit.Record("peer.unban", actor, room.ID, map[string]interface{}{
+		"ban": banID,
+	})
+	respondJSON(w, true, nil, http.StatusOK)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// compressTypes are the content types of the responses that are compressed.
+// Others, eg: images and PDFs, are already compressed.
+var compressTypes = map[string]bool{
+	"text/html":              true,
+	"text/css":               true,
+	"text/plain":             true,
+	"text/csv":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/json":       true,
+	"image/svg+xml":          true,
+}
+
+// encoder is a streaming compressor that can be reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compress is a middleware that compresses responses with gzip or deflate,
+// whichever the client accepts, if their content types are compressible.
+// Websocket upgrades are passed through.
+func compress(level int) func(http.Handler) http.Handler {
+	pools := map[string]*sync.Pool{
+		"gzip": {New: func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, level)
+			return w
+		}},
+		"deflate": {New: func() interface{} {
+			w, _ := zlib.NewWriterLevel(nil, level)
+			return w
+		}},
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enc := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			if enc == "" || r.Method == http.MethodHead || websocket.IsWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Responses vary by the header even if they aren't compressed.
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			cw := &compressWriter{ResponseWriter: w, enc: enc, pool: pools[enc]}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptedEncoding returns the encoding to compress a response with from
+// an Accept-Encoding header. gzip is preferred over deflate. It's empty if
+// the client accepts neither.
+func acceptedEncoding(h string) string {
+	accepted := make(map[string]bool)
+	for _, v := range strings.Split(h, ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		// q=0 rejects an encoding.
+		ok := true
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+					ok = false
+				}
+			}
+		}
+		accepted[name] = ok
+	}
+
+	for _, enc := range []string{"gzip", "deflate"} {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses a response if its status and headers allow it
+// once the header is written.
+type compressWriter struct {
+	http.ResponseWriter
+
+	enc  string
+	pool *sync.Pool
+
+	// Compressor of the response. It's nil if the response isn't
+	// compressed.
+	w           encoder
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	if cw.compressible(code) {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.enc)
+		h.Del("Content-Length")
+
+		// Validators of the uncompressed representation don't match the
+		// compressed one.
+		if et := h.Get("ETag"); et != "" && !strings.HasPrefix(et, "W/") {
+			h.Set("ETag", "W/"+et)
+		}
+
+		cw.w = cw.pool.Get().(encoder)
+		cw.w.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.w != nil {
+		return cw.w.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// compressible checks if a response with the given status and the headers
+// written so far should be compressed.
+func (cw *compressWriter) compressible(code int) bool {
+	h := cw.Header()
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+
+	ct := h.Get("Content-Type")
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	return compressTypes[strings.TrimSpace(strings.ToLower(ct))]
+}
+
+// Flush flushes the compressed data written so far to the client.
+func (cw *compressWriter) Flush() {
+	if cw.w != nil {
+		cw.w.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the underlying connection.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	return hj.Hijack()
+}
+
+// close finishes the compressed stream and returns the compressor to the
+// pool.
+func (cw *compressWriter) close() {
+	if cw.w == nil {
+		return
+	}
+	cw.w.Close()
+	cw.pool.Put(cw.w)
+	cw.w = nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for h, enc := range map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"gzip":                      "gzip",
+		"deflate":                   "deflate",
+		"deflate, gzip":             "gzip",
+		"GZIP;q=0.5, deflate":       "gzip",
+		"gzip;q=0, deflate":         "deflate",
+		"gzip; q=0.0, deflate;q=0":  "",
+		"br, gzip;q=0.8":            "gzip",
+		"br":                        "",
+		" gzip ; q=1 , deflate;q=0": "gzip",
+	} {
+		if got := acceptedEncoding(h); got != enc {
+			t.Errorf("acceptedEncoding(%q): expected %q, got %q", h, enc, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("hello, world. ", 100)
+	handler := func(ct string, code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"abc"`)
+
+			// Without a content type, it's detected on the first write with
+			// an implicit 200.
+			if ct != "" {
+				w.Header().Set("Content-Type", ct)
+				w.WriteHeader(code)
+			}
+			if code != http.StatusNoContent && code != http.StatusNotModified {
+				io.WriteString(w, body)
+			}
+		})
+	}
+
+	for _, c := range []struct {
+		name   string
+		accept string
+		ct     string
+		code   int
+		enc    string
+	}{
+		{"gzip", "gzip", "text/html; charset=utf-8", http.StatusOK, "gzip"},
+		{"deflate", "deflate", "application/json", http.StatusOK, "deflate"},
+		{"not accepted", "", "text/html", http.StatusOK, ""},
+		{"incompressible type", "gzip", "image/png", http.StatusOK, ""},
+		{"detected type", "gzip", "", http.StatusOK, "gzip"},
+		{"error", "gzip", "text/plain", http.StatusNotFound, "gzip"},
+		{"no content", "gzip", "text/plain", http.StatusNoContent, ""},
+		{"not modified", "gzip", "text/plain", http.StatusNotModified, ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.accept != "" {
+			r.Header.Set("Accept-Encoding", c.accept)
+		}
+		w := httptest.NewRecorder()
+		compress(5)(handler(c.ct, c.code)).ServeHTTP(w, r)
+
+		res := w.Result()
+		if res.StatusCode != c.code {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.code, res.StatusCode)
+		}
+		if enc := res.Header.Get("Content-Encoding"); enc != c.enc {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", c.name, c.enc, enc)
+			continue
+		}
+		if c.accept != "" && res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected Vary: Accept-Encoding", c.name)
+		}
+		if c.code == http.StatusNoContent || c.code == http.StatusNotModified {
+			continue
+		}
+
+		// Compressed responses have weak validators and decompress to the
+		// original body.
+		var rd io.Reader = res.Body
+		switch c.enc {
+		case "gzip":
+			rd, _ = gzip.NewReader(res.Body)
+		case "deflate":
+			rd, _ = zlib.NewReader(res.Body)
+		}
+		if et := res.Header.Get("ETag"); c.enc != "" && et != `W/"abc"` {
+			t.Errorf("%s: expected a weak ETag, got %s", c.name, et)
+		}
+		b, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if string(b) != body {
+			t.Errorf("%s: body doesn't match the original", c.name)
+		}
+	}
+}
+
+// TestCompressHead checks that HEAD requests and websocket upgrades are
+// passed through untouched.
+func TestCompressHead(t *testing.T) {
+	h := compress(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+
+	r := httptest.NewRequest("HEAD", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("expected a HEAD response not to be compressed")
+	}
+
+	r = httptest.NewRequest("GET", "/ws/room", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "" {
+		t.Error("expected a websocket upgrade to be passed through")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// handleGetConnections returns the connections to a room with when they
+// were made, their user agents, and rough locations (if geolocation is
+// configured) to the room's owner for moderation decisions.
+func handleGetConnections(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if _, ok := roomOwner(r, ctx); !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	out := room.Connections(time.Second)
+	if out == nil {
+		out = []hub.PeerConn{}
+	}
+	respondJSON(w, out, nil, http.StatusOK)
+}
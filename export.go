@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/pdf"
+	"github.com/knadh/niltalk/store"
+)
+
+// formattedTranscript is a human readable transcript of a room's history for
+// archiving or emailing as an HTML page or a PDF document.
+type formattedTranscript struct {
+	RoomID     string
+	RoomName   string
+	ExportedAt string
+	Timezone   string
+	Anonymized bool
+	Messages   []formattedMessage
+}
+
+// formattedMessage is a message in a transcript with its timestamp
+// formatted in the transcript's timezone.
+type formattedMessage struct {
+	Time    string
+	Handle  string
+	Message string
+	System  bool
+	Poll    *store.Poll
+}
+
+// newFormattedTranscript prepares the transcript of a room's messages with
+// timestamps in the given timezone.
+func newFormattedTranscript(roomID, roomName string, msgs []store.Message, loc *time.Location, anonymized bool) formattedTranscript {
+	const layout = "Jan 02, 2006 15:04:05 MST"
+
+	t := formattedTranscript{
+		RoomID:     roomID,
+		RoomName:   roomName,
+		ExportedAt: time.Now().In(loc).Format(layout),
+		Timezone:   loc.String(),
+		Anonymized: anonymized,
+		Messages:   make([]formattedMessage, 0, len(msgs)),
+	}
+	for _, m := range msgs {
+		// Poll results are folded into the polls.
+		if m.Type == hub.TypePollResults {
+			continue
+		}
+		t.Messages = append(t.Messages, formattedMessage{
+			Time:    m.Timestamp.In(loc).Format(layout),
+			Handle:  m.PeerHandle,
+			Message: m.Message,
+			System:  m.Type == hub.TypeSystem,
+			Poll:    m.Poll,
+		})
+	}
+	return t
+}
+
+// renderHTMLTranscript renders an HTML transcript with the templates of the
+// given vhost in the given language.
+func renderHTMLTranscript(w io.Writer, app *App, vh *vhost, lang string, t formattedTranscript) error {
+	return app.templates(vh).ExecuteTemplate(w, "transcript", tpl{
+		L:      translator.Lang(lang),
+		Config: vh.cfg,
+		Data: tplData{
+			Title:      t.RoomName,
+			Transcript: t,
+		},
+	})
+}
+
+// renderPDFTranscript renders a transcript as a PDF document in the given
+// language. Characters outside Latin-1 are replaced as the document uses
+// the standard PDF fonts.
+func renderPDFTranscript(w io.Writer, lang string, t formattedTranscript) error {
+	var (
+		l = translator.Lang(lang)
+		d = pdf.New()
+
+		title  = pdf.Style{Size: 16, Bold: true}
+		meta   = pdf.Style{Size: 9, Gray: 0.45}
+		header = pdf.Style{Size: 8, Bold: true, Gray: 0.45}
+		text   = pdf.Style{Size: 10}
+		system = pdf.Style{Size: 10, Gray: 0.45}
+	)
+
+	name := "#" + t.RoomID
+	if t.RoomName != "" {
+		name = fmt.Sprintf("%s (#%s)", t.RoomName, t.RoomID)
+	}
+	d.Text(name, title)
+
+	info := fmt.Sprintf("%s %s - %s: %s", l.T("Exported"), t.ExportedAt, l.T("Timezone"), t.Timezone)
+	if t.Anonymized {
+		info += " - " + l.T("Participants are anonymized")
+	}
+	d.Text(info, meta)
+	d.Space(15)
+
+	for _, m := range t.Messages {
+		d.Text(fmt.Sprintf("%s  %s", m.Time, m.Handle), header)
+
+		switch {
+		case m.Poll != nil:
+			q := m.Poll.Question
+			if m.Poll.Closed {
+				q = fmt.Sprintf("%s (%s)", q, l.T("Poll closed"))
+			}
+			d.Text(q, pdf.Style{Size: 10, Bold: true})
+			for i, o := range m.Poll.Options {
+				var n int
+				if i < len(m.Poll.Votes) {
+					n = m.Poll.Votes[i]
+				}
+				d.Text(fmt.Sprintf("- %s: %d", o, n), text)
+			}
+		case m.System:
+			d.Text(m.Message, system)
+		default:
+			d.Text(m.Message, text)
+		}
+		d.Space(6)
+	}
+
+	_, err := d.WriteTo(w)
+	return err
+}
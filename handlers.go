@@ -1,33 +1,66 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/captcha"
 	"github.com/knadh/niltalk/internal/hub"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/knadh/niltalk/internal/i18n"
+	"github.com/knadh/niltalk/internal/passwd"
+	"github.com/knadh/niltalk/internal/transcript"
+	"github.com/knadh/niltalk/store"
 )
 
 const (
 	hasAuth = 1 << iota
 	hasRoom
+	isAdmin
+	hasCSRF
 )
 
 type sess struct {
-	ID     string
-	Handle string
+	ID       string
+	Handle   string
+	Timezone string
+
+	// End of an operator's support session. nil for regular peers.
+	OperatorUntil *time.Time
+
+	// Session of the room's owner.
+	Owner bool
+
+	// Preferred colour scheme.
+	Scheme string
+
+	// Device link token shared by the peer's sessions.
+	Link string
 }
 
 // reqCtx is the context injected into every request.
 type reqCtx struct {
-	app  *App
-	room *hub.Room
-	sess sess
+	app   *App
+	vhost *vhost
+	room  *hub.Room
+	sess  sess
+
+	// Language of the response.
+	lang string
 }
 
 // jsonResp is the envelope for all JSON API responses.
@@ -38,8 +71,16 @@ type jsonResp struct {
 
 // tplWrap is the envelope for all HTML template executions.
 type tpl struct {
-	Config *hub.Config
-	Data   tplData
+	L       *i18n.Lang
+	Config  *hub.Config
+	Captcha *captcha.Captcha
+	Passwd  *passwd.Passwd
+	Regions []string
+	Presets []string
+	Data    tplData
+
+	// Content hashes of the vhost's static files for Asset.
+	assets map[string]string
 }
 
 type tplData struct {
@@ -47,17 +88,142 @@ type tplData struct {
 	Description string
 	Room        interface{}
 	Auth        bool
+	CSRF        string
+	Status      interface{}
+	Stats       interface{}
+	Transcript  interface{}
+
+	// Colour scheme of the page.
+	Scheme string
 }
 
 type reqRoom struct {
 	Name     string `json:"name"`
 	Handle   string `json:"handle"`
 	Password string `json:"password"`
+	Captcha  string `json:"captcha"`
+	Kiosk    bool   `json:"kiosk"`
+
+	// IANA timezone. The room's default timezone when creating a room,
+	// and the peer's preference when logging in.
+	Timezone string `json:"timezone"`
+
+	// Persistent rooms don't expire.
+	Persistent bool `json:"persistent"`
+
+	// Device link token of another of the peer's sessions to log in as
+	// the same peer from a new device.
+	Link string `json:"link"`
+
+	// Optional capacity reservation for a scheduled event.
+	Reservation *store.Reservation `json:"reservation"`
+
+	// Optional time at which a scheduled room opens and the duration
+	// (eg: 2h) for which it's open.
+	OpensAt  *time.Time `json:"opens_at"`
+	Duration string     `json:"duration"`
+
+	// Optional data residency region the room's data is stored in.
+	Region string `json:"region"`
+
+	// Optional language (eg: de) of the room that overrides the peers'
+	// browser languages.
+	Language string `json:"language"`
+
+	// Optional notification channels the room's events are sent to.
+	Notify []string `json:"notify"`
+
+	// Optional number of recent messages sent to peers when they connect.
+	ReplayMessages int `json:"replay_messages"`
+
+	// Optionally disable logging messages or cap the history's retention.
+	NoLogging      bool `json:"no_logging"`
+	RetentionHours int  `json:"retention_hours"`
+
+	// Optional read-only mode where only the owner and the speakers
+	// (handles) can post.
+	ReadOnly bool     `json:"read_only"`
+	Speakers []string `json:"speakers"`
+
+	// Optional room preset ([presets.<name>]) that pre-fills the options
+	// that aren't set in the request.
+	Preset string `json:"preset"`
+
+	// Key returned to the room's creator that identifies the owner on login.
+	OwnerKey string `json:"owner_key"`
+}
+
+// loginState is the room's state returned on login.
+type loginState struct {
+	Room     roomState       `json:"room"`
+	Self     hub.PeerInfo    `json:"self"`
+	Peers    []hub.PeerInfo  `json:"peers"`
+	Messages []store.Message `json:"messages"`
+}
+
+type roomState struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Kiosk    bool     `json:"kiosk"`
+	Timezone string   `json:"timezone"`
+	Features []string `json:"features"`
+
+	// Features that depend on the deployment's backends, eg: history
+	// isn't available without a message cache.
+	Capabilities hub.Capabilities `json:"capabilities"`
+}
+
+// reqBatch is a batch of messages posted to a room.
+type reqBatch struct {
+	Messages []hub.NewMessage `json:"messages"`
+}
+
+// sessInfo represents a peer's session (device) in a room. ID is the
+// public session key and not the session ID.
+type sessInfo struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
 }
 
-var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
-	return true
-}}
+var upgrader = websocket.Upgrader{}
+
+// checkOrigin returns a websocket origin check that accepts connections from
+// the app's own origin (the request's host or root_url) and the configured
+// allowed origins. "*" allows all origins. Requests without an Origin header
+// aren't from browsers and are allowed.
+func checkOrigin(app *App) (func(r *http.Request) bool, error) {
+	allowed := make(map[string]bool)
+	for _, o := range append([]string{app.cfg.RootURL}, app.cfg.WSAllowedOrigins...) {
+		if o == "" {
+			continue
+		}
+		if o == "*" {
+			return func(r *http.Request) bool { return true }, nil
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid websocket origin: %s", o)
+		}
+		allowed[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+
+	return func(r *http.Request) bool {
+		o := r.Header.Get("Origin")
+		if o == "" {
+			return true
+		}
+		u, err := url.Parse(o)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		return allowed[strings.ToLower(u.Scheme+"://"+u.Host)]
+	}, nil
+}
 
 // handleIndex renders the homepage.
 func handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -66,8 +232,10 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		app = ctx.app
 	)
 	respondHTML("index", tplData{
-		Title: app.cfg.Name,
-	}, http.StatusOK, w, app)
+		Title:  ctx.vhost.cfg.Name,
+		CSRF:   csrfToken(w, r, app),
+		Scheme: pageScheme(ctx),
+	}, http.StatusOK, w, ctx)
 }
 
 // handleRoomPage renders the chat room page.
@@ -79,13 +247,19 @@ func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 	)
 
 	if room == nil {
-		respondHTML("room-not-found", tplData{}, http.StatusNotFound, w, app)
+		respondHTML("room-not-found", tplData{}, http.StatusNotFound, w, ctx)
+		return
+	}
+	if !room.IsOpen() {
+		respondHTML("room-waiting", tplData{Title: room.Name(), Room: room}, http.StatusOK, w, ctx)
 		return
 	}
 
 	out := tplData{
-		Title: room.Name,
-		Room:  room,
+		Title:  room.Name(),
+		Room:   room,
+		CSRF:   csrfToken(w, r, app),
+		Scheme: pageScheme(ctx),
 	}
 	if ctx.sess.ID != "" {
 		out.Auth = true
@@ -95,7 +269,7 @@ func handleRoomPage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	respondHTML("room", out, http.StatusOK, w, app)
+	respondHTML("room", out, http.StatusOK, w, ctx)
 }
 
 // handleLogin authenticates a peer into a room.
@@ -116,10 +290,65 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
 		return
 	}
+	if !room.IsOpen() {
+		respondJSON(w, nil, hub.ErrRoomNotOpen, http.StatusForbidden)
+		return
+	}
 
-	// Validate password.
-	if err := bcrypt.CompareHashAndPassword(room.Password, []byte(req.Password)); err != nil {
-		respondJSON(w, nil, errors.New("incorrect password"), http.StatusForbidden)
+	// Validate password. Rooms without one are open to anyone with the link.
+	if room.HasPassword() {
+		if err := passwd.Compare(room.PasswordHash(), req.Password); err != nil {
+			if err != passwd.ErrMismatch {
+				app.logger.Printf("error comparing password: %v", err)
+			}
+			app.hub.Audit.Record("login.failed", req.Handle, room.ID, map[string]interface{}{
+				"ip": clientIP(r, app),
+			})
+			respondJSON(w, nil, passwd.ErrMismatch, http.StatusForbidden)
+			return
+		}
+	}
+
+	// A device link logs the peer in with the handle of the session it
+	// belongs to.
+	linked, err := linkedSession(app, room, req.Link)
+	if err != nil {
+		app.logger.Printf("error fetching sessions: %v", err)
+		respondJSON(w, nil, errors.New("error fetching sessions"), http.StatusInternalServerError)
+		return
+	}
+	if req.Link != "" && linked.ID == "" {
+		respondJSON(w, nil, errors.New("invalid or expired device link"), http.StatusForbidden)
+		return
+	}
+	allowHandle := ctx.sess.Handle
+	if linked.ID != "" {
+		req.Handle = linked.Handle
+		allowHandle = linked.Handle
+	}
+
+	// Banned peers can't log in again with a fresh session. Kiosk handles
+	// are assigned, so only the IP is checked in kiosk rooms.
+	ipHash := room.HashIP(clientIP(r, app))
+	handle := req.Handle
+	if room.Opts.Kiosk {
+		handle = ""
+	}
+	if !room.IsOwnerKey(req.OwnerKey) && room.IsBanned(ctx.sess.ID, handle, ipHash) {
+		respondJSON(w, nil, hub.ErrBanned, http.StatusForbidden)
+		return
+	}
+
+	// Enforce the weak password policy.
+	switch weakPasswordAction(app, room) {
+	case hub.WeakPasswordRotate:
+		respondJSON(w, nil, errors.New("the room's password is weak and has to be changed by an admin"),
+			http.StatusForbidden)
+		return
+	case hub.WeakPasswordExpire:
+		app.hub.Audit.Record("room.password_expire", "", room.ID, nil)
+		room.Dispose()
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusGone)
 		return
 	}
 
@@ -131,16 +360,98 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := app.hub.Store.AddSession(sessID, req.Handle, room.ID, app.cfg.RoomAge); err != nil {
+	// Kiosk rooms force anonymous handles. Linked devices keep the handle
+	// they're linked to.
+	if room.Opts.Kiosk {
+		if linked.ID == "" {
+			req.Handle = room.NextKioskHandle()
+		}
+	} else if err := room.CheckHandle(req.Handle, allowHandle); err != nil {
+		respondJSON(w, nil, err, http.StatusConflict)
+		return
+	}
+
+	// Sessions of the same peer share a device link. A peer logging in again
+	// from the same browser keeps theirs unless they change their handle.
+	link := linked.Link
+	if link == "" && ctx.sess.Link != "" && strings.EqualFold(ctx.sess.Handle, req.Handle) {
+		link = ctx.sess.Link
+	}
+	if link == "" {
+		if link, err = hub.GenerateGUID(32); err != nil {
+			app.logger.Printf("error generating device link: %v", err)
+			respondJSON(w, nil, errors.New("error generating session ID"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s := store.Sess{
+		ID:        sessID,
+		Handle:    req.Handle,
+		Device:    userAgent(r),
+		Timezone:  validTimezone(req.Timezone),
+		CreatedAt: time.Now(),
+		Owner:     room.IsOwnerKey(req.OwnerKey),
+		IPHash:    ipHash,
+		Link:      link,
+	}
+	if err := app.hub.Store.AddSession(s, room.ID, room.TTL()); err != nil {
 		app.logger.Printf("error creating session: %v", err)
 		respondJSON(w, nil, errors.New("error creating session"), http.StatusInternalServerError)
 		return
 	}
 
+	// Rotate the session. Invalidate the peer's existing session, if any.
+	if ck, _ := r.Cookie(app.cfg.SessionCookie); ck != nil && ck.Value != "" {
+		if err := app.hub.Store.RemoveSession(ck.Value, room.ID); err != nil {
+			app.logger.Printf("error removing old session: %v", err)
+		}
+	}
+
 	// Set the session cookie.
-	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: sessID, Path: "/"}
-	http.SetCookie(w, ck)
-	respondJSON(w, true, nil, http.StatusOK)
+	http.SetCookie(w, newCookie(app, app.cfg.SessionCookie, sessID, 0))
+
+	// Optionally return the room's state so that clients can render it
+	// without further requests.
+	if r.URL.Query().Get("with_state") != "true" {
+		respondJSON(w, true, nil, http.StatusOK)
+		return
+	}
+
+	out := loginState{
+		Room: roomState{
+			ID:       room.ID,
+			Name:     room.Name(),
+			Kiosk:    room.Opts.Kiosk,
+			Timezone: room.Opts.Timezone,
+			Features: room.Features(),
+
+			Capabilities: room.Capabilities(),
+		},
+		Self:     hub.PeerInfo{ID: hub.SessionKey(sessID), Handle: req.Handle},
+		Peers:    room.Peers(time.Second),
+		Messages: []store.Message{},
+	}
+	if out.Peers == nil {
+		out.Peers = []hub.PeerInfo{}
+	}
+
+	// Last N messages.
+	if room.Capabilities().Backfill {
+		msgs, err := app.hub.MsgCache.GetMessageCache(room.ID)
+		if err != nil {
+			app.logger.Printf("error fetching message cache: %v", err)
+		}
+		if n := len(msgs) - app.cfg.MaxCachedMessages; n > 0 {
+			msgs = msgs[n:]
+		}
+		hub.HidePeerIDs(msgs)
+		if msgs != nil {
+			out.Messages = msgs
+		}
+	}
+
+	respondJSON(w, out, nil, http.StatusOK)
 }
 
 // handleLogout logs out a peer.
@@ -163,11 +474,289 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete the session cookie.
-	ck := &http.Cookie{Name: app.cfg.SessionCookie, Value: "", MaxAge: -1, Path: "/"}
-	http.SetCookie(w, ck)
+	http.SetCookie(w, newCookie(app, app.cfg.SessionCookie, "", -1))
 	respondJSON(w, true, nil, http.StatusOK)
 }
 
+// handlePostMessages posts a batch of messages to a room, eg: from bots or
+// imports. The batch counts against the session's batch rate limit as a
+// whole.
+func handlePostMessages(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	var req reqBatch
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 || len(req.Messages) > app.cfg.MaxBatchMessages {
+		respondJSON(w, nil, fmt.Errorf("batch should have 1 - %d messages", app.cfg.MaxBatchMessages),
+			http.StatusBadRequest)
+		return
+	}
+
+	if !app.batchLimiter.AllowN(ctx.sess.ID, len(req.Messages)) {
+		secs := int(math.Ceil(app.batchLimiter.RetryAfter().Seconds() * float64(len(req.Messages))))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		respondJSON(w, nil, errors.New("too many messages. Try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	respondJSON(w, room.PostMessages(ctx.sess.ID, ctx.sess.Handle, ctx.sess.Owner, ctx.sess.OperatorUntil != nil, req.Messages),
+		nil, http.StatusOK)
+}
+
+// handleGetMySessions lists the peer's sessions (devices) in a room, that
+// is, the sessions that share the peer's device link.
+func handleGetMySessions(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	ss, err := app.hub.Store.GetSessions(room.ID)
+	if err != nil {
+		app.logger.Printf("error fetching sessions: %v", err)
+		respondJSON(w, nil, errors.New("error fetching sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	out := []sessInfo{}
+	for _, s := range ss {
+		if !isMySession(s, ctx.sess) {
+			continue
+		}
+		out = append(out, sessInfo{
+			ID:        hub.SessionKey(s.ID),
+			Device:    s.Device,
+			CreatedAt: s.CreatedAt,
+			Current:   s.ID == ctx.sess.ID,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// handleRevokeMySession logs out one of the peer's sessions (devices) and
+// disconnects it.
+func handleRevokeMySession(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+		key  = chi.URLParam(r, "sessID")
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	ss, err := app.hub.Store.GetSessions(room.ID)
+	if err != nil {
+		app.logger.Printf("error fetching sessions: %v", err)
+		respondJSON(w, nil, errors.New("error fetching sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	for _, s := range ss {
+		if !isMySession(s, ctx.sess) || hub.SessionKey(s.ID) != key {
+			continue
+		}
+
+		if err := app.hub.Store.RemoveSession(s.ID, room.ID); err != nil {
+			app.logger.Printf("error removing session: %v", err)
+			respondJSON(w, nil, errors.New("error removing session"), http.StatusInternalServerError)
+			return
+		}
+		room.RevokeSession(s.ID)
+		respondJSON(w, true, nil, http.StatusOK)
+		return
+	}
+
+	respondJSON(w, nil, errors.New("session not found"), http.StatusNotFound)
+}
+
+// handleGetDeviceLink returns the peer's device link with which they can log
+// into the room as themselves from another device. Sessions that predate
+// device links are issued one.
+func handleGetDeviceLink(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" || ctx.sess.OperatorUntil != nil {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	link := ctx.sess.Link
+	if link == "" {
+		s, err := app.hub.Store.GetSession(ctx.sess.ID, room.ID)
+		if err != nil {
+			app.logger.Printf("error fetching session: %v", err)
+			respondJSON(w, nil, errors.New("error checking session"), http.StatusInternalServerError)
+			return
+		}
+		if s.Link, err = hub.GenerateGUID(32); err != nil {
+			app.logger.Printf("error generating device link: %v", err)
+			respondJSON(w, nil, errors.New("error generating device link"), http.StatusInternalServerError)
+			return
+		}
+		if err := app.hub.Store.AddSession(s, room.ID, room.TTL()); err != nil {
+			app.logger.Printf("error updating session: %v", err)
+			respondJSON(w, nil, errors.New("error updating session"), http.StatusInternalServerError)
+			return
+		}
+		link = s.Link
+	}
+
+	// The link is carried in the URL fragment so that it isn't sent to
+	// the server when the page is opened.
+	respondJSON(w, struct {
+		Link string `json:"link"`
+		URL  string `json:"url"`
+	}{link, ctx.vhost.cfg.RootURL + "/r/" + room.ID + "#link=" + link}, nil, http.StatusOK)
+}
+
+// linkedSession returns the session in the room with a device link, if any.
+func linkedSession(app *App, room *hub.Room, link string) (store.Sess, error) {
+	if link == "" {
+		return store.Sess{}, nil
+	}
+	ss, err := app.hub.Store.GetSessions(room.ID)
+	if err != nil {
+		return store.Sess{}, err
+	}
+	for _, s := range ss {
+		if s.Link != "" && subtle.ConstantTimeCompare([]byte(s.Link), []byte(link)) == 1 {
+			return s, nil
+		}
+	}
+	return store.Sess{}, nil
+}
+
+// isMySession checks whether a session in the room is one of the peer's
+// own, ie: the peer's current session or one linked to it.
+func isMySession(s store.Sess, me sess) bool {
+	return s.ID == me.ID || (me.Link != "" && s.Link == me.Link)
+}
+
+// handleSetRoomAge sets the inactivity period after which a room expires.
+// Ages beyond the global cap need the approval of the hub's AgeApprover,
+// which may require the request to carry the admin token.
+func handleSetRoomAge(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Age string `json:"age"`
+	}
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	age, err := time.ParseDuration(req.Age)
+	if err != nil {
+		respondJSON(w, nil, hub.ErrAgeInvalid, http.StatusBadRequest)
+		return
+	}
+
+	d, err := app.hub.ApproveAge(hub.AgeRequest{
+		RoomID:   room.ID,
+		RoomName: room.Name(),
+		Age:      age,
+		Handle:   ctx.sess.Handle,
+	})
+	if err != nil {
+		app.logger.Printf("error approving room age: %v", err)
+		respondJSON(w, nil, errors.New("error approving room age"), http.StatusBadGateway)
+		return
+	}
+
+	switch d.Decision {
+	case hub.AgeApprove:
+	case hub.AgeRequireAdmin:
+		if !hasAdminToken(r, app) {
+			respondJSON(w, nil, errors.New("room age requires admin approval"), http.StatusForbidden)
+			return
+		}
+	default:
+		msg := "room age not approved"
+		if d.Reason != "" {
+			msg += ": " + d.Reason
+		}
+		respondJSON(w, nil, errors.New(msg), http.StatusForbidden)
+		return
+	}
+
+	if err := room.SetAge(age); err != nil {
+		if err == hub.ErrAgeInvalid || err == hub.ErrAgePersistent {
+			respondJSON(w, nil, err, http.StatusBadRequest)
+			return
+		}
+		app.logger.Printf("error updating room age: %v", err)
+		respondJSON(w, nil, errors.New("error updating room age"), http.StatusInternalServerError)
+		return
+	}
+
+	app.hub.Audit.Record("room.age", ctx.sess.Handle, room.ID, map[string]interface{}{
+		"age":      age.String(),
+		"decision": d.Decision,
+	})
+	respondJSON(w, struct {
+		Age string `json:"age"`
+	}{age.String()}, nil, http.StatusOK)
+}
+
 // handleWS handles incoming connections.
 func handleWS(w http.ResponseWriter, r *http.Request) {
 	var (
@@ -180,16 +769,266 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
 		return
 	}
+	if !room.IsOpen() {
+		respondJSON(w, nil, hub.ErrRoomNotOpen, http.StatusForbidden)
+		return
+	}
+	if !ctx.sess.Owner && room.IsBanned(ctx.sess.ID, ctx.sess.Handle, room.HashIP(clientIP(r, app))) {
+		respondJSON(w, nil, hub.ErrBanned, http.StatusForbidden)
+		return
+	}
+
+	// Wait for admission to protect against reconnect storms.
+	admitted := app.wsQueue.Admit()
 
 	// Create the WS connection.
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		app.logger.Printf("Websocket upgrade failed: %s: %v", r.RemoteAddr, err)
+		app.logger.Printf("Websocket upgrade failed: %s: %v", clientIP(r, app), err)
+		return
+	}
+
+	// Browsers can't read the HTTP status of a failed upgrade, so the
+	// connection is closed with a jittered reconnect hint instead.
+	if !admitted {
+		ws.WriteControl(websocket.CloseMessage,
+			hub.ReconnectCloseMessage(websocket.CloseTryAgainLater, app.hub.ReconnectHint()),
+			time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	// Negotiate the protocol version and encoding with the client.
+	var enc string
+	proto, err := hub.NegotiateProtocol(r.URL.Query().Get("proto"))
+	if err == nil {
+		enc, err = hub.NegotiateEncoding(r.URL.Query().Get("enc"), room.HasFeature(hub.FeatureMsgpack))
+	}
+	if err != nil {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error()),
+			time.Now().Add(time.Second))
+		ws.Close()
 		return
 	}
+	if app.cfg.WSCompression && app.cfg.WSCompressionLvl != 0 {
+		if err := ws.SetCompressionLevel(app.cfg.WSCompressionLvl); err != nil {
+			app.logger.Printf("invalid websocket compression level: %v", err)
+		}
+	}
 
 	// Create a new peer instance and add to the room.
-	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, ws)
+	opts := hub.ConnOpts{
+		ClientVersion: r.URL.Query().Get("v"),
+		Proto:         proto,
+		Encoding:      enc,
+		Owner:         ctx.sess.Owner,
+		IP:            clientIP(r, app),
+		UserAgent:     userAgent(r),
+		Country:       clientCountry(r, app),
+		Resume:        r.URL.Query().Get("resume"),
+	}
+	if opts.Resume != "" {
+		opts.ResumeSeq, _ = strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	}
+	if ctx.sess.OperatorUntil != nil {
+		room.AddOperator(ctx.sess.ID, ctx.sess.Handle, opts, ws, *ctx.sess.OperatorUntil)
+		return
+	}
+	room.AddPeer(ctx.sess.ID, ctx.sess.Handle, opts, ws)
+}
+
+// handleChatHistory returns the cached messages of a room. With
+// format=transcript, it returns a downloadable transcript signed with the
+// instance key, and with format=html or format=pdf, a standalone HTML page
+// or PDF document with the timestamps in the requested timezone. Exports
+// with anonymize=true replace participants' identities with pseudonyms.
+// mention=handle only returns the messages that mention the handle, and
+// handle, peer_id, and type (chat, system, poll) only return the messages
+// from the given peers and of the given types, eg: type=chat,poll excludes
+// joins and leaves. Polls are returned with their latest votes.
+func handleChatHistory(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+	if !room.Capabilities().History {
+		respondJSON(w, nil, hub.ErrHistoryDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && !app.routes.check(routeExport, w) {
+		return
+	}
+
+	loc, tzSource, err := historyTimezone(r, ctx.sess.Timezone, room.Opts.Timezone)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+	preset, from, to, err := historyWindow(r, loc)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	limit, cursor, err := historyPage(r)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	// Exports always include all the messages in the window.
+	var (
+		msgs []store.Message
+		next int64
+	)
+	if limit > 0 && format == "" {
+		msgs, next, err = app.hub.MsgCache.GetMessageCachePage(room.ID, cursor, limit)
+	} else {
+		msgs, err = app.hub.MsgCache.GetMessageCache(room.ID)
+	}
+	if err != nil {
+		app.logger.Printf("error fetching message cache: %v", err)
+		respondJSON(w, nil, errors.New("error fetching history"), http.StatusInternalServerError)
+		return
+	}
+
+	room.ApplyPolls(msgs)
+	hub.HidePeerIDs(msgs)
+
+	// Pseudonyms are assigned over the whole history before it's filtered.
+	var (
+		anonymize = format != "" && r.URL.Query().Get("anonymize") == "true"
+		anon      *anonymizer
+	)
+	if anonymize {
+		anon = newAnonymizer(msgs)
+	}
+	msgs = filterMessages(msgs, from, to)
+	if h := r.URL.Query().Get("mention"); h != "" {
+		msgs = filterMentions(msgs, h)
+	}
+	msgs = filter.apply(msgs)
+	if anonymize {
+		msgs = anon.apply(msgs)
+	}
+
+	if format == "transcript" || format == "csv" || format == "html" || format == "pdf" {
+		app.hub.Audit.Record("history.export", ctx.sess.Handle, room.ID, map[string]interface{}{
+			"format":    format,
+			"anonymize": anonymize,
+			"messages":  len(msgs),
+		})
+	}
+
+	switch format {
+	case "transcript":
+		t := transcript.Transcript{
+			RoomID:     room.ID,
+			RoomName:   room.Name(),
+			ExportedAt: time.Now(),
+			Messages:   msgs,
+			Anonymized: anonymize,
+		}
+		// The room's name may identify participants too.
+		if anonymize {
+			t.RoomName = ""
+		}
+
+		b, err := app.signer.Marshal(t)
+		if err != nil {
+			app.logger.Printf("error generating transcript: %v", err)
+			respondJSON(w, nil, errors.New("error generating transcript"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="niltalk-%s.json"`, room.ID))
+		w.Write(b)
+
+	// Standalone, styled page for archiving or emailing.
+	case "html":
+		name := room.Name()
+		if anonymize {
+			name = ""
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="niltalk-%s.html"`, room.ID))
+		t := newFormattedTranscript(room.ID, name, msgs, loc, anonymize)
+		if err := renderHTMLTranscript(w, app, ctx.vhost, ctx.lang, t); err != nil {
+			app.logger.Printf("error rendering HTML transcript: %v", err)
+		}
+
+	// Printable archive, eg: for compliance records.
+	case "pdf":
+		name := room.Name()
+		if anonymize {
+			name = ""
+		}
+
+		// The document is rendered before responding so that errors
+		// aren't sent as a broken download.
+		var b bytes.Buffer
+		t := newFormattedTranscript(room.ID, name, msgs, loc, anonymize)
+		if err := renderPDFTranscript(&b, ctx.lang, t); err != nil {
+			app.logger.Printf("error rendering PDF transcript: %v", err)
+			respondJSON(w, nil, errors.New("error generating transcript"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="niltalk-%s.pdf"`, room.ID))
+		w.Write(b.Bytes())
+
+	// Spreadsheet friendly export of chat messages. System messages are
+	// excluded.
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="niltalk-%s.csv"`, room.ID))
+
+		c := csv.NewWriter(w)
+		c.Write([]string{"timestamp", "handle", "message"})
+		for _, m := range msgs {
+			if m.Type == hub.TypeSystem {
+				continue
+			}
+			c.Write([]string{m.Timestamp.In(loc).Format(time.RFC3339), m.PeerHandle, m.Message})
+		}
+		c.Flush()
+
+	default:
+		respondJSON(w, historyResp{
+			Timezone:       loc.String(),
+			TimezoneSource: tzSource,
+			Preset:         preset,
+			From:           from,
+			To:             to,
+			Messages:       msgs,
+			NextCursor:     formatCursor(next),
+		}, nil, http.StatusOK)
+	}
 }
 
 // respondJSON responds to an HTTP request with a generic payload or an error.
@@ -198,12 +1037,13 @@ func respondJSON(w http.ResponseWriter, data interface{}, err error, statusCode
 		statusCode = http.StatusOK
 	}
 
-	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
 
+	// Errors are translated to the language picked for the request.
 	out := jsonResp{Data: data}
 	if err != nil {
-		e := err.Error()
+		e := translator.T(w.Header().Get("Content-Language"), err.Error())
 		out.Error = &e
 	}
 	b, err := json.Marshal(out)
@@ -215,16 +1055,28 @@ func respondJSON(w http.ResponseWriter, data interface{}, err error, statusCode
 	w.Write(b)
 }
 
-// respondHTML responds to an HTTP request with the HTML output of a given template.
-func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWriter, app *App) {
+// respondHTML responds to an HTTP request with the HTML output of a given
+// template of the request's vhost.
+func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWriter, ctx *reqCtx) {
+	app := ctx.app
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	// Pages have sessions' CSRF tokens and link to the current versions
+	// of the static files.
+	w.Header().Set("Cache-Control", "no-store")
 	if statusCode > 0 {
 		w.WriteHeader(statusCode)
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	err := app.tpl.ExecuteTemplate(w, tplName, tpl{
-		Config: app.cfg,
-		Data:   data,
+	err := app.templates(ctx.vhost).ExecuteTemplate(w, tplName, tpl{
+		L:       translator.Lang(ctx.lang),
+		Config:  ctx.vhost.cfg,
+		Captcha: app.captcha,
+		Passwd:  app.passwd,
+		Regions: app.regions,
+		Presets: ctx.vhost.presetNames(app.presets),
+		Data:    data,
+		assets:  app.assetHashes(ctx.vhost),
 	})
 	if err != nil {
 		app.logger.Printf("error rendering template %s: %s", tplName, err)
@@ -232,6 +1084,27 @@ func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWr
 	}
 }
 
+// handleGetChallenge issues a proof-of-work challenge for room creation.
+func handleGetChallenge(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	if app.captcha.Provider() != captcha.ProviderPoW {
+		respondJSON(w, nil, errors.New("proof-of-work is not enabled"), http.StatusNotFound)
+		return
+	}
+
+	c, err := app.captcha.NewChallenge()
+	if err != nil {
+		app.logger.Printf("error generating challenge: %v", err)
+		respondJSON(w, nil, errors.New("error generating challenge"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, c, nil, http.StatusOK)
+}
+
 // handleCreateRoom handles the creation of a new room.
 func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	var (
@@ -245,18 +1118,34 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Verify the CAPTCHA or proof-of-work.
+	if err := app.captcha.Verify(req.Captcha, clientIP(r, app)); err != nil {
+		if err != captcha.ErrInvalid {
+			app.logger.Printf("error verifying captcha: %v", err)
+		}
+		respondJSON(w, nil, captcha.ErrInvalid, http.StatusForbidden)
+		return
+	}
+
 	if req.Name != "" && (len(req.Name) < 3 || len(req.Name) > 100) {
 		respondJSON(w, nil, errors.New("invalid room name (6 - 100 chars)"), http.StatusBadRequest)
 		return
 	}
 
-	if len(req.Password) < 6 || len(req.Password) > 100 {
-		respondJSON(w, nil, errors.New("invalid password (6 - 100 chars)"), http.StatusBadRequest)
+	preset, ok := app.presets[req.Preset]
+	if req.Preset != "" && (!ok || !ctx.vhost.hasPreset(req.Preset)) {
+		respondJSON(w, nil, errors.New("unknown preset"), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.passwd.Validate(req.Password); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
 		return
 	}
 
 	// Hash the password.
-	pwdHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), 8)
+	meta := passwordMeta(req.Password)
+	pwdHash, err := app.passwd.Hash(req.Password)
 	if err != nil {
 		app.logger.Printf("error hashing password: %v", err)
 		respondJSON(w, "Error hashing password", nil, http.StatusInternalServerError)
@@ -264,15 +1153,161 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create and activate the new room.
-	room, err := app.hub.AddRoom(req.Name, pwdHash)
+	// Persistent rooms may be restricted to admins.
+	if req.Persistent {
+		switch app.cfg.PersistentRooms {
+		case hub.PersistentAll:
+		case hub.PersistentAdmin:
+			if !hasAdminToken(r, app) {
+				respondJSON(w, nil, errors.New("only admins can create persistent rooms"), http.StatusForbidden)
+				return
+			}
+		default:
+			respondJSON(w, nil, errors.New("persistent rooms are disabled"), http.StatusForbidden)
+			return
+		}
+	}
+
+	if req.Region != "" && !hasRegion(app.regions, req.Region) {
+		respondJSON(w, nil, errors.New("unknown region"), http.StatusBadRequest)
+		return
+	}
+	for _, n := range req.Notify {
+		if !app.hub.Notify.Has(n) {
+			respondJSON(w, nil, fmt.Errorf("unknown notification channel '%s'", n), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ReplayMessages < 0 || req.ReplayMessages > app.cfg.MaxReplayMessages {
+		respondJSON(w, nil, fmt.Errorf("replay_messages should be 0 - %d", app.cfg.MaxReplayMessages), http.StatusBadRequest)
+		return
+	}
+
+	if !hub.ValidRetention(req.RetentionHours) {
+		respondJSON(w, nil, hub.ErrInvalidRetention, http.StatusBadRequest)
+		return
+	}
+
+	if !app.hub.ValidLanguage(req.Language) {
+		respondJSON(w, nil, hub.ErrInvalidLanguage, http.StatusBadRequest)
+		return
+	}
+
+	// Scheduled rooms open at a later time for a duration. They close at
+	// the end of it, so they can't be persistent.
+	var schedule *store.Schedule
+	if req.OpensAt != nil {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || req.Persistent {
+			respondJSON(w, nil, hub.ErrInvalidSchedule, http.StatusBadRequest)
+			return
+		}
+		schedule = &store.Schedule{Opens: *req.OpensAt, Closes: req.OpensAt.Add(d)}
+	}
+
+	// The owner key is only returned to the creator.
+	ownerKey, ownerHash, err := hub.NewOwnerKey()
 	if err != nil {
-		respondJSON(w, nil, err, http.StatusInternalServerError)
+		app.logger.Printf("error generating owner key: %v", err)
+		respondJSON(w, nil, errors.New("error generating owner key"), http.StatusInternalServerError)
 		return
 	}
 
+	opts := store.RoomOpts{
+		Kiosk:       req.Kiosk,
+		Persistent:  req.Persistent,
+		Timezone:    validTimezone(req.Timezone),
+		Reservation: req.Reservation,
+		Schedule:    schedule,
+		Region:      req.Region,
+		Tenant:      ctx.vhost.ID,
+		Language:    req.Language,
+		Notify:      req.Notify,
+
+		ReplayMessages: req.ReplayMessages,
+		NoLogging:      req.NoLogging,
+		RetentionHours: req.RetentionHours,
+		ReadOnly:       req.ReadOnly,
+		Speakers:       req.Speakers,
+		OwnerKey:       ownerHash,
+		PasswordMeta:   &meta,
+	}
+	name := preset.apply(req.Name, &opts)
+	name = app.roomDefaults(ctx.vhost).apply(name, &opts)
+	room, err := app.hub.AddRoom(name, pwdHash, opts)
+	if err != nil {
+		switch err {
+		case hub.ErrInvalidReservation, hub.ErrInvalidSchedule, hub.ErrInvalidSpeakers:
+			respondJSON(w, nil, err, http.StatusBadRequest)
+		case hub.ErrOvercommitted:
+			respondJSON(w, nil, err, http.StatusConflict)
+		case hub.ErrTooManyRooms:
+			respondJSON(w, nil, err, http.StatusTooManyRequests)
+		default:
+			respondJSON(w, nil, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.hub.Audit.Record("room.create", "", room.ID, map[string]interface{}{
+		"ip":         clientIP(r, app),
+		"kiosk":      opts.Kiosk,
+		"persistent": opts.Persistent,
+		"region":     opts.Region,
+		"vhost":      opts.Tenant,
+		"preset":     req.Preset,
+		"read_only":  opts.ReadOnly,
+	})
 	respondJSON(w, struct {
-		ID string `json:"id"`
-	}{room.ID}, nil, http.StatusOK)
+		ID       string `json:"id"`
+		OwnerKey string `json:"owner_key"`
+	}{room.ID, ownerKey}, nil, http.StatusOK)
+}
+
+// handleDisposeRoom disposes of a room immediately: peers are disconnected,
+// sessions are cleared, and the history is purged. It's restricted to the
+// room's owner, who is identified by their session or the owner key in the
+// X-Owner-Key header.
+func handleDisposeRoom(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+
+	actor, ok := roomOwner(r, ctx)
+	if !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	app.hub.Audit.Record("room.dispose", actor, room.ID, nil)
+	room.Dispose()
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// hasRegion checks if a region is in the list of configured regions.
+func hasRegion(regions []string, name string) bool {
+	for _, r := range regions {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAdminToken checks if the request carries the admin token. If there's no
+// token configured, the admin API is disabled.
+func hasAdminToken(r *http.Request, app *App) bool {
+	tk := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return app.cfg.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(tk), []byte(app.cfg.AdminToken)) == 1
 }
 
 // wrap is a middleware that handles auth and room check for various HTTP handlers.
@@ -280,10 +1315,31 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
-			req    = &reqCtx{app: app}
+			req    = &reqCtx{app: app, vhost: app.vhostFor(r)}
 			roomID = chi.URLParam(r, "roomID")
 		)
 
+		// Responses are in the browser's language unless the room has
+		// its own. The language is picked up by respondJSON from the
+		// Content-Language header.
+		req.lang = translator.Match(r.Header.Get("Accept-Language"))
+		w.Header().Set("Content-Language", req.lang)
+
+		// Check if the request carries the admin token. If there's no token
+		// configured, the admin API is disabled.
+		if opts&isAdmin != 0 && !hasAdminToken(r, app) {
+			respondJSON(w, nil, errors.New("invalid admin token"), http.StatusForbidden)
+			return
+		}
+
+		// Validate the CSRF token on state changing requests. Requests
+		// with the admin token, which is never sent by browsers on their
+		// own, don't need one.
+		if opts&hasCSRF != 0 && !hasAdminToken(r, app) && !checkCSRF(r, app) {
+			respondJSON(w, nil, errors.New("invalid CSRF token. Reload the page"), http.StatusForbidden)
+			return
+		}
+
 		// Check if the request is authenticated.
 		if opts&hasAuth != 0 {
 			ck, _ := r.Cookie(app.cfg.SessionCookie)
@@ -294,9 +1350,17 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 					respondJSON(w, nil, errors.New("error checking session"), http.StatusForbidden)
 					return
 				}
-				req.sess = sess{
-					ID:     s.ID,
-					Handle: s.Handle,
+				// Operator sessions end after their duration.
+				if s.OperatorUntil == nil || s.OperatorUntil.After(time.Now()) {
+					req.sess = sess{
+						ID:            s.ID,
+						Handle:        s.Handle,
+						Timezone:      s.Timezone,
+						OperatorUntil: s.OperatorUntil,
+						Owner:         s.Owner,
+						Scheme:        s.Scheme,
+						Link:          s.Link,
+					}
 				}
 			}
 		}
@@ -307,8 +1371,15 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 			// handler. It's the handler's responsibility to throw an error,
 			// API or HTML response.
 			room, err := app.hub.ActivateRoom(roomID)
-			if err == nil {
+
+			// Rooms of other vhosts don't exist for this one. The admin API
+			// spans all vhosts.
+			if err == nil && (room.Tenant() == req.vhost.ID || opts&isAdmin != 0) {
 				req.room = room
+				if l := room.Language(); l != "" {
+					req.lang = l
+					w.Header().Set("Content-Language", l)
+				}
 			}
 		}
 
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/store"
+)
+
+// History date presets.
+const (
+	presetAll       = "all"
+	presetToday     = "today"
+	presetYesterday = "yesterday"
+	presetLast7Days = "last_7_days"
+)
+
+// Maximum number of messages in a page of history.
+const maxHistoryLimit = 500
+
+// Categories of messages that the history can be filtered by and the
+// message types in them.
+var historyTypes = map[string][]string{
+	"chat":   {hub.TypeMessage},
+	"system": {hub.TypeSystem},
+	"poll":   {hub.TypePoll, hub.TypePollResults},
+}
+
+// Sources of the effective timezone of a history request.
+const (
+	tzSourceRequest  = "request"
+	tzSourceSession  = "session"
+	tzSourceRoom     = "room"
+	tzSourceLanguage = "accept-language"
+	tzSourceDefault  = "default"
+)
+
+// langZones maps Accept-Language regions that have a single timezone to it.
+var langZones = map[string]string{
+	"AT": "Europe/Vienna",
+	"BE": "Europe/Brussels",
+	"CH": "Europe/Zurich",
+	"CN": "Asia/Shanghai",
+	"DE": "Europe/Berlin",
+	"DK": "Europe/Copenhagen",
+	"ES": "Europe/Madrid",
+	"FI": "Europe/Helsinki",
+	"FR": "Europe/Paris",
+	"GB": "Europe/London",
+	"IE": "Europe/Dublin",
+	"IN": "Asia/Kolkata",
+	"IT": "Europe/Rome",
+	"JP": "Asia/Tokyo",
+	"KR": "Asia/Seoul",
+	"NL": "Europe/Amsterdam",
+	"NO": "Europe/Oslo",
+	"PL": "Europe/Warsaw",
+	"SE": "Europe/Stockholm",
+	"SG": "Asia/Singapore",
+}
+
+// historyResp is the response of the history API with the window of
+// messages and the timezone it was computed in.
+type historyResp struct {
+	Timezone       string          `json:"timezone"`
+	TimezoneSource string          `json:"timezone_source"`
+	Preset         string          `json:"preset"`
+	From           *time.Time      `json:"from"`
+	To             *time.Time      `json:"to"`
+	Messages       []store.Message `json:"messages"`
+
+	// Cursor of the page of older messages when paginating. It's empty
+	// on the last (oldest) page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// historyTimezone returns the effective timezone of a history request and
+// its source. An explicit timezone in the request takes precedence over
+// the session's preference, the room's setting, and the browser's language,
+// in that order.
+func historyTimezone(r *http.Request, sessTZ, roomTZ string) (*time.Location, string, error) {
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, "", errors.New("invalid timezone")
+		}
+		return loc, tzSourceRequest, nil
+	}
+
+	// Stored settings were validated when they were set.
+	if loc, err := time.LoadLocation(sessTZ); sessTZ != "" && err == nil {
+		return loc, tzSourceSession, nil
+	}
+	if loc, err := time.LoadLocation(roomTZ); roomTZ != "" && err == nil {
+		return loc, tzSourceRoom, nil
+	}
+	if loc := langTimezone(r.Header.Get("Accept-Language")); loc != nil {
+		return loc, tzSourceLanguage, nil
+	}
+	return time.UTC, tzSourceDefault, nil
+}
+
+// langTimezone returns the timezone of the region of the preferred language
+// in an Accept-Language header, eg: en-IN, if the region has a single
+// timezone.
+func langTimezone(h string) *time.Location {
+	lang := strings.TrimSpace(strings.Split(strings.Split(h, ",")[0], ";")[0])
+	parts := strings.Split(lang, "-")
+	if len(parts) < 2 {
+		return nil
+	}
+
+	zone, ok := langZones[strings.ToUpper(parts[len(parts)-1])]
+	if !ok {
+		return nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+// historyWindow returns the [from, to) window of a history request from a
+// preset or from and to dates (YYYY-MM-DD, inclusive) in the given timezone.
+// Nil bounds are open.
+func historyWindow(r *http.Request, loc *time.Location) (string, *time.Time, *time.Time, error) {
+	var (
+		q     = r.URL.Query()
+		now   = time.Now().In(loc)
+		today = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	)
+
+	// Explicit dates.
+	if q.Get("from") != "" || q.Get("to") != "" {
+		var from, to *time.Time
+		if s := q.Get("from"); s != "" {
+			t, err := time.ParseInLocation("2006-01-02", s, loc)
+			if err != nil {
+				return "", nil, nil, errors.New("invalid from date")
+			}
+			from = &t
+		}
+		if s := q.Get("to"); s != "" {
+			t, err := time.ParseInLocation("2006-01-02", s, loc)
+			if err != nil {
+				return "", nil, nil, errors.New("invalid to date")
+			}
+			t = t.AddDate(0, 0, 1)
+			to = &t
+		}
+		return "", from, to, nil
+	}
+
+	preset := q.Get("preset")
+	switch preset {
+	case "", presetAll:
+		return presetAll, nil, nil, nil
+	case presetToday:
+		return preset, &today, nil, nil
+	case presetYesterday:
+		from := today.AddDate(0, 0, -1)
+		return preset, &from, &today, nil
+	case presetLast7Days:
+		from := today.AddDate(0, 0, -6)
+		return preset, &from, nil, nil
+	}
+	return "", nil, nil, errors.New("unknown preset")
+}
+
+// historyPage returns the page size (limit) and cursor of a paginated history
+// request. Pages go backwards from the latest message (or the cursor, which
+// is the next_cursor of the previous page). A limit of 0 disables pagination.
+func historyPage(r *http.Request) (int, int64, error) {
+	q := r.URL.Query()
+
+	limit, err := queryInt(q.Get("limit"), 0)
+	if err != nil || limit < 0 || limit > maxHistoryLimit {
+		return 0, 0, fmt.Errorf("invalid limit (1 - %d)", maxHistoryLimit)
+	}
+
+	var cursor int64
+	if c := q.Get("cursor"); c != "" {
+		if limit == 0 {
+			return 0, 0, errors.New("cursor requires a limit")
+		}
+		cursor, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || cursor <= 0 {
+			return 0, 0, errors.New("invalid cursor")
+		}
+	}
+	return limit, cursor, nil
+}
+
+// formatCursor formats a page cursor. It's empty if there are no more pages.
+func formatCursor(c int64) string {
+	if c <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(c, 10)
+}
+
+// filterMessages returns the messages in the [from, to) window.
+func filterMessages(msgs []store.Message, from, to *time.Time) []store.Message {
+	out := make([]store.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if from != nil && m.Timestamp.Before(*from) {
+			continue
+		}
+		if to != nil && !m.Timestamp.Before(*to) {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// filterMentions returns the messages that mention the given handle. Handles
+// are matched case-insensitively.
+func filterMentions(msgs []store.Message, handle string) []store.Message {
+	out := make([]store.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if mentions(m, handle) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// mentions checks if a message mentions the given handle.
+func mentions(m store.Message, handle string) bool {
+	for _, h := range m.Mentions {
+		if strings.EqualFold(h, handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// historyFilter filters the history by the peers who sent the messages and
+// by message categories. Empty filters match all messages.
+type historyFilter struct {
+	handles []string
+	peerIDs map[string]bool
+	types   map[string]bool
+}
+
+// parseHistoryFilter returns the filter of a history request from its
+// handle, peer_id, and type (historyTypes) params, which are comma
+// separated lists.
+func parseHistoryFilter(r *http.Request) (historyFilter, error) {
+	var (
+		q = r.URL.Query()
+		f historyFilter
+	)
+
+	f.handles = splitParam(q.Get("handle"))
+	if ids := splitParam(q.Get("peer_id")); len(ids) > 0 {
+		f.peerIDs = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			f.peerIDs[id] = true
+		}
+	}
+	if cats := splitParam(q.Get("type")); len(cats) > 0 {
+		f.types = make(map[string]bool)
+		for _, c := range cats {
+			types, ok := historyTypes[c]
+			if !ok {
+				return f, errors.New("unknown message type")
+			}
+			for _, t := range types {
+				f.types[t] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// apply returns the messages that match the filter. Handles are matched
+// case-insensitively.
+func (f historyFilter) apply(msgs []store.Message) []store.Message {
+	if len(f.handles) == 0 && f.peerIDs == nil && f.types == nil {
+		return msgs
+	}
+
+	out := make([]store.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if f.types != nil && !f.types[m.Type] {
+			continue
+		}
+		if f.peerIDs != nil && !f.peerIDs[m.PeerID] {
+			continue
+		}
+		if len(f.handles) > 0 && !hasHandle(f.handles, m.PeerHandle) {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// hasHandle checks if a handle is in a list of handles case-insensitively.
+func hasHandle(handles []string, h string) bool {
+	for _, v := range handles {
+		if strings.EqualFold(v, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitParam splits a comma separated query param into its non-empty
+// values.
+func splitParam(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// validTimezone returns the timezone if it's a valid IANA timezone and an
+// empty string otherwise.
+func validTimezone(tz string) string {
+	if tz == "" {
+		return ""
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return ""
+	}
+	return tz
+}
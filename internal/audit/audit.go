@@ -0,0 +1,81 @@
+// Package audit records administrative and security relevant events
+// separately from chat history.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event represents an audited event.
+type Event struct {
+	Time   time.Time              `json:"time"`
+	Action string                 `json:"action"`
+	Actor  string                 `json:"actor,omitempty"`
+	RoomID string                 `json:"room_id,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// Log records audit events as JSON lines.
+type Log struct {
+	w    io.Writer
+	path string
+	mut  sync.Mutex
+	log  *log.Logger
+
+	// Recent events for queries if there's no file.
+	recent []Event
+}
+
+// New returns a new audit log that appends events to the file at path.
+// If path is empty, events are written to the given logger and the recent
+// events are retained in memory.
+func New(path string, l *log.Logger) (*Log, error) {
+	a := &Log{path: path, log: l}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.w = f
+	}
+	return a, nil
+}
+
+// Record records an event. It's a no-op on a nil Log.
+func (a *Log) Record(action, actor, roomID string, data map[string]interface{}) {
+	if a == nil {
+		return
+	}
+
+	e := Event{
+		Time:   time.Now(),
+		Action: action,
+		Actor:  actor,
+		RoomID: roomID,
+		Data:   data,
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		a.log.Printf("error encoding audit event: %v", err)
+		return
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.w == nil {
+		a.log.Printf("audit: %s", b)
+		if len(a.recent) >= maxRecent {
+			a.recent = append(a.recent[:0], a.recent[1:]...)
+		}
+		a.recent = append(a.recent, e)
+		return
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		a.log.Printf("error writing audit event: %v", err)
+	}
+}
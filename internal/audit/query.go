@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// Number of recent events retained in memory for queries when events
+// aren't written to a file.
+const maxRecent = 1000
+
+// Maximum length of an event's line in the audit file.
+const maxLineLen = 1 << 20
+
+// Filter filters audit events. Empty fields match all events. An Action
+// ending in "." matches all the actions with that prefix, eg: "room.".
+type Filter struct {
+	Action string
+	Actor  string
+	RoomID string
+
+	// Events between From (inclusive) and To (exclusive).
+	From *time.Time
+	To   *time.Time
+}
+
+// Query returns a page of events that match the filter, newest first,
+// along with the total number of matching events. Events are read from the
+// audit file or, if there's no file, the recent events in memory.
+func (a *Log) Query(f Filter, offset, limit int) ([]Event, int, error) {
+	if a == nil {
+		return []Event{}, 0, nil
+	}
+
+	var (
+		// Ring of the latest offset+limit matching events.
+		size  = offset + limit
+		ring  = make([]Event, 0, size)
+		total = 0
+	)
+	add := func(e Event) {
+		if !f.match(e) {
+			return
+		}
+		if len(ring) < size {
+			ring = append(ring, e)
+		} else if size > 0 {
+			ring[total%size] = e
+		}
+		total++
+	}
+
+	if a.path == "" {
+		a.mut.Lock()
+		for _, e := range a.recent {
+			add(e)
+		}
+		a.mut.Unlock()
+	} else if err := a.scan(add); err != nil {
+		return nil, 0, err
+	}
+
+	// Unroll the ring newest first and skip the offset.
+	out := []Event{}
+	for i := 0; i < len(ring); i++ {
+		n := total - 1 - i
+		if i < offset {
+			continue
+		}
+		out = append(out, ring[n%size])
+	}
+	return out, total, nil
+}
+
+// scan reads the events in the audit file in the order they were recorded.
+func (a *Log) scan(fn func(Event)) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineLen)
+	for sc.Scan() {
+		var e Event
+		// Skip partially written and corrupt lines.
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		fn(e)
+	}
+	return sc.Err()
+}
+
+// match checks if an event matches the filter.
+func (f Filter) match(e Event) bool {
+	if f.Action != "" {
+		if strings.HasSuffix(f.Action, ".") {
+			if !strings.HasPrefix(e.Action, f.Action) {
+				return false
+			}
+		} else if e.Action != f.Action {
+			return false
+		}
+	}
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.RoomID != "" && e.RoomID != f.RoomID {
+		return false
+	}
+	if f.From != nil && e.Time.Before(*f.From) {
+		return false
+	}
+	if f.To != nil && !e.Time.Before(*f.To) {
+		return false
+	}
+	return true
+}
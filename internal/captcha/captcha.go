@@ -0,0 +1,256 @@
+// Package captcha implements abuse protection for public endpoints, either
+// via a third party CAPTCHA provider (hCaptcha, reCAPTCHA) or a client side
+// proof-of-work challenge.
+package captcha
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported providers.
+const (
+	ProviderNone      = "none"
+	ProviderHCaptcha  = "hcaptcha"
+	ProviderReCaptcha = "recaptcha"
+	ProviderPoW       = "pow"
+)
+
+var verifyURLs = map[string]string{
+	ProviderHCaptcha:  "https://hcaptcha.com/siteverify",
+	ProviderReCaptcha: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+// ErrInvalid indicates that a CAPTCHA or proof-of-work solution was invalid.
+var ErrInvalid = errors.New("invalid or expired captcha")
+
+// Config represents the CAPTCHA configuration.
+type Config struct {
+	Provider string `koanf:"provider"`
+
+	// hCaptcha / reCAPTCHA keys.
+	SiteKey string `koanf:"site_key"`
+	Secret  string `koanf:"secret"`
+
+	// Number of leading zero bits required in the proof-of-work hash.
+	Difficulty int `koanf:"pow_difficulty"`
+
+	// Validity of a proof-of-work challenge.
+	ChallengeTTL time.Duration `koanf:"pow_ttl"`
+
+	// Key for signing proof-of-work challenges. It has to be the same on
+	// all instances behind a load balancer. If it's empty, a random key is
+	// generated and challenges are only valid on the instance that issued
+	// them until it restarts.
+	PoWSecret string `koanf:"pow_secret"`
+}
+
+// Challenge is a proof-of-work challenge issued to a client. The client has
+// to find a nonce such that sha256(challenge + ":" + nonce) has at least
+// Difficulty leading zero bits.
+type Challenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// Captcha verifies CAPTCHA and proof-of-work solutions.
+type Captcha struct {
+	cfg Config
+
+	// Key for signing stateless proof-of-work challenges.
+	key []byte
+
+	// Solved challenges that are remembered until they expire to prevent
+	// replays.
+	used map[string]time.Time
+	mut  sync.Mutex
+
+	client *http.Client
+}
+
+// New returns a new instance of Captcha.
+func New(cfg Config) (*Captcha, error) {
+	if cfg.Provider == "" {
+		cfg.Provider = ProviderNone
+	}
+	switch cfg.Provider {
+	case ProviderNone:
+	case ProviderPoW:
+		if cfg.Difficulty <= 0 {
+			return nil, errors.New("pow_difficulty should be greater than 0")
+		}
+	case ProviderHCaptcha, ProviderReCaptcha:
+		if cfg.Secret == "" || cfg.SiteKey == "" {
+			return nil, fmt.Errorf("%s requires site_key and secret", cfg.Provider)
+		}
+	default:
+		return nil, fmt.Errorf("unknown captcha provider: %s", cfg.Provider)
+	}
+
+	if cfg.ChallengeTTL == 0 {
+		cfg.ChallengeTTL = time.Minute * 5
+	}
+
+	key := []byte(cfg.PoWSecret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Captcha{
+		cfg:    cfg,
+		key:    key,
+		used:   make(map[string]time.Time),
+		client: &http.Client{Timeout: time.Second * 5},
+	}, nil
+}
+
+// Enabled returns true if a CAPTCHA provider is configured.
+func (c *Captcha) Enabled() bool {
+	return c.cfg.Provider != ProviderNone
+}
+
+// Provider returns the name of the configured provider.
+func (c *Captcha) Provider() string {
+	return c.cfg.Provider
+}
+
+// SiteKey returns the public site key for third party providers.
+func (c *Captcha) SiteKey() string {
+	return c.cfg.SiteKey
+}
+
+// NewChallenge generates a signed proof-of-work challenge.
+func (c *Captcha) NewChallenge() (Challenge, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b[8:]); err != nil {
+		return Challenge{}, err
+	}
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().Add(c.cfg.ChallengeTTL).Unix()))
+
+	s := base64.RawURLEncoding.EncodeToString(b)
+	return Challenge{
+		Challenge:  s + "." + c.sign(s),
+		Difficulty: c.cfg.Difficulty,
+	}, nil
+}
+
+// Verify verifies a CAPTCHA response or a proof-of-work solution of the form
+// "challenge:nonce".
+func (c *Captcha) Verify(token, remoteIP string) error {
+	switch c.cfg.Provider {
+	case ProviderNone:
+		return nil
+	case ProviderPoW:
+		return c.verifyPoW(token)
+	default:
+		return c.verifyRemote(token, remoteIP)
+	}
+}
+
+// verifyPoW verifies a proof-of-work solution.
+func (c *Captcha) verifyPoW(token string) error {
+	i := strings.LastIndex(token, ":")
+	if i < 0 {
+		return ErrInvalid
+	}
+	chal := token[:i]
+
+	// Verify the signature and expiry of the challenge.
+	p := strings.Split(chal, ".")
+	if len(p) != 2 || !hmac.Equal([]byte(p[1]), []byte(c.sign(p[0]))) {
+		return ErrInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p[0])
+	if err != nil || len(b) < 8 {
+		return ErrInvalid
+	}
+	exp := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if time.Now().After(exp) {
+		return ErrInvalid
+	}
+
+	// Verify the work.
+	h := sha256.Sum256([]byte(token))
+	if leadingZeroBits(h[:]) < c.cfg.Difficulty {
+		return ErrInvalid
+	}
+
+	// Reject replays and sweep expired challenges.
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if _, ok := c.used[chal]; ok {
+		return ErrInvalid
+	}
+	now := time.Now()
+	for k, t := range c.used {
+		if now.After(t) {
+			delete(c.used, k)
+		}
+	}
+	c.used[chal] = exp
+	return nil
+}
+
+// verifyRemote verifies a CAPTCHA response with the third party provider.
+func (c *Captcha) verifyRemote(token, remoteIP string) error {
+	if token == "" {
+		return ErrInvalid
+	}
+
+	resp, err := c.client.PostForm(verifyURLs[c.cfg.Provider], url.Values{
+		"secret":   {c.cfg.Secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+		"sitekey":  {c.cfg.SiteKey},
+	})
+	if err != nil {
+		return fmt.Errorf("error verifying captcha: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("error decoding captcha response: %v", err)
+	}
+	if !out.Success {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// sign returns the hex HMAC of a string.
+func (c *Captcha) sign(s string) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(s))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// leadingZeroBits counts the leading zero bits in a byte slice.
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
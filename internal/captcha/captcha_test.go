@@ -0,0 +1,141 @@
+package captcha
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// solve finds a nonce for a challenge like a client does.
+func solve(c Challenge) string {
+	for n := 0; ; n++ {
+		token := c.Challenge + ":" + strconv.Itoa(n)
+		h := sha256.Sum256([]byte(token))
+		if leadingZeroBits(h[:]) >= c.Difficulty {
+			return token
+		}
+	}
+}
+
+func newPoW(t *testing.T, cfg Config) *Captcha {
+	cfg.Provider = ProviderPoW
+	if cfg.Difficulty == 0 {
+		cfg.Difficulty = 8
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestVerifyPoW(t *testing.T) {
+	c := newPoW(t, Config{})
+	chal, err := c.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chal.Difficulty != 8 {
+		t.Errorf("expected difficulty 8, got %d", chal.Difficulty)
+	}
+
+	token := solve(chal)
+	if err := c.Verify(token, ""); err != nil {
+		t.Fatalf("expected the solution to verify: %v", err)
+	}
+
+	// Replay.
+	if err := c.Verify(token, ""); err != ErrInvalid {
+		t.Errorf("expected a replayed solution to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyPoWInvalid(t *testing.T) {
+	c := newPoW(t, Config{Difficulty: 12})
+	chal, _ := c.NewChallenge()
+
+	// A nonce that doesn't do the work.
+	var lazy string
+	for n := 0; ; n++ {
+		lazy = chal.Challenge + ":" + strconv.Itoa(n)
+		h := sha256.Sum256([]byte(lazy))
+		if leadingZeroBits(h[:]) < chal.Difficulty {
+			break
+		}
+	}
+
+	// A challenge signed with another key.
+	other, _ := newPoW(t, Config{Difficulty: 12}).NewChallenge()
+
+	for _, token := range []string{
+		"",
+		"no-nonce",
+		lazy,
+		solve(other),
+		strings.Split(chal.Challenge, ".")[0] + ".forged:1",
+	} {
+		if err := c.Verify(token, ""); err != ErrInvalid {
+			t.Errorf("expected %q to be rejected, got %v", token, err)
+		}
+	}
+}
+
+func TestVerifyPoWExpired(t *testing.T) {
+	c := newPoW(t, Config{ChallengeTTL: -time.Minute})
+	chal, _ := c.NewChallenge()
+	if err := c.Verify(solve(chal), ""); err != ErrInvalid {
+		t.Errorf("expected an expired challenge to be rejected, got %v", err)
+	}
+}
+
+// TestPoWSecret checks that challenges issued by one instance can be solved
+// on another with the same secret.
+func TestPoWSecret(t *testing.T) {
+	a := newPoW(t, Config{PoWSecret: "secret"})
+	b := newPoW(t, Config{PoWSecret: "secret"})
+
+	chal, _ := a.NewChallenge()
+	if err := b.Verify(solve(chal), ""); err != nil {
+		t.Errorf("expected the challenge to verify on another instance: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, cfg := range []Config{
+		{Provider: ProviderPoW, Difficulty: 0},
+		{Provider: ProviderPoW, Difficulty: -1},
+		{Provider: ProviderHCaptcha},
+		{Provider: "unknown"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+
+	c, err := New(Config{})
+	if err != nil || c.Enabled() {
+		t.Errorf("expected a disabled captcha, got %v", err)
+	}
+	if err := c.Verify("", ""); err != nil {
+		t.Errorf("expected a disabled captcha to verify: %v", err)
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	for _, c := range []struct {
+		b []byte
+		n int
+	}{
+		{[]byte{0xff}, 0},
+		{[]byte{0x01}, 7},
+		{[]byte{0x00, 0x80}, 8},
+		{[]byte{0x00, 0x0f}, 12},
+		{[]byte{0x00, 0x00}, 16},
+	} {
+		if n := leadingZeroBits(c.b); n != c.n {
+			t.Errorf("leadingZeroBits(%x): expected %d, got %d", c.b, c.n, n)
+		}
+	}
+}
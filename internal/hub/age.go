@@ -0,0 +1,176 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Modes of approving rooms' requests to live longer than the global cap
+// (max_room_age).
+const (
+	AgeApprovalDeny    = "deny"
+	AgeApprovalAdmin   = "admin"
+	AgeApprovalWebhook = "webhook"
+)
+
+// Decisions of an AgeApprover.
+const (
+	AgeApprove      = "approve"
+	AgeDeny         = "deny"
+	AgeRequireAdmin = "admin"
+)
+
+var (
+	// ErrAgePersistent indicates that a persistent room's age can't be set
+	// as persistent rooms don't expire.
+	ErrAgePersistent = errors.New("persistent rooms don't expire")
+
+	// ErrAgeInvalid indicates that the requested age is too short.
+	ErrAgeInvalid = errors.New("invalid room age")
+)
+
+var ageClient = &http.Client{Timeout: time.Second * 5}
+
+// AgeRequest is a room's request to live longer than the global cap.
+type AgeRequest struct {
+	RoomID   string
+	RoomName string
+	Age      time.Duration
+
+	// Handle of the peer that requested it.
+	Handle string
+}
+
+// AgeDecision is an AgeApprover's decision on an AgeRequest. Reason is
+// shown to the requester if the request is denied.
+type AgeDecision struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+}
+
+// AgeApprover approves or denies rooms' requests to live longer than the
+// global cap, or requires the request to carry the admin token, eg: to gate
+// long lived rooms behind a billing system.
+type AgeApprover interface {
+	ApproveAge(AgeRequest) (AgeDecision, error)
+}
+
+// AgeApproverFunc is an adapter to use a function as an AgeApprover.
+type AgeApproverFunc func(AgeRequest) (AgeDecision, error)
+
+// ApproveAge calls f(req).
+func (f AgeApproverFunc) ApproveAge(req AgeRequest) (AgeDecision, error) {
+	return f(req)
+}
+
+// NewAgeApprover returns the AgeApprover for an approval mode. The webhook
+// is POSTed {"room_id", "room_name", "age" (seconds), "handle"} and is
+// expected to respond with {"decision": "approve|deny|admin", "reason"}.
+func NewAgeApprover(mode, webhook string) (AgeApprover, error) {
+	switch mode {
+	case "", AgeApprovalDeny:
+		return AgeApproverFunc(func(AgeRequest) (AgeDecision, error) {
+			return AgeDecision{Decision: AgeDeny}, nil
+		}), nil
+	case AgeApprovalAdmin:
+		return AgeApproverFunc(func(AgeRequest) (AgeDecision, error) {
+			return AgeDecision{Decision: AgeRequireAdmin}, nil
+		}), nil
+	case AgeApprovalWebhook:
+		if webhook == "" {
+			return nil, errors.New("room_age_webhook is required for webhook approvals")
+		}
+		return AgeApproverFunc(func(req AgeRequest) (AgeDecision, error) {
+			return approveAgeWebhook(webhook, req)
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown room age approval mode: %s", mode)
+}
+
+// approveAgeWebhook asks the webhook to approve a request.
+func approveAgeWebhook(url string, req AgeRequest) (AgeDecision, error) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"room_id":   req.RoomID,
+		"room_name": req.RoomName,
+		"age":       int64(req.Age / time.Second),
+		"handle":    req.Handle,
+	})
+	resp, err := ageClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return AgeDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return AgeDecision{}, fmt.Errorf("room age webhook: %s", resp.Status)
+	}
+
+	var out AgeDecision
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return AgeDecision{}, err
+	}
+	switch out.Decision {
+	case AgeApprove, AgeDeny, AgeRequireAdmin:
+	default:
+		return AgeDecision{}, fmt.Errorf("room age webhook: unknown decision %q", out.Decision)
+	}
+	return out, nil
+}
+
+// ApproveAge checks if a room can live for the requested age. Ages up to
+// the global cap are approved and longer ones are passed to the hub's
+// AgeApprover.
+func (h *Hub) ApproveAge(req AgeRequest) (AgeDecision, error) {
+	if req.Age <= h.cfg.MaxRoomAge {
+		return AgeDecision{Decision: AgeApprove}, nil
+	}
+	if h.AgeApprover == nil {
+		return AgeDecision{Decision: AgeDeny}, nil
+	}
+	return h.AgeApprover.ApproveAge(req)
+}
+
+// roomAge returns the inactivity period after which a room with the given
+// options expires.
+func (h *Hub) roomAge(opts store.RoomOpts) time.Duration {
+	if opts.Age > 0 {
+		return opts.Age
+	}
+	return h.cfg.RoomAge
+}
+
+// Age returns the inactivity period after which the room expires.
+func (r *Room) Age() time.Duration {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.hub.roomAge(r.Opts)
+}
+
+// SetAge sets the inactivity period after which the room expires, persists
+// it, and extends the room's TTL in the store. The age should've been
+// approved with ApproveAge.
+func (r *Room) SetAge(age time.Duration) error {
+	if age < time.Second*3 {
+		return ErrAgeInvalid
+	}
+
+	r.mut.Lock()
+	if r.Opts.Persistent {
+		r.mut.Unlock()
+		return ErrAgePersistent
+	}
+	r.Opts.Age = age
+	r.mut.Unlock()
+
+	if err := r.hub.Store.UpdateRoom(r.storeRoom()); err != nil {
+		return err
+	}
+	r.extendTTL()
+	return nil
+}
@@ -0,0 +1,17 @@
+package hub
+
+// Announce broadcasts a server announcement (eg: "maintenance in 10
+// minutes") as a system message to all the active rooms with connected
+// peers. It returns the number of rooms it was sent to. Rooms that are
+// closing are skipped.
+func (h *Hub) Announce(msg string) int {
+	n := 0
+	for _, r := range h.getRooms() {
+		if r.NumPeers() == 0 || r.exited() {
+			continue
+		}
+		r.broadcastSystem(SystemAnnouncement, msg, nil)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"errors"
+	"net/mail"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+var (
+	// ErrInvalidEmail is returned when a room's transcript email address
+	// is invalid.
+	ErrInvalidEmail = errors.New("invalid email address")
+
+	// ErrArchiveDisabled is returned when a room's transcript email is set
+	// on an instance that can't send emails.
+	ErrArchiveDisabled = errors.New("transcript emails are disabled")
+
+	// ErrEmailNotAllowed is returned when a room's transcript email address
+	// isn't one that the instance sends emails to.
+	ErrEmailNotAllowed = errors.New("transcripts can't be emailed to this address")
+)
+
+// RoomArchive is the history of a room that's being removed.
+type RoomArchive struct {
+	RoomID   string
+	RoomName string
+	Tenant   string
+	Language string
+	Timezone string
+
+	// Address the transcript is emailed to.
+	Email string
+
+	// Why the room was removed: room.dispose or room.closed (expired).
+	Reason   string
+	ClosedAt time.Time
+
+	// Messages with their polls' latest votes.
+	Messages []store.Message
+}
+
+// Archiver archives the history of rooms that are removed, eg: by emailing
+// it to their owners. ArchiveRoom is invoked from the room's event loop and
+// shouldn't block. AllowRecipient checks if the archiver sends transcripts
+// to an address.
+type Archiver interface {
+	ArchiveRoom(RoomArchive)
+	AllowRecipient(addr string) bool
+}
+
+// validTranscriptEmail checks the address that a room's transcript is
+// emailed to. An empty address disables the email.
+func (h *Hub) validTranscriptEmail(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if h.Archiver == nil {
+		return ErrArchiveDisabled
+	}
+	if a, err := mail.ParseAddress(addr); err != nil || a.Address != addr {
+		return ErrInvalidEmail
+	}
+	if !h.Archiver.AllowRecipient(addr) {
+		return ErrEmailNotAllowed
+	}
+	return nil
+}
+
+// archive hands the room's history to the archiver before the room is
+// removed if the room has a transcript email. It should only be invoked from
+// the room's event loop.
+func (r *Room) archive(reason string) {
+	r.mut.RLock()
+	a := RoomArchive{
+		RoomID:   r.ID,
+		RoomName: r.name,
+		Tenant:   r.Opts.Tenant,
+		Language: r.Opts.Language,
+		Timezone: r.Opts.Timezone,
+		Email:    r.Opts.TranscriptEmail,
+		Reason:   reason,
+		ClosedAt: time.Now(),
+	}
+	r.mut.RUnlock()
+
+	if a.Email == "" || r.hub.Archiver == nil || r.hub.MsgCache == nil {
+		return
+	}
+
+	t := time.Now()
+	msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	r.storeLat.observe("get_message_cache", t)
+	if err != nil {
+		r.hub.log.Printf("error fetching message cache to archive %s: %v", r.ID, err)
+		return
+	}
+	r.ApplyPolls(msgs)
+	HidePeerIDs(msgs)
+	a.Messages = msgs
+
+	r.hub.Archiver.ArchiveRoom(a)
+}
@@ -0,0 +1,183 @@
+package hub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/store"
+)
+
+// Bans are persisted in the room's options so that they survive restarts
+// and are shared by instances. A banned peer is matched by their session,
+// handle, or IP address, so logging in again with a fresh cookie doesn't
+// bypass a ban.
+
+// typeBanPeer is an internal peer request to disconnect a banned peer.
+const typeBanPeer = "peer.ban"
+
+// Maximum number of bans in a room.
+const maxBans = 1000
+
+var (
+	// ErrBanned indicates that a peer is banned from the room.
+	ErrBanned = errors.New("you've been banned from this room")
+
+	// ErrBanNotFound indicates that the requested ban was not found.
+	ErrBanNotFound = errors.New("ban not found")
+
+	// ErrBanOwner indicates that the room's owner can't be banned.
+	ErrBanOwner = errors.New("the room's owner can't be banned")
+
+	// ErrTooManyBans indicates that the room has the maximum number of bans.
+	ErrTooManyBans = errors.New("too many bans in the room")
+)
+
+// HashIP returns the hash of a peer's IP address that's recorded in their
+// session and bans. IPs are hashed with the room's ID so that hashes can't
+// be correlated across rooms. The hash is keyed with the server's secret as
+// the IPv4 space is small enough to brute-force a plain hash.
+func (r *Room) HashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	h := hmac.New(sha256.New, r.hub.ipHashKey)
+	h.Write([]byte(r.ID + ":" + ip))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Bans returns the room's bans.
+func (r *Room) Bans() []store.Ban {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return append([]store.Ban{}, r.Opts.Bans...)
+}
+
+// IsBanned checks if a session, handle, or IP hash is banned from the room.
+// Empty values are ignored.
+func (r *Room) IsBanned(sessID, handle, ipHash string) bool {
+	key := ""
+	if sessID != "" {
+		key = SessionKey(sessID)
+	}
+	handle = strings.TrimSpace(handle)
+
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	for _, b := range r.Opts.Bans {
+		if (key != "" && b.SessionKey == key) ||
+			(handle != "" && strings.EqualFold(b.Handle, handle)) ||
+			(ipHash != "" && b.IPHash == ipHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// BanPeer bans a peer by their public ID (session key) and persists the ban. The peer's
+// handle and IP hash are recorded from their session. The sessions of the
+// handle are removed and their connections are closed.
+func (r *Room) BanPeer(peerID, reason, by string) (store.Ban, error) {
+	ss, err := r.hub.Store.GetSessions(r.ID)
+	if err != nil {
+		return store.Ban{}, err
+	}
+
+	var sess *store.Sess
+	for i := range ss {
+		if SessionKey(ss[i].ID) == peerID {
+			sess = &ss[i]
+			break
+		}
+	}
+	if sess == nil {
+		return store.Ban{}, ErrPeerNotFound
+	}
+	if sess.Owner {
+		return store.Ban{}, ErrBanOwner
+	}
+
+	id, err := GenerateGUID(12)
+	if err != nil {
+		return store.Ban{}, err
+	}
+	b := store.Ban{
+		ID:         id,
+		SessionKey: SessionKey(sess.ID),
+		Handle:     sess.Handle,
+		IPHash:     sess.IPHash,
+		Reason:     reason,
+		By:         by,
+		CreatedAt:  time.Now(),
+	}
+
+	r.mut.Lock()
+	if len(r.Opts.Bans) >= maxBans {
+		r.mut.Unlock()
+		return store.Ban{}, ErrTooManyBans
+	}
+	r.Opts.Bans = append(r.Opts.Bans, b)
+	r.mut.Unlock()
+
+	if err := r.hub.Store.UpdateRoom(r.storeRoom()); err != nil {
+		r.removeBan(b.ID)
+		return store.Ban{}, err
+	}
+
+	for _, s := range ss {
+		if s.ID != sess.ID && s.Handle != sess.Handle {
+			continue
+		}
+		if err := r.hub.Store.RemoveSession(s.ID, r.ID); err != nil {
+			r.hub.log.Printf("error removing banned session in %s: %v", r.ID, err)
+		}
+	}
+	r.queuePeerReq(typeBanPeer, &Peer{ID: sess.ID, Key: SessionKey(sess.ID), Handle: sess.Handle, room: r})
+	return b, nil
+}
+
+// Unban removes a ban and persists the room's bans.
+func (r *Room) Unban(banID string) error {
+	b, ok := r.removeBan(banID)
+	if !ok {
+		return ErrBanNotFound
+	}
+	if err := r.hub.Store.UpdateRoom(r.storeRoom()); err != nil {
+		r.mut.Lock()
+		r.Opts.Bans = append(r.Opts.Bans, b)
+		r.mut.Unlock()
+		return err
+	}
+	return nil
+}
+
+// removeBan removes a ban from the room's options.
+func (r *Room) removeBan(banID string) (store.Ban, bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for i, b := range r.Opts.Bans {
+		if b.ID == banID {
+			r.Opts.Bans = append(r.Opts.Bans[:i:i], r.Opts.Bans[i+1:]...)
+			return b, true
+		}
+	}
+	return store.Ban{}, false
+}
+
+// banPeer closes the connections of a banned peer's session and handle and
+// announces the ban. It should only be invoked from the room's event loop.
+func (r *Room) banPeer(p *Peer) {
+	for c := range r.peers {
+		if c.ID != p.ID && c.Handle != p.Handle {
+			continue
+		}
+		c.writeWSControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerBanned))
+		c.ws.Close()
+	}
+	r.broadcastSystem(SystemPeerBanned, r.systemPeerMsg(SystemPeerBanned, p), p)
+}
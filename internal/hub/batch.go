@@ -0,0 +1,146 @@
+package hub
+
+import (
+	"errors"
+
+	"github.com/knadh/niltalk/internal/notify"
+)
+
+// MessageResult is the result of posting a message in a batch.
+type MessageResult struct {
+	Index   int    `json:"index"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Delayed bool   `json:"delayed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var errInvalidMessage = errors.New("message is empty or too long")
+
+// PostMessages posts a batch of messages to the room on behalf of a peer
+// session in the given order. Messages in a batch are contiguous and are
+// assigned increasing sequence numbers.
+func (r *Room) PostMessages(peerID, handle string, owner, operator bool, msgs []NewMessage) []MessageResult {
+	var (
+		p   = &Peer{ID: peerID, Key: SessionKey(peerID), Handle: handle, Owner: owner, Operator: operator, room: r}
+		out = make([]MessageResult, len(msgs))
+	)
+
+	canPost := p.canPost()
+
+	// Filter the messages before posting them as filters may be slow,
+	// eg: external moderation APIs.
+	for i, m := range msgs {
+		out[i].Index = i
+		if !canPost {
+			out[i].Error = ErrReadOnly.Error()
+			continue
+		}
+		if m.Message == "" || len(m.Message) > r.hub.cfg.MaxMessageLen {
+			out[i].Error = errInvalidMessage.Error()
+			continue
+		}
+
+		var err error
+		if msgs[i].Message, err = r.filterMessage(m.Message, p); err != nil {
+			out[i].Error = err.Error()
+		}
+	}
+
+	r.postMut.Lock()
+	defer r.postMut.Unlock()
+
+	for i, m := range msgs {
+		if out[i].Error != "" {
+			continue
+		}
+
+		seq, delayed, err := r.sendMessage(m, p)
+		if err != nil {
+			out[i].Error = err.Error()
+			continue
+		}
+		out[i].Seq = seq
+		out[i].Delayed = delayed
+	}
+	return out
+}
+
+// postMessage posts a chat message from a peer to the room and returns its
+// sequence number.
+func (r *Room) postMessage(m NewMessage, p *Peer) (uint64, error) {
+	r.postMut.Lock()
+	defer r.postMut.Unlock()
+	seq, _, err := r.sendMessage(m, p)
+	return seq, err
+}
+
+// sendMessage assigns a sequence number to a chat message, broadcasts it,
+// and records it in the history. It returns the sequence number and whether
+// the message was delayed. A retry of a message that was already posted
+// returns its original sequence number. postMut should be held so that
+// messages are queued in the order of their sequence numbers.
+func (r *Room) sendMessage(m NewMessage, p *Peer) (uint64, bool, error) {
+	if seq, ok := r.postedSeq(p, m.ClientID); ok {
+		return seq, false, nil
+	}
+
+	sentAt, err := r.hub.delayedAt(m.SentAt)
+	if err != nil {
+		return 0, false, err
+	}
+	if !validBurn(m.Burn) {
+		return 0, false, errInvalidBurn
+	}
+
+	seq := r.nextSeq()
+	r.trackClientID(p, m.ClientID, seq)
+
+	// Burn-after-reading messages are only sent to connected peers.
+	mentions := parseMentions(m.Message)
+	if m.Burn > 0 {
+		r.Broadcast(r.makeMessagePayload(m, p, seq, sentAt), false)
+		r.queueMentions(mentions, m, p, seq)
+		if p.Operator {
+			r.hub.Audit.Record("operator.message", p.Handle, r.ID, map[string]interface{}{
+				"seq":  seq,
+				"burn": m.Burn,
+			})
+		}
+		return seq, sentAt != nil, nil
+	}
+
+	r.Broadcast(r.makeMessagePayload(m, p, seq, sentAt), true)
+	r.cacheMessageAt(TypeMessage, m.Message, p, seq, sentAt, mentions)
+	r.queueMentions(mentions, m, p, seq)
+	r.autoTitleFromMessage(m.Message)
+	r.notify(notify.EventMessage, p, m.Message)
+	if p.Operator {
+		r.hub.Audit.Record("operator.message", p.Handle, r.ID, map[string]interface{}{
+			"seq":     seq,
+			"message": m.Message,
+		})
+	}
+	return seq, sentAt != nil, nil
+}
+
+// nextSeq returns the next message sequence number. postMut should be held.
+func (r *Room) nextSeq() uint64 {
+	// Continue the sequence of a room that's reloaded with history.
+	if !r.seqLoaded {
+		r.seqLoaded = true
+		if r.hub.MsgCache != nil {
+			msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+			if err != nil {
+				r.hub.log.Printf("error loading message sequence in %s: %v", r.ID, err)
+			}
+			for _, m := range msgs {
+				if m.Seq > r.msgSeq {
+					r.msgSeq = m.Seq
+				}
+			}
+		}
+	}
+
+	r.msgSeq++
+	return r.msgSeq
+}
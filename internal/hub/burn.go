@@ -0,0 +1,20 @@
+package hub
+
+import "errors"
+
+// Peers can flag a message to be burnt after reading (burn, in seconds, in
+// the WS envelope or in batched messages) to share secrets in rooms with
+// history. Such messages are broadcast to peers that are connected but are
+// never written to the message cache or the in-memory cache that's sent to
+// peers who join later, and aren't sent to notification channels. Clients
+// remove them the given number of seconds after displaying them.
+
+// Maximum number of seconds a burn-after-reading message is displayed for.
+const maxBurnSeconds = 3600
+
+var errInvalidBurn = errors.New("invalid burn-after-reading duration")
+
+// validBurn checks if a burn-after-reading duration is valid. 0 disables it.
+func validBurn(secs int) bool {
+	return secs >= 0 && secs <= maxBurnSeconds
+}
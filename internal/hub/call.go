@@ -0,0 +1,306 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Peers can make voice and video calls to each other over WebRTC. The
+// server only relays the signaling: a peer offers a call to another peer
+// with an SDP offer (call.offer), a connection of the callee answers it
+// with an SDP answer (call.answer), and the two exchange ICE candidates
+// (call.ice) until the media connection is up. Either peer can hang up
+// (call.hangup), which also rejects an offer. Media never passes through
+// the server. Group calls are meshes of calls between pairs of peers.
+const (
+	TypeCallOffer  = "call.offer"
+	TypeCallAnswer = "call.answer"
+	TypeCallICE    = "call.ice"
+	TypeCallHangup = "call.hangup"
+)
+
+const (
+	// Time a callee has to answer an offer.
+	callOfferTTL = time.Minute
+
+	// Maximum number of calls a connection can be in at a time.
+	maxPeerCalls = 8
+)
+
+var (
+	errCallsDisabled = errors.New("calls are disabled")
+	errCallRoomSize  = errors.New("the room has too many peers for calls")
+	errCallInvalid   = errors.New("invalid call")
+	errCallNotFound  = errors.New("call not found or has ended")
+	errCallLimit     = errors.New("too many calls")
+)
+
+// call is a WebRTC call between two peers relayed by the room.
+type call struct {
+	ID    string
+	Media string
+
+	from *Peer
+	to   string
+
+	// Connection of the callee that answered the call. It's nil until the
+	// call is answered.
+	peer *Peer
+
+	offeredAt time.Time
+}
+
+// callReq is a call message from a peer.
+type callReq struct {
+	ID     string          `json:"id"`
+	To     string          `json:"to"`
+	Media  string          `json:"media"`
+	Signal json.RawMessage `json:"signal"`
+}
+
+type payloadMsgCall struct {
+	ID     string          `json:"id"`
+	From   *payloadMsgPeer `json:"from,omitempty"`
+	Media  string          `json:"media,omitempty"`
+	Signal json.RawMessage `json:"signal,omitempty"`
+}
+
+// queueCall parses a call message from a peer and queues it to the room's
+// event loop.
+func (p *Peer) queueCall(typ string, data interface{}) {
+	if p.room.hub.cfg.MaxCallPeers <= 0 {
+		p.SendData(p.room.makeNoticePayload(errCallsDisabled.Error()))
+		return
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	var req callReq
+	if err := json.Unmarshal(b, &req); err != nil {
+		p.SendData(p.room.makeNoticePayload(errCallInvalid.Error()))
+		return
+	}
+	if len(req.Signal) > maxSignalSize {
+		p.SendData(p.room.makeNoticePayload(errSignalTooLarge.Error()))
+		return
+	}
+
+	p.room.queueReq(peerReq{reqType: typ, peer: p, data: req})
+}
+
+// handleCall processes a call message from a peer. It should only be
+// invoked from the room's event loop.
+func (r *Room) handleCall(typ string, p *Peer, req callReq) {
+	var err error
+	switch typ {
+	case TypeCallOffer:
+		err = r.offerCall(p, req)
+	case TypeCallAnswer:
+		err = r.answerCall(p, req)
+	case TypeCallICE:
+		err = r.relayICE(p, req)
+	case TypeCallHangup:
+		err = r.hangupCall(p, req.ID)
+	}
+
+	if err != nil {
+		p.SendData(r.makeNoticePayload(err.Error()))
+	}
+}
+
+// offerCall relays a peer's call offer to the connections of the callee.
+func (r *Room) offerCall(p *Peer, req callReq) error {
+	if req.To == "" || req.To == p.Key || len(req.Signal) == 0 {
+		return errCallInvalid
+	}
+	if req.Media != "audio" && req.Media != "video" {
+		return errCallInvalid
+	}
+	if len(r.peers) > r.hub.cfg.MaxCallPeers {
+		return errCallRoomSize
+	}
+
+	// Expire unanswered offers and limit the number of calls.
+	n := 0
+	for id, c := range r.calls {
+		if c.peer == nil && time.Since(c.offeredAt) > callOfferTTL {
+			delete(r.calls, id)
+			continue
+		}
+		if c.from == p || c.peer == p {
+			n++
+		}
+	}
+	if n >= maxPeerCalls {
+		return errCallLimit
+	}
+
+	to := r.peersByKey(req.To)
+	if len(to) == 0 {
+		return errTransferPeer
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating call ID: %v", err)
+		return errCallInvalid
+	}
+
+	c := &call{
+		ID:        id,
+		Media:     req.Media,
+		from:      p,
+		to:        req.To,
+		offeredAt: time.Now(),
+	}
+	if r.calls == nil {
+		r.calls = make(map[string]*call)
+	}
+	r.calls[id] = c
+
+	// The caller gets the ID of the call.
+	p.SendData(r.makeCallPayload(TypeCallOffer, c, nil, nil))
+
+	b := r.makeCallPayload(TypeCallOffer, c, p, req.Signal)
+	for _, t := range to {
+		t.SendData(b)
+	}
+	r.auditCall(TypeCallOffer, p, c)
+	return nil
+}
+
+// answerCall binds an offered call to the callee's connection that answered
+// it and relays the answer to the caller. The callee's other connections
+// are told that the call has been answered elsewhere.
+func (r *Room) answerCall(p *Peer, req callReq) error {
+	c, ok := r.calls[req.ID]
+	if !ok || c.to != p.Key || c.peer != nil || time.Since(c.offeredAt) > callOfferTTL {
+		return errCallNotFound
+	}
+	if len(req.Signal) == 0 {
+		return errCallInvalid
+	}
+
+	c.peer = p
+	c.from.SendData(r.makeCallPayload(TypeCallAnswer, c, p, req.Signal))
+
+	b := r.makeCallPayload(TypeCallAnswer, c, p, nil)
+	for _, t := range r.peersByKey(c.to) {
+		if t != p {
+			t.SendData(b)
+		}
+	}
+	r.auditCall(TypeCallAnswer, p, c)
+	return nil
+}
+
+// relayICE relays an ICE candidate between the peers of a call. The
+// caller's candidates can be sent before the call is answered and go to all
+// the callee's connections.
+func (r *Room) relayICE(p *Peer, req callReq) error {
+	c, ok := r.calls[req.ID]
+	if !ok {
+		return errCallNotFound
+	}
+
+	var to []*Peer
+	switch p {
+	case c.from:
+		to = c.recipients(r)
+	case c.peer:
+		to = []*Peer{c.from}
+	default:
+		return errCallNotFound
+	}
+
+	b := r.makeCallPayload(TypeCallICE, c, p, req.Signal)
+	for _, t := range to {
+		t.SendData(b)
+	}
+	return nil
+}
+
+// hangupCall ends a call that's hung up or rejected by either peer and
+// informs the other peer.
+func (r *Room) hangupCall(p *Peer, id string) error {
+	c, ok := r.calls[id]
+	if !ok {
+		return errCallNotFound
+	}
+
+	var to []*Peer
+	switch {
+	case p == c.from:
+		to = c.recipients(r)
+	case p == c.peer || (c.peer == nil && p.Key == c.to):
+		to = []*Peer{c.from}
+	default:
+		return errCallNotFound
+	}
+
+	b := r.makeCallPayload(TypeCallHangup, c, p, nil)
+	for _, t := range to {
+		t.SendData(b)
+	}
+	delete(r.calls, id)
+	r.auditCall(TypeCallHangup, p, c)
+	return nil
+}
+
+// hangupPeerCalls ends the calls of a peer that has left and informs the
+// other peers.
+func (r *Room) hangupPeerCalls(p *Peer) {
+	for id, c := range r.calls {
+		var to []*Peer
+		switch p {
+		case c.from:
+			to = c.recipients(r)
+		case c.peer:
+			to = []*Peer{c.from}
+		default:
+			continue
+		}
+
+		delete(r.calls, id)
+		b := r.makeCallPayload(TypeCallHangup, c, p, nil)
+		for _, t := range to {
+			t.SendData(b)
+		}
+		r.auditCall(TypeCallHangup, p, c)
+	}
+}
+
+// recipients returns the callee's connection that answered the call or all
+// its connections if it hasn't been answered.
+func (c *call) recipients(r *Room) []*Peer {
+	if c.peer != nil {
+		return []*Peer{c.peer}
+	}
+	return r.peersByKey(c.to)
+}
+
+// makeCallPayload prepares a call message payload from the given peer. The
+// media type is only included in offers.
+func (r *Room) makeCallPayload(typ string, c *call, from *Peer, signal json.RawMessage) *payload {
+	d := payloadMsgCall{ID: c.ID, Signal: signal}
+	if from != nil {
+		d.From = &payloadMsgPeer{ID: from.Key, Handle: from.Handle}
+	}
+	if typ == TypeCallOffer {
+		d.Media = c.Media
+	}
+	return r.makePayload(d, typ)
+}
+
+// auditCall records a call event in the audit log.
+func (r *Room) auditCall(typ string, p *Peer, c *call) {
+	r.hub.Audit.Record(typ, p.Handle, r.ID, map[string]interface{}{
+		"id":    c.ID,
+		"from":  c.from.Handle,
+		"to":    c.to,
+		"media": c.Media,
+	})
+}
@@ -0,0 +1,43 @@
+package hub
+
+import "errors"
+
+// ErrHistoryDisabled indicates that a room's messages aren't persisted,
+// either because there's no message cache backend (history is disabled)
+// or because the room doesn't keep history (kiosk).
+var ErrHistoryDisabled = errors.New("history is disabled")
+
+// Capabilities represents the optional features that depend on the
+// deployment's backends and are available in a room.
+type Capabilities struct {
+	// Messages are persisted and the history API is available.
+	History bool `json:"history"`
+
+	// The history can be exported as transcripts.
+	Export bool `json:"export"`
+
+	// Recent messages are sent to peers on login.
+	Backfill bool `json:"backfill"`
+
+	// Recent messages from the history are sent to peers when they connect.
+	Replay bool `json:"replay"`
+
+	// Peers can call each other over WebRTC.
+	Calls bool `json:"calls"`
+
+	// Peers that reconnect are sent the messages they missed.
+	Resume bool `json:"resume"`
+}
+
+// Capabilities returns the optional features available in the room.
+func (r *Room) Capabilities() Capabilities {
+	h := r.logging()
+	return Capabilities{
+		History:  h,
+		Export:   h,
+		Backfill: h && r.hub.cfg.MaxCachedMessages > 0,
+		Replay:   h && r.Opts.ReplayMessages > 0,
+		Calls:    r.hub.cfg.MaxCallPeers > 0,
+		Resume:   h && r.hub.cfg.ResumeTTL > 0,
+	}
+}
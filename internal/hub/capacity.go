@@ -0,0 +1,156 @@
+package hub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Window ahead of the current time for which upcoming reservations are
+// reported as autoscaling hints.
+const reservationLookahead = time.Hour
+
+var (
+	// ErrOvercommitted indicates that a capacity reservation would exceed
+	// the instance's capacity.
+	ErrOvercommitted = errors.New("the instance doesn't have enough capacity at that time")
+
+	// ErrInvalidReservation indicates an invalid capacity reservation.
+	ErrInvalidReservation = errors.New("invalid reservation")
+)
+
+// Capacity represents the peer capacity of the instance and the
+// reservations against it.
+type Capacity struct {
+	MaxPeers int `json:"max_peers"`
+	Peers    int `json:"peers"`
+
+	// Peers reserved by reservations that are active now.
+	Reserved int `json:"reserved"`
+
+	// Highest number of peers reserved at any point in the lookahead window.
+	ReservedUpcoming int `json:"reserved_upcoming"`
+}
+
+// validateReservation validates a capacity reservation for a new room.
+func (h *Hub) validateReservation(rv store.Reservation, tenant string) error {
+	now := time.Now()
+	switch {
+	case rv.Peers < 1 || rv.Peers > h.tenant(tenant).MaxPeersPerRoom:
+		return ErrInvalidReservation
+	case !rv.End.After(rv.Start) || rv.End.Before(now):
+		return ErrInvalidReservation
+	// The room expires if it's not used within the room age.
+	case rv.Start.After(now.Add(h.cfg.RoomAge)):
+		return ErrInvalidReservation
+	}
+	return nil
+}
+
+// reserve registers a room's capacity reservation if it doesn't overcommit
+// the instance.
+func (h *Hub) reserve(roomID string, rv store.Reservation) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	// Drop lapsed reservations.
+	now := time.Now()
+	for id, r := range h.reservations {
+		if r.End.Before(now) {
+			delete(h.reservations, id)
+		}
+	}
+
+	if h.cfg.MaxPeers > 0 && h.peakReserved(rv.Start, rv.End)+rv.Peers > h.cfg.MaxPeers {
+		return ErrOvercommitted
+	}
+	h.reservations[roomID] = rv
+	return nil
+}
+
+// peakReserved returns the highest number of peers reserved at any point
+// in the given interval. The reservations lock should be held.
+func (h *Hub) peakReserved(start, end time.Time) int {
+	// The total only changes at the start of a reservation, so it's enough
+	// to check the beginning of the interval and the starts within it.
+	points := []time.Time{start}
+	for _, r := range h.reservations {
+		if r.Start.After(start) && r.Start.Before(end) {
+			points = append(points, r.Start)
+		}
+	}
+
+	peak := 0
+	for _, t := range points {
+		n := 0
+		for _, r := range h.reservations {
+			if !t.Before(r.Start) && t.Before(r.End) {
+				n += r.Peers
+			}
+		}
+		if n > peak {
+			peak = n
+		}
+	}
+	return peak
+}
+
+// admitPeer checks if the instance has capacity for a new peer in a room
+// without eating into the unused capacity reserved for other rooms. Rooms
+// can always fill their own active reservations.
+func (h *Hub) admitPeer(room *Room) bool {
+	if h.cfg.MaxPeers <= 0 {
+		return true
+	}
+
+	var (
+		now   = time.Now()
+		held  = 0
+		rooms = h.getRooms()
+	)
+
+	h.mut.RLock()
+	own, hasOwn := h.reservations[room.ID]
+	for id, rv := range h.reservations {
+		if now.Before(rv.Start) || !now.Before(rv.End) {
+			continue
+		}
+
+		// Unused capacity of the reservation.
+		n := rv.Peers
+		if r, ok := h.rooms[id]; ok {
+			n -= r.NumPeers()
+		}
+		if n > 0 && id != room.ID {
+			held += n
+		}
+	}
+	h.mut.RUnlock()
+
+	if hasOwn && !now.Before(own.Start) && now.Before(own.End) && room.NumPeers() < own.Peers {
+		return true
+	}
+
+	peers := 0
+	for _, r := range rooms {
+		peers += r.NumPeers()
+	}
+	return peers+held < h.cfg.MaxPeers
+}
+
+// Capacity returns the instance's capacity and reservations.
+func (h *Hub) Capacity() Capacity {
+	_, peers := h.Stats()
+	now := time.Now()
+
+	h.mut.RLock()
+	c := Capacity{
+		MaxPeers:         h.cfg.MaxPeers,
+		Peers:            peers,
+		Reserved:         h.peakReserved(now, now.Add(time.Nanosecond)),
+		ReservedUpcoming: h.peakReserved(now, now.Add(reservationLookahead)),
+	}
+	h.mut.RUnlock()
+	return c
+}
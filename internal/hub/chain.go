@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// ChainResult is the result of verifying a room's message hash chain.
+type ChainResult struct {
+	Valid       bool   `json:"valid"`
+	NumMessages int    `json:"num_messages"`
+	BrokenAt    string `json:"broken_at,omitempty"`
+}
+
+// hashMessage computes the hash of a message chained to the hash of the
+// message before it.
+func hashMessage(prevHash string, m store.Message) string {
+	h := sha256.New()
+	for _, s := range []string{
+		prevHash,
+		m.ID,
+		m.Type,
+		m.PeerID,
+		m.PeerHandle,
+		m.Message,
+		m.Timestamp.UTC().Format(time.RFC3339Nano),
+	} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyChain verifies the hash chain of a room's cached messages starting
+// from the room's chain anchor and returns the ID of the first message where
+// the chain breaks. A message that's been modified, removed, inserted, or
+// reordered breaks the chain.
+func VerifyChain(anchor string, msgs []store.Message) ChainResult {
+	prev := anchor
+	for _, m := range msgs {
+		if m.PrevHash != prev || m.Hash != hashMessage(prev, m) {
+			return ChainResult{NumMessages: len(msgs), BrokenAt: m.ID}
+		}
+		prev = m.Hash
+	}
+	return ChainResult{Valid: true, NumMessages: len(msgs)}
+}
+
+// chainMessage links a message to the room's hash chain. It should be
+// called with chainMut held and messages should be written to the cache
+// in the order they're chained.
+func (r *Room) chainMessage(m *store.Message) error {
+	// Resume the chain of a room that has been reactivated.
+	if !r.chainLoaded {
+		msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+		if err != nil {
+			return err
+		}
+		if len(msgs) > 0 {
+			r.lastHash = msgs[len(msgs)-1].Hash
+		} else {
+			r.lastHash = r.ChainAnchor()
+		}
+		r.chainLoaded = true
+	}
+
+	m.PrevHash = r.lastHash
+	m.Hash = hashMessage(m.PrevHash, *m)
+	r.lastHash = m.Hash
+	return nil
+}
+
+// ChainAnchor returns the hash that the first message in the room's history
+// is chained to.
+func (r *Room) ChainAnchor() string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.Opts.ChainAnchor
+}
+
+// setChainAnchor sets the room's chain anchor and persists it.
+func (r *Room) setChainAnchor(anchor string) error {
+	r.mut.Lock()
+	if r.Opts.ChainAnchor == anchor {
+		r.mut.Unlock()
+		return nil
+	}
+	r.Opts.ChainAnchor = anchor
+	r.mut.Unlock()
+	return r.hub.Store.UpdateRoom(r.storeRoom())
+}
+
+// linked checks if the messages are chained to the anchor and each other
+// without gaps.
+func linked(anchor string, msgs []store.Message) bool {
+	prev := anchor
+	for _, m := range msgs {
+		if m.PrevHash != prev {
+			return false
+		}
+		prev = m.Hash
+	}
+	return true
+}
+
+// rechain chains the messages to the anchor and each other and returns the
+// hash of the last one.
+func rechain(anchor string, msgs []store.Message) string {
+	prev := anchor
+	for i := range msgs {
+		msgs[i].PrevHash = prev
+		msgs[i].Hash = hashMessage(prev, msgs[i])
+		prev = msgs[i].Hash
+	}
+	return prev
+}
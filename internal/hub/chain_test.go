@@ -0,0 +1,189 @@
+package hub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/lock"
+	"github.com/knadh/niltalk/store/mem"
+)
+
+// chainedMessages returns n chained messages posted a minute apart from
+// start.
+func chainedMessages(anchor string, n int, start time.Time) []store.Message {
+	msgs := make([]store.Message, n)
+	for i := range msgs {
+		msgs[i] = store.Message{
+			ID:         fmt.Sprintf("m%d", i),
+			Type:       TypeMessage,
+			PeerID:     "p1",
+			PeerHandle: "alice",
+			Message:    fmt.Sprintf("message %d", i),
+			Timestamp:  start.Add(time.Duration(i) * time.Minute),
+		}
+	}
+	rechain(anchor, msgs)
+	return msgs
+}
+
+// newChainRoom returns a persistent room with the hash chain enabled and
+// the given messages in its history.
+func newChainRoom(t *testing.T, msgs []store.Message) *Room {
+	st, err := mem.New(mem.Config{}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Hub{
+		cfg:      &Config{HistoryHashChain: true},
+		Store:    st,
+		MsgCache: st,
+		Locker:   lock.NewLocal(),
+		log:      log.New(ioutil.Discard, "", 0),
+	}
+	r := &Room{
+		ID:       "room1",
+		mut:      &sync.RWMutex{},
+		hub:      h,
+		Opts:     store.RoomOpts{Persistent: true, RetentionHours: 1},
+		storeLat: &storeLatencies{ops: make(map[string]StoreLatency)},
+	}
+	if err := st.AddRoom(r.storeRoom(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AddMessageCacheBatch(r.ID, msgs, 0); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// verifyRoom verifies the room's cached history from its anchor.
+func verifyRoom(t *testing.T, r *Room) ChainResult {
+	msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return VerifyChain(r.ChainAnchor(), msgs)
+}
+
+func TestVerifyChain(t *testing.T) {
+	now := time.Now()
+
+	msgs := chainedMessages("", 5, now)
+	if res := VerifyChain("", msgs); !res.Valid || res.NumMessages != 5 {
+		t.Fatalf("expected a valid chain of 5, got %+v", res)
+	}
+
+	// Modified.
+	mod := chainedMessages("", 5, now)
+	mod[2].Message = "edited"
+	if res := VerifyChain("", mod); res.Valid || res.BrokenAt != "m2" {
+		t.Errorf("expected the chain to break at m2, got %+v", res)
+	}
+
+	// Removed.
+	rem := append(chainedMessages("", 5, now)[:2:2], chainedMessages("", 5, now)[3:]...)
+	if res := VerifyChain("", rem); res.Valid || res.BrokenAt != "m3" {
+		t.Errorf("expected the chain to break at m3, got %+v", res)
+	}
+
+	// Reordered.
+	ord := chainedMessages("", 5, now)
+	ord[1], ord[2] = ord[2], ord[1]
+	if res := VerifyChain("", ord); res.Valid || res.BrokenAt != "m2" {
+		t.Errorf("expected the chain to break at m2, got %+v", res)
+	}
+
+	// Anchored.
+	anc := chainedMessages("anchor", 3, now)
+	if res := VerifyChain("anchor", anc); !res.Valid {
+		t.Errorf("expected the anchored chain to be valid, got %+v", res)
+	}
+	if res := VerifyChain("", anc); res.Valid {
+		t.Error("expected the anchored chain to break without its anchor")
+	}
+}
+
+// TestPruneHistoryAnchors checks that pruning the head of the history
+// keeps the hashes of the remaining messages and anchors the chain to the
+// last message removed.
+func TestPruneHistoryAnchors(t *testing.T) {
+	msgs := chainedMessages("", 5, time.Now().Add(-3*time.Hour))
+	msgs[3].Timestamp = time.Now().Add(-10 * time.Minute)
+	msgs[4].Timestamp = time.Now().Add(-5 * time.Minute)
+	rechain("", msgs)
+
+	r := newChainRoom(t, msgs)
+	r.pruneHistory()
+
+	cached, _ := r.hub.MsgCache.GetMessageCache(r.ID)
+	if len(cached) != 2 || cached[0].ID != "m3" {
+		t.Fatalf("expected m3 and m4 to remain, got %d messages", len(cached))
+	}
+	if cached[0].Hash != msgs[3].Hash || cached[1].Hash != msgs[4].Hash {
+		t.Error("expected the remaining messages to keep their hashes")
+	}
+	if r.ChainAnchor() != msgs[2].Hash {
+		t.Errorf("expected the anchor to be the hash of m2")
+	}
+	if res := verifyRoom(t, r); !res.Valid {
+		t.Errorf("expected the pruned chain to verify, got %+v", res)
+	}
+}
+
+// TestPruneHistoryKeepsTampering checks that tampering with a message
+// before the history is pruned remains detectable.
+func TestPruneHistoryKeepsTampering(t *testing.T) {
+	msgs := chainedMessages("", 5, time.Now().Add(-3*time.Hour))
+	for i := 2; i < 5; i++ {
+		msgs[i].Timestamp = time.Now().Add(-time.Duration(10-i) * time.Minute)
+	}
+	rechain("", msgs)
+	msgs[3].Message = "edited"
+
+	r := newChainRoom(t, msgs)
+	r.pruneHistory()
+
+	if res := verifyRoom(t, r); res.Valid || res.BrokenAt != "m3" {
+		t.Errorf("expected the chain to remain broken at m3, got %+v", res)
+	}
+}
+
+// TestPruneHistoryByTimestamp checks that old messages cached after newer
+// ones, eg: delayed ones, are pruned and the rest are rechained over the
+// gap if the chain verifies.
+func TestPruneHistoryByTimestamp(t *testing.T) {
+	now := time.Now()
+	msgs := chainedMessages("", 4, now)
+	msgs[0].Timestamp = now.Add(-3 * time.Hour)
+	msgs[1].Timestamp = now.Add(-10 * time.Minute)
+	msgs[2].Timestamp = now.Add(-2 * time.Hour)
+	msgs[3].Timestamp = now.Add(-5 * time.Minute)
+	rechain("", msgs)
+
+	// Intact chain.
+	r := newChainRoom(t, append([]store.Message{}, msgs...))
+	r.pruneHistory()
+
+	cached, _ := r.hub.MsgCache.GetMessageCache(r.ID)
+	if len(cached) != 2 || cached[0].ID != "m1" || cached[1].ID != "m3" {
+		t.Fatalf("expected m1 and m3 to remain, got %v", cached)
+	}
+	if res := verifyRoom(t, r); !res.Valid {
+		t.Errorf("expected the rechained history to verify, got %+v", res)
+	}
+
+	// Broken chain. It's not rechained over the gap.
+	tampered := append([]store.Message{}, msgs...)
+	tampered[1].Message = "edited"
+	r = newChainRoom(t, tampered)
+	r.pruneHistory()
+
+	if res := verifyRoom(t, r); res.Valid {
+		t.Error("expected the tampered history to remain broken after pruning")
+	}
+}
@@ -0,0 +1,40 @@
+package hub
+
+import "strings"
+
+// Slash commands peers can send as messages.
+const (
+	cmdDispose = "/dispose"
+
+	// /poll Question? | Option 1 | Option 2 ...
+	cmdPoll = "/poll"
+)
+
+// runCommand runs a slash command sent by a peer as a message and reports
+// whether the message was a command. Commands aren't posted to the room.
+func (p *Peer) runCommand(msg string) bool {
+	msg = strings.TrimSpace(msg)
+	switch {
+	case msg == cmdDispose:
+		p.disposeRoom()
+	case strings.HasPrefix(msg, cmdPoll+" "):
+		p.runPollCommand(strings.TrimPrefix(msg, cmdPoll+" "))
+	default:
+		return false
+	}
+	return true
+}
+
+// runPollCommand creates a poll from the arguments of the poll command.
+func (p *Peer) runPollCommand(args string) {
+	if !p.canPost() {
+		p.SendData(p.room.makeNoticePayload(ErrReadOnly.Error()))
+		return
+	}
+
+	parts := strings.Split(args, "|")
+	np := NewPoll{Question: parts[0], Options: parts[1:]}
+	if err := p.room.createPoll(np, p); err != nil {
+		p.SendData(p.room.makeNoticePayload(err.Error()))
+	}
+}
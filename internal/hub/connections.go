@@ -0,0 +1,48 @@
+package hub
+
+import "time"
+
+// PeerConn represents a peer's connection to a room with the metadata that
+// room owners can use for moderation decisions. Unlike PeerInfo, every
+// connection (device) of a handle is listed.
+type PeerConn struct {
+	ID          string      `json:"id"`
+	Handle      string      `json:"handle"`
+	Owner       bool        `json:"owner"`
+	Operator    bool        `json:"operator"`
+	ConnectedAt time.Time   `json:"connected_at"`
+	UserAgent   string      `json:"user_agent"`
+	Country     string      `json:"country,omitempty"`
+	Quality     PeerQuality `json:"quality"`
+}
+
+// Connections returns the list of connections to the room. It returns nil if
+// the room's event loop doesn't respond within the timeout.
+func (r *Room) Connections(timeout time.Duration) []PeerConn {
+	ch := make(chan []PeerConn, 1)
+	select {
+	case r.connsQ <- ch:
+		return <-ch
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// connList returns the list of connections to the room. It should only be
+// invoked from the room's event loop.
+func (r *Room) connList() []PeerConn {
+	out := make([]PeerConn, 0, len(r.peers))
+	for p := range r.peers {
+		out = append(out, PeerConn{
+			ID:          p.Key,
+			Handle:      p.Handle,
+			Owner:       p.Owner,
+			Operator:    p.Operator,
+			ConnectedAt: p.connectedAt,
+			UserAgent:   p.UserAgent,
+			Country:     p.Country,
+			Quality:     p.quality(),
+		})
+	}
+	return out
+}
@@ -0,0 +1,199 @@
+package hub
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Number of recent events a room keeps for debugging.
+const numDebugEvents = 100
+
+// RoomDebug is a snapshot of a room's internals for troubleshooting.
+type RoomDebug struct {
+	ID string `json:"id"`
+
+	// The room's event loop didn't respond in time. Peers and events
+	// are unavailable.
+	LoopBlocked bool `json:"loop_blocked"`
+
+	// Number of payloads broadcast to the room.
+	Seq uint64 `json:"seq"`
+
+	BroadcastQueue int                     `json:"broadcast_queue"`
+	PeerQueue      int                     `json:"peer_queue"`
+	Peers          []PeerDebug             `json:"peers"`
+	Events         []DebugEvent            `json:"events"`
+	StoreLatency   map[string]StoreLatency `json:"store_latency"`
+}
+
+// PeerDebug is a snapshot of a connected peer.
+type PeerDebug struct {
+	Key           string `json:"key"`
+	Handle        string `json:"handle"`
+	ClientVersion string `json:"client_version"`
+	RemoteAddr    string `json:"remote_addr"`
+
+	// Number of outbound payloads waiting to be written to the peer.
+	BufferDepth int `json:"buffer_depth"`
+	BufferCap   int `json:"buffer_cap"`
+
+	// Round trip time of a websocket ping. 0 if the peer didn't respond.
+	RTT     time.Duration `json:"rtt_ns"`
+	Quality PeerQuality   `json:"quality"`
+}
+
+// DebugEvent is a room event recorded for debugging.
+type DebugEvent struct {
+	Type   string    `json:"type"`
+	Handle string    `json:"handle,omitempty"`
+	Size   int       `json:"size,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// StoreLatency represents the latencies of a store operation.
+type StoreLatency struct {
+	Count int64         `json:"count"`
+	Last  time.Duration `json:"last_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// debugSnapshot is a snapshot prepared by the room's event loop along with
+// the peers in it.
+type debugSnapshot struct {
+	RoomDebug
+	peers []*Peer
+}
+
+// storeLatencies records the latencies of store operations made by a room.
+type storeLatencies struct {
+	sync.Mutex
+	ops map[string]StoreLatency
+}
+
+// observe records the latency of a store operation that started at t.
+func (s *storeLatencies) observe(op string, t time.Time) {
+	d := time.Since(t)
+
+	s.Lock()
+	l := s.ops[op]
+	l.Count++
+	l.Last = d
+	if d > l.Max {
+		l.Max = d
+	}
+	s.ops[op] = l
+	s.Unlock()
+}
+
+func (s *storeLatencies) get() map[string]StoreLatency {
+	s.Lock()
+	out := make(map[string]StoreLatency, len(s.ops))
+	for k, v := range s.ops {
+		out[k] = v
+	}
+	s.Unlock()
+	return out
+}
+
+// Debug returns a snapshot of the room for troubleshooting. Connected
+// peers are pinged and their round trip times are measured for up to
+// the given duration.
+func (r *Room) Debug(wait time.Duration) RoomDebug {
+	// Probe the store.
+	t := time.Now()
+	r.hub.Store.RoomExists(r.ID)
+	r.storeLat.observe("room_exists", t)
+
+	out := RoomDebug{
+		ID:             r.ID,
+		Seq:            atomic.LoadUint64(&r.seq),
+		BroadcastQueue: len(r.broadcastQ),
+		PeerQueue:      len(r.peerQ),
+		StoreLatency:   r.storeLat.get(),
+	}
+
+	// Request the snapshot from the room's event loop.
+	var (
+		ch    = make(chan debugSnapshot, 1)
+		peers []*Peer
+	)
+	select {
+	case r.debugQ <- ch:
+		d := <-ch
+		out.Events = d.Events
+		out.Peers = d.Peers
+		peers = d.peers
+	case <-time.After(wait):
+		out.LoopBlocked = true
+		return out
+	}
+
+	// Collect the ping round trip times.
+	time.Sleep(wait)
+	for i, p := range peers {
+		out.Peers[i].RTT = time.Duration(atomic.LoadInt64(&p.rtt))
+		out.Peers[i].Quality = p.quality()
+	}
+	return out
+}
+
+// makeDebug prepares a snapshot of the room's peers and events. It should
+// only be invoked from the room's event loop.
+func (r *Room) makeDebug() debugSnapshot {
+	var (
+		peers = make([]PeerDebug, 0, len(r.peers))
+		list  = make([]*Peer, 0, len(r.peers))
+		now   = strconv.FormatInt(time.Now().UnixNano(), 10)
+	)
+
+	for p := range r.peers {
+		list = append(list, p)
+		peers = append(peers, PeerDebug{
+			Key:           p.Key,
+			Handle:        p.Handle,
+			ClientVersion: p.ClientVersion,
+			RemoteAddr:    p.IP,
+			BufferDepth:   len(p.dataQ),
+			BufferCap:     cap(p.dataQ),
+		})
+
+		// The pong handler records the round trip time.
+		atomic.StoreInt64(&p.rtt, 0)
+		p.writeWSControl(websocket.PingMessage, []byte(now))
+	}
+
+	events := make([]DebugEvent, len(r.events))
+	copy(events, r.events)
+	return debugSnapshot{RoomDebug: RoomDebug{Peers: peers, Events: events}, peers: list}
+}
+
+// recordEvent records a room event for debugging. It should only be invoked
+// from the room's event loop.
+func (r *Room) recordEvent(typ string, p *Peer, size int) {
+	e := DebugEvent{Type: typ, Size: size, Time: time.Now()}
+	if p != nil {
+		e.Handle = p.Handle
+	}
+
+	if len(r.events) >= numDebugEvents {
+		r.events = r.events[1:]
+	}
+	r.events = append(r.events, e)
+}
+
+// handlePong records the round trip time of a ping sent by makeDebug or
+// a heartbeat.
+func (p *Peer) handlePong(data string) error {
+	ts, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return nil
+	}
+	atomic.StoreInt64(&p.rtt, time.Now().UnixNano()-ts)
+	atomic.StoreInt32(&p.pendingPongs, 0)
+	atomic.StoreInt64(&p.lastPong, time.Now().UnixNano())
+	return nil
+}
@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encodings of the websocket protocol that clients can negotiate when
+// connecting (?enc=). JSON payloads are sent as text frames and MessagePack
+// payloads as binary frames. The envelope and its fields are the same in
+// all encodings.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// ErrUnsupportedEncoding indicates that a client requested an encoding
+// that isn't supported.
+var ErrUnsupportedEncoding = errors.New("unsupported encoding")
+
+// payload is a message payload prepared for peers. It's encoded lazily,
+// once per encoding, no matter how many peers it's sent to.
+type payload struct {
+	msg payloadMsgWrap
+
+	json    encodedPayload
+	msgpack encodedPayload
+
+	// Version 1 envelopes.
+	jsonV1    encodedPayload
+	msgpackV1 encodedPayload
+}
+
+type encodedPayload struct {
+	once sync.Once
+	b    []byte
+}
+
+// NegotiateEncoding validates the encoding requested by a client. Clients
+// that don't request one get JSON, as do those that request MessagePack when
+// it's not enabled (msgpack) for the room. The negotiated encoding is
+// reported in the protocol payload.
+func NegotiateEncoding(requested string, msgpack bool) (string, error) {
+	switch requested {
+	case "", EncodingJSON:
+		return EncodingJSON, nil
+	case EncodingMsgpack:
+		if !msgpack {
+			return EncodingJSON, nil
+		}
+		return EncodingMsgpack, nil
+	}
+	return "", ErrUnsupportedEncoding
+}
+
+// encode returns the payload in the given encoding and the envelope of the
+// given protocol version, and the websocket frame type to write it with.
+func (p *payload) encode(enc string, proto int) ([]byte, int) {
+	if proto == 1 {
+		return p.encodeV1(enc)
+	}
+
+	if enc == EncodingMsgpack {
+		p.msgpack.once.Do(func() {
+			p.msgpack.b, _ = marshalMsgpack(p.msg)
+		})
+		return p.msgpack.b, websocket.BinaryMessage
+	}
+
+	p.json.once.Do(func() {
+		p.json.b, _ = encodeJSON(&p.msg)
+	})
+	return p.json.b, websocket.TextMessage
+}
+
+// encodeV1 returns the payload in a version 1 envelope.
+func (p *payload) encodeV1(enc string) ([]byte, int) {
+	m := payloadMsgWrapV1{Type: p.msg.Type, Data: p.msg.Data, Timestamp: p.msg.Timestamp}
+	if enc == EncodingMsgpack {
+		p.msgpackV1.once.Do(func() {
+			p.msgpackV1.b, _ = marshalMsgpack(m)
+		})
+		return p.msgpackV1.b, websocket.BinaryMessage
+	}
+
+	p.jsonV1.once.Do(func() {
+		p.jsonV1.b, _ = json.Marshal(m)
+	})
+	return p.jsonV1.b, websocket.TextMessage
+}
+
+// size returns the size of the payload's JSON encoding.
+func (p *payload) size() int {
+	b, _ := p.encode(EncodingJSON, ProtocolVersion)
+	return len(b)
+}
+
+// marshalMsgpack encodes v with MessagePack using its JSON field names.
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decodeMessage decodes an incoming message from a peer in the given
+// encoding.
+func decodeMessage(enc string, b []byte, m *payloadMsgWrap) error {
+	if enc == EncodingMsgpack {
+		dec := msgpack.NewDecoder(bytes.NewReader(b))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(m)
+	}
+	return json.Unmarshal(b, m)
+}
@@ -0,0 +1,234 @@
+package hub
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Envelopes are encoded to JSON by appending their fields to a pooled
+// buffer instead of going through encoding/json's reflection for every
+// payload. Only type specific data that doesn't have a fast path below is
+// encoded with encoding/json. The output is equivalent to json.Marshal.
+
+// Pre-encoded fragments of the envelope.
+const (
+	fragV         = `{"v":`
+	fragType      = `,"type":`
+	fragID        = `,"id":`
+	fragTS        = `,"ts":`
+	fragPeer      = `,"peer":`
+	fragData      = `,"data":`
+	fragClientID  = `,"client_id":`
+	fragBurn      = `,"burn":`
+	fragTimestamp = `,"timestamp":`
+)
+
+const hexDigits = "0123456789abcdef"
+
+// Buffers for encoding envelopes. Buffers that have grown beyond
+// maxPooledBuf (eg: for a large import) aren't returned to the pool.
+const maxPooledBuf = 64 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// encodeJSON encodes an envelope to JSON.
+func encodeJSON(m *payloadMsgWrap) ([]byte, error) {
+	bp := bufPool.Get().(*[]byte)
+	b, err := appendEnvelope((*bp)[:0], m)
+
+	// The pooled buffer is reused, so the payload gets its own copy.
+	var out []byte
+	if err == nil {
+		out = make([]byte, len(b))
+		copy(out, b)
+	}
+	if cap(b) <= maxPooledBuf {
+		*bp = b
+		bufPool.Put(bp)
+	}
+	return out, err
+}
+
+// appendEnvelope appends the JSON encoding of an envelope to b.
+func appendEnvelope(b []byte, m *payloadMsgWrap) ([]byte, error) {
+	var err error
+
+	b = append(b, fragV...)
+	b = strconv.AppendInt(b, int64(m.V), 10)
+	b = append(b, fragType...)
+	b = appendString(b, m.Type)
+	b = append(b, fragID...)
+	b = strconv.AppendUint(b, m.ID, 10)
+	b = append(b, fragTS...)
+	b = strconv.AppendInt(b, m.TS, 10)
+
+	if m.Peer != nil {
+		b = append(b, fragPeer...)
+		if b, err = appendPeer(b, m.Peer); err != nil {
+			return nil, err
+		}
+	}
+
+	b = append(b, fragData...)
+	if b, err = appendData(b, m.Data); err != nil {
+		return nil, err
+	}
+
+	if m.ClientID != "" {
+		b = append(b, fragClientID...)
+		b = appendString(b, m.ClientID)
+	}
+
+	if m.Burn != 0 {
+		b = append(b, fragBurn...)
+		b = strconv.AppendInt(b, int64(m.Burn), 10)
+	}
+
+	b = append(b, fragTimestamp...)
+	b = appendTime(b, m.Timestamp)
+	return append(b, '}'), nil
+}
+
+// appendPeer appends the JSON encoding of a peer.
+func appendPeer(b []byte, p *payloadMsgPeer) ([]byte, error) {
+	if p.Quality != nil {
+		return appendJSON(b, p)
+	}
+
+	b = append(b, `{"id":`...)
+	b = appendString(b, p.ID)
+	b = append(b, `,"handle":`...)
+	b = appendString(b, p.Handle)
+	if p.Operator {
+		b = append(b, `,"operator":true`...)
+	}
+	return append(b, '}'), nil
+}
+
+// appendData appends the JSON encoding of an envelope's data. Chat messages
+// and plain strings, the bulk of the payloads, have fast paths.
+func appendData(b []byte, data interface{}) ([]byte, error) {
+	switch d := data.(type) {
+	case string:
+		return appendString(b, d), nil
+
+	case payloadMsgChat:
+		b = append(b, `{"peer_id":`...)
+		b = appendString(b, d.PeerID)
+		b = append(b, `,"peer_handle":`...)
+		b = appendString(b, d.PeerHandle)
+		if d.PeerOperator {
+			b = append(b, `,"peer_operator":true`...)
+		}
+		b = append(b, `,"message":`...)
+		b = appendString(b, d.Msg)
+		b = append(b, `,"seq":`...)
+		b = strconv.AppendUint(b, d.Seq, 10)
+		if d.ClientID != "" {
+			b = append(b, `,"client_id":`...)
+			b = appendString(b, d.ClientID)
+		}
+		if d.Delayed {
+			b = append(b, `,"delayed":true`...)
+		}
+		if d.SentAt != nil {
+			b = append(b, `,"sent_at":`...)
+			b = appendTime(b, *d.SentAt)
+		}
+		if d.Burn != 0 {
+			b = append(b, `,"burn":`...)
+			b = strconv.AppendInt(b, int64(d.Burn), 10)
+		}
+		if len(d.Mentions) > 0 {
+			b = append(b, `,"mentions":[`...)
+			for i, h := range d.Mentions {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				b = appendString(b, h)
+			}
+			b = append(b, ']')
+		}
+		return append(b, '}'), nil
+	}
+
+	return appendJSON(b, data)
+}
+
+// appendJSON appends the encoding/json encoding of v.
+func appendJSON(b []byte, v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, j...), nil
+}
+
+// appendTime appends a time as a JSON string like time.Time's MarshalJSON.
+func appendTime(b []byte, t time.Time) []byte {
+	b = append(b, '"')
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// appendString appends a JSON string escaped like encoding/json does (as of
+// Go 1.22, which writes \b and \f instead of \u0008 and \u000c), including
+// HTML characters and the line and paragraph separators.
+func appendString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+		case r == '\u2028' || r == '\u2029':
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// jsonSamples are strings with the characters that encoding/json escapes.
+var jsonSamples = []string{
+	"",
+	"hello, world",
+	`quote " and backslash \`,
+	"\b\f\n\r\t",
+	"\x00\x01\x02\x03\x04\x05\x06\x07\x0b\x0e\x0f\x10\x11\x12\x13\x14\x15\x16\x17\x18\x19\x1a\x1b\x1c\x1d\x1e\x1f\x7f",
+	"<script>alert('x')</script> & co",
+	"line\u2028and paragraph\u2029separators",
+	"invalid \xff\xfe utf-8 \xc3 and a truncated \xe2\x82",
+	"multi-byte: héllo, 日本語, 🙂",
+}
+
+func TestAppendString(t *testing.T) {
+	for _, s := range jsonSamples {
+		want, _ := json.Marshal(s)
+		if got := appendString(nil, s); !bytes.Equal(got, want) {
+			t.Errorf("appendString(%q):\n got %s\nwant %s", s, got, want)
+		}
+	}
+}
+
+// TestEncodeJSON checks that envelopes with every payload type are encoded
+// exactly like json.Marshal encodes them.
+func TestEncodeJSON(t *testing.T) {
+	now := time.Date(2026, 10, 17, 5, 30, 15, 123456789, time.FixedZone("IST", 19800))
+	sentAt := now.Add(-time.Minute)
+
+	for _, s := range jsonSamples {
+		peers := []*payloadMsgPeer{
+			nil,
+			{ID: s, Handle: s},
+			{ID: s, Handle: s, Operator: true},
+			{ID: s, Handle: s, Quality: &PeerQuality{Score: 80, Level: s}},
+		}
+
+		data := []interface{}{
+			s,
+			payloadMsgChat{PeerID: s, PeerHandle: s, Msg: s, Seq: 7},
+			payloadMsgChat{PeerID: s, PeerHandle: s, PeerOperator: true, Msg: s, Seq: 8,
+				ClientID: s, Delayed: true, SentAt: &sentAt, Burn: 30, Mentions: []string{s, "bob"}},
+			[]payloadMsgPeerInfo{fillStrings(payloadMsgPeerInfo{ReadOnly: true}, s).(payloadMsgPeerInfo)},
+			fillStrings(payloadMsgCall{Signal: json.RawMessage(`{"sdp":"x"}`)}, s),
+			payloadMsgMissed{Count: 3},
+			fillStrings(payloadMsgMention{Seq: 9}, s),
+			fillStrings(payloadMsgAck{Seq: 10}, s),
+			fillStrings(payloadMsgPoll{Poll: store.Poll{ID: 11, Votes: []int{1, 2}}}, s),
+			fillStrings(payloadMsgProtocol{Version: 2, MinVersion: 1, MaxVersion: 2}, s),
+			payloadMsgReplay{Messages: []store.Message{fillStrings(store.Message{Timestamp: now}, s).(store.Message)}},
+			fillStrings(payloadMsgResume{TTL: 60}, s),
+			fillStrings(payloadMsgSystem{}, s),
+			fillStrings(payloadMsgRoom{}, s),
+			fillStrings(payloadMsgTransfer{Size: 1024}, s),
+			fillStrings(payloadMsgOutdated{}, s),
+			nil,
+		}
+
+		for _, p := range peers {
+			for _, d := range data {
+				for _, m := range []*payloadMsgWrap{
+					{V: ProtocolVersion, Type: s, ID: 1, TS: 2, Peer: p, Data: d, Timestamp: now},
+					{V: 1, Type: s, ID: 3, TS: 4, Peer: p, Data: d, ClientID: s, Burn: 5, Timestamp: now},
+				} {
+					want, err := json.Marshal(m)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := encodeJSON(m)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("%T with %q:\n got %s\nwant %s", d, s, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// fillStrings returns a copy of v, a struct, with its string fields and
+// string slices, including those of nested structs, set to s.
+func fillStrings(v interface{}, s string) interface{} {
+	rv := reflect.New(reflect.TypeOf(v)).Elem()
+	rv.Set(reflect.ValueOf(v))
+	fillValue(rv, s)
+	return rv.Interface()
+}
+
+func fillValue(v reflect.Value, s string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				fillValue(f, s)
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			v.Set(reflect.ValueOf([]string{s, s}).Convert(v.Type()))
+		}
+	}
+}
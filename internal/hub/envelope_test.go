@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Benchmarks of encoding envelopes with encoding/json (the previous
+// implementation) and the pooled, pre-encoded fast path. Run with:
+// go test -run xxx -bench Envelope -benchmem ./internal/hub
+
+func benchChatMsg() *payloadMsgWrap {
+	now := time.Now()
+	return &payloadMsgWrap{
+		V:    ProtocolVersion,
+		Type: TypeMessage,
+		ID:   1234567,
+		TS:   now.UnixNano() / int64(time.Millisecond),
+		Peer: &payloadMsgPeer{ID: "d3b07384d113edec49eaa6238ad5ff00", Handle: "alice"},
+		Data: payloadMsgChat{
+			PeerID:     "d3b07384d113edec49eaa6238ad5ff00",
+			PeerHandle: "alice",
+			Msg:        strings.Repeat("hello <world> & everyone in the room. ", 4),
+			Seq:        42,
+			ClientID:   "c-8f14e45fceea167a",
+		},
+		Timestamp: now,
+	}
+}
+
+func benchNoticeMsg() *payloadMsgWrap {
+	now := time.Now()
+	return &payloadMsgWrap{
+		V:         ProtocolVersion,
+		Type:      TypeNotice,
+		ID:        1234568,
+		TS:        now.UnixNano() / int64(time.Millisecond),
+		Data:      "alice has joined the room",
+		Timestamp: now,
+	}
+}
+
+func BenchmarkEnvelopeChatStdlib(b *testing.B) {
+	m := benchChatMsg()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnvelopeChatFast(b *testing.B) {
+	m := benchChatMsg()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeJSON(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnvelopeNoticeStdlib(b *testing.B) {
+	m := benchNoticeMsg()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEnvelopeNoticeFast(b *testing.B) {
+	m := benchNoticeMsg()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeJSON(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Encoding from many rooms at once, which is where the buffer pool matters.
+func BenchmarkEnvelopeChatParallelStdlib(b *testing.B) {
+	m := benchChatMsg()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := json.Marshal(m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEnvelopeChatParallelFast(b *testing.B) {
+	m := benchChatMsg()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := encodeJSON(m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package hub
+
+import "time"
+
+// expiryDeadline returns the time at which the room expires for inactivity
+// or, for scheduled rooms, closes.
+func (r *Room) expiryDeadline() time.Time {
+	if s := r.Opts.Schedule; s != nil {
+		return s.Closes
+	}
+	return r.lastActivity.Add(r.Age())
+}
+
+// nextExpiryCheck returns the duration until the next expiry warning is due
+// or the room expires.
+func (r *Room) nextExpiryCheck() time.Duration {
+	var (
+		deadline = r.expiryDeadline()
+		next     = deadline
+	)
+	for i, w := range r.hub.cfg.RoomExpiryWarnings {
+		// Persistent rooms don't expire.
+		if r.expiryWarned[i] || r.Opts.Persistent {
+			continue
+		}
+		if t := deadline.Add(-w); t.Before(next) {
+			next = t
+		}
+	}
+
+	d := time.Until(next)
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// checkExpiry sends the expiry warnings that are due and reports whether the
+// room has expired. It should only be invoked from the room's event loop.
+func (r *Room) checkExpiry() bool {
+	left := time.Until(r.expiryDeadline())
+	if left <= 0 {
+		if r.Opts.Schedule != nil {
+			r.cacheMessage(TypeSystem, r.t("The scheduled room has closed"), nil, 0)
+		} else {
+			r.cacheMessage(TypeSystem, r.t("The room was closed due to inactivity"), nil, 0)
+		}
+		return true
+	}
+
+	for i, w := range r.hub.cfg.RoomExpiryWarnings {
+		if r.expiryWarned[i] || left > w {
+			continue
+		}
+		r.expiryWarned[i] = true
+
+		// Warnings are written to peers directly as broadcasts count as
+		// activity and would extend the room's life.
+		msg := r.t("This room will close in %s due to inactivity", left.Round(time.Second))
+		if r.Opts.Schedule != nil {
+			msg = r.t("This scheduled room will close in %s", left.Round(time.Second))
+		}
+		b := r.makeSystemPayload(SystemRoomExpiring, msg, nil)
+		for p := range r.peers {
+			p.SendData(b)
+		}
+		r.cacheMessage(TypeSystem, msg, nil, 0)
+	}
+	return false
+}
+
+// touch records activity in the room, which postpones its expiry. Activity
+// doesn't postpone the closing of scheduled rooms.
+func (r *Room) touch() {
+	r.lastActivity = time.Now()
+	if r.Opts.Schedule != nil {
+		return
+	}
+	for i := range r.expiryWarned {
+		r.expiryWarned[i] = false
+	}
+}
@@ -0,0 +1,235 @@
+package hub
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Policies for payloads sent to a peer whose queue is full.
+const (
+	// Disconnect the peer. It's asked to reconnect after a while.
+	SlowPeerDisconnect = "disconnect"
+
+	// Discard the oldest queued payload to make room for the new one.
+	SlowPeerDropOldest = "drop_oldest"
+
+	// Discard the new payload.
+	SlowPeerDropNewest = "drop_newest"
+)
+
+// Maximum number of payloads written to a peer before the worker moves on
+// to other peers so that a busy peer doesn't starve the others.
+const maxWriteBatch = 32
+
+// Control payloads queued to peers in order with their messages so that all
+// writes to a peer's connection happen on the write pool.
+var (
+	// pingPayload writes a heartbeat ping.
+	pingPayload = &payload{}
+
+	// closePayload writes a close frame after the queued messages and
+	// closes the connection.
+	closePayload = &payload{}
+)
+
+type payloadMsgMissed struct {
+	Count int `json:"count"`
+}
+
+// writePool is a bounded pool of workers that write queued payloads to
+// peers' WS connections. A peer is scheduled on the pool when payloads are
+// queued for it and is only handled by one worker at a time.
+//
+// A peer is queued at most once at a time, so the queue is bounded by the
+// number of connected peers. It isn't a fixed size channel so that neither
+// the rooms scheduling peers nor the workers rescheduling them ever block
+// on it.
+type writePool struct {
+	mut  sync.Mutex
+	cond *sync.Cond
+	q    []*Peer
+}
+
+// newWritePool starts a pool with the given number of workers.
+func newWritePool(workers int) *writePool {
+	w := &writePool{}
+	w.cond = sync.NewCond(&w.mut)
+	for i := 0; i < workers; i++ {
+		go w.run()
+	}
+	return w
+}
+
+// schedule queues a peer to have its payloads written if it isn't already.
+func (w *writePool) schedule(p *Peer) {
+	if atomic.CompareAndSwapInt32(&p.scheduled, 0, 1) {
+		w.push(p)
+	}
+}
+
+// push appends a peer to the queue and wakes up a worker.
+func (w *writePool) push(p *Peer) {
+	w.mut.Lock()
+	w.q = append(w.q, p)
+	w.mut.Unlock()
+	w.cond.Signal()
+}
+
+// pop removes the peer at the head of the queue, waiting for one if the
+// queue is empty.
+func (w *writePool) pop() *Peer {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	for len(w.q) == 0 {
+		w.cond.Wait()
+	}
+	p := w.q[0]
+	w.q[0] = nil
+	w.q = w.q[1:]
+	return p
+}
+
+// run writes payloads to scheduled peers. Peers with payloads remaining
+// after a batch go to the back of the queue. This should be invoked as a
+// goroutine.
+func (w *writePool) run() {
+	for {
+		p := w.pop()
+		if p.flush() {
+			w.push(p)
+		}
+	}
+}
+
+// fanout sends a payload to all peers in the room. The payload is encoded
+// once per encoding in use and slow peers are evicted instead of blocking
+// the room. It should only be invoked from the room's event loop.
+func (r *Room) fanout(m *payload) {
+	for p := range r.peers {
+		p.SendData(m)
+	}
+}
+
+// flush writes a batch of the peer's queued payloads to its WS connection.
+// It returns true if payloads remain and the peer should be rescheduled.
+func (p *Peer) flush() bool {
+	for i := 0; i < maxWriteBatch; i++ {
+		select {
+		case m := <-p.dataQ:
+			if atomic.LoadInt32(&p.closed) == 1 {
+				continue
+			}
+
+			// Inform the peer of messages that were dropped before this one.
+			if n := atomic.SwapInt32(&p.missed, 0); n > 0 {
+				if err := p.write(p.room.makeMissedPayload(int(n))); err != nil {
+					p.close()
+					continue
+				}
+			}
+			if err := p.write(m); err != nil {
+				p.close()
+			}
+		default:
+			// The queue is drained. Unschedule the peer, but if payloads
+			// were queued in the meantime, continue writing.
+			atomic.StoreInt32(&p.scheduled, 0)
+			if len(p.dataQ) == 0 || !atomic.CompareAndSwapInt32(&p.scheduled, 0, 1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// write writes a queued payload to the peer's WS connection.
+func (p *Peer) write(m *payload) error {
+	switch m {
+	case pingPayload:
+		atomic.AddInt32(&p.pendingPongs, 1)
+		return p.writeWSControl(websocket.PingMessage,
+			[]byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
+	case closePayload:
+		p.writeWSData(websocket.CloseMessage, []byte{})
+		p.close()
+		return nil
+	}
+
+	b, typ := m.encode(p.Encoding, p.Proto)
+	return p.writeWSData(typ, b)
+}
+
+// overflow handles a payload sent to a peer whose queue is full as per the
+// slow peer policy.
+func (p *Peer) overflow(m *payload) {
+	switch p.room.hub.cfg.SlowPeerPolicy {
+	case SlowPeerDropOldest:
+		select {
+		case old := <-p.dataQ:
+			p.drop(old)
+		default:
+		}
+
+		select {
+		case p.dataQ <- m:
+			p.room.hub.writer.schedule(p)
+		default:
+			p.drop(m)
+		}
+
+	case SlowPeerDropNewest:
+		p.drop(m)
+
+	default:
+		p.evict()
+	}
+}
+
+// drop discards a payload that couldn't be written to the peer. The peer is
+// told how many messages it missed before the next payload written to it.
+func (p *Peer) drop(m *payload) {
+	switch m {
+	case pingPayload:
+	case closePayload:
+		p.close()
+	default:
+		atomic.AddInt32(&p.missed, 1)
+	}
+}
+
+// makeMissedPayload prepares a message payload informing a peer of the number
+// of messages that were dropped as it couldn't keep up.
+func (r *Room) makeMissedPayload(n int) *payload {
+	return r.makePayload(payloadMsgMissed{Count: n}, TypeMessagesMissed)
+}
+
+// evict disconnects a peer that can't keep up with the payloads sent to it.
+// It's asked to reconnect after a while.
+func (p *Peer) evict() {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+	p.room.hub.log.Printf("evicting slow peer %s@%s in %s", p.Handle, p.ID, p.room.ID)
+
+	// The close frame may have to wait for a write in progress, which
+	// shouldn't hold up the room.
+	go func() {
+		p.ws.WriteControl(websocket.CloseMessage,
+			ReconnectCloseMessage(websocket.CloseTryAgainLater, p.room.hub.ReconnectHint()),
+			time.Now().Add(p.room.hub.cfg.WSTimeout))
+		p.ws.Close()
+	}()
+}
+
+// close closes the peer's WS connection. The listener then removes the peer
+// from the room.
+func (p *Peer) close() {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		p.ws.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWritePoolOverload schedules more peers, each with more payloads than
+// a worker writes in a batch, than there are workers and than the previous
+// fixed size queue held. Every peer should be drained without the pool
+// blocking on itself.
+func TestWritePoolOverload(t *testing.T) {
+	const (
+		numPeers = 5000
+		numMsgs  = maxWriteBatch*3 + 1
+	)
+
+	// Closed peers have their payloads discarded instead of written to a
+	// connection.
+	peers := make([]*Peer, numPeers)
+	for i := range peers {
+		p := &Peer{dataQ: make(chan *payload, numMsgs), closed: 1}
+		for j := 0; j < numMsgs; j++ {
+			p.dataQ <- &payload{}
+		}
+		peers[i] = p
+	}
+
+	w := newWritePool(2)
+	done := make(chan bool)
+	go func() {
+		for _, p := range peers {
+			w.schedule(p)
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("schedule blocked on the write pool")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, p := range peers {
+		for len(p.dataQ) > 0 || atomic.LoadInt32(&p.scheduled) == 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("peers weren't drained: %d payloads queued", len(p.dataQ))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// TestWritePoolScheduleOnce checks that a peer that's already scheduled
+// isn't queued again.
+func TestWritePoolScheduleOnce(t *testing.T) {
+	// No workers to drain the queue.
+	w := newWritePool(0)
+	p := &Peer{dataQ: make(chan *payload, 1)}
+
+	w.schedule(p)
+	w.schedule(p)
+	if len(w.q) != 1 {
+		t.Fatalf("expected the peer to be queued once, got %d", len(w.q))
+	}
+}
@@ -0,0 +1,67 @@
+package hub
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRolloutEnabled(t *testing.T) {
+	rooms := make([]string, 10000)
+	for i := range rooms {
+		rooms[i] = "room" + strconv.Itoa(i)
+	}
+
+	count := func(ro Rollout) (map[string]bool, int) {
+		on := make(map[string]bool)
+		for _, id := range rooms {
+			if ro.enabled(FeatureMsgpack, id) {
+				on[id] = true
+			}
+		}
+		return on, len(on)
+	}
+
+	if _, n := count(Rollout{}); n != 0 {
+		t.Errorf("expected 0%% to enable no rooms, got %d", n)
+	}
+	if _, n := count(Rollout{Percent: 100}); n != len(rooms) {
+		t.Errorf("expected 100%% to enable all rooms, got %d", n)
+	}
+
+	// Rooms are bucketed roughly in proportion to the percentage, and rooms
+	// in a smaller percentage stay in a larger one.
+	small, n := count(Rollout{Percent: 10})
+	if n < 800 || n > 1200 {
+		t.Errorf("expected about 1000 rooms at 10%%, got %d", n)
+	}
+	large, n := count(Rollout{Percent: 50})
+	if n < 4500 || n > 5500 {
+		t.Errorf("expected about 5000 rooms at 50%%, got %d", n)
+	}
+	for id := range small {
+		if !large[id] {
+			t.Fatalf("expected %s enabled at 10%% to be enabled at 50%%", id)
+		}
+	}
+
+	// Buckets are consistent and independent across features.
+	ro := Rollout{Percent: 50}
+	same := 0
+	for _, id := range rooms {
+		if ro.enabled(FeatureMsgpack, id) != large[id] {
+			t.Fatalf("expected %s to be bucketed consistently", id)
+		}
+		if ro.enabled("other", id) == large[id] {
+			same++
+		}
+	}
+	if same == len(rooms) {
+		t.Error("expected features to be bucketed independently")
+	}
+
+	// Listed rooms are always enabled.
+	ro = Rollout{Rooms: []string{"room1", "room2"}}
+	if !ro.enabled(FeatureMsgpack, "room1") || !ro.enabled(FeatureMsgpack, "room2") || ro.enabled(FeatureMsgpack, "room3") {
+		t.Error("expected only the listed rooms to be enabled")
+	}
+}
@@ -0,0 +1,236 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Actions of the blocked words filter.
+const (
+	FilterMask   = "mask"
+	FilterReject = "reject"
+)
+
+// Actions of the moderation API.
+const (
+	moderationAllow   = "allow"
+	moderationReject  = "reject"
+	moderationRewrite = "rewrite"
+)
+
+var errMessageBlocked = errors.New("message was blocked by the room's filters")
+
+// FilterConfig represents the config of the built-in message filters.
+type FilterConfig struct {
+	// Words that are masked or that reject messages (BlockedWordsAction).
+	BlockedWords       []string `koanf:"blocked_words"`
+	BlockedWordsAction string   `koanf:"blocked_words_action"`
+
+	// Regular expressions that reject messages that match them.
+	BlockedPatterns []string `koanf:"blocked_patterns"`
+
+	// External moderation API. If FailOpen is set, messages are allowed
+	// when the API fails.
+	ModerationURL      string        `koanf:"moderation_url"`
+	ModerationTimeout  time.Duration `koanf:"moderation_timeout"`
+	ModerationFailOpen bool          `koanf:"moderation_fail_open"`
+}
+
+// FilterMessage is a chat message that's being filtered.
+type FilterMessage struct {
+	RoomID  string
+	Handle  string
+	Message string
+}
+
+// MessageFilter filters chat messages before they're broadcast. It returns
+// the message, which may be rewritten, or an error that rejects it. The
+// error is shown to the sender.
+type MessageFilter interface {
+	FilterMessage(FilterMessage) (string, error)
+}
+
+// MessageFilterFunc is an adapter to use a function as a MessageFilter.
+type MessageFilterFunc func(FilterMessage) (string, error)
+
+// FilterMessage calls f(m).
+func (f MessageFilterFunc) FilterMessage(m FilterMessage) (string, error) {
+	return f(m)
+}
+
+// NewFilters returns the built-in message filters that are configured in
+// the order they're applied: blocked words, blocked patterns, and the
+// moderation API.
+func NewFilters(cfg FilterConfig) ([]MessageFilter, error) {
+	var out []MessageFilter
+
+	if re := compileWords(cfg.BlockedWords); re != nil {
+		switch cfg.BlockedWordsAction {
+		case "", FilterMask:
+			out = append(out, MessageFilterFunc(func(m FilterMessage) (string, error) {
+				return maskWords(re, m.Message), nil
+			}))
+		case FilterReject:
+			out = append(out, MessageFilterFunc(func(m FilterMessage) (string, error) {
+				if re.MatchString(m.Message) {
+					return "", errMessageBlocked
+				}
+				return m.Message, nil
+			}))
+		default:
+			return nil, fmt.Errorf("unknown blocked_words_action: %s", cfg.BlockedWordsAction)
+		}
+	}
+
+	if len(cfg.BlockedPatterns) > 0 {
+		res := make([]*regexp.Regexp, 0, len(cfg.BlockedPatterns))
+		for _, p := range cfg.BlockedPatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blocked pattern '%s': %v", p, err)
+			}
+			res = append(res, re)
+		}
+		out = append(out, MessageFilterFunc(func(m FilterMessage) (string, error) {
+			for _, re := range res {
+				if re.MatchString(m.Message) {
+					return "", errMessageBlocked
+				}
+			}
+			return m.Message, nil
+		}))
+	}
+
+	if cfg.ModerationURL != "" {
+		if cfg.ModerationTimeout <= 0 {
+			cfg.ModerationTimeout = time.Second * 2
+		}
+		out = append(out, &moderationFilter{
+			url:      cfg.ModerationURL,
+			failOpen: cfg.ModerationFailOpen,
+			client:   &http.Client{Timeout: cfg.ModerationTimeout},
+		})
+	}
+	return out, nil
+}
+
+// moderationFilter asks an external moderation API to allow, reject, or
+// rewrite messages. The API is POSTed {"room_id", "handle", "message"} and
+// is expected to respond with {"action": "allow|reject|rewrite", "message",
+// "reason"}, where message is the rewritten message and reason is shown to
+// the sender of a rejected message.
+type moderationFilter struct {
+	url      string
+	failOpen bool
+	client   *http.Client
+}
+
+// FilterMessage asks the moderation API to filter a message.
+func (f *moderationFilter) FilterMessage(m FilterMessage) (string, error) {
+	out, err := f.moderate(m)
+	if err != nil {
+		if f.failOpen {
+			return m.Message, nil
+		}
+		return "", errors.New("message couldn't be moderated. Try again")
+	}
+
+	switch out.Action {
+	case moderationReject:
+		if out.Reason != "" {
+			return "", errors.New(out.Reason)
+		}
+		return "", errMessageBlocked
+	case moderationRewrite:
+		return out.Message, nil
+	}
+	return m.Message, nil
+}
+
+type moderationResp struct {
+	Action  string `json:"action"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+func (f *moderationFilter) moderate(m FilterMessage) (moderationResp, error) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"room_id": m.RoomID,
+		"handle":  m.Handle,
+		"message": m.Message,
+	})
+	resp, err := f.client.Post(f.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return moderationResp{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return moderationResp{}, fmt.Errorf("moderation API: %s", resp.Status)
+	}
+
+	var out moderationResp
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return moderationResp{}, err
+	}
+	switch out.Action {
+	case moderationAllow, moderationReject, moderationRewrite:
+	default:
+		return moderationResp{}, fmt.Errorf("moderation API: unknown action %q", out.Action)
+	}
+	return out, nil
+}
+
+// SetFilters replaces the hub's message filters, eg: when the config is
+// reloaded.
+func (h *Hub) SetFilters(fs []MessageFilter) {
+	h.filterMut.Lock()
+	h.Filters = fs
+	h.filterMut.Unlock()
+}
+
+// filterMessage applies the room's filters to a message from a peer: spam
+// heuristics, kiosk mode rules, and then the hub's filters in order. A
+// filter's rewritten message is passed to the next one.
+func (r *Room) filterMessage(msg string, p *Peer) (string, error) {
+	if err := r.checkSpam(p, msg); err != nil {
+		return "", err
+	}
+
+	if r.Opts.Kiosk {
+		var err error
+		if msg, err = r.filterKioskMessage(msg); err != nil {
+			return "", err
+		}
+	}
+
+	r.hub.filterMut.RLock()
+	filters := r.hub.Filters
+	r.hub.filterMut.RUnlock()
+
+	for _, f := range filters {
+		out, err := f.FilterMessage(FilterMessage{RoomID: r.ID, Handle: p.Handle, Message: msg})
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(out) == "" || len(out) > r.hub.cfg.MaxMessageLen {
+			return "", errMessageBlocked
+		}
+		msg = out
+	}
+	return msg, nil
+}
+
+// maskWords masks the matches of re in a message with *.
+func maskWords(re *regexp.Regexp, msg string) string {
+	return re.ReplaceAllStringFunc(msg, func(s string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(s))
+	})
+}
@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrHandleReserved indicates that a handle is reserved.
+	ErrHandleReserved = errors.New("handle is reserved")
+
+	// ErrHandleInUse indicates that a handle is in use by another peer.
+	ErrHandleInUse = errors.New("handle is already in use")
+)
+
+// CheckHandle checks if a handle can be used by a peer logging into the room.
+// sessHandle is the handle of the peer's existing session or of the session
+// whose device link the peer is logging in with, if any, which is allowed to
+// be used again.
+func (r *Room) CheckHandle(handle, sessHandle string) error {
+	key := strings.ToLower(strings.TrimSpace(handle))
+	for _, h := range r.hub.cfg.ReservedHandles {
+		if strings.ToLower(h) == key {
+			return ErrHandleReserved
+		}
+	}
+
+	if !r.hub.cfg.UniqueHandles || strings.EqualFold(handle, sessHandle) {
+		return nil
+	}
+
+	r.mut.RLock()
+	n := r.handles[key]
+	r.mut.RUnlock()
+	if n > 0 {
+		return ErrHandleInUse
+	}
+	return nil
+}
+
+// trackHandle updates the number of connected peers using a handle. It should
+// only be invoked from the room's event loop.
+func (r *Room) trackHandle(handle string, delta int) {
+	key := strings.ToLower(strings.TrimSpace(handle))
+
+	r.mut.Lock()
+	r.handles[key] += delta
+	if r.handles[key] <= 0 {
+		delete(r.handles, key)
+	}
+	r.mut.Unlock()
+}
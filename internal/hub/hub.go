@@ -4,10 +4,16 @@ import (
 	"crypto/rand"
 	"errors"
 	"log"
+	"regexp"
+	"runtime"
 	"sync"
 	"time"
 
+	"github.com/knadh/niltalk/internal/audit"
+	"github.com/knadh/niltalk/internal/i18n"
+	"github.com/knadh/niltalk/internal/notify"
 	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/lock"
 )
 
 // Types of messages sent to peers.
@@ -19,10 +25,21 @@ const (
 	TypePeerJoin        = "peer.join"
 	TypePeerLeave       = "peer.leave"
 	TypePeerRateLimited = "peer.ratelimited"
+	TypePeerSpam        = "peer.spam"
+	TypePeerBanned      = "peer.banned"
+	TypePeerQuality     = "peer.quality"
+	TypeMessagesMissed  = "messages.missed"
+	TypeHistoryReplay   = "history.replay"
 	TypeRoomDispose     = "room.dispose"
 	TypeRoomFull        = "room.full"
+	TypeRoomClosed      = "room.closed"
+	TypeRoomInfo        = "room.info"
 	TypeNotice          = "notice"
 	TypeHandle          = "handle"
+	TypeClientOutdated  = "client.outdated"
+	TypeSessionRevoked  = "session.revoked"
+	TypeSystem          = "system"
+	TypeProtocol        = "protocol"
 )
 
 // Config represents the app configuration.
@@ -30,62 +47,318 @@ type Config struct {
 	Address string `koanf:"address"`
 	RootURL string `koanf:"root_url"`
 
+	// Path (eg: /chat) the app is mounted at behind a reverse proxy. It's
+	// empty when the app is served at the root.
+	RootPath string `koanf:"root_path"`
+
+	// Default language for requests that don't ask for an available one.
+	Language string `koanf:"language"`
+
+	// Optional directory with templates, static files, and language
+	// catalogs that replace the embedded ones (theme).
+	ThemeDir string `koanf:"theme_dir"`
+
+	// Default colour scheme of the pages (light, dark). Empty is light.
+	// Peers can pick their own in each room.
+	ColorScheme string `koanf:"color_scheme"`
+
+	// Headers (eg: X-Forwarded-For) to derive client IPs from in requests
+	// from trusted reverse proxies (CIDRs).
+	RealIPHeaders  []string `koanf:"real_ip_headers"`
+	TrustedProxies []string `koanf:"trusted_proxies"`
+
+	// Header (eg: CF-IPCountry) with the country code of the client's IP
+	// address set by trusted reverse proxies. Empty disables geolocation.
+	GeoHeader string `koanf:"geo_header"`
+
+	// Log every HTTP request.
+	AccessLog bool `koanf:"access_log"`
+
+	// Compress HTTP responses (gzip, deflate) with the level (1 - 9).
+	HTTPCompression    bool `koanf:"http_compression"`
+	HTTPCompressionLvl int  `koanf:"http_compression_level"`
+
+	// Public routes that are disabled on startup. They can be toggled at
+	// runtime with the admin API.
+	DisabledRoutes []string `koanf:"disabled_routes"`
+
 	Name              string        `koanf:"name"`
+	History           bool          `koanf:"history"`
+	HistoryHashChain  bool          `koanf:"history_hash_chain"`
 	RoomIDLen         int           `koanf:"room_id_length"`
 	MaxCachedMessages int           `koanf:"max_cached_messages"`
+	MaxReplayMessages int           `koanf:"max_replay_messages"`
 	MaxMessageLen     int           `koanf:"max_message_length"`
+	MaxBatchMessages  int           `koanf:"max_batch_messages"`
+	MaxMessageDelay   time.Duration `koanf:"max_message_delay"`
+	MaxImportMessages int           `koanf:"max_import_messages"`
 	WSTimeout         time.Duration `koanf:"websocket_timeout"`
+	PeerHeartbeat     time.Duration `koanf:"peer_heartbeat_interval"`
+	PongTimeout       time.Duration `koanf:"peer_pong_timeout"`
+	IdleTimeout       time.Duration `koanf:"peer_idle_timeout"`
+	IdleWarning       time.Duration `koanf:"peer_idle_warning"`
+	WSCompression     bool          `koanf:"websocket_compression"`
+	WSCompressionLvl  int           `koanf:"websocket_compression_level"`
+	WSAllowedOrigins  []string      `koanf:"websocket_allowed_origins"`
+	HTTP2Cleartext    bool          `koanf:"http2_cleartext"`
 	MaxMessageQueue   int           `koanf:"max_message_queue"`
 	RateLimitInterval time.Duration `koanf:"rate_limit_interval"`
 	RateLimitMessages int           `koanf:"rate_limit_messages"`
+	SpamAction        string        `koanf:"spam_action"`
+	SpamWindow        time.Duration `koanf:"spam_window"`
+	SpamDuplicates    int           `koanf:"spam_duplicates"`
+	SpamLinks         int           `koanf:"spam_links"`
+	SpamJoins         int           `koanf:"spam_joins"`
+	SpamMuteDuration  time.Duration `koanf:"spam_mute_duration"`
 	MaxRooms          int           `koanf:"max_rooms"`
 	MaxPeersPerRoom   int           `koanf:"max_peers_per_room"`
+	MaxPeers          int           `koanf:"max_peers"`
+	RoomQueueSize     int           `koanf:"room_queue_size"`
 	PeerHandleFormat  string        `koanf:"peer_handle_format"`
+	UniqueHandles     bool          `koanf:"unique_handles"`
+	ReservedHandles   []string      `koanf:"reserved_handles"`
 	RoomTimeout       time.Duration `koanf:"room_timeout"`
 	RoomAge           time.Duration `koanf:"room_age"`
+	MaxRoomAge        time.Duration `koanf:"max_room_age"`
+	MaxScheduleAhead  time.Duration `koanf:"max_schedule_ahead"`
+	RoomAgeApproval   string        `koanf:"room_age_approval"`
+	RoomAgeWebhook    string        `koanf:"room_age_webhook"`
 	SessionCookie     string        `koanf:"session_cookie"`
+	CookieSecure      bool          `koanf:"cookie_secure"`
+	CookieSameSite    string        `koanf:"cookie_samesite"`
+	CSRF              bool          `koanf:"csrf"`
+	AdminToken        string        `koanf:"admin_token"`
+	AdminTOTPSecret   string        `koanf:"admin_totp_secret"`
+	AuditLog          string        `koanf:"audit_log"`
+	IPHashSecret      string        `koanf:"ip_hash_secret"`
+	StatusNotesFile   string        `koanf:"status_notes_file"`
+	PublicStats       bool          `koanf:"public_stats"`
+	MinClientVersion  string        `koanf:"min_client_version"`
+	ReconnectJitter   time.Duration `koanf:"reconnect_jitter"`
+	PersistentRooms   string        `koanf:"persistent_rooms"`
+
+	// Messages are buffered and written to the message cache in batches
+	// every flush interval or when flush size messages are buffered.
+	// Disabled if the interval is 0.
+	MessageCacheFlushInterval time.Duration `koanf:"message_cache_flush_interval"`
+	MessageCacheFlushSize     int           `koanf:"message_cache_flush_size"`
+
+	// Rooms whose passwords fall below the password policy and are older
+	// than the max age are rotated (logins are refused until an admin sets
+	// a new password) or expired. Disabled if the policy is empty.
+	WeakPasswordPolicy string        `koanf:"weak_password_policy"`
+	WeakPasswordMaxAge time.Duration `koanf:"weak_password_max_age"`
+
+	// Payloads are written to peers by a pool of workers from per-peer
+	// queues. Payloads to peers whose queues are full are handled as per
+	// the slow peer policy.
+	WriteWorkers   int    `koanf:"write_workers"`
+	PeerQueueSize  int    `koanf:"peer_queue_size"`
+	SlowPeerPolicy string `koanf:"slow_peer_policy"`
+
+	// Maximum size of files peers can transfer to each other directly.
+	// The server only brokers the WebRTC signaling. 0 disables transfers.
+	MaxTransferSize int64 `koanf:"max_transfer_size"`
+
+	// Maximum number of peers in a room for them to call each other. The
+	// server only relays the WebRTC signaling. 0 disables calls.
+	MaxCallPeers int `koanf:"max_call_peers"`
+
+	// Duration after disconnecting within which peers can reconnect with
+	// their resume token to be sent the messages they missed. 0 disables
+	// resumption.
+	ResumeTTL time.Duration `koanf:"resume_ttl"`
+
+	// Maximum duration of an operator's support session in a room.
+	OperatorMaxDuration time.Duration `koanf:"operator_max_duration"`
+
+	// Peers are warned at these durations before a room expires.
+	RoomExpiryWarnings []time.Duration `koanf:"room_expiry_warnings"`
+
+	// Derive names for rooms created without one.
+	RoomAutoTitle    string `koanf:"room_auto_title"`
+	RoomTitleWebhook string `koanf:"room_title_webhook"`
+
+	// Kiosk mode rooms.
+	KioskHandleFormat string        `koanf:"kiosk_handle_format"`
+	KioskMessageTTL   time.Duration `koanf:"kiosk_message_ttl"`
+	KioskBlockedWords []string      `koanf:"kiosk_blocked_words"`
+
+	// Staged rollouts of optional protocol features.
+	Features map[string]Rollout `koanf:"features"`
 }
 
 // Hub acts as the controller and container for all chat rooms.
 type Hub struct {
 	Store store.Store
+
+	// MsgCache persists chat messages. It's nil if history is disabled.
+	MsgCache store.MessageCache
+
+	// Audit records administrative and security relevant events.
+	Audit *audit.Log
+
+	// Notify dispatches room events to external notification channels.
+	Notify *notify.Dispatcher
+
+	// AgeApprover approves rooms' requests to live longer than the global
+	// cap. They're denied if it's nil.
+	AgeApprover AgeApprover
+
+	// Filters filter chat messages in order before they're broadcast.
+	// Deployments can add their own filters to the built-in ones. They
+	// should be replaced with SetFilters once the hub is running.
+	Filters   []MessageFilter
+	filterMut sync.RWMutex
+
+	// Locker holds locks that keep instances sharing the store from
+	// rewriting a room's history at once.
+	Locker lock.Locker
+
+	// Counter persists instance-wide counts, eg: rooms created. It's nil
+	// if the store doesn't keep counts.
+	Counter store.Counter
+
+	// Archiver archives the history of rooms with a transcript email when
+	// they're removed. Transcript emails are disabled if it's nil.
+	Archiver Archiver
+
+	// Translations of system messages. Text is left in English if it's nil.
+	I18n *i18n.I18n
+
+	// Settings of virtual hosts by tenant ID. It should be set before
+	// the hub starts serving.
+	Tenants map[string]Tenant
+
 	rooms map[string]*Room
 
+	// Feature rollouts that can be changed at runtime.
+	features map[string]Rollout
+
+	// Blocked words in kiosk rooms.
+	kioskWords *regexp.Regexp
+
+	// Capacity reservations by room ID. Guarded by mut.
+	reservations map[string]store.Reservation
+
+	// Pool that writes payloads to peers.
+	writer *writePool
+
+	// Write-behind buffer of the message cache. It's nil if disabled.
+	cacheWriter *writeBehind
+
+	// Key of the HMAC that peers' IP addresses are hashed with.
+	ipHashKey []byte
+
 	cfg *Config
 	mut sync.RWMutex
 	log *log.Logger
 }
 
 // NewHub returns a new instance of Hub.
-func NewHub(cfg *Config, store store.Store, l *log.Logger) *Hub {
+func NewHub(cfg *Config, st store.Store, msgCache store.MessageCache, l *log.Logger) *Hub {
+	features := make(map[string]Rollout, len(cfg.Features))
+	for k, v := range cfg.Features {
+		if !KnownFeature(k) {
+			l.Printf("unknown feature in rollouts: %s", k)
+		}
+		features[k] = v
+	}
+
+	if cfg.WriteWorkers <= 0 {
+		cfg.WriteWorkers = runtime.NumCPU() * 4
+	}
+	if cfg.PeerQueueSize <= 0 {
+		cfg.PeerQueueSize = 100
+	}
+
+	// Buffer writes to the message cache.
+	var cacheWriter *writeBehind
+	if msgCache != nil && cfg.MessageCacheFlushInterval > 0 {
+		if cfg.MessageCacheFlushSize <= 0 {
+			cfg.MessageCacheFlushSize = 500
+		}
+		cacheWriter = newWriteBehind(msgCache, cfg.MessageCacheFlushInterval, cfg.MessageCacheFlushSize, l)
+		msgCache = cacheWriter
+	}
+
 	return &Hub{
-		rooms: make(map[string]*Room),
+		rooms:      make(map[string]*Room),
+		features:   features,
+		kioskWords: compileWords(cfg.KioskBlockedWords),
 
-		cfg:   cfg,
-		Store: store,
-		log:   l,
+		reservations: make(map[string]store.Reservation),
+		writer:       newWritePool(cfg.WriteWorkers),
+		cacheWriter:  cacheWriter,
+		ipHashKey:    []byte(cfg.IPHashSecret),
+
+		cfg:      cfg,
+		Store:    st,
+		MsgCache: msgCache,
+		Locker:   lock.NewLocal(),
+		log:      l,
 	}
 }
 
 // AddRoom creates a new room in the store, adds it to the hub, and
 // returns the room (which has to be .Run() on a goroutine then).
-func (h *Hub) AddRoom(name string, password []byte) (*Room, error) {
+func (h *Hub) AddRoom(name string, password []byte, opts store.RoomOpts) (*Room, error) {
+	if t := h.tenant(opts.Tenant); t.MaxRooms > 0 && h.numTenantRooms(opts.Tenant) >= t.MaxRooms {
+		return nil, ErrTooManyRooms
+	}
+	if opts.Reservation != nil {
+		if err := h.validateReservation(*opts.Reservation, opts.Tenant); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Schedule != nil {
+		if err := h.validateSchedule(*opts.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateSpeakers(opts.Speakers); err != nil {
+		return nil, err
+	}
+
 	id, err := h.generateRoomID(h.cfg.RoomIDLen, 5)
 	if err != nil {
 		return nil, err
 	}
 
+	// Reserve capacity for the room.
+	if opts.Reservation != nil {
+		if err := h.reserve(id, *opts.Reservation); err != nil {
+			return nil, err
+		}
+	}
+
 	// Add the room to DB.
-	if err := h.Store.AddRoom(store.Room{ID: id,
+	r := store.Room{ID: id,
 		Name:      name,
 		CreatedAt: time.Now(),
-		Password:  password}, h.cfg.RoomAge); err != nil {
+		Password:  password,
+		Opts:      opts}
+	if err := h.Store.AddRoom(r, h.roomTTL(opts)); err != nil {
+		h.mut.Lock()
+		delete(h.reservations, id)
+		h.mut.Unlock()
+
 		h.log.Printf("error creating room in the store: %v", err)
 		return nil, errors.New("error creating room")
 	}
 
+	if h.Counter != nil {
+		if _, err := h.Counter.IncrCounter(store.CounterRoomsCreated); err != nil {
+			h.log.Printf("error counting room: %v", err)
+		}
+	}
+
 	// Initialize the room.
-	return h.initRoom(id, name, password), nil
+	room := h.initRoom(r)
+	if name == "" && h.cfg.RoomAutoTitle == AutoTitleWebhook {
+		go room.lookupTitle()
+	}
+	return room, nil
 }
 
 // ActivateRoom loads a room from the store into the hub if it's not already active.
@@ -103,7 +376,7 @@ func (h *Hub) ActivateRoom(id string) (*Room, error) {
 	}
 
 	// Initialize the room.
-	return h.initRoom(r.ID, r.Name, r.Password), nil
+	return h.initRoom(r), nil
 }
 
 // GetRoom retrives an active room from the hub.
@@ -115,10 +388,16 @@ func (h *Hub) GetRoom(id string) *Room {
 }
 
 // initRoom initializes a room on the Hub.
-func (h *Hub) initRoom(id, name string, password []byte) *Room {
-	r := NewRoom(id, name, password, h)
+func (h *Hub) initRoom(sr store.Room) *Room {
+	r := NewRoom(sr.ID, sr.Name, sr.Password, sr.Opts, h)
 	h.mut.Lock()
-	h.rooms[id] = r
+	h.rooms[sr.ID] = r
+
+	// Reservations are only held in memory. Restore the reservation of a
+	// room that's loaded from the store, eg: after a restart.
+	if rv := sr.Opts.Reservation; rv != nil && rv.End.After(time.Now()) {
+		h.reservations[sr.ID] = *rv
+	}
 	h.mut.Unlock()
 	go r.run()
 	return r
@@ -135,10 +414,32 @@ func (h *Hub) getRooms() []*Room {
 	return out
 }
 
+// Stats returns the number of active rooms and peers connected to them.
+func (h *Hub) Stats() (int, int) {
+	rooms := h.getRooms()
+	peers := 0
+	for _, r := range rooms {
+		peers += r.NumPeers()
+	}
+	return len(rooms), peers
+}
+
+// RoomPeers returns the number of connected peers in each active room by
+// room ID.
+func (h *Hub) RoomPeers() map[string]int {
+	rooms := h.getRooms()
+	out := make(map[string]int, len(rooms))
+	for _, r := range rooms {
+		out[r.ID] = r.NumPeers()
+	}
+	return out
+}
+
 // removeRoom removes a room from the hub and the store.
 func (h *Hub) removeRoom(id string) error {
 	h.mut.Lock()
 	delete(h.rooms, id)
+	delete(h.reservations, id)
 	h.mut.Unlock()
 
 	err := h.Store.RemoveRoom(id)
@@ -146,6 +447,13 @@ func (h *Hub) removeRoom(id string) error {
 		h.log.Printf("error removing room from store: %v", err)
 		return err
 	}
+
+	if h.MsgCache != nil {
+		if err := h.MsgCache.ClearMessageCache(id); err != nil {
+			h.log.Printf("error clearing message cache: %v", err)
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,58 @@
+package hub
+
+import (
+	"sort"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// ImportMessages adds messages from an external transcript to the room's
+// history as backdated messages flagged as imported. The history is
+// rewritten in the order of timestamps and rechained if the hash chain is
+// enabled. Imported messages aren't broadcast to peers.
+func (r *Room) ImportMessages(msgs []store.Message) (int, error) {
+	if !r.Capabilities().History {
+		return 0, ErrHistoryDisabled
+	}
+
+	for i := range msgs {
+		id, err := GenerateGUID(16)
+		if err != nil {
+			return 0, err
+		}
+		msgs[i].ID = id
+		msgs[i].Type = TypeMessage
+		msgs[i].Imported = true
+	}
+
+	// Block live messages from being written while the history is rewritten.
+	r.postMut.Lock()
+	defer r.postMut.Unlock()
+	r.chainMut.Lock()
+	defer r.chainMut.Unlock()
+
+	cur, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	all := append(msgs, cur...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Timestamp.Before(all[j].Timestamp)
+	})
+
+	if err := r.hub.MsgCache.ClearMessageCache(r.ID); err != nil {
+		return 0, err
+	}
+
+	prev := r.ChainAnchor()
+	if r.hub.cfg.HistoryHashChain {
+		prev = rechain(prev, all)
+	}
+	if err := r.hub.MsgCache.AddMessageCacheBatch(r.ID, all, r.TTL()); err != nil {
+		return 0, err
+	}
+	r.lastHash = prev
+	r.chainLoaded = true
+	return len(msgs), nil
+}
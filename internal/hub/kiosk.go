@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	reLink = regexp.MustCompile(`(?i)([a-z][a-z0-9+.-]*://|www\.|\b[a-z0-9-]+\.(com|net|org|io|co|me|info|biz|xyz|ly|gg|app|dev)\b)`)
+
+	errLinksNotAllowed = errors.New("links are not allowed in this room")
+)
+
+// NextKioskHandle returns the next anonymous numbered handle for a peer
+// joining a kiosk room.
+func (r *Room) NextKioskHandle() string {
+	n := atomic.AddInt32(&r.numGuests, 1)
+	return fmt.Sprintf(r.hub.cfg.KioskHandleFormat, n)
+}
+
+// filterKioskMessage enforces kiosk mode rules on a message. Messages with
+// links are rejected and blocked words are masked.
+func (r *Room) filterKioskMessage(msg string) (string, error) {
+	if reLink.MatchString(msg) {
+		return "", errLinksNotAllowed
+	}
+	if r.hub.kioskWords == nil {
+		return msg, nil
+	}
+
+	// Mask blocked words.
+	return maskWords(r.hub.kioskWords, msg), nil
+}
+
+// compileWords compiles a list of words into a case insensitive expression
+// that also matches the words within other words. It returns nil if
+// there are no words.
+func compileWords(words []string) *regexp.Regexp {
+	q := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			q = append(q, regexp.QuoteMeta(w))
+		}
+	}
+	if len(q) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)(` + strings.Join(q, "|") + `)`)
+}
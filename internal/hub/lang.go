@@ -0,0 +1,30 @@
+package hub
+
+import "errors"
+
+// ErrInvalidLanguage is returned when a room's language isn't available.
+var ErrInvalidLanguage = errors.New("unknown language")
+
+// ValidLanguage checks if a room language is available. An empty language
+// uses the peers' browser languages.
+func (h *Hub) ValidLanguage(lang string) bool {
+	return lang == "" || h.I18n.Has(lang)
+}
+
+// Language returns the room's language that overrides the languages of
+// peers' browsers. It's empty if the room doesn't have one.
+func (r *Room) Language() string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.Opts.Language
+}
+
+// t translates text to the room's language or the default language. System
+// messages are broadcast to all peers and are translated once.
+func (r *Room) t(text string, args ...interface{}) string {
+	lang := r.Language()
+	if lang == "" {
+		lang = r.hub.I18n.Default()
+	}
+	return r.hub.I18n.T(lang, text, args...)
+}
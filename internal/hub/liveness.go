@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TypePeerIdle is the close reason of peers disconnected for inactivity.
+const TypePeerIdle = "peer.idle"
+
+// SystemIdleWarning is the code of the notice sent to peers that are about
+// to be disconnected for inactivity.
+const SystemIdleWarning = "idle.warning"
+
+// touchActive records activity from the peer. It's invoked from the peer's
+// listener for every message it sends.
+func (p *Peer) touchActive() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+	atomic.StoreInt32(&p.idleWarned, 0)
+}
+
+// checkLiveness disconnects a peer that hasn't answered pings within the
+// pong timeout or that hasn't sent anything for the idle timeout. Idle peers
+// are sent a notice before they're disconnected. It returns true if the peer
+// was disconnected. It should only be invoked from the room's event loop on
+// heartbeats.
+func (r *Room) checkLiveness(p *Peer, now time.Time) bool {
+	cfg := r.hub.cfg
+
+	// The connection is dead. Closing it ends the peer's listener, which
+	// removes it from the room. Clients reconnect on abnormal closures.
+	if cfg.PongTimeout > 0 {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&p.lastPong))) > cfg.PeerHeartbeat+cfg.PongTimeout {
+			r.hub.log.Printf("%s@%s timed out in %s", p.Handle, p.ID, r.ID)
+			p.ws.Close()
+			return true
+		}
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		return false
+	}
+
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&p.lastActive)))
+	if idle > cfg.IdleTimeout {
+		p.writeWSControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerIdle))
+		p.ws.Close()
+		r.hub.log.Printf("%s@%s disconnected from %s for inactivity", p.Handle, p.ID, r.ID)
+		return true
+	}
+
+	if cfg.IdleWarning > 0 && idle > cfg.IdleTimeout-cfg.IdleWarning &&
+		atomic.CompareAndSwapInt32(&p.idleWarned, 0, 1) {
+		left := (cfg.IdleTimeout - idle).Round(time.Second)
+		p.SendData(r.makeSystemPayload(SystemIdleWarning,
+			r.t("You'll be disconnected in %s for inactivity", left), p))
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TypeMention is sent to the connections of a peer who's mentioned
+// (@handle) in a message.
+const TypeMention = "mention"
+
+// Maximum number of mentions in a message. Further mentions are ignored.
+const maxMentions = 20
+
+// reMention matches @handle at the start of a message or after a character
+// that can't be in a handle, so that emails (eg: a@b.com) aren't mentions.
+var reMention = regexp.MustCompile(`(?:^|[^\w@.\-])@([\w.\-]+)`)
+
+type payloadMsgMention struct {
+	Seq        uint64 `json:"seq"`
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	Msg        string `json:"message"`
+}
+
+// mentionReq is a message with mentions that's queued to the room's event
+// loop to notify the mentioned peers.
+type mentionReq struct {
+	handles []string
+	data    *payload
+}
+
+// parseMentions returns the unique handles mentioned in a message in the
+// order in which they appear.
+func parseMentions(msg string) []string {
+	var (
+		out  []string
+		seen = make(map[string]bool)
+	)
+	for _, m := range reMention.FindAllStringSubmatch(msg, -1) {
+		// Trailing punctuation, eg: "thanks @john."
+		h := strings.TrimRight(m[1], ".-")
+		if h == "" || seen[strings.ToLower(h)] {
+			continue
+		}
+		seen[strings.ToLower(h)] = true
+		out = append(out, h)
+		if len(out) == maxMentions {
+			break
+		}
+	}
+	return out
+}
+
+// queueMentions queues a mention event for the peers mentioned in a
+// message.
+func (r *Room) queueMentions(handles []string, m NewMessage, p *Peer, seq uint64) {
+	if len(handles) == 0 || r.closed {
+		return
+	}
+	b := r.makePeerPayload(payloadMsgMention{
+		Seq:        seq,
+		PeerID:     p.Key,
+		PeerHandle: p.Handle,
+		Msg:        m.Message,
+	}, TypeMention, p)
+	r.queueReq(peerReq{reqType: TypeMention, peer: p, data: mentionReq{handles: handles, data: b}})
+}
+
+// sendMentions sends a mention event to all the connections of the
+// mentioned peers except the sender's. Handles are matched
+// case-insensitively. It should only be invoked from the room's event loop.
+func (r *Room) sendMentions(from *Peer, req mentionReq) {
+	for p := range r.peers {
+		if p.Handle == from.Handle {
+			continue
+		}
+		for _, h := range req.handles {
+			if strings.EqualFold(p.Handle, h) {
+				p.SendData(req.data)
+				break
+			}
+		}
+	}
+}
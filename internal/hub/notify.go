@@ -0,0 +1,20 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/knadh/niltalk/internal/notify"
+)
+
+// notify dispatches a room event from a peer to the notification channels
+// of the room.
+func (r *Room) notify(typ string, p *Peer, msg string) {
+	r.hub.Notify.Dispatch(r.Opts.Notify, notify.Event{
+		Type:     typ,
+		RoomID:   r.ID,
+		RoomName: r.Name(),
+		Handle:   p.Handle,
+		Message:  msg,
+		Time:     time.Now(),
+	})
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Clients may queue messages composed while they're offline and send them
+// when they reconnect along with the time they were composed at (ts in the
+// WS envelope, sent_at in batches). Queued messages are assigned sequence
+// numbers on arrival, so they're ordered after messages posted in the
+// meantime, and are flagged as delayed with their original time. Messages
+// composed longer ago than max_message_delay are rejected.
+//
+// Clients may also tag messages with an ID (client_id) to retry sends
+// safely. A message with the ID of a recent message from the same session
+// isn't posted again and the original sequence number is returned. Messages
+// sent over websockets with an ID are acknowledged to the sender
+// (message.ack) with their sequence number or the error they were rejected
+// with, so that clients can retry the sends that weren't acknowledged, eg:
+// after the connection drops.
+
+// Messages composed longer ago than this are flagged as delayed. It allows
+// for network latency and minor clock skew.
+const delayedAfter = 5 * time.Second
+
+// Maximum number of recent client message IDs retained per room for
+// deduplicating retries.
+const maxClientIDs = 1000
+
+var errMessageTooOld = errors.New("message is too old to be delivered")
+
+// NewMessage is a message posted by a peer.
+type NewMessage struct {
+	Message  string     `json:"message"`
+	ClientID string     `json:"client_id"`
+	SentAt   *time.Time `json:"sent_at"`
+
+	// Seconds after which clients remove the message. It's never cached.
+	Burn int `json:"burn"`
+}
+
+// UnmarshalJSON unmarshals a message that's either a plain string or an
+// object with the message and its metadata.
+func (m *NewMessage) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*m = NewMessage{}
+		return json.Unmarshal(b, &m.Message)
+	}
+
+	type msg NewMessage
+	return json.Unmarshal(b, (*msg)(m))
+}
+
+// delayedAt validates the time a message was composed at. It returns the
+// time if the message is delayed and nil otherwise. Times in the future,
+// that is, from clients with clocks that are ahead, are treated as now.
+func (h *Hub) delayedAt(t *time.Time) (*time.Time, error) {
+	if t == nil || t.IsZero() || h.cfg.MaxMessageDelay == 0 {
+		return nil, nil
+	}
+
+	d := time.Since(*t)
+	if d > h.cfg.MaxMessageDelay {
+		return nil, errMessageTooOld
+	}
+	if d < delayedAfter {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// TypeMessageAck acknowledges a message sent with a client ID to the sender.
+const TypeMessageAck = "message.ack"
+
+type payloadMsgAck struct {
+	ClientID string `json:"client_id"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ackMessage acknowledges a message the peer sent with a client ID. seq is
+// 0 for messages that aren't posted, eg: commands, and err is the error the
+// message was rejected with. Messages without IDs aren't acknowledged.
+func (p *Peer) ackMessage(clientID string, seq uint64, err error) {
+	if clientID == "" {
+		return
+	}
+
+	d := payloadMsgAck{ClientID: clientID, Seq: seq}
+	if err != nil {
+		d.Error = p.room.t(err.Error())
+	}
+	p.SendData(p.room.makePayload(d, TypeMessageAck))
+}
+
+// clientIDKey returns the key of a client message ID from a peer session.
+func clientIDKey(p *Peer, id string) string {
+	return p.ID + ":" + id
+}
+
+// postedSeq returns the sequence number of a message that a peer already
+// posted with the given client ID. postMut should be held.
+func (r *Room) postedSeq(p *Peer, id string) (uint64, bool) {
+	if id == "" {
+		return 0, false
+	}
+	seq, ok := r.clientIDs[clientIDKey(p, id)]
+	return seq, ok
+}
+
+// trackClientID records the sequence number of a message posted with a
+// client ID. The oldest IDs are discarded. postMut should be held.
+func (r *Room) trackClientID(p *Peer, id string, seq uint64) {
+	if id == "" {
+		return
+	}
+	if r.clientIDs == nil {
+		r.clientIDs = make(map[string]uint64)
+	}
+
+	k := clientIDKey(p, id)
+	if len(r.clientIDOrder) >= maxClientIDs {
+		delete(r.clientIDs, r.clientIDOrder[0])
+		r.clientIDOrder = r.clientIDOrder[1:]
+	}
+	r.clientIDs[k] = seq
+	r.clientIDOrder = append(r.clientIDOrder, k)
+}
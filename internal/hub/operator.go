@@ -0,0 +1,39 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// AddOperator adds an operator peer to the room for support. The operator's
+// session is revoked when it ends at the given time.
+func (r *Room) AddOperator(id, handle string, opts ConnOpts, ws *websocket.Conn, until time.Time) {
+	p := newPeer(id, handle, opts, ws, r)
+	p.Operator = true
+	r.queuePeerReq(TypePeerJoin, p)
+
+	time.AfterFunc(time.Until(until), func() {
+		if err := r.hub.Store.RemoveSession(id, r.ID); err != nil {
+			r.hub.log.Printf("error removing operator session: %v", err)
+		}
+		r.RevokeSession(id)
+		r.hub.Audit.Record("operator.expire", handle, r.ID, nil)
+	})
+}
+
+// operatorJoined announces an operator's presence to the room. It should
+// only be invoked from the room's event loop.
+func (r *Room) operatorJoined(p *Peer) {
+	r.broadcastSystem(SystemOperatorJoin, r.systemPeerMsg(SystemOperatorJoin, p), p)
+	r.hub.Audit.Record("operator.join", p.Handle, r.ID, map[string]interface{}{
+		"ip": p.IP,
+	})
+}
+
+// operatorLeft announces an operator's departure to the room. It should
+// only be invoked from the room's event loop.
+func (r *Room) operatorLeft(p *Peer) {
+	r.broadcastSystem(SystemOperatorLeave, r.systemPeerMsg(SystemOperatorLeave, p), p)
+	r.hub.Audit.Record("operator.leave", p.Handle, r.ID, nil)
+}
@@ -0,0 +1,57 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrNotOwner indicates that an action is restricted to the room's owner.
+var ErrNotOwner = errors.New("only the room's owner can do this")
+
+// NewOwnerKey generates a key that identifies the owner (creator) of a room
+// and its hash, which is stored in the room's options.
+func NewOwnerKey() (string, string, error) {
+	key, err := GenerateGUID(32)
+	if err != nil {
+		return "", "", err
+	}
+	return key, hashOwnerKey(key), nil
+}
+
+func hashOwnerKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// HasOwner returns true if the room has an owner. Rooms created before
+// owners were recorded don't.
+func (r *Room) HasOwner() bool {
+	return r.Opts.OwnerKey != ""
+}
+
+// IsOwnerKey checks if the given key is the room's owner key.
+func (r *Room) IsOwnerKey(key string) bool {
+	if key == "" || !r.HasOwner() {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashOwnerKey(key)), []byte(r.Opts.OwnerKey)) == 1
+}
+
+// canDispose checks if the peer can dispose of the room. Rooms without an
+// owner can be disposed of by any peer.
+func (p *Peer) canDispose() bool {
+	return p.Owner || !p.room.HasOwner()
+}
+
+// disposeRoom disposes of the peer's room if it's allowed to.
+func (p *Peer) disposeRoom() {
+	if !p.canDispose() {
+		p.SendData(p.room.makeNoticePayload(ErrNotOwner.Error()))
+		return
+	}
+
+	p.room.hub.Audit.Record("room.dispose", p.Handle, p.room.ID, nil)
+	p.room.Dispose()
+}
@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Actions on rooms whose passwords fall below the password policy and are
+// older than the maximum age.
+const (
+	WeakPasswordRotate = "rotate"
+	WeakPasswordExpire = "expire"
+)
+
+// PasswordHash returns the hash of the room's password.
+func (r *Room) PasswordHash() []byte {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.Password
+}
+
+// HasPassword checks if the room has a password. Rooms whose owners have
+// removed their passwords can be joined by anyone with their links.
+func (r *Room) HasPassword() bool {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return len(r.Password) > 0
+}
+
+// PasswordMeta returns the metadata of the room's password. It's nil for
+// rooms created before it was recorded.
+func (r *Room) PasswordMeta() *store.PasswordMeta {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.Opts.PasswordMeta
+}
+
+// WeakPasswordDue checks if a room's password was set longer than the
+// maximum age for weak passwords ago.
+func (h *Hub) WeakPasswordDue(meta *store.PasswordMeta) bool {
+	return h.cfg.WeakPasswordMaxAge > 0 && meta != nil &&
+		time.Since(meta.SetAt) > h.cfg.WeakPasswordMaxAge
+}
+
+// SetPassword changes the room's password and persists it. Existing
+// sessions aren't affected.
+func (r *Room) SetPassword(hash []byte, meta store.PasswordMeta) error {
+	r.mut.Lock()
+	r.Password = hash
+	r.Opts.PasswordMeta = &meta
+	r.mut.Unlock()
+	return r.hub.Store.UpdateRoom(r.storeRoom())
+}
+
+// RemovePassword removes the room's password and persists it. Existing
+// sessions aren't affected.
+func (r *Room) RemovePassword() error {
+	r.mut.Lock()
+	r.Password = nil
+	r.Opts.PasswordMeta = nil
+	r.mut.Unlock()
+	return r.hub.Store.UpdateRoom(r.storeRoom())
+}
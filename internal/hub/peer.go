@@ -1,22 +1,59 @@
 package hub
 
 import (
-	"encoding/json"
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Peer represents an individual peer / connection into a room.
 type Peer struct {
-	// Peer's chat handle.
+	// Peer's session ID and chat handle. The session ID authenticates the
+	// peer and is never sent to other peers.
 	ID     string
 	Handle string
 
+	// Public ID of the peer (SessionKey of its session ID) that identifies
+	// it to other peers in payloads and the history.
+	Key string
+
+	// Protocol version reported by the client.
+	ClientVersion string
+
+	// Websocket protocol version and encoding negotiated with the client.
+	Proto    int
+	Encoding string
+
+	// Operator joined for support with the admin token.
+	Operator bool
+
+	// Owner (creator) of the room.
+	Owner bool
+
+	// Client IP address the peer connected from.
+	IP string
+
+	// User agent and country (ISO code) the peer connected from, and when.
+	UserAgent   string
+	Country     string
+	connectedAt time.Time
+
 	ws *websocket.Conn
 
-	// Channel for outbound messages.
-	dataQ chan []byte
+	// Queue of outbound messages written by the hub's write pool. The
+	// peer is scheduled on the pool (1) when messages are queued and
+	// closed (1) when its connection is closed.
+	dataQ     chan *payload
+	scheduled int32
+	closed    int32
+
+	// Number of messages dropped since the last payload written.
+	missed int32
 
 	// Peer's room.
 	room *Room
@@ -24,21 +61,83 @@ type Peer struct {
 	// Rate limiting.
 	numMessages int
 	lastMessage time.Time
+
+	// Round trip time (ns) of the last heartbeat or debug ping and the
+	// number of pings that haven't been answered.
+	rtt          int64
+	pendingPongs int32
+
+	// Times (ns) of the last pong and of the last message from the peer, and
+	// whether it has been warned about being idle (1).
+	lastPong   int64
+	lastActive int64
+	idleWarned int32
+
+	// Connection quality level last broadcast to the room.
+	qualityLevel string
+
+	// Peer is waiting in the room's queue (1). Messages from waiting peers
+	// are ignored.
+	queued int32
+
+	// Resume token issued to the connection, and the token and sequence
+	// number it's resuming from.
+	resumeToken string
+	resumeFrom  string
+	resumeSeq   uint64
 }
 
-type peerInfo struct {
-	ID     string `json:"id"`
-	Handle string `json:"handle"`
+// ConnOpts represents the options a peer's connection was made with.
+type ConnOpts struct {
+	ClientVersion string
+	Proto         int
+	Encoding      string
+
+	// Session belongs to the room's owner.
+	Owner bool
+
+	// Client IP address resolved from trusted proxy headers.
+	IP string
+
+	// User agent of the client and the country (ISO code) derived from its
+	// IP address, if known.
+	UserAgent string
+	Country   string
+
+	// Resume token of the session's previous connection and the sequence
+	// number of the last message it received.
+	Resume    string
+	ResumeSeq uint64
+}
+
+// PeerInfo represents the public info of a peer.
+type PeerInfo struct {
+	ID       string      `json:"id"`
+	Handle   string      `json:"handle"`
+	Operator bool        `json:"operator,omitempty"`
+	Quality  PeerQuality `json:"quality"`
 }
 
 // newPeer returns a new instance of Peer.
-func newPeer(id, handle string, ws *websocket.Conn, room *Room) *Peer {
+func newPeer(id, handle string, opts ConnOpts, ws *websocket.Conn, room *Room) *Peer {
 	return &Peer{
-		ID:     id,
-		Handle: handle,
-		ws:     ws,
-		dataQ:  make(chan []byte, 100),
-		room:   room,
+		ID:            id,
+		Key:           SessionKey(id),
+		Handle:        handle,
+		ClientVersion: opts.ClientVersion,
+		Proto:         opts.Proto,
+		Encoding:      opts.Encoding,
+		Owner:         opts.Owner,
+		IP:            opts.IP,
+		UserAgent:     opts.UserAgent,
+		Country:       opts.Country,
+		connectedAt:   time.Now(),
+		ws:            ws,
+		dataQ:         make(chan *payload, room.hub.cfg.PeerQueueSize),
+		room:          room,
+		qualityLevel:  QualityGood,
+		resumeFrom:    opts.Resume,
+		resumeSeq:     opts.ResumeSeq,
 	}
 }
 
@@ -47,11 +146,16 @@ func newPeer(id, handle string, ws *websocket.Conn, room *Room) *Peer {
 // as a goroutine.
 func (p *Peer) RunListener() {
 	p.ws.SetReadLimit(int64(p.room.hub.cfg.MaxMessageLen))
+	p.ws.SetPongHandler(p.handlePong)
 	for {
 		_, m, err := p.ws.ReadMessage()
 		if err != nil {
 			break
 		}
+		if atomic.LoadInt32(&p.queued) == 1 {
+			continue
+		}
+		p.touchActive()
 		p.processMessage(m)
 	}
 
@@ -60,28 +164,20 @@ func (p *Peer) RunListener() {
 	p.room.queuePeerReq(TypePeerLeave, p)
 }
 
-// RunWriter is a blocking function that writes messages in a peer's queue to the
-// peer's WS connection. This should be invoked as a goroutine.
-func (p *Peer) RunWriter() {
-	defer p.ws.Close()
-	for {
-		select {
-		// Wait for outgoing message to appear in the channel.
-		case message, ok := <-p.dataQ:
-			if !ok {
-				p.writeWSData(websocket.CloseMessage, []byte{})
-				return
-			}
-			if err := p.writeWSData(websocket.TextMessage, message); err != nil {
-				return
-			}
-		}
+// SendData queues a message to be written to the peer's WS. It doesn't
+// block. Payloads to a peer whose queue is full are handled as per the slow
+// peer policy.
+func (p *Peer) SendData(b *payload) {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return
 	}
-}
 
-// SendData queues a message to be written to the peer's WS.
-func (p *Peer) SendData(b []byte) {
-	p.dataQ <- b
+	select {
+	case p.dataQ <- b:
+		p.room.hub.writer.schedule(p)
+	default:
+		p.overflow(b)
+	}
 }
 
 // writeWSData writes the given payload to the peer's WS connection.
@@ -92,14 +188,14 @@ func (p *Peer) writeWSData(msgType int, payload []byte) error {
 
 // writeWSControl writes the given control payload to the peer's WS connection.
 func (p *Peer) writeWSControl(control int, payload []byte) error {
-	return p.ws.WriteControl(websocket.CloseMessage, payload, time.Time{})
+	return p.ws.WriteControl(control, payload, time.Now().Add(p.room.hub.cfg.WSTimeout))
 }
 
 // processMessage processes incoming messages from peers.
 func (p *Peer) processMessage(b []byte) {
 	var m payloadMsgWrap
 
-	if err := json.Unmarshal(b, &m); err != nil {
+	if err := decodeMessage(p.Encoding, b, &m); err != nil {
 		// TODO: Respond
 		return
 	}
@@ -109,25 +205,100 @@ func (p *Peer) processMessage(b []byte) {
 	case TypeMessage:
 		// Check rate limits and update counters.
 		now := time.Now()
-		if p.numMessages > 0 {
-			if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-				time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
+		if p.numMessages > 0 && time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
+			n := p.numMessages%p.room.hub.cfg.RateLimitMessages + 1
+			if n >= p.room.hub.cfg.RateLimitMessages {
 				p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
 				p.writeWSControl(websocket.CloseMessage,
 					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
 				p.ws.Close()
+				p.room.broadcastSystem(SystemPeerKicked, p.room.systemPeerMsg(SystemPeerKicked, p), p)
+				p.room.hub.Audit.Record("peer.kick", "", p.room.ID, map[string]interface{}{
+					"handle": p.Handle,
+					"reason": "rate_limit",
+				})
 				return
 			}
+
+			// Warn the peer before it's kicked out.
+			if n+1 == p.room.hub.cfg.RateLimitMessages {
+				p.SendData(p.room.makeSystemPayload(SystemRateLimitWarning,
+					p.room.t("You're sending messages too fast. Slow down or you'll be removed"), p))
+			}
 		}
 		p.lastMessage = now
 		p.numMessages++
 
 		msg, ok := m.Data.(string)
 		if !ok {
-			// TODO: Respond
+			p.ackMessage(m.ClientID, 0, errInvalidMessage)
+			return
+		}
+		if p.runCommand(msg) {
+			p.ackMessage(m.ClientID, 0, nil)
+			return
+		}
+		if !p.canPost() {
+			p.SendData(p.room.makeNoticePayload(ErrReadOnly.Error()))
+			p.ackMessage(m.ClientID, 0, ErrReadOnly)
 			return
 		}
-		p.room.Broadcast(p.room.makeMessagePayload(msg, p), true)
+
+		// The span covers filtering (eg: the moderation API) and posting
+		// (broadcast and the message cache).
+		_, span := tracing.Tracer.Start(context.Background(), "room.message",
+			trace.WithAttributes(attribute.String("room.id", p.room.ID)))
+		var err error
+		if msg, err = p.room.filterMessage(msg, p); err != nil {
+			tracing.End(span, err)
+			p.SendData(p.room.makeNoticePayload(err.Error()))
+			p.ackMessage(m.ClientID, 0, err)
+			return
+		}
+
+		nm := NewMessage{Message: msg, ClientID: m.ClientID, Burn: m.Burn}
+		if m.TS > 0 {
+			t := time.Unix(0, m.TS*int64(time.Millisecond))
+			nm.SentAt = &t
+		}
+		seq, err := p.room.postMessage(nm, p)
+		tracing.End(span, err)
+		if err != nil {
+			p.SendData(p.room.makeNoticePayload(err.Error()))
+		}
+		p.ackMessage(m.ClientID, seq, err)
+
+	// Polls.
+	case TypePoll:
+		var np NewPoll
+		if err := decodePoll(m.Data, &np); err != nil {
+			p.SendData(p.room.makeNoticePayload(ErrInvalidPoll.Error()))
+			return
+		}
+		if !p.canPost() {
+			p.SendData(p.room.makeNoticePayload(ErrReadOnly.Error()))
+			return
+		}
+		if err := p.room.createPoll(np, p); err != nil {
+			p.SendData(p.room.makeNoticePayload(err.Error()))
+		}
+
+	case TypePollVote, TypePollClose:
+		var req pollReq
+		if err := decodePoll(m.Data, &req); err != nil {
+			p.SendData(p.room.makeNoticePayload(ErrInvalidPoll.Error()))
+			return
+		}
+
+		var err error
+		if m.Type == TypePollVote {
+			err = p.room.votePoll(req, p)
+		} else {
+			err = p.room.closePoll(req.ID, p)
+		}
+		if err != nil {
+			p.SendData(p.room.makeNoticePayload(err.Error()))
+		}
 
 	// "Typing" status.
 	case TypeTyping:
@@ -137,9 +308,18 @@ func (p *Peer) processMessage(b []byte) {
 	case TypePeerList:
 		p.room.sendPeerList(p)
 
+	// Peer to peer file transfer negotiation.
+	case TypeTransferOffer, TypeTransferAccept, TypeTransferReject,
+		TypeTransferSignal, TypeTransferCancel:
+		p.queueTransfer(m.Type, m.Data)
+
+	// WebRTC call signaling.
+	case TypeCallOffer, TypeCallAnswer, TypeCallICE, TypeCallHangup:
+		p.queueCall(m.Type, m.Data)
+
 	// Dipose of a room.
 	case TypeRoomDispose:
-		p.room.Dispose()
+		p.disposeRoom()
 	default:
 	}
 }
@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Modes of creating persistent rooms.
+const (
+	PersistentDisabled = "disabled"
+	PersistentAdmin    = "admin"
+	PersistentAll      = "all"
+)
+
+// roomTTL returns the store TTL of a room with the given options. Persistent
+// rooms don't expire and scheduled rooms expire when they close.
+func (h *Hub) roomTTL(opts store.RoomOpts) time.Duration {
+	if opts.Persistent {
+		return 0
+	}
+	if opts.Schedule != nil {
+		if d := time.Until(opts.Schedule.Closes); d > time.Second {
+			return d
+		}
+		return time.Second
+	}
+	return h.roomAge(opts)
+}
+
+// TTL returns the store TTL of the room's data. 0 means it doesn't expire.
+func (r *Room) TTL() time.Duration {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.hub.roomTTL(r.Opts)
+}
+
+// unloadRoom removes an idle persistent room from the hub retaining it
+// in the store. It's loaded again when a peer accesses it.
+func (h *Hub) unloadRoom(id string) {
+	h.mut.Lock()
+	delete(h.rooms, id)
+	delete(h.reservations, id)
+	h.mut.Unlock()
+}
@@ -0,0 +1,289 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Types of poll messages. Peers create polls (TypePoll), vote in them, and
+// close them. Vote counts are broadcast as tallies. The results of closed
+// polls are recorded in the history as TypePollResults.
+const (
+	TypePoll        = "poll"
+	TypePollVote    = "poll.vote"
+	TypePollClose   = "poll.close"
+	TypePollTally   = "poll.tally"
+	TypePollResults = "poll.results"
+)
+
+const (
+	maxPollOptions   = 10
+	maxPollOptionLen = 200
+
+	// Maximum number of open polls in a room.
+	maxOpenPolls = 20
+)
+
+var (
+	// ErrInvalidPoll indicates that a poll is invalid.
+	ErrInvalidPoll = errors.New("a poll needs a question and 2 - 10 options")
+
+	// ErrPollNotFound indicates that a poll doesn't exist or is closed.
+	ErrPollNotFound = errors.New("poll not found or closed")
+
+	// ErrAlreadyVoted indicates that a session has already voted in a poll.
+	ErrAlreadyVoted = errors.New("you've already voted in this poll")
+
+	errTooManyPolls = errors.New("too many open polls")
+)
+
+// NewPoll represents a poll created by a peer.
+type NewPoll struct {
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+}
+
+// pollReq is a vote in or a request to close a poll.
+type pollReq struct {
+	ID     uint64 `json:"id"`
+	Option int    `json:"option"`
+}
+
+type payloadMsgPoll struct {
+	PeerID     string `json:"peer_id"`
+	PeerHandle string `json:"peer_handle"`
+	store.Poll
+}
+
+// poll is an open poll in a room.
+type poll struct {
+	store.Poll
+
+	// Session of the peer that created the poll.
+	creator string
+
+	// Sessions that have voted.
+	voters map[string]bool
+}
+
+// decodePoll decodes poll data sent by a peer into out.
+func decodePoll(data interface{}, out interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// createPoll filters and validates a poll from a peer, broadcasts it to the
+// room, and records it in the history.
+func (r *Room) createPoll(np NewPoll, p *Peer) error {
+	np.Question = strings.TrimSpace(np.Question)
+	if np.Question == "" || len(np.Question) > r.hub.cfg.MaxMessageLen ||
+		len(np.Options) < 2 || len(np.Options) > maxPollOptions {
+		return ErrInvalidPoll
+	}
+	for i, o := range np.Options {
+		if o = strings.TrimSpace(o); o == "" || len(o) > maxPollOptionLen {
+			return ErrInvalidPoll
+		}
+		np.Options[i] = o
+	}
+
+	// The question and options are filtered like messages.
+	var err error
+	if np.Question, err = r.filterMessage(np.Question, p); err != nil {
+		return err
+	}
+	for i, o := range np.Options {
+		if np.Options[i], err = r.filterMessage(o, p); err != nil {
+			return err
+		}
+	}
+
+	r.postMut.Lock()
+	defer r.postMut.Unlock()
+
+	r.pollMut.Lock()
+	if len(r.polls) >= maxOpenPolls {
+		r.pollMut.Unlock()
+		return errTooManyPolls
+	}
+	pl := &poll{
+		Poll: store.Poll{
+			ID:       r.nextSeq(),
+			Question: np.Question,
+			Options:  np.Options,
+			Votes:    make([]int, len(np.Options)),
+		},
+		creator: p.ID,
+		voters:  make(map[string]bool),
+	}
+	r.polls[pl.ID] = pl
+
+	// Payloads are encoded lazily while votes may be recorded, so they
+	// get a copy of the votes.
+	snap := pl.Poll
+	snap.Votes = append([]int{}, pl.Votes...)
+	r.pollMut.Unlock()
+
+	r.Broadcast(r.makePeerPayload(payloadMsgPoll{PeerID: p.Key, PeerHandle: p.Handle, Poll: snap}, TypePoll, p), true)
+	r.cachePoll(TypePoll, np.Question, snap, p)
+	return nil
+}
+
+// votePoll records a peer's vote in a poll and broadcasts the poll's tally.
+// A session can only vote once in a poll.
+func (r *Room) votePoll(req pollReq, p *Peer) error {
+	r.pollMut.Lock()
+	pl, ok := r.polls[req.ID]
+	switch {
+	case !ok:
+		r.pollMut.Unlock()
+		return ErrPollNotFound
+	case req.Option < 0 || req.Option >= len(pl.Options):
+		r.pollMut.Unlock()
+		return ErrInvalidPoll
+	case pl.voters[p.ID]:
+		r.pollMut.Unlock()
+		return ErrAlreadyVoted
+	}
+
+	pl.voters[p.ID] = true
+	pl.Votes[req.Option]++
+	tally := r.makePollTallyPayload(pl.Poll)
+	r.pollMut.Unlock()
+
+	// The broadcast may block, so the lock isn't held for it.
+	r.Broadcast(tally, false)
+	return nil
+}
+
+// closePoll closes a poll, broadcasts its final tally, and records its
+// results in the history. Polls can be closed by the peers that created them,
+// the room's owner, and operators.
+func (r *Room) closePoll(id uint64, p *Peer) error {
+	r.pollMut.Lock()
+	pl, ok := r.polls[id]
+	if ok && pl.creator != p.ID && !p.Owner && !p.Operator {
+		r.pollMut.Unlock()
+		return ErrNotOwner
+	}
+	delete(r.polls, id)
+	r.pollMut.Unlock()
+
+	if !ok {
+		return ErrPollNotFound
+	}
+	r.endPoll(pl)
+	return nil
+}
+
+// closePolls closes all the open polls in the room, eg: when it's unloaded.
+func (r *Room) closePolls() {
+	r.pollMut.Lock()
+	polls := r.polls
+	r.polls = make(map[uint64]*poll)
+	r.pollMut.Unlock()
+
+	for _, pl := range polls {
+		r.endPoll(pl)
+	}
+}
+
+// endPoll broadcasts the final tally of a closed poll and records its
+// results.
+func (r *Room) endPoll(pl *poll) {
+	pl.Closed = true
+	r.Broadcast(r.makePollTallyPayload(pl.Poll), false)
+	r.cachePoll(TypePollResults, pollText(pl.Poll), pl.Poll, nil)
+}
+
+// sendPollTallies sends the tallies of the open polls to a peer, eg: after
+// the polls are replayed to it on joining.
+func (r *Room) sendPollTallies(p *Peer) {
+	r.pollMut.Lock()
+	defer r.pollMut.Unlock()
+	for _, pl := range r.polls {
+		p.SendData(r.makePollTallyPayload(pl.Poll))
+	}
+}
+
+// ApplyPolls replaces the votes of the polls in the room's messages, which
+// are recorded when the polls are created, with the recorded results of
+// closed polls or the live tallies of open polls.
+func (r *Room) ApplyPolls(msgs []store.Message) {
+	polls := make(map[uint64]store.Poll)
+	for _, m := range msgs {
+		if m.Type == TypePollResults && m.Poll != nil {
+			polls[m.Poll.ID] = *m.Poll
+		}
+	}
+
+	r.pollMut.Lock()
+	for id, pl := range r.polls {
+		c := pl.Poll
+		c.Votes = append([]int{}, pl.Votes...)
+		polls[id] = c
+	}
+	r.pollMut.Unlock()
+
+	for i, m := range msgs {
+		if m.Type != TypePoll || m.Poll == nil {
+			continue
+		}
+		if pl, ok := polls[m.Poll.ID]; ok {
+			msgs[i].Poll = &pl
+		}
+	}
+}
+
+// cachePoll records a poll or its results in the history. p is nil for
+// results.
+func (r *Room) cachePoll(typ, msg string, pl store.Poll, p *Peer) {
+	if !r.logging() {
+		return
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating message ID: %v", err)
+		return
+	}
+
+	pl.Votes = append([]int{}, pl.Votes...)
+	m := store.Message{
+		ID:        id,
+		Type:      typ,
+		Message:   msg,
+		Seq:       pl.ID,
+		Timestamp: time.Now(),
+		Poll:      &pl,
+	}
+	if p != nil {
+		m.PeerID = p.Key
+		m.PeerHandle = p.Handle
+	}
+	r.writeCachedMessage(m)
+}
+
+// makePollTallyPayload prepares a payload with the vote counts of a poll.
+func (r *Room) makePollTallyPayload(pl store.Poll) *payload {
+	pl.Votes = append([]int{}, pl.Votes...)
+	return r.makePayload(pl, TypePollTally)
+}
+
+// pollText returns a plain text summary of a poll's results, eg: for
+// exports.
+func pollText(pl store.Poll) string {
+	opts := make([]string, len(pl.Options))
+	for i, o := range pl.Options {
+		opts[i] = fmt.Sprintf("%s (%d)", o, pl.Votes[i])
+	}
+	return pl.Question + ": " + strings.Join(opts, ", ")
+}
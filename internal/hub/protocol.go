@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Versions of the websocket protocol supported by the hub. Clients report
+// the highest version they speak when connecting (?proto=) and the hub
+// picks the highest version both sides support. Clients that don't report
+// a version speak version 1.
+//
+// Every payload sent to clients is an envelope of the form:
+//
+//	{
+//	  "v": 2,              // Protocol version of the envelope.
+//	  "type": "message",   // Type of the payload, eg: message, peer.join.
+//	  "id": 42,            // Increasing ID of the payload in the room.
+//	  "ts": 1600000000000, // Unix timestamp (ms) of the payload.
+//	  "peer": {...},       // Optional peer the payload is from or about.
+//	  "data": {...}        // Type specific data.
+//	}
+//
+// Version 1 envelopes only have type, timestamp (RFC3339), and data, which
+// are retained in later versions. Peers that negotiate version 1 are sent
+// version 1 envelopes. Fields may be added to the data of types, which
+// clients ignore if they don't know them, but existing fields aren't changed
+// or removed without a new version.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// ErrUnsupportedProtocol indicates that a client only speaks protocol
+// versions older than the minimum supported version.
+var ErrUnsupportedProtocol = errors.New("unsupported protocol version")
+
+type payloadMsgProtocol struct {
+	Version    int    `json:"version"`
+	MinVersion int    `json:"min_version"`
+	MaxVersion int    `json:"max_version"`
+	Encoding   string `json:"encoding"`
+}
+
+// payloadMsgWrapV1 is the envelope of payloads sent to version 1 peers.
+type payloadMsgWrapV1 struct {
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// NegotiateProtocol returns the protocol version to speak with a client
+// given the highest version reported by it.
+func NegotiateProtocol(requested string) (int, error) {
+	if requested == "" {
+		return MinProtocolVersion, nil
+	}
+
+	v, err := strconv.Atoi(requested)
+	if err != nil || v < MinProtocolVersion {
+		return 0, ErrUnsupportedProtocol
+	}
+	if v > ProtocolVersion {
+		v = ProtocolVersion
+	}
+	return v, nil
+}
+
+// makeProtocolPayload prepares a message payload informing a peer of the
+// negotiated protocol version and encoding. It's the first payload sent to
+// a peer.
+func (r *Room) makeProtocolPayload(p *Peer) *payload {
+	return r.makePayload(payloadMsgProtocol{
+		Version:    p.Proto,
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Encoding:   p.Encoding,
+	}, TypeProtocol)
+}
@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// TestEncodeVersions checks that peers are sent the envelope of the protocol
+// version they negotiated in either encoding.
+func TestEncodeVersions(t *testing.T) {
+	r := &Room{}
+	p := r.makePeerPayload(payloadMsgChat{PeerID: "a", PeerHandle: "alice", Msg: "hi", Seq: 1},
+		TypeMessage, &Peer{Key: "a", Handle: "alice"})
+
+	for _, c := range []struct {
+		proto  int
+		fields []string
+	}{
+		{1, []string{"data", "timestamp", "type"}},
+		{2, []string{"data", "id", "peer", "timestamp", "ts", "type", "v"}},
+	} {
+		for _, enc := range []string{EncodingJSON, EncodingMsgpack} {
+			var (
+				m      map[string]interface{}
+				b, _   = p.encode(enc, c.proto)
+				err    error
+				fields []string
+			)
+			if enc == EncodingMsgpack {
+				err = msgpack.Unmarshal(b, &m)
+			} else {
+				err = json.Unmarshal(b, &m)
+			}
+			if err != nil {
+				t.Fatalf("v%d %s: %v", c.proto, enc, err)
+			}
+
+			for f := range m {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, c.fields) {
+				t.Errorf("v%d %s: expected fields %v, got %v", c.proto, enc, c.fields, fields)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package hub
+
+import (
+	"errors"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// ErrPeerNotFound indicates that there's no data stored for a peer.
+var ErrPeerNotFound = errors.New("peer not found")
+
+// PurgeResult is the number of records removed when purging a peer's data.
+type PurgeResult struct {
+	Sessions int `json:"sessions"`
+	Messages int `json:"messages"`
+}
+
+// PurgePeer removes all the data stored for a peer, identified by their
+// public ID (session key), in the room to fulfil a deletion request: the
+// sessions of the peer's handle and the messages and events they posted. The
+// peer's connections are closed before the history is purged. The handle is looked up from the peer's session or, if it has
+// ended, their messages. It returns lock.ErrLocked if the history is being
+// rewritten by someone else.
+func (r *Room) PurgePeer(peerID string) (PurgeResult, error) {
+	var res PurgeResult
+
+	ss, err := r.hub.Store.GetSessions(r.ID)
+	if err != nil {
+		return res, err
+	}
+	handle := ""
+	for _, s := range ss {
+		if SessionKey(s.ID) == peerID {
+			handle = s.Handle
+			break
+		}
+	}
+	if res.Sessions, err = r.removeSessions(ss, peerID, handle); err != nil {
+		return res, err
+	}
+
+	if r.hub.MsgCache != nil {
+		ls, err := r.lockHistory()
+		if err != nil {
+			return res, err
+		}
+
+		// Block messages from being written while the history is rewritten.
+		r.postMut.Lock()
+		r.chainMut.Lock()
+		n, h, err := r.purgeMessages(peerID, handle)
+		r.chainMut.Unlock()
+		r.postMut.Unlock()
+		ls.Release()
+		if err != nil {
+			return res, err
+		}
+		res.Messages = n
+
+		// The handle's other sessions if it was found in the messages.
+		if handle == "" && h != "" {
+			n, err := r.removeSessions(ss, "", h)
+			if err != nil {
+				return res, err
+			}
+			res.Sessions += n
+		}
+	}
+
+	if res.Sessions == 0 && res.Messages == 0 {
+		return res, ErrPeerNotFound
+	}
+	return res, nil
+}
+
+// removeSessions removes the session of the public ID peerID and the sessions of handle
+// from the store and closes their connections.
+func (r *Room) removeSessions(ss []store.Sess, peerID, handle string) (int, error) {
+	n := 0
+	for _, s := range ss {
+		if SessionKey(s.ID) != peerID && (handle == "" || s.Handle != handle) {
+			continue
+		}
+		if err := r.hub.Store.RemoveSession(s.ID, r.ID); err != nil {
+			return n, err
+		}
+		r.RevokeSession(s.ID)
+		n++
+	}
+	return n, nil
+}
+
+// purgeMessages removes a peer's messages from the message cache and returns
+// the number of messages removed and the peer's handle. The caller should
+// hold postMut, chainMut and the history lock.
+func (r *Room) purgeMessages(peerID, handle string) (int, string, error) {
+	msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	if err != nil {
+		return 0, handle, err
+	}
+	if handle == "" {
+		for _, m := range msgs {
+			if isPeerKey(m.PeerID, peerID) && m.PeerHandle != "" {
+				handle = m.PeerHandle
+				break
+			}
+		}
+	}
+
+	keep := make([]store.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if isPeerKey(m.PeerID, peerID) || (handle != "" && m.PeerHandle == handle) {
+			continue
+		}
+		keep = append(keep, m)
+	}
+	n := len(msgs) - len(keep)
+	if n == 0 {
+		return 0, handle, nil
+	}
+	return n, handle, r.rewriteHistory(msgs, keep)
+}
@@ -0,0 +1,87 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Connection quality levels of a peer derived from its heartbeats.
+const (
+	QualityGood = "good"
+	QualityFair = "fair"
+	QualityPoor = "poor"
+	QualityLost = "lost"
+)
+
+// PeerQuality represents the connection quality of a peer. Score is
+// 0 (lost) - 100 (good).
+type PeerQuality struct {
+	Score int    `json:"score"`
+	Level string `json:"level"`
+}
+
+// quality derives the peer's connection quality from the round trip time of
+// the last heartbeat and the number of heartbeats that went unanswered.
+func (p *Peer) quality() PeerQuality {
+	var (
+		score = 100
+		rtt   = time.Duration(atomic.LoadInt64(&p.rtt))
+	)
+	switch {
+	case rtt > time.Second:
+		score -= 60
+	case rtt > time.Millisecond*500:
+		score -= 40
+	case rtt > time.Millisecond*200:
+		score -= 20
+	}
+
+	// One heartbeat may be in flight.
+	if missed := atomic.LoadInt32(&p.pendingPongs) - 1; missed > 0 {
+		score -= int(missed) * 35
+	}
+	if score < 0 {
+		score = 0
+	}
+
+	q := PeerQuality{Score: score, Level: QualityGood}
+	switch {
+	case score == 0:
+		q.Level = QualityLost
+	case score < 50:
+		q.Level = QualityPoor
+	case score < 80:
+		q.Level = QualityFair
+	}
+	return q
+}
+
+// heartbeat pings all peers in the room and broadcasts the connection
+// quality of peers whose level has changed since the last heartbeat. Dead and
+// idle peers are disconnected. Quality updates don't count as activity in
+// the room. It should only be invoked
+// from the room's event loop.
+func (r *Room) heartbeat() {
+	now := time.Now()
+	for p := range r.peers {
+		if r.checkLiveness(p, now) {
+			continue
+		}
+		if q := p.quality(); q.Level != p.qualityLevel {
+			p.qualityLevel = q.Level
+			r.fanout(r.makePeerQualityPayload(p, q))
+		}
+		p.SendData(pingPayload)
+	}
+}
+
+// makePeerQualityPayload prepares a message payload with a peer's connection
+// quality.
+func (r *Room) makePeerQualityPayload(p *Peer, q PeerQuality) *payload {
+	d := payloadMsgPeer{
+		ID:      p.Key,
+		Handle:  p.Handle,
+		Quality: &q,
+	}
+	return r.makePayload(d, TypePeerQuality)
+}
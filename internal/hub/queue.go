@@ -0,0 +1,76 @@
+package hub
+
+import "sync/atomic"
+
+// TypeQueuePosition is sent to peers waiting in a full room's queue when
+// they join it and when their position in it changes.
+const TypeQueuePosition = "queue.position"
+
+type payloadQueuePosition struct {
+	// 1 is the head of the queue.
+	Position int `json:"position"`
+	Size     int `json:"size"`
+}
+
+// hasCapacity checks if the room and the instance can take another peer.
+func (r *Room) hasCapacity() bool {
+	return len(r.peers) < r.maxPeers() && r.hub.admitPeer(r)
+}
+
+// enqueuePeer adds a peer that can't join the full room to the end of the
+// room's queue.
+func (r *Room) enqueuePeer(p *Peer) {
+	atomic.StoreInt32(&p.queued, 1)
+	r.queue = append(r.queue, p)
+	r.sendQueuePositions(len(r.queue) - 1)
+	r.hub.log.Printf("%s@%s queued in %s (%d)", p.Handle, p.ID, r.ID, len(r.queue))
+}
+
+// dequeuePeer removes a peer that has left from the room's queue. It returns
+// false if the peer isn't in the queue.
+func (r *Room) dequeuePeer(p *Peer) bool {
+	for i, q := range r.queue {
+		if q != p {
+			continue
+		}
+
+		r.queue = append(r.queue[:i], r.queue[i+1:]...)
+		p.SendData(closePayload)
+		r.sendQueuePositions(i)
+		return true
+	}
+	return false
+}
+
+// admitQueued admits peers from the head of the room's queue while there's
+// capacity for them.
+func (r *Room) admitQueued() {
+	n := 0
+	for ; n < len(r.queue) && r.hasCapacity(); n++ {
+		p := r.queue[n]
+		atomic.StoreInt32(&p.queued, 0)
+		r.joinPeer(p)
+	}
+	if n == 0 {
+		return
+	}
+
+	r.queue = r.queue[n:]
+	r.sendQueuePositions(0)
+}
+
+// sendQueuePositions sends peers in the queue from the given index onwards
+// their positions.
+func (r *Room) sendQueuePositions(from int) {
+	for i := from; i < len(r.queue); i++ {
+		r.queue[i].SendData(r.makeQueuePositionPayload(i + 1))
+	}
+}
+
+// makeQueuePositionPayload prepares a queue position payload.
+func (r *Room) makeQueuePositionPayload(pos int) *payload {
+	return r.makePayload(payloadQueuePosition{
+		Position: pos,
+		Size:     len(r.queue),
+	}, TypeQueuePosition)
+}
@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"errors"
+	"strings"
+)
+
+// maxSpeakers is the maximum number of speakers in a read-only room.
+const maxSpeakers = 100
+
+var (
+	// ErrReadOnly indicates that a peer can't post in a read-only room.
+	ErrReadOnly = errors.New("only the owner and speakers can post in this room")
+
+	// ErrInvalidSpeakers indicates that a room's speakers are invalid.
+	ErrInvalidSpeakers = errors.New("invalid speakers")
+)
+
+// validateSpeakers checks the handles of a read-only room's speakers.
+func validateSpeakers(speakers []string) error {
+	if len(speakers) > maxSpeakers {
+		return ErrInvalidSpeakers
+	}
+	for _, s := range speakers {
+		if s = strings.TrimSpace(s); s == "" || len(s) > 100 {
+			return ErrInvalidSpeakers
+		}
+	}
+	return nil
+}
+
+// IsSpeaker checks if a handle is one of the room's speakers. Handles are
+// matched case-insensitively.
+func (r *Room) IsSpeaker(handle string) bool {
+	handle = strings.TrimSpace(handle)
+
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	for _, s := range r.Opts.Speakers {
+		if strings.EqualFold(strings.TrimSpace(s), handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// canPost checks if the peer can post messages in its room. Only the owner,
+// speakers, and operators can post in read-only rooms.
+func (p *Peer) canPost() bool {
+	p.room.mut.RLock()
+	readOnly := p.room.Opts.ReadOnly
+	p.room.mut.RUnlock()
+
+	return !readOnly || p.Owner || p.Operator || p.room.IsSpeaker(p.Handle)
+}
@@ -0,0 +1,59 @@
+package hub
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ReconnectHint returns a random delay after which a disconnected client
+// should reconnect, so that clients disconnected at the same time don't all
+// reconnect at once.
+func (h *Hub) ReconnectHint() time.Duration {
+	if h.cfg.ReconnectJitter <= time.Second {
+		return time.Second
+	}
+	return time.Second + time.Duration(rand.Int63n(int64(h.cfg.ReconnectJitter-time.Second)))
+}
+
+// ReconnectCloseMessage returns a websocket close frame payload with a
+// reconnect hint (reason "reconnect:milliseconds") for the client.
+func ReconnectCloseMessage(code int, d time.Duration) []byte {
+	return websocket.FormatCloseMessage(code, fmt.Sprintf("reconnect:%d", d.Milliseconds()))
+}
+
+// Shutdown disconnects the peers in all active rooms with jittered
+// reconnect hints. Rooms are retained in the store so that peers can
+// reconnect to them once the server is back. Messages buffered for the
+// message cache are written before it returns.
+func (h *Hub) Shutdown() {
+	for _, r := range h.getRooms() {
+		select {
+		case r.shutdownSig <- true:
+		case <-r.done:
+		case <-time.After(time.Second):
+			h.log.Printf("timed out shutting down room %s", r.ID)
+		}
+	}
+
+	if h.cacheWriter != nil {
+		h.cacheWriter.Close()
+	}
+}
+
+// shutdown disconnects all peers in the room with reconnect hints.
+func (r *Room) shutdown() {
+	// Open polls don't survive restarts. Their results are recorded.
+	r.closePolls()
+	r.closed = true
+	for p := range r.peers {
+		p.writeWSControl(websocket.CloseMessage,
+			ReconnectCloseMessage(websocket.CloseServiceRestart, r.hub.ReconnectHint()))
+	}
+	for _, p := range r.queue {
+		p.writeWSControl(websocket.CloseMessage,
+			ReconnectCloseMessage(websocket.CloseServiceRestart, r.hub.ReconnectHint()))
+	}
+}
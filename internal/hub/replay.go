@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+type payloadMsgReplay struct {
+	Messages []store.Message `json:"messages"`
+
+	// The messages are the ones a resuming peer missed and follow the
+	// ones it already has.
+	Resumed bool `json:"resumed,omitempty"`
+}
+
+// replayHistory sends a peer that has joined the last N messages from the
+// room's message cache, as configured for the room, so that it has context
+// without having to call the history API. It returns false if the room
+// doesn't replay history. It should only be invoked from the room's event
+// loop so that the replay precedes newer messages.
+func (r *Room) replayHistory(p *Peer) bool {
+	n := r.Opts.ReplayMessages
+	if !r.Capabilities().Replay {
+		return false
+	}
+
+	t := time.Now()
+	msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	r.storeLat.observe("get_message_cache", t)
+	if err != nil {
+		r.hub.log.Printf("error fetching message cache in %s: %v", r.ID, err)
+		return true
+	}
+
+	r.ApplyPolls(msgs)
+	HidePeerIDs(msgs)
+	if len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+	if len(msgs) > 0 {
+		p.SendData(r.makePayload(payloadMsgReplay{Messages: msgs}, TypeHistoryReplay))
+	}
+	return true
+}
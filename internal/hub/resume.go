@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Peers in rooms with history are sent a resume token when they join
+// (session.resume). If the connection drops, the client can reconnect with
+// the token and the sequence number of the last message it received within
+// the resume TTL to be sent the messages it missed from the room's message
+// cache instead of the usual replay. Tokens are single use and a new one is
+// issued on every connection.
+const TypeSessionResume = "session.resume"
+
+const resumeTokenLen = 32
+
+// resume is a resume token issued to a peer's connection.
+type resume struct {
+	sessID string
+
+	// Time after which the token can't be used. It's zero while the peer
+	// the token was issued to is connected.
+	expires time.Time
+}
+
+type payloadMsgResume struct {
+	Token string `json:"token"`
+
+	// Seconds after disconnecting for which the token is valid.
+	TTL int `json:"ttl"`
+}
+
+// issueResume issues a new resume token to a peer that has joined. It should
+// only be invoked from the room's event loop.
+func (r *Room) issueResume(p *Peer) {
+	if !r.Capabilities().Resume {
+		return
+	}
+
+	tok, err := GenerateGUID(resumeTokenLen)
+	if err != nil {
+		r.hub.log.Printf("error generating resume token: %v", err)
+		return
+	}
+	if r.resumes == nil {
+		r.resumes = make(map[string]*resume)
+	}
+	r.resumes[tok] = &resume{sessID: p.ID}
+	p.resumeToken = tok
+
+	p.SendData(r.makePayload(payloadMsgResume{
+		Token: tok,
+		TTL:   int(r.hub.cfg.ResumeTTL.Seconds()),
+	}, TypeSessionResume))
+}
+
+// expireResume starts the TTL of the resume token of a peer that has left.
+// It should only be invoked from the room's event loop.
+func (r *Room) expireResume(p *Peer) {
+	if rs, ok := r.resumes[p.resumeToken]; ok {
+		rs.expires = time.Now().Add(r.hub.cfg.ResumeTTL)
+	}
+}
+
+// pruneResumes removes the resume tokens that have expired. It should only
+// be invoked from the room's event loop.
+func (r *Room) pruneResumes() {
+	now := time.Now()
+	for tok, rs := range r.resumes {
+		if !rs.expires.IsZero() && now.After(rs.expires) {
+			delete(r.resumes, tok)
+		}
+	}
+}
+
+// resumeHistory sends a peer that has reconnected with a valid resume token
+// the cached messages after the last one it received. It returns false if
+// the peer didn't resume, in which case the history is replayed as usual.
+// It should only be invoked from the room's event loop.
+func (r *Room) resumeHistory(p *Peer) bool {
+	if p.resumeFrom == "" || !r.Capabilities().Resume {
+		return false
+	}
+
+	rs, ok := r.resumes[p.resumeFrom]
+	if !ok || rs.sessID != p.ID || rs.expires.IsZero() || time.Now().After(rs.expires) {
+		return false
+	}
+	delete(r.resumes, p.resumeFrom)
+
+	t := time.Now()
+	msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	r.storeLat.observe("get_message_cache", t)
+	if err != nil {
+		r.hub.log.Printf("error fetching message cache in %s: %v", r.ID, err)
+		return true
+	}
+
+	r.ApplyPolls(msgs)
+	HidePeerIDs(msgs)
+	missed := make([]store.Message, 0)
+	for _, m := range msgs {
+		if m.Seq > p.resumeSeq {
+			missed = append(missed, m)
+		}
+	}
+	if len(missed) > 0 {
+		p.SendData(r.makePayload(payloadMsgReplay{Messages: missed, Resumed: true}, TypeHistoryReplay))
+	}
+	return true
+}
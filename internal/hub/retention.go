@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/lock"
+)
+
+// Rooms can disable logging (no_logging), in which case their messages are
+// never written to the message cache, or cap the retention of their history
+// to a number of hours. Messages older than the retention are pruned from
+// the cache periodically while the room is active.
+
+// Maximum retention of a room's history in hours.
+const maxRetentionHours = 24 * 365
+
+// Interval at which rooms with a retention prune their history.
+const pruneInterval = time.Minute
+
+// Lease of the lock held while a room's history is rewritten.
+const historyLockTTL = time.Minute
+
+// ErrInvalidRetention indicates that a room's retention is out of range.
+var ErrInvalidRetention = errors.New("retention_hours should be 0 - 8760")
+
+// ValidRetention checks if a room's history retention in hours is valid.
+// 0 retains the history for the room's lifetime.
+func ValidRetention(hours int) bool {
+	return hours >= 0 && hours <= maxRetentionHours
+}
+
+// logging returns true if the room's messages are written to the message
+// cache.
+func (r *Room) logging() bool {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.hub.MsgCache != nil && !r.Opts.Kiosk && !r.Opts.NoLogging
+}
+
+// pruneHistory removes messages older than the room's retention from the
+// message cache. It blocks posting messages, so it shouldn't be invoked from
+// the room's event loop.
+func (r *Room) pruneHistory() {
+	if !atomic.CompareAndSwapInt32(&r.pruning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&r.pruning, 0)
+
+	r.mut.RLock()
+	hours := r.Opts.RetentionHours
+	r.mut.RUnlock()
+	if hours == 0 || !r.logging() {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	// Another instance sharing the store may be pruning the room.
+	ls, err := r.lockHistory()
+	if err != nil {
+		if err != lock.ErrLocked {
+			r.hub.log.Printf("error pruning history in %s: %v", r.ID, err)
+		}
+		return
+	}
+	defer ls.Release()
+
+	// Block messages from being written while the history is rewritten.
+	r.postMut.Lock()
+	defer r.postMut.Unlock()
+	r.chainMut.Lock()
+	defer r.chainMut.Unlock()
+
+	t := time.Now()
+	msgs, err := r.hub.MsgCache.GetMessageCache(r.ID)
+	r.storeLat.observe("get_message_cache", t)
+	if err != nil {
+		r.hub.log.Printf("error pruning history in %s: %v", r.ID, err)
+		return
+	}
+
+	// Delayed and imported messages may be older than the ones cached
+	// before them, so messages are picked by their timestamps and not
+	// their positions.
+	keep := make([]store.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if !m.Timestamp.Before(cutoff) {
+			keep = append(keep, m)
+		}
+	}
+	if len(keep) == len(msgs) {
+		return
+	}
+	if err := r.rewriteHistory(msgs, keep); err != nil {
+		r.hub.log.Printf("error pruning history in %s: %v", r.ID, err)
+	}
+}
+
+// lockHistory acquires the lock on rewriting the room's history.
+func (r *Room) lockHistory() (*lock.Lease, error) {
+	return lock.Acquire(r.hub.Locker, "history:"+r.ID, historyLockTTL)
+}
+
+// rewriteHistory replaces the room's history (all) with the messages in it
+// to keep.
+//
+// With the hash chain, the kept messages retain their hashes so that
+// tampering with them remains detectable. Messages removed from the start
+// of the history move the chain's anchor to the hash of the last one
+// removed. Messages removed after the first one kept leave gaps, so the kept
+// messages are rechained, but only if the chain verifies so that rechaining
+// doesn't cover up tampering. The caller should hold postMut, chainMut and
+// the history lock.
+func (r *Room) rewriteHistory(all, keep []store.Message) error {
+	var (
+		anchor = r.ChainAnchor()
+		last   = anchor
+	)
+	if r.hub.cfg.HistoryHashChain {
+		switch {
+		case len(keep) > 0:
+			anchor = keep[0].PrevHash
+		case len(all) > 0:
+			anchor = all[len(all)-1].Hash
+		}
+
+		last = anchor
+		if len(keep) > 0 {
+			last = keep[len(keep)-1].Hash
+		}
+		if !linked(anchor, keep) {
+			if res := VerifyChain(r.ChainAnchor(), all); res.Valid {
+				last = rechain(anchor, keep)
+			} else {
+				r.hub.log.Printf("not rechaining history of %s as its hash chain is broken at %s", r.ID, res.BrokenAt)
+			}
+		}
+	}
+
+	if err := r.hub.MsgCache.ClearMessageCache(r.ID); err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		if err := r.hub.MsgCache.AddMessageCacheBatch(r.ID, keep, r.TTL()); err != nil {
+			r.chainLoaded = false
+			return err
+		}
+	}
+	r.lastHash = last
+	r.chainLoaded = true
+	return r.setChainAnchor(anchor)
+}
@@ -1,28 +1,81 @@
 package hub
 
 import (
-	"encoding/json"
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/internal/tracing"
+	"github.com/knadh/niltalk/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// payloadMsgWrap is the envelope of payloads. See ProtocolVersion.
 type payloadMsgWrap struct {
-	Type      string      `json:"type"`
-	Timestamp time.Time   `json:"timestamp"`
-	Data      interface{} `json:"data"`
+	V    int             `json:"v"`
+	Type string          `json:"type"`
+	ID   uint64          `json:"id"`
+	TS   int64           `json:"ts"`
+	Peer *payloadMsgPeer `json:"peer,omitempty"`
+	Data interface{}     `json:"data"`
+
+	// Optional ID a client assigns to a message it sends.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Optional seconds after which a message a client sends is removed.
+	Burn int `json:"burn,omitempty"`
+
+	// Version 1 timestamp.
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type payloadMsgPeer struct {
-	ID     string `json:"id"`
-	Handle string `json:"handle"`
+	ID       string       `json:"id"`
+	Handle   string       `json:"handle"`
+	Operator bool         `json:"operator,omitempty"`
+	Quality  *PeerQuality `json:"quality,omitempty"`
+}
+
+type payloadMsgPeerInfo struct {
+	payloadMsgPeer
+	Features []string `json:"features"`
+
+	// The peer can't post in the read-only room.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// The peer is the room's owner.
+	Owner bool `json:"owner,omitempty"`
 }
 
 type payloadMsgChat struct {
-	PeerID     string `json:"peer_id"`
-	PeerHandle string `json:"peer_handle"`
-	Msg        string `json:"message"`
+	PeerID       string `json:"peer_id"`
+	PeerHandle   string `json:"peer_handle"`
+	PeerOperator bool   `json:"peer_operator,omitempty"`
+	Msg          string `json:"message"`
+	Seq          uint64 `json:"seq"`
+
+	// Echo of the ID the sender assigned to the message.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Time a message queued by an offline client was composed at.
+	Delayed bool       `json:"delayed,omitempty"`
+	SentAt  *time.Time `json:"sent_at,omitempty"`
+
+	// Seconds after which clients remove the message.
+	Burn int `json:"burn,omitempty"`
+
+	// Handles mentioned (@handle) in the message.
+	Mentions []string `json:"mentions,omitempty"`
+}
+
+// cachedPayload is a message payload cached for replaying to new peers.
+type cachedPayload struct {
+	data *payload
+	ts   time.Time
 }
 
 // peerReq represents a peer request (join, leave etc.) that's processed
@@ -30,67 +83,183 @@ type payloadMsgChat struct {
 type peerReq struct {
 	reqType string
 	peer    *Peer
+
+	// Optional data of the request.
+	data interface{}
 }
 
 // Room represents a chat room.
 type Room struct {
 	ID       string
-	Name     string
+	name     string
 	Password []byte
+	Opts     store.RoomOpts
 	hub      *Hub
 	mut      *sync.RWMutex
 
+	// Last activity in the room and the inactivity expiry warnings sent
+	// since.
 	lastActivity time.Time
+	expiryWarned []bool
+
+	// Optional features enabled for the room at the time of activation.
+	features map[string]bool
 
 	// List of connected peers.
 	peers map[*Peer]bool
 
+	// Number of connected peers by (lowercased) handle for checking
+	// uniqueness outside the room's event loop. Guarded by mut.
+	handles map[string]int
+
+	// Number of connected peers that's safe to read outside the room's
+	// event loop.
+	numPeers int32
+
+	// ID of the last payload prepared for the room.
+	payloadID uint64
+
 	// Broadcast channel for messages.
-	broadcastQ chan []byte
+	broadcastQ chan *payload
 
 	// Peer related requests.
 	peerQ chan peerReq
 
+	// Names for the room derived from its first message or looked up.
+	titleQ chan string
+
 	// Dispose signal.
 	disposeSig chan bool
 	closed     bool
 
+	// Server shutdown signal.
+	shutdownSig chan bool
+
+	// Closed when the event loop exits, after which there's nothing to
+	// receive the signals above.
+	done chan bool
+
+	// Peer list requests from outside the room's event loop.
+	peersQ chan chan []PeerInfo
+
+	// Connection list requests from outside the room's event loop.
+	connsQ chan chan []PeerConn
+
+	// Sequence number of the last chat message and the lock for posting
+	// messages in order. Guarded by postMut.
+	msgSeq    uint64
+	seqLoaded bool
+	postMut   sync.Mutex
+
+	// Sequence numbers of recent messages by client message ID and the
+	// order of the IDs. Guarded by postMut.
+	clientIDs     map[string]uint64
+	clientIDOrder []string
+
+	// Debug snapshot requests and the data for them.
+	debugQ   chan chan debugSnapshot
+	events   []DebugEvent
+	seq      uint64
+	storeLat *storeLatencies
+
 	// Message / payload cache.
-	payloadCache [][]byte
+	payloadCache []cachedPayload
+
+	// File transfers brokered between peers by ID. Only accessed from the
+	// room's event loop.
+	transfers map[string]*transfer
+
+	// WebRTC calls relayed between peers by ID. Only accessed from the
+	// room's event loop.
+	calls map[string]*call
+
+	// Resume tokens issued to peers' connections. Only accessed from the
+	// room's event loop.
+	resumes map[string]*resume
+
+	// Handles that have been sent the welcome messages. Only accessed from
+	// the room's event loop.
+	welcomed map[string]bool
+
+	// Peers waiting for a slot in a full room in the order they joined. Only
+	// accessed from the room's event loop.
+	queue []*Peer
+
+	// Open polls by ID. Guarded by pollMut.
+	polls   map[uint64]*poll
+	pollMut sync.Mutex
+
+	// History is being pruned (1).
+	pruning int32
+
+	// Recent activity of handles for spam heuristics. Guarded by spamMut.
+	spam    map[string]*spamState
+	spamMut sync.Mutex
+
+	// Counter for numbering anonymous handles in kiosk mode.
+	numGuests int32
+
+	// Hash chain of messages written to the message cache. chainMut also
+	// serializes writes to the cache with imports that rewrite it.
+	chainMut    sync.Mutex
+	chainLoaded bool
+	lastHash    string
 
 	timestamp time.Time
 }
 
 // NewRoom returns a new instance of Room.
-func NewRoom(id, name string, password []byte, h *Hub) *Room {
+func NewRoom(id, name string, password []byte, opts store.RoomOpts, h *Hub) *Room {
 	return &Room{
 		ID:           id,
-		Name:         name,
+		name:         name,
+		mut:          &sync.RWMutex{},
 		Password:     password,
+		Opts:         opts,
 		hub:          h,
 		peers:        make(map[*Peer]bool, 100),
-		broadcastQ:   make(chan []byte, 100),
+		handles:      make(map[string]int),
+		lastActivity: time.Now(),
+		expiryWarned: make([]bool, len(h.cfg.RoomExpiryWarnings)),
+		broadcastQ:   make(chan *payload, 100),
 		peerQ:        make(chan peerReq, 100),
+		titleQ:       make(chan string),
 		disposeSig:   make(chan bool),
-		payloadCache: make([][]byte, 0, h.cfg.MaxCachedMessages),
+		shutdownSig:  make(chan bool),
+		done:         make(chan bool),
+		peersQ:       make(chan chan []PeerInfo),
+		connsQ:       make(chan chan []PeerConn),
+		debugQ:       make(chan chan debugSnapshot),
+		storeLat:     &storeLatencies{ops: make(map[string]StoreLatency)},
+		payloadCache: make([]cachedPayload, 0, h.cfg.MaxCachedMessages),
+		features:     h.roomFeatures(id, opts.Tenant),
+		polls:        make(map[uint64]*poll),
 	}
 }
 
 // AddPeer adds a new peer to the room given a WS connection from an HTTP
 // handler.
-func (r *Room) AddPeer(id, handle string, ws *websocket.Conn) {
-	r.queuePeerReq(TypePeerJoin, newPeer(id, handle, ws, r))
+func (r *Room) AddPeer(id, handle string, opts ConnOpts, ws *websocket.Conn) {
+	r.queuePeerReq(TypePeerJoin, newPeer(id, handle, opts, ws, r))
 }
 
 // Dispose signals the room to notify all connected peer messages, and dispose
-// of itself.
+// of itself. It's a no-op if the room's event loop has already exited, eg:
+// if the room was disposed of concurrently.
 func (r *Room) Dispose() {
-	r.disposeSig <- true
+	select {
+	case r.disposeSig <- true:
+	case <-r.done:
+	}
 }
 
 // Broadcast broadcasts a message to all connected peers.
-func (r *Room) Broadcast(data []byte, record bool) {
-	r.broadcastQ <- data
+func (r *Room) Broadcast(data *payload, record bool) {
+	select {
+	case r.broadcastQ <- data:
+	case <-r.done:
+		return
+	}
 	if record {
 		r.recordMsgPayload(data)
 	}
@@ -100,6 +269,21 @@ func (r *Room) Broadcast(data []byte, record bool) {
 // handles peer connection events and message broadcasts. This should be invoked
 // as a goroutine.
 func (r *Room) run() {
+	defer close(r.done)
+	closeReason := TypeRoomDispose
+
+	// Heartbeats are disabled if the interval is 0.
+	var beat <-chan time.Time
+	if r.hub.cfg.PeerHeartbeat > 0 {
+		t := time.NewTicker(r.hub.cfg.PeerHeartbeat)
+		defer t.Stop()
+		beat = t.C
+	}
+
+	// Prune the history of rooms with a retention.
+	go r.pruneHistory()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
 loop:
 	for {
 		select {
@@ -108,61 +292,112 @@ loop:
 			r.hub.Store.ClearSessions(r.ID)
 			break loop
 
-		// Incoming peer request.
-		case req, ok := <-r.peerQ:
-			if !ok {
-				break loop
-			}
+		// Server is shutting down. Disconnect peers but retain the room.
+		case <-r.shutdownSig:
+			r.shutdown()
+			return
 
+		// Incoming peer request.
+		case req := <-r.peerQ:
+			r.touch()
+			r.recordEvent(req.reqType, req.peer, 0)
 			switch req.reqType {
 			// A new peer has joined.
 			case TypePeerJoin:
-				// Room's capacity is exchausted. Kick the peer out.
-				if len(r.peers) >= r.hub.cfg.MaxPeersPerRoom {
+				// Room's or the instance's capacity is exchausted. Peers
+				// wait in the room's queue if there's room in it, or are
+				// kicked out. Peers that join when others are already
+				// waiting join the queue. Operators are always admitted.
+				r.admitQueued()
+				full := !req.peer.Operator && (len(r.queue) > 0 || !r.hasCapacity())
+				if full && len(r.queue) >= r.hub.cfg.RoomQueueSize {
 					r.hub.Store.RemoveSession(req.peer.ID, r.ID)
 					req.peer.writeWSControl(websocket.CloseMessage,
 						websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomFull))
 					req.peer.ws.Close()
 					continue
 				}
-
-				r.peers[req.peer] = true
-				go req.peer.RunListener()
-				go req.peer.RunWriter()
-
-				// Send the peer its info.
-				req.peer.SendData(r.makePeerUpdatePayload(req.peer, TypePeerInfo))
-
-				// Send the peer last N message.
-				if r.hub.cfg.MaxCachedMessages > 0 {
-					for _, b := range r.payloadCache {
-						req.peer.SendData(b)
-					}
+				if r.checkJoinSpam(req.peer) {
+					continue
 				}
 
-				// Notify all peers of the new addition.
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerJoin), true)
-				r.hub.log.Printf("%s@%s joined %s", req.peer.Handle, req.peer.ID, r.ID)
+				// Queued peers are marked as such before their listener
+				// starts so that their messages aren't handled.
+				if full {
+					r.enqueuePeer(req.peer)
+					go req.peer.RunListener()
+					continue
+				}
+				go req.peer.RunListener()
+				r.joinPeer(req.peer)
 
 			// A peer has left.
 			case TypePeerLeave:
+				// Peers waiting in the queue leave quietly.
+				if r.dequeuePeer(req.peer) {
+					continue
+				}
+
 				r.removePeer(req.peer)
-				r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
+				r.cancelPeerTransfers(req.peer)
+				r.hangupPeerCalls(req.peer)
+				r.expireResume(req.peer)
+
+				// Admit waiting peers before the departure is broadcast so
+				// that they receive it once, live, and not also in the
+				// replay of the cached messages.
+				r.admitQueued()
+				if r.numHandleConns(req.peer.Handle) == 0 && !r.isMuted(req.peer.Handle) {
+					r.Broadcast(r.makePeerUpdatePayload(req.peer, TypePeerLeave), true)
+					r.broadcastSystem(SystemPeerLeave, r.systemPeerMsg(SystemPeerLeave, req.peer), req.peer)
+				}
+				if req.peer.Operator {
+					r.operatorLeft(req.peer)
+				}
 				r.hub.log.Printf("%s@%s left %s", req.peer.Handle, req.peer.ID, r.ID)
 
 			// A peer has requested the room's peer list.
 			case TypePeerList:
 				req.peer.SendData(r.makePeerListPayload())
+
+			// A session has been revoked.
+			case typeRevokeSession:
+				r.revokeSession(req.peer.ID)
+
+			// A session has been detected as spamming.
+			case typeKickSpammer:
+				r.kickSpammer(req.peer)
+
+			// A peer has been banned.
+			case typeBanPeer:
+				r.banPeer(req.peer)
+
+			// File transfer negotiation between peers.
+			case TypeTransferOffer, TypeTransferAccept, TypeTransferReject,
+				TypeTransferSignal, TypeTransferCancel:
+				r.handleTransfer(req.reqType, req.peer, req.data.(transferReq))
+
+			// WebRTC call signaling between peers.
+			case TypeCallOffer, TypeCallAnswer, TypeCallICE, TypeCallHangup:
+				r.handleCall(req.reqType, req.peer, req.data.(callReq))
+
+			// A message mentions peers.
+			case TypeMention:
+				r.sendMentions(req.peer, req.data.(mentionReq))
 			}
 
 		// Fanout broadcast to all peers.
-		case m, ok := <-r.broadcastQ:
-			if !ok {
-				break loop
-			}
-			for p := range r.peers {
-				p.SendData(m)
-			}
+		case m := <-r.broadcastQ:
+			r.touch()
+			atomic.AddUint64(&r.seq, 1)
+			r.recordEvent("broadcast", nil, m.size())
+			_, span := tracing.Tracer.Start(context.Background(), "room.fanout",
+				trace.WithAttributes(
+					attribute.String("room.id", r.ID),
+					attribute.Int("peers", len(r.peers)),
+				))
+			r.fanout(m)
+			span.End()
 
 			// Extend the room's expiry (once every 30 seconds).
 			if time.Since(r.timestamp) > time.Duration(30)*time.Second {
@@ -170,42 +405,90 @@ loop:
 				r.extendTTL()
 			}
 
-		// Kill the room after the inactivity period.
-		case <-time.After(r.hub.cfg.RoomAge):
-			break loop
+		// Ping peers and broadcast changes in their connection quality.
+		case <-beat:
+			r.heartbeat()
+			r.admitQueued()
+
+		// Remove messages older than the room's retention.
+		case <-prune.C:
+			go r.pruneHistory()
+			r.pruneResumes()
+
+		// Name for an unnamed room.
+		case name := <-r.titleQ:
+			r.setTitle(name)
+
+		// Peer list request.
+		case ch := <-r.peersQ:
+			ch <- r.peerList()
+
+		// Connection list request.
+		case ch := <-r.connsQ:
+			ch <- r.connList()
+
+		// Debug snapshot request.
+		case ch := <-r.debugQ:
+			ch <- r.makeDebug()
+
+		// Warn peers and kill the room after the inactivity period.
+		case <-time.After(r.nextExpiryCheck()):
+			// Idle persistent rooms are unloaded from the hub.
+			if r.Opts.Persistent {
+				if len(r.peers) == 0 {
+					r.closePolls()
+					r.closed = true
+					r.hub.unloadRoom(r.ID)
+					r.hub.log.Printf("unloaded persistent room: %v", r.ID)
+					return
+				}
+				r.touch()
+				continue
+			}
+
+			if r.checkExpiry() {
+				closeReason = TypeRoomClosed
+				break loop
+			}
 		}
 	}
 
 	r.hub.log.Printf("stopped room: %v", r.ID)
-	r.remove()
+	r.remove(closeReason)
 }
 
 // extendTTL extends a room's TTL in the store.
 func (r *Room) extendTTL() {
-	r.hub.Store.ExtendRoomTTL(r.ID, r.hub.cfg.RoomAge)
+	t := time.Now()
+	r.hub.Store.ExtendRoomTTL(r.ID, r.TTL())
+	r.storeLat.observe("extend_ttl", t)
 }
 
-// remove disposes a room by notifying and disconnecting all peers and
-// removing the room from the store.
-func (r *Room) remove() {
+// remove disposes a room by notifying and disconnecting all peers with the
+// given reason and removing the room from the store.
+func (r *Room) remove(reason string) {
 	r.closed = true
 
 	// Close all peer WS connections.
 	for peer := range r.peers {
 		peer.writeWSControl(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomDispose))
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
 		delete(r.peers, peer)
 	}
+	for _, peer := range r.queue {
+		peer.writeWSControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	}
+	r.queue = nil
 
-	// Close all room channels.
-	close(r.broadcastQ)
-	close(r.peerQ)
+	// The history is cleared with the room.
+	r.archive(reason)
 	r.hub.removeRoom(r.ID)
 }
 
 // recordMsgPayload records message payloads (events) sent out. It maintains last
 // N messages to be sent to new users when they join.
-func (r *Room) recordMsgPayload(b []byte) {
+func (r *Room) recordMsgPayload(b *payload) {
 	if r.hub.cfg.MaxCachedMessages == 0 {
 		return
 	}
@@ -215,65 +498,256 @@ func (r *Room) recordMsgPayload(b []byte) {
 		r.payloadCache = r.payloadCache[1:]
 	}
 
-	r.payloadCache = append(r.payloadCache, b)
+	r.payloadCache = append(r.payloadCache, cachedPayload{data: b, ts: time.Now()})
+}
+
+// cacheMessage persists a chat or system message (typ) in the message cache
+// if history is enabled. p and seq are optional for system messages.
+func (r *Room) cacheMessage(typ, msg string, p *Peer, seq uint64) {
+	r.cacheMessageAt(typ, msg, p, seq, nil, nil)
+}
+
+// cacheMessageAt persists a message like cacheMessage. sentAt is the time a
+// delayed message was composed at and is nil for other messages. mentions
+// are the handles mentioned in the message.
+func (r *Room) cacheMessageAt(typ, msg string, p *Peer, seq uint64, sentAt *time.Time, mentions []string) {
+	// Kiosk and no logging rooms are never logged.
+	if !r.logging() {
+		return
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating message ID: %v", err)
+		return
+	}
+
+	m := store.Message{
+		ID:        id,
+		Type:      typ,
+		Message:   msg,
+		Seq:       seq,
+		Timestamp: time.Now(),
+		Delayed:   sentAt != nil,
+		SentAt:    sentAt,
+		Mentions:  mentions,
+	}
+	if p != nil {
+		m.PeerID = p.Key
+		m.PeerHandle = p.Handle
+	}
+	r.writeCachedMessage(m)
+}
+
+// writeCachedMessage chains and writes a message to the message cache.
+func (r *Room) writeCachedMessage(m store.Message) {
+	// Messages are chained and written in order.
+	r.chainMut.Lock()
+	defer r.chainMut.Unlock()
+	if r.hub.cfg.HistoryHashChain {
+		if err := r.chainMessage(&m); err != nil {
+			r.hub.log.Printf("error chaining message in %s: %v", r.ID, err)
+			return
+		}
+	}
+
+	t := time.Now()
+	if err := r.hub.MsgCache.AddMessageCache(r.ID, m, r.TTL()); err != nil {
+		r.hub.log.Printf("error caching message in %s: %v", r.ID, err)
+	}
+	r.storeLat.observe("add_message_cache", t)
 }
 
 // queuePeerReq queues a peer addition / removal request to the room.
 func (r *Room) queuePeerReq(reqType string, p *Peer) {
-	if r.closed {
-		return
+	r.queueReq(peerReq{reqType: reqType, peer: p})
+}
+
+// exited checks if the room's event loop has exited.
+func (r *Room) exited() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueReq queues a request to the room's event loop. It's dropped if the
+// loop has exited.
+func (r *Room) queueReq(req peerReq) {
+	select {
+	case r.peerQ <- req:
+	case <-r.done:
 	}
-	p.room.peerQ <- peerReq{reqType: reqType, peer: p}
+}
+
+// joinPeer adds a peer to the room, sends it the room's state, and announces
+// it to the room.
+func (r *Room) joinPeer(p *Peer) {
+	// Peers may have waited in the queue without being pinged.
+	atomic.StoreInt64(&p.lastPong, time.Now().UnixNano())
+	p.touchActive()
+
+	r.peers[p] = true
+	r.trackHandle(p.Handle, 1)
+	atomic.StoreInt32(&r.numPeers, int32(len(r.peers)))
+
+	// Send the peer the negotiated protocol and its info.
+	p.SendData(r.makeProtocolPayload(p))
+	p.SendData(r.makePeerInfoPayload(p))
+
+	// Prompt clients older than the minimum version to reload.
+	if r.hub.IsClientOutdated(p.ClientVersion) {
+		p.SendData(r.makeOutdatedPayload())
+	}
+
+	// Send a resuming peer the messages it missed, or the last N messages
+	// from the room's history if it's configured, or from the events cached
+	// in memory. Kiosk rooms only replay recent messages.
+	if !r.resumeHistory(p) && !r.replayHistory(p) && r.hub.cfg.MaxCachedMessages > 0 {
+		for _, c := range r.payloadCache {
+			if r.Opts.Kiosk && time.Since(c.ts) > r.hub.cfg.KioskMessageTTL {
+				continue
+			}
+			p.SendData(c.data)
+		}
+	}
+	r.sendPollTallies(p)
+	r.issueResume(p)
+
+	// Notify all peers of the new addition. Additional connections (devices)
+	// of a handle and muted handles aren't announced.
+	r.sendWelcome(p)
+	if r.numHandleConns(p.Handle) == 1 && !r.isMuted(p.Handle) {
+		r.Broadcast(r.makePeerUpdatePayload(p, TypePeerJoin), true)
+		r.broadcastSystem(SystemPeerJoin, r.systemPeerMsg(SystemPeerJoin, p), p)
+		r.notify(notify.EventPeerJoin, p, "")
+	}
+	if p.Operator {
+		r.operatorJoined(p)
+	}
+	r.hub.log.Printf("%s@%s joined %s", p.Handle, p.ID, r.ID)
 }
 
 // removePeer removes a peer from the room and broadcasts a message to the
 // room notifying all peers of the action.
 func (r *Room) removePeer(p *Peer) {
-	close(p.dataQ)
+	p.SendData(closePayload)
 	delete(r.peers, p)
+	r.trackHandle(p.Handle, -1)
+	atomic.StoreInt32(&r.numPeers, int32(len(r.peers)))
+}
+
+// NumPeers returns the number of peers connected to the room.
+func (r *Room) NumPeers() int {
+	return int(atomic.LoadInt32(&r.numPeers))
 }
 
 // sendPeerList sends the peer list to the given peer.
 func (r *Room) sendPeerList(p *Peer) {
-	r.peerQ <- peerReq{reqType: TypePeerList, peer: p}
+	r.queueReq(peerReq{reqType: TypePeerList, peer: p})
 }
 
-// makePeerListPayload prepares a message payload with the list of peers.
-func (r *Room) makePeerListPayload() []byte {
-	peers := make([]payloadMsgPeer, 0, len(r.peers))
+// Peers returns the list of peers connected to the room. It returns nil if
+// the room's event loop doesn't respond within the timeout.
+func (r *Room) Peers(timeout time.Duration) []PeerInfo {
+	ch := make(chan []PeerInfo, 1)
+	select {
+	case r.peersQ <- ch:
+		return <-ch
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// peerList returns the list of connected peers. A handle connected from
+// multiple devices is listed once. It should only be invoked from the room's
+// event loop.
+func (r *Room) peerList() []PeerInfo {
+	var (
+		peers   = make([]PeerInfo, 0, len(r.peers))
+		handles = make(map[string]bool, len(r.peers))
+	)
 	for p := range r.peers {
-		peers = append(peers, payloadMsgPeer{ID: p.ID, Handle: p.Handle})
+		if handles[p.Handle] {
+			continue
+		}
+		handles[p.Handle] = true
+		peers = append(peers, PeerInfo{ID: p.Key, Handle: p.Handle, Operator: p.Operator, Quality: p.quality()})
 	}
-	return r.makePayload(peers, TypePeerList)
+	return peers
+}
+
+// makePeerListPayload prepares a message payload with the list of peers.
+func (r *Room) makePeerListPayload() *payload {
+	return r.makePayload(r.peerList(), TypePeerList)
 }
 
 // makePeerUpdatePayload prepares a message payload representing a peer
 // join / leave event.
-func (r *Room) makePeerUpdatePayload(p *Peer, peerUpdateType string) []byte {
+func (r *Room) makePeerUpdatePayload(p *Peer, peerUpdateType string) *payload {
 	d := payloadMsgPeer{
-		ID:     p.ID,
-		Handle: p.Handle,
+		ID:       p.Key,
+		Handle:   p.Handle,
+		Operator: p.Operator,
+	}
+	return r.makePeerPayload(d, peerUpdateType, p)
+}
+
+// makePeerInfoPayload prepares a message payload with a peer's own info and
+// the optional protocol features enabled for the room.
+func (r *Room) makePeerInfoPayload(p *Peer) *payload {
+	d := payloadMsgPeerInfo{
+		payloadMsgPeer: payloadMsgPeer{ID: p.Key, Handle: p.Handle, Operator: p.Operator},
+		Features:       r.Features(),
+		ReadOnly:       !p.canPost(),
+		Owner:          p.Owner,
 	}
-	return r.makePayload(d, peerUpdateType)
+	return r.makePayload(d, TypePeerInfo)
+}
+
+// makeNoticePayload prepares a notice to a peer.
+func (r *Room) makeNoticePayload(msg string) *payload {
+	return r.makePayload(r.t(msg), TypeNotice)
 }
 
-// makeMessagePayload prepares a chat message.
-func (r *Room) makeMessagePayload(msg string, p *Peer) []byte {
+// makeMessagePayload prepares a chat message. sentAt is the time a delayed
+// message was composed at and is nil for other messages.
+func (r *Room) makeMessagePayload(m NewMessage, p *Peer, seq uint64, sentAt *time.Time) *payload {
 	d := payloadMsgChat{
-		PeerID:     p.ID,
-		PeerHandle: p.Handle,
-		Msg:        msg,
+		PeerID:       p.Key,
+		PeerHandle:   p.Handle,
+		PeerOperator: p.Operator,
+		Msg:          m.Message,
+		Seq:          seq,
+		ClientID:     m.ClientID,
+		Delayed:      sentAt != nil,
+		SentAt:       sentAt,
+		Burn:         m.Burn,
+		Mentions:     parseMentions(m.Message),
 	}
-	return r.makePayload(d, TypeMessage)
+	return r.makePeerPayload(d, TypeMessage, p)
 }
 
 // makePayload prepares a message payload.
-func (r *Room) makePayload(data interface{}, typ string) []byte {
+func (r *Room) makePayload(data interface{}, typ string) *payload {
+	return r.makePeerPayload(data, typ, nil)
+}
+
+// makePeerPayload prepares a message payload from or about a peer.
+func (r *Room) makePeerPayload(data interface{}, typ string, p *Peer) *payload {
+	now := time.Now()
 	m := payloadMsgWrap{
-		Timestamp: time.Now(),
+		V:         ProtocolVersion,
 		Type:      typ,
+		ID:        atomic.AddUint64(&r.payloadID, 1),
+		TS:        now.UnixNano() / int64(time.Millisecond),
 		Data:      data,
+		Timestamp: now,
+	}
+	if p != nil {
+		m.Peer = &payloadMsgPeer{ID: p.Key, Handle: p.Handle, Operator: p.Operator}
 	}
-	b, _ := json.Marshal(m)
-	return b
+	return &payload{msg: m}
 }
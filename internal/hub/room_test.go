@@ -0,0 +1,50 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDisposeAfterExit checks that disposing of a room whose event loop has
+// exited, eg: concurrently, doesn't block.
+func TestDisposeAfterExit(t *testing.T) {
+	r := &Room{disposeSig: make(chan bool), done: make(chan bool)}
+	close(r.done)
+
+	finished := make(chan bool)
+	go func() {
+		r.Dispose()
+		r.Dispose()
+		finished <- true
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Dispose blocked after the room's event loop exited")
+	}
+}
+
+// TestQueueAfterExit checks that broadcasts and requests to a room whose
+// event loop has exited, eg: announcements to a room being removed, are
+// dropped instead of blocking.
+func TestQueueAfterExit(t *testing.T) {
+	r := &Room{broadcastQ: make(chan *payload), peerQ: make(chan peerReq), done: make(chan bool)}
+	close(r.done)
+
+	finished := make(chan bool)
+	go func() {
+		r.Broadcast(&payload{}, false)
+		r.queuePeerReq(TypePeerLeave, &Peer{room: r})
+		finished <- true
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("queueing to the room blocked after its event loop exited")
+	}
+	if !r.exited() {
+		t.Error("expected the room to have exited")
+	}
+}
@@ -0,0 +1,44 @@
+package hub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+var (
+	// ErrInvalidSchedule indicates an invalid schedule for a new room.
+	ErrInvalidSchedule = errors.New("invalid schedule")
+
+	// ErrRoomNotOpen is returned when peers try to join a scheduled room
+	// before it opens.
+	ErrRoomNotOpen = errors.New("the room hasn't opened yet")
+)
+
+// validateSchedule validates the schedule of a new room. Rooms can be
+// scheduled up to app.max_schedule_ahead ahead and can be open for up to
+// app.max_room_age.
+func (h *Hub) validateSchedule(s store.Schedule) error {
+	now := time.Now()
+	switch {
+	case h.cfg.MaxScheduleAhead <= 0:
+		return ErrInvalidSchedule
+	case !s.Opens.After(now) || s.Opens.After(now.Add(h.cfg.MaxScheduleAhead)):
+		return ErrInvalidSchedule
+	case !s.Closes.After(s.Opens) || s.Closes.Sub(s.Opens) > h.cfg.MaxRoomAge:
+		return ErrInvalidSchedule
+	}
+	return nil
+}
+
+// Schedule returns the schedule of a scheduled room and nil for other rooms.
+func (r *Room) Schedule() *store.Schedule {
+	return r.Opts.Schedule
+}
+
+// IsOpen checks if peers can join the room, which is always true for rooms
+// that aren't scheduled.
+func (r *Room) IsOpen() bool {
+	return r.Opts.Schedule == nil || !time.Now().Before(r.Opts.Schedule.Opens)
+}
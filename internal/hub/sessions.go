@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// typeRevokeSession is an internal peer request to disconnect all the
+// connections of a session.
+const typeRevokeSession = "session.revoke"
+
+// sessionKeyLen is the length of a session key.
+const sessionKeyLen = 16
+
+// SessionKey returns a public identifier for a session ID that can be
+// exposed to peers without revealing the session ID itself.
+func SessionKey(sessID string) string {
+	h := sha256.Sum256([]byte(sessID))
+	return hex.EncodeToString(h[:8])
+}
+
+// HidePeerIDs replaces the session IDs that messages cached before peers
+// were identified by their session keys carry with the keys. It should be
+// called on messages before they're sent out.
+func HidePeerIDs(msgs []store.Message) {
+	for i, m := range msgs {
+		if m.PeerID != "" && len(m.PeerID) != sessionKeyLen {
+			msgs[i].PeerID = SessionKey(m.PeerID)
+		}
+	}
+}
+
+// isPeerKey checks whether a cached message's peer ID, which may be the
+// session ID of a message cached before session keys, matches a key.
+func isPeerKey(peerID, key string) bool {
+	if len(peerID) == sessionKeyLen {
+		return peerID == key
+	}
+	return SessionKey(peerID) == key
+}
+
+// RevokeSession disconnects all the connections of a session in the room.
+// The session should be removed from the store before revoking it so that
+// the peer can't reconnect.
+func (r *Room) RevokeSession(sessID string) {
+	r.queuePeerReq(typeRevokeSession, &Peer{ID: sessID, Key: SessionKey(sessID), room: r})
+}
+
+// RevokeSessions removes all the sessions in the room except the given one
+// from the store and disconnects them, eg: after the room's password is
+// changed. It returns the number of sessions revoked.
+func (r *Room) RevokeSessions(except string) (int, error) {
+	ss, err := r.hub.Store.GetSessions(r.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range ss {
+		if s.ID == except {
+			continue
+		}
+		if err := r.hub.Store.RemoveSession(s.ID, r.ID); err != nil {
+			return n, err
+		}
+		r.RevokeSession(s.ID)
+		n++
+	}
+	return n, nil
+}
+
+// revokeSession closes all the peer connections of a session.
+func (r *Room) revokeSession(sessID string) {
+	r.closeSession(sessID, TypeSessionRevoked)
+}
+
+// numHandleConns returns the number of peer connections (devices) of a
+// handle in the room.
+func (r *Room) numHandleConns(handle string) int {
+	n := 0
+	for p := range r.peers {
+		if p.Handle == handle {
+			n++
+		}
+	}
+	return n
+}
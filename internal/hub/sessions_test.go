@@ -0,0 +1,33 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// TestHidePeerIDs checks that the session IDs of messages cached before
+// peers were identified by their session keys aren't sent out.
+func TestHidePeerIDs(t *testing.T) {
+	sessID := "0123456789abcdef0123456789abcdef"
+	key := SessionKey(sessID)
+
+	msgs := []store.Message{
+		{ID: "m1", PeerID: sessID},
+		{ID: "m2", PeerID: key},
+		{ID: "m3"},
+	}
+	HidePeerIDs(msgs)
+	for i, id := range []string{key, key, ""} {
+		if msgs[i].PeerID != id {
+			t.Errorf("%s: expected peer ID %q, got %q", msgs[i].ID, id, msgs[i].PeerID)
+		}
+	}
+
+	if !isPeerKey(sessID, key) || !isPeerKey(key, key) {
+		t.Error("expected legacy and current peer IDs to match the key")
+	}
+	if isPeerKey(sessID, sessID) || isPeerKey(SessionKey("other"), key) {
+		t.Error("expected a session ID or another key not to match")
+	}
+}
@@ -0,0 +1,91 @@
+package hub
+
+// RoomSettings are the settings of a room that its owner can change.
+type RoomSettings struct {
+	// Private messages sent to peers when they first join the room.
+	// They're templates with the variables in welcomeVars.
+	Welcome []string `json:"welcome"`
+
+	// Messages aren't logged or are retained for a number of hours.
+	NoLogging      bool `json:"no_logging"`
+	RetentionHours int  `json:"retention_hours"`
+
+	// Language of the room's pages, system messages, and API errors that
+	// overrides the peers' browser languages.
+	Language string `json:"language"`
+
+	// Only the owner and the speakers (handles) can post in read-only
+	// rooms.
+	ReadOnly bool     `json:"read_only"`
+	Speakers []string `json:"speakers"`
+
+	// Email address the transcript is sent to when the room expires or is
+	// disposed of. Requires SMTP to be configured.
+	TranscriptEmail string `json:"transcript_email"`
+}
+
+// Settings returns the room's settings.
+func (r *Room) Settings() RoomSettings {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return RoomSettings{
+		Welcome:        append([]string{}, r.Opts.Welcome...),
+		NoLogging:      r.Opts.NoLogging,
+		RetentionHours: r.Opts.RetentionHours,
+		Language:       r.Opts.Language,
+		ReadOnly:       r.Opts.ReadOnly,
+		Speakers:       append([]string{}, r.Opts.Speakers...),
+
+		TranscriptEmail: r.Opts.TranscriptEmail,
+	}
+}
+
+// ValidateSettings validates room settings.
+func (h *Hub) ValidateSettings(s RoomSettings) error {
+	if !ValidRetention(s.RetentionHours) {
+		return ErrInvalidRetention
+	}
+	if !h.ValidLanguage(s.Language) {
+		return ErrInvalidLanguage
+	}
+	if err := validateSpeakers(s.Speakers); err != nil {
+		return err
+	}
+	if err := h.validTranscriptEmail(s.TranscriptEmail); err != nil {
+		return err
+	}
+	_, err := h.parseWelcome(s.Welcome)
+	return err
+}
+
+// SetSettings updates the room's settings, which should've been validated
+// with ValidateSettings, and persists them. The history is purged if
+// logging is disabled and pruned if the retention is changed.
+func (r *Room) SetSettings(s RoomSettings) error {
+	r.mut.Lock()
+	purge := s.NoLogging && !r.Opts.NoLogging && r.hub.MsgCache != nil
+	r.Opts.Welcome = s.Welcome
+	r.Opts.NoLogging = s.NoLogging
+	r.Opts.RetentionHours = s.RetentionHours
+	r.Opts.Language = s.Language
+	r.Opts.ReadOnly = s.ReadOnly
+	r.Opts.Speakers = s.Speakers
+	r.Opts.TranscriptEmail = s.TranscriptEmail
+	r.mut.Unlock()
+
+	if err := r.hub.Store.UpdateRoom(r.storeRoom()); err != nil {
+		return err
+	}
+
+	if purge {
+		r.chainMut.Lock()
+		defer r.chainMut.Unlock()
+		if err := r.hub.MsgCache.ClearMessageCache(r.ID); err != nil {
+			return err
+		}
+		r.lastHash = ""
+		return r.setChainAnchor("")
+	}
+	r.pruneHistory()
+	return nil
+}
@@ -0,0 +1,227 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Actions taken on peers detected as spamming.
+const (
+	SpamNone = "none"
+	SpamMute = "mute"
+	SpamKick = "kick"
+)
+
+// Spam heuristics.
+const (
+	spamDuplicates = "duplicates"
+	spamLinks      = "links"
+	spamJoins      = "joins"
+)
+
+// typeKickSpammer is an internal peer request to disconnect a session
+// that's spamming.
+const typeKickSpammer = "spam.kick"
+
+// Maximum number of recent messages of a handle checked for duplicates.
+const maxSpamMessages = 50
+
+var errSpam = errors.New("you've been removed for spamming")
+
+// spamState is a handle's recent activity in a room.
+type spamState struct {
+	msgs       []spamMsg
+	links      []time.Time
+	joins      []time.Time
+	mutedUntil time.Time
+}
+
+type spamMsg struct {
+	msg string
+	ts  time.Time
+}
+
+// spamEnabled checks if spam heuristics apply to a peer. Operators are
+// exempt.
+func (r *Room) spamEnabled(p *Peer) bool {
+	a := r.hub.cfg.SpamAction
+	return a != "" && a != SpamNone && r.hub.cfg.SpamWindow > 0 && !p.Operator
+}
+
+// checkSpam checks a message from a peer against the spam heuristics and
+// returns an error if the peer is muted or has been detected as spamming.
+func (r *Room) checkSpam(p *Peer, msg string) error {
+	if !r.spamEnabled(p) {
+		return nil
+	}
+
+	var (
+		cfg    = r.hub.cfg
+		now    = time.Now()
+		since  = now.Add(-cfg.SpamWindow)
+		reason = ""
+	)
+
+	r.spamMut.Lock()
+	s := r.spamState(p.Handle)
+	if now.Before(s.mutedUntil) {
+		r.spamMut.Unlock()
+		return fmt.Errorf("you've been muted for spamming. Try again in %s",
+			s.mutedUntil.Sub(now).Round(time.Second))
+	}
+
+	// Duplicate messages.
+	n := 0
+	msgs := s.msgs[:0]
+	for _, m := range s.msgs {
+		if m.ts.After(since) {
+			msgs = append(msgs, m)
+			if m.msg == msg {
+				n++
+			}
+		}
+	}
+	if len(msgs) >= maxSpamMessages {
+		msgs = msgs[1:]
+	}
+	s.msgs = append(msgs, spamMsg{msg: msg, ts: now})
+	if cfg.SpamDuplicates > 0 && n+1 >= cfg.SpamDuplicates {
+		reason = spamDuplicates
+	}
+
+	// Link floods.
+	if reLink.MatchString(msg) {
+		s.links = append(trimTimes(s.links, since), now)
+		if cfg.SpamLinks > 0 && len(s.links) >= cfg.SpamLinks {
+			reason = spamLinks
+		}
+	}
+
+	if reason != "" && cfg.SpamAction == SpamMute {
+		s.mutedUntil = now.Add(cfg.SpamMuteDuration)
+	}
+	r.spamMut.Unlock()
+
+	if reason == "" {
+		return nil
+	}
+	r.punishSpammer(p, reason)
+	if cfg.SpamAction == SpamMute {
+		return fmt.Errorf("you've been muted for spamming for %s", cfg.SpamMuteDuration)
+	}
+	return errSpam
+}
+
+// checkJoinSpam records a peer joining the room and mutes or kicks it if
+// its handle is flapping (joining and leaving repeatedly). It returns true
+// if the peer was kicked. It should only be invoked from the room's event
+// loop before the peer is added to the room.
+func (r *Room) checkJoinSpam(p *Peer) bool {
+	cfg := r.hub.cfg
+	if !r.spamEnabled(p) || cfg.SpamJoins <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	r.spamMut.Lock()
+	s := r.spamState(p.Handle)
+	s.joins = append(trimTimes(s.joins, now.Add(-cfg.SpamWindow)), now)
+	spam := len(s.joins) >= cfg.SpamJoins
+	if spam {
+		s.joins = nil
+		if cfg.SpamAction == SpamMute {
+			s.mutedUntil = now.Add(cfg.SpamMuteDuration)
+		}
+	}
+	r.spamMut.Unlock()
+	if !spam {
+		return false
+	}
+
+	r.hub.Audit.Record("peer."+cfg.SpamAction, "", r.ID, map[string]interface{}{
+		"handle": p.Handle,
+		"reason": "spam." + spamJoins,
+	})
+	if cfg.SpamAction == SpamMute {
+		return false
+	}
+
+	r.hub.Store.RemoveSession(p.ID, r.ID)
+	p.writeWSControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerSpam))
+	p.ws.Close()
+	return true
+}
+
+// isMuted checks if a handle is muted. The joins and leaves of muted
+// handles aren't announced.
+func (r *Room) isMuted(handle string) bool {
+	r.spamMut.Lock()
+	defer r.spamMut.Unlock()
+	s, ok := r.spam[handle]
+	return ok && time.Now().Before(s.mutedUntil)
+}
+
+// punishSpammer mutes or kicks a peer detected as spamming as per the
+// spam action.
+func (r *Room) punishSpammer(p *Peer, reason string) {
+	action := r.hub.cfg.SpamAction
+	r.hub.Audit.Record("peer."+action, "", r.ID, map[string]interface{}{
+		"handle": p.Handle,
+		"reason": "spam." + reason,
+	})
+
+	if action == SpamMute {
+		r.broadcastSystem(SystemPeerMuted, r.systemPeerMsg(SystemPeerMuted, p), p)
+		return
+	}
+
+	r.hub.Store.RemoveSession(p.ID, r.ID)
+	r.queuePeerReq(typeKickSpammer, &Peer{ID: p.ID, Key: p.Key, Handle: p.Handle, room: r})
+}
+
+// kickSpammer disconnects the connections of a session that's been detected
+// as spamming. It should only be invoked from the room's event loop.
+func (r *Room) kickSpammer(p *Peer) {
+	r.closeSession(p.ID, TypePeerSpam)
+	r.broadcastSystem(SystemPeerSpam, r.systemPeerMsg(SystemPeerSpam, p), p)
+}
+
+// spamState returns the spam state of a handle. spamMut should be held.
+func (r *Room) spamState(handle string) *spamState {
+	if r.spam == nil {
+		r.spam = make(map[string]*spamState)
+	}
+	s, ok := r.spam[handle]
+	if !ok {
+		s = &spamState{}
+		r.spam[handle] = s
+	}
+	return s
+}
+
+// closeSession closes all the peer connections of a session with the given
+// reason. It should only be invoked from the room's event loop.
+func (r *Room) closeSession(sessID, reason string) {
+	for p := range r.peers {
+		if p.ID != sessID {
+			continue
+		}
+		p.writeWSControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+		p.ws.Close()
+	}
+}
+
+// trimTimes removes the times before since from a list of times in
+// ascending order.
+func trimTimes(ts []time.Time, since time.Time) []time.Time {
+	n := 0
+	for n < len(ts) && !ts[n].After(since) {
+		n++
+	}
+	return append(ts[:0], ts[n:]...)
+}
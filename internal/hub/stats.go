@@ -0,0 +1,95 @@
+package hub
+
+import (
+	"sort"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Number of most active handles in a room's stats.
+const maxStatsHandles = 10
+
+// RoomStats represents the activity in a room computed from its history.
+type RoomStats struct {
+	// Number of chat messages.
+	Messages int `json:"messages"`
+
+	// Number of chat messages by hour, in order, for the hours that have
+	// any.
+	Hourly []HourlyCount `json:"hourly"`
+
+	// Highest number of handles that were in the room at a time and when.
+	PeakPeers int        `json:"peak_peers"`
+	PeakAt    *time.Time `json:"peak_at,omitempty"`
+
+	// Handles that posted the most messages.
+	TopHandles []HandleCount `json:"top_handles"`
+}
+
+// HourlyCount is the number of messages posted in the hour starting at Hour.
+type HourlyCount struct {
+	Hour     time.Time `json:"hour"`
+	Messages int       `json:"messages"`
+}
+
+// HandleCount is the number of messages posted by a handle.
+type HandleCount struct {
+	Handle   string `json:"handle"`
+	Messages int    `json:"messages"`
+}
+
+// ComputeStats computes the activity stats of a room from its cached
+// messages. Concurrent peers are counted from the join and leave notices.
+func ComputeStats(msgs []store.Message) RoomStats {
+	var (
+		out = RoomStats{
+			Hourly:     []HourlyCount{},
+			TopHandles: []HandleCount{},
+		}
+		handles = make(map[string]int)
+		online  = make(map[string]bool)
+	)
+	for _, m := range msgs {
+		switch m.Type {
+		case TypeMessage:
+			out.Messages++
+			handles[m.PeerHandle]++
+
+			h := m.Timestamp.UTC().Truncate(time.Hour)
+			if n := len(out.Hourly); n > 0 && out.Hourly[n-1].Hour.Equal(h) {
+				out.Hourly[n-1].Messages++
+			} else {
+				out.Hourly = append(out.Hourly, HourlyCount{Hour: h, Messages: 1})
+			}
+
+		case TypeSystem:
+			switch m.Code {
+			case SystemPeerJoin:
+				online[m.PeerHandle] = true
+				if len(online) > out.PeakPeers {
+					t := m.Timestamp
+					out.PeakPeers = len(online)
+					out.PeakAt = &t
+				}
+			case SystemPeerLeave:
+				delete(online, m.PeerHandle)
+			}
+		}
+	}
+
+	for h, n := range handles {
+		out.TopHandles = append(out.TopHandles, HandleCount{Handle: h, Messages: n})
+	}
+	sort.Slice(out.TopHandles, func(i, j int) bool {
+		a, b := out.TopHandles[i], out.TopHandles[j]
+		if a.Messages != b.Messages {
+			return a.Messages > b.Messages
+		}
+		return a.Handle < b.Handle
+	})
+	if len(out.TopHandles) > maxStatsHandles {
+		out.TopHandles = out.TopHandles[:maxStatsHandles]
+	}
+	return out
+}
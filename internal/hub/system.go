@@ -0,0 +1,98 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Codes of system messages emitted by the hub.
+const (
+	SystemPeerJoin         = "peer.join"
+	SystemPeerLeave        = "peer.leave"
+	SystemPeerKicked       = "peer.kicked"
+	SystemPeerMuted        = "peer.muted"
+	SystemPeerSpam         = "peer.spam"
+	SystemPeerBanned       = "peer.banned"
+	SystemRateLimitWarning = "ratelimit.warning"
+	SystemRoomExpiring     = "room.expiring"
+	SystemOperatorJoin     = "operator.join"
+	SystemOperatorLeave    = "operator.leave"
+	SystemAnnouncement     = "server.announcement"
+)
+
+type payloadMsgSystem struct {
+	Code       string `json:"code"`
+	Msg        string `json:"message"`
+	PeerID     string `json:"peer_id,omitempty"`
+	PeerHandle string `json:"peer_handle,omitempty"`
+}
+
+// makeSystemPayload prepares a system message, optionally about a peer.
+func (r *Room) makeSystemPayload(code, msg string, p *Peer) *payload {
+	d := payloadMsgSystem{Code: code, Msg: msg}
+	if p != nil {
+		d.PeerID = p.Key
+		d.PeerHandle = p.Handle
+	}
+	return r.makePeerPayload(d, TypeSystem, p)
+}
+
+// broadcastSystem broadcasts a system message to the room and records it
+// in the room's history.
+func (r *Room) broadcastSystem(code, msg string, p *Peer) {
+	r.Broadcast(r.makeSystemPayload(code, msg, p), true)
+	r.cacheSystemMessage(code, msg, p)
+}
+
+// cacheSystemMessage persists a system message with its code in the message
+// cache if history is enabled.
+func (r *Room) cacheSystemMessage(code, msg string, p *Peer) {
+	if !r.logging() {
+		return
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating message ID: %v", err)
+		return
+	}
+
+	m := store.Message{
+		ID:        id,
+		Type:      TypeSystem,
+		Code:      code,
+		Message:   msg,
+		Timestamp: time.Now(),
+	}
+	if p != nil {
+		m.PeerID = p.Key
+		m.PeerHandle = p.Handle
+	}
+	r.writeCachedMessage(m)
+}
+
+// systemPeerMsg returns the text of a system message about a peer in the
+// room's language.
+func (r *Room) systemPeerMsg(code string, p *Peer) string {
+	switch code {
+	case SystemPeerJoin:
+		return r.t("%s joined", p.Handle)
+	case SystemPeerLeave:
+		return r.t("%s left", p.Handle)
+	case SystemPeerKicked:
+		return r.t("%s was removed for sending too many messages", p.Handle)
+	case SystemPeerMuted:
+		return r.t("%s was muted for spamming", p.Handle)
+	case SystemPeerSpam:
+		return r.t("%s was removed for spamming", p.Handle)
+	case SystemPeerBanned:
+		return r.t("%s was banned from the room", p.Handle)
+	case SystemOperatorJoin:
+		return r.t("%s, a server operator, joined the room to provide support. "+
+			"Their actions and messages are recorded", p.Handle)
+	case SystemOperatorLeave:
+		return r.t("%s, a server operator, left the room", p.Handle)
+	}
+	return ""
+}
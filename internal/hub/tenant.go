@@ -0,0 +1,56 @@
+package hub
+
+import "errors"
+
+// ErrTooManyRooms is returned when a tenant has reached its room limit.
+var ErrTooManyRooms = errors.New("too many rooms. Try again later")
+
+// Tenant represents the settings of a virtual host (tenant) that override
+// the global config for its rooms. Rooms are tagged with their tenant on
+// creation (RoomOpts.Tenant) and the rooms of one tenant aren't accessible
+// from another. Zero values fall back to the global config.
+type Tenant struct {
+	RootURL         string
+	MaxRooms        int
+	MaxPeersPerRoom int
+
+	// Features enabled for all the tenant's rooms.
+	Features []string
+}
+
+// tenant returns the settings of a tenant with the global config filled in.
+// The default tenant ("") has the global config.
+func (h *Hub) tenant(id string) Tenant {
+	t := h.Tenants[id]
+	if t.RootURL == "" {
+		t.RootURL = h.cfg.RootURL
+	}
+	if t.MaxPeersPerRoom <= 0 {
+		t.MaxPeersPerRoom = h.cfg.MaxPeersPerRoom
+	}
+	return t
+}
+
+// numTenantRooms returns the number of active rooms of a tenant.
+func (h *Hub) numTenantRooms(id string) int {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+
+	n := 0
+	for _, r := range h.rooms {
+		if r.Opts.Tenant == id {
+			n++
+		}
+	}
+	return n
+}
+
+// Tenant returns the ID of the room's tenant.
+func (r *Room) Tenant() string {
+	return r.Opts.Tenant
+}
+
+// maxPeers returns the maximum number of peers in the room.
+func (r *Room) maxPeers() int {
+	return r.hub.tenant(r.Opts.Tenant).MaxPeersPerRoom
+}
@@ -0,0 +1,126 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Room auto-title modes.
+const (
+	AutoTitleFirstMessage = "first_message"
+	AutoTitleWebhook      = "webhook"
+)
+
+// maxAutoTitleLen is the max length (runes) of derived room names.
+const maxAutoTitleLen = 100
+
+var titleClient = &http.Client{Timeout: time.Second * 5}
+
+type payloadMsgRoom struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Name returns the display name of the room.
+func (r *Room) Name() string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.name
+}
+
+// setTitle sets the name of an unnamed room, persists it, and sends the
+// change to all peers. A room that has been named in the meantime, eg: by an
+// earlier message, keeps its name. It should only be invoked from the room's
+// event loop.
+func (r *Room) setTitle(name string) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxAutoTitleLen {
+		name = string([]rune(name)[:maxAutoTitleLen])
+	}
+	if name == "" {
+		return
+	}
+
+	r.mut.Lock()
+	if r.name != "" {
+		r.mut.Unlock()
+		return
+	}
+	r.name = name
+	r.mut.Unlock()
+
+	if err := r.hub.Store.UpdateRoom(r.storeRoom()); err != nil {
+		r.hub.log.Printf("error updating room name in store: %v", err)
+	}
+	r.fanout(r.makePayload(payloadMsgRoom{ID: r.ID, Name: name}, TypeRoomInfo))
+}
+
+// queueTitle asks the room's event loop to name the room. It's dropped if
+// the room has been closed.
+func (r *Room) queueTitle(name string) {
+	select {
+	case r.titleQ <- name:
+	case <-r.done:
+	}
+}
+
+// autoTitleFromMessage names an unnamed room after its first message.
+func (r *Room) autoTitleFromMessage(msg string) {
+	if r.hub.cfg.RoomAutoTitle != AutoTitleFirstMessage || r.Name() != "" {
+		return
+	}
+
+	// Use the first line of the message.
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	r.queueTitle(msg)
+}
+
+// lookupTitle names an unnamed room by looking up its ID on the title
+// webhook. The webhook is sent {"id": "roomID"} and is expected to respond
+// with {"name": "Room name"}. This should be invoked as a goroutine.
+func (r *Room) lookupTitle() {
+	b, _ := json.Marshal(payloadMsgRoom{ID: r.ID})
+	resp, err := titleClient.Post(r.hub.cfg.RoomTitleWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		r.hub.log.Printf("error looking up room title: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r.hub.log.Printf("error looking up room title: %s", resp.Status)
+		return
+	}
+
+	var out payloadMsgRoom
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		r.hub.log.Printf("error decoding room title: %v", err)
+		return
+	}
+
+	// The room may have been named in the meantime.
+	if r.Name() != "" {
+		return
+	}
+	r.queueTitle(out.Name)
+}
+
+// storeRoom returns the store representation of the room.
+func (r *Room) storeRoom() store.Room {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return store.Room{
+		ID:       r.ID,
+		Name:     r.name,
+		Password: r.Password,
+		Opts:     r.Opts,
+	}
+}
@@ -0,0 +1,325 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Peers can transfer files directly to each other over WebRTC data
+// channels. The server only brokers the transfer: a peer offers a file to
+// another peer (transfer.offer), the other peer accepts or rejects it
+// (transfer.accept, transfer.reject), and the two exchange WebRTC signaling
+// messages (transfer.signal) through the server until the data channel is
+// up. Either peer can cancel a transfer (transfer.cancel). The file itself
+// never passes through the server.
+const (
+	TypeTransferOffer  = "transfer.offer"
+	TypeTransferAccept = "transfer.accept"
+	TypeTransferReject = "transfer.reject"
+	TypeTransferSignal = "transfer.signal"
+	TypeTransferCancel = "transfer.cancel"
+)
+
+const (
+	// Time a peer has to accept an offer.
+	transferOfferTTL = 2 * time.Minute
+
+	// Maximum number of transfers a peer can have offered at a time.
+	maxPendingTransfers = 3
+
+	// Maximum size of a signaling message (SDP or ICE candidate).
+	maxSignalSize = 16 * 1024
+)
+
+var (
+	errTransferDisabled = errors.New("file transfers are disabled")
+	errTransferTooLarge = errors.New("file is too large to transfer")
+	errTransferInvalid  = errors.New("invalid file transfer")
+	errTransferNotFound = errors.New("file transfer not found or has expired")
+	errTransferPeer     = errors.New("peer not found")
+	errTransferLimit    = errors.New("too many pending file transfers")
+	errSignalTooLarge   = errors.New("signaling message is too large")
+)
+
+// transfer is a file transfer between two peers brokered by the room.
+type transfer struct {
+	ID   string
+	Name string
+	Size int64
+	Mime string
+
+	from *Peer
+	to   string
+
+	// Connection of the recipient that accepted the offer. It's nil until
+	// the offer is accepted.
+	peer *Peer
+
+	offeredAt time.Time
+}
+
+// transferReq is a transfer message from a peer.
+type transferReq struct {
+	ID     string          `json:"id"`
+	To     string          `json:"to"`
+	Name   string          `json:"name"`
+	Size   int64           `json:"size"`
+	Mime   string          `json:"mime"`
+	Signal json.RawMessage `json:"signal"`
+}
+
+type payloadMsgTransfer struct {
+	ID     string          `json:"id"`
+	From   *payloadMsgPeer `json:"from,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Size   int64           `json:"size,omitempty"`
+	Mime   string          `json:"mime,omitempty"`
+	Signal json.RawMessage `json:"signal,omitempty"`
+}
+
+// queueTransfer parses a transfer message from a peer and queues it to the
+// room's event loop.
+func (p *Peer) queueTransfer(typ string, data interface{}) {
+	if p.room.hub.cfg.MaxTransferSize <= 0 {
+		p.SendData(p.room.makeNoticePayload(errTransferDisabled.Error()))
+		return
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	var req transferReq
+	if err := json.Unmarshal(b, &req); err != nil {
+		p.SendData(p.room.makeNoticePayload(errTransferInvalid.Error()))
+		return
+	}
+	if len(req.Signal) > maxSignalSize {
+		p.SendData(p.room.makeNoticePayload(errSignalTooLarge.Error()))
+		return
+	}
+
+	p.room.queueReq(peerReq{reqType: typ, peer: p, data: req})
+}
+
+// handleTransfer processes a transfer message from a peer. It should only
+// be invoked from the room's event loop.
+func (r *Room) handleTransfer(typ string, p *Peer, req transferReq) {
+	var err error
+	switch typ {
+	case TypeTransferOffer:
+		err = r.offerTransfer(p, req)
+	case TypeTransferAccept:
+		err = r.acceptTransfer(p, req.ID)
+	case TypeTransferReject, TypeTransferCancel:
+		err = r.endTransfer(typ, p, req.ID)
+	case TypeTransferSignal:
+		err = r.signalTransfer(p, req)
+	}
+
+	if err != nil {
+		p.SendData(r.makeNoticePayload(err.Error()))
+	}
+}
+
+// offerTransfer sends a peer's file offer to the connections of the
+// recipient.
+func (r *Room) offerTransfer(p *Peer, req transferReq) error {
+	if req.Name == "" || req.Size <= 0 || req.To == "" || req.To == p.Key {
+		return errTransferInvalid
+	}
+	if req.Size > r.hub.cfg.MaxTransferSize {
+		return errTransferTooLarge
+	}
+
+	// Expire stale offers and limit the number of pending offers.
+	n := 0
+	for id, t := range r.transfers {
+		if t.peer == nil && time.Since(t.offeredAt) > transferOfferTTL {
+			delete(r.transfers, id)
+			continue
+		}
+		if t.from == p && t.peer == nil {
+			n++
+		}
+	}
+	if n >= maxPendingTransfers {
+		return errTransferLimit
+	}
+
+	to := r.peersByKey(req.To)
+	if len(to) == 0 {
+		return errTransferPeer
+	}
+
+	id, err := GenerateGUID(16)
+	if err != nil {
+		r.hub.log.Printf("error generating transfer ID: %v", err)
+		return errTransferInvalid
+	}
+
+	t := &transfer{
+		ID:        id,
+		Name:      req.Name,
+		Size:      req.Size,
+		Mime:      req.Mime,
+		from:      p,
+		to:        req.To,
+		offeredAt: time.Now(),
+	}
+	if r.transfers == nil {
+		r.transfers = make(map[string]*transfer)
+	}
+	r.transfers[id] = t
+
+	// The offerer gets the ID of the transfer.
+	p.SendData(r.makeTransferPayload(TypeTransferOffer, t, nil, nil))
+
+	b := r.makeTransferPayload(TypeTransferOffer, t, p, nil)
+	for _, c := range to {
+		c.SendData(b)
+	}
+	r.auditTransfer(TypeTransferOffer, p, t)
+	return nil
+}
+
+// acceptTransfer binds an offered transfer to the recipient's connection
+// that accepted it and informs the offerer, who then starts signaling.
+func (r *Room) acceptTransfer(p *Peer, id string) error {
+	t, ok := r.transfers[id]
+	if !ok || t.to != p.Key || t.peer != nil || time.Since(t.offeredAt) > transferOfferTTL {
+		return errTransferNotFound
+	}
+
+	t.peer = p
+	t.from.SendData(r.makeTransferPayload(TypeTransferAccept, t, p, nil))
+	r.auditTransfer(TypeTransferAccept, p, t)
+	return nil
+}
+
+// endTransfer ends a transfer that's rejected by the recipient or
+// cancelled by either peer and informs the other peer.
+func (r *Room) endTransfer(typ string, p *Peer, id string) error {
+	t, ok := r.transfers[id]
+	if !ok {
+		return errTransferNotFound
+	}
+
+	b := r.makeTransferPayload(typ, t, p, nil)
+	switch {
+	case p == t.from:
+		if typ == TypeTransferReject {
+			return errTransferInvalid
+		}
+		for _, c := range t.recipients(r) {
+			c.SendData(b)
+		}
+	case p == t.peer || (t.peer == nil && p.Key == t.to):
+		t.from.SendData(b)
+	default:
+		return errTransferNotFound
+	}
+
+	delete(r.transfers, id)
+	r.auditTransfer(typ, p, t)
+	return nil
+}
+
+// signalTransfer relays a WebRTC signaling message between the peers of an
+// accepted transfer.
+func (r *Room) signalTransfer(p *Peer, req transferReq) error {
+	t, ok := r.transfers[req.ID]
+	if !ok || t.peer == nil {
+		return errTransferNotFound
+	}
+
+	other := t.other(p)
+	if other == nil {
+		return errTransferNotFound
+	}
+	other.SendData(r.makeTransferPayload(TypeTransferSignal, t, p, req.Signal))
+	return nil
+}
+
+// cancelPeerTransfers cancels the transfers of a peer that has left and
+// informs the other peers.
+func (r *Room) cancelPeerTransfers(p *Peer) {
+	for id, t := range r.transfers {
+		var to []*Peer
+		switch p {
+		case t.from:
+			to = t.recipients(r)
+		case t.peer:
+			to = []*Peer{t.from}
+		default:
+			continue
+		}
+
+		delete(r.transfers, id)
+		b := r.makeTransferPayload(TypeTransferCancel, t, p, nil)
+		for _, c := range to {
+			c.SendData(b)
+		}
+		r.auditTransfer(TypeTransferCancel, p, t)
+	}
+}
+
+// recipients returns the recipient's connection that accepted the transfer
+// or all its connections if it hasn't been accepted.
+func (t *transfer) recipients(r *Room) []*Peer {
+	if t.peer != nil {
+		return []*Peer{t.peer}
+	}
+	return r.peersByKey(t.to)
+}
+
+// other returns the peer on the other end of a transfer from the given peer.
+// It's nil if the given peer isn't a party to the transfer or the transfer
+// hasn't been accepted.
+func (t *transfer) other(p *Peer) *Peer {
+	switch p {
+	case t.from:
+		return t.peer
+	case t.peer:
+		return t.from
+	}
+	return nil
+}
+
+// peersByKey returns the connections of a peer in the room by its public ID.
+func (r *Room) peersByKey(key string) []*Peer {
+	var out []*Peer
+	for p := range r.peers {
+		if p.Key == key {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// makeTransferPayload prepares a transfer message payload from the given
+// peer. The file's details are only included in offers.
+func (r *Room) makeTransferPayload(typ string, t *transfer, from *Peer, signal json.RawMessage) *payload {
+	d := payloadMsgTransfer{ID: t.ID, Signal: signal}
+	if from != nil {
+		d.From = &payloadMsgPeer{ID: from.Key, Handle: from.Handle}
+	}
+	if typ == TypeTransferOffer {
+		d.Name = t.Name
+		d.Size = t.Size
+		d.Mime = t.Mime
+	}
+	return r.makePayload(d, typ)
+}
+
+// auditTransfer records a transfer event in the audit log.
+func (r *Room) auditTransfer(typ string, p *Peer, t *transfer) {
+	r.hub.Audit.Record(typ, p.Handle, r.ID, map[string]interface{}{
+		"id":   t.ID,
+		"from": t.from.Handle,
+		"to":   t.to,
+		"name": t.Name,
+		"size": t.Size,
+	})
+}
@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"strconv"
+	"strings"
+)
+
+type payloadMsgOutdated struct {
+	MinVersion string `json:"min_version"`
+}
+
+// IsClientOutdated checks if a client version is older than the minimum
+// client version configured. Clients that don't report a version are
+// considered outdated.
+func (h *Hub) IsClientOutdated(version string) bool {
+	if h.cfg.MinClientVersion == "" {
+		return false
+	}
+	return compareVersions(version, h.cfg.MinClientVersion) < 0
+}
+
+// compareVersions compares two dot separated numeric versions (eg: 1.2.0)
+// and returns -1, 0, or 1 if a is lesser than, equal to, or greater than b.
+// Missing and non-numeric parts are treated as 0.
+func compareVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+
+		if na < nb {
+			return -1
+		} else if na > nb {
+			return 1
+		}
+	}
+	return 0
+}
+
+// makeOutdatedPayload prepares a message payload prompting a client to
+// reload as it's older than the minimum supported version.
+func (r *Room) makeOutdatedPayload() *payload {
+	return r.makePayload(payloadMsgOutdated{MinVersion: r.hub.cfg.MinClientVersion}, TypeClientOutdated)
+}
@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// SystemWelcome is the code of the private welcome messages sent to peers
+// when they first join a room.
+const SystemWelcome = "room.welcome"
+
+// Maximum number of messages in a room's welcome sequence.
+const maxWelcomeMessages = 5
+
+// welcomeVars are the variables available in welcome message templates,
+// eg: "Welcome to {{ .Room }}, {{ .Handle }}".
+type welcomeVars struct {
+	Room   string
+	RoomID string
+	URL    string
+	Handle string
+	Peers  int
+}
+
+// parseWelcome validates and parses a welcome message sequence.
+func (h *Hub) parseWelcome(msgs []string) ([]*template.Template, error) {
+	return parseWelcome(msgs, h.cfg.MaxMessageLen)
+}
+
+// ValidateWelcome validates a welcome message sequence with messages of up
+// to maxLen bytes, eg: in room presets.
+func ValidateWelcome(msgs []string, maxLen int) error {
+	_, err := parseWelcome(msgs, maxLen)
+	return err
+}
+
+func parseWelcome(msgs []string, maxLen int) ([]*template.Template, error) {
+	if len(msgs) > maxWelcomeMessages {
+		return nil, fmt.Errorf("welcome can have up to %d messages", maxWelcomeMessages)
+	}
+
+	out := make([]*template.Template, 0, len(msgs))
+	for i, m := range msgs {
+		if strings.TrimSpace(m) == "" || len(m) > maxLen {
+			return nil, fmt.Errorf("welcome message %d is empty or too long", i+1)
+		}
+		t, err := template.New("").Option("missingkey=error").Parse(m)
+		if err == nil {
+			// Catch unknown variables.
+			err = t.Execute(ioutil.Discard, welcomeVars{})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("welcome message %d: %v", i+1, err)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// sendWelcome sends a peer the room's welcome messages, if any, the first
+// time its handle joins the room. It should only be invoked from the room's
+// event loop.
+func (r *Room) sendWelcome(p *Peer) {
+	if r.welcomed[p.Handle] {
+		return
+	}
+
+	r.mut.RLock()
+	msgs := r.Opts.Welcome
+	r.mut.RUnlock()
+	if len(msgs) == 0 {
+		return
+	}
+
+	tpls, err := r.hub.parseWelcome(msgs)
+	if err != nil {
+		r.hub.log.Printf("invalid welcome messages in %s: %v", r.ID, err)
+		return
+	}
+
+	if r.welcomed == nil {
+		r.welcomed = make(map[string]bool)
+	}
+	r.welcomed[p.Handle] = true
+
+	vars := welcomeVars{
+		Room:   r.Name(),
+		RoomID: r.ID,
+		URL:    fmt.Sprintf("%s/r/%s", r.hub.tenant(r.Opts.Tenant).RootURL, r.ID),
+		Handle: p.Handle,
+		Peers:  len(r.peers),
+	}
+	for _, t := range tpls {
+		var b bytes.Buffer
+		if err := t.Execute(&b, vars); err != nil {
+			r.hub.log.Printf("error executing welcome message in %s: %v", r.ID, err)
+			continue
+		}
+		p.SendData(r.makeSystemPayload(SystemWelcome, b.String(), nil))
+	}
+}
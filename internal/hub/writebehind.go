@@ -0,0 +1,190 @@
+package hub
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// writeBehind buffers messages written to the message cache and writes
+// them in batches in the background so that a slow cache doesn't add
+// latency to broadcasts. Buffered messages are flushed every interval or
+// when size messages are buffered, and a room's buffered messages are
+// flushed before its messages are read so that reads are consistent.
+type writeBehind struct {
+	store.MessageCache
+
+	interval time.Duration
+	size     int
+
+	// Buffered messages by room ID and their total count. Guarded by mut.
+	pending map[string]*pendingMessages
+	n       int
+	mut     sync.Mutex
+
+	// Serializes flushes so that a room's messages are written in order.
+	flushMut sync.Mutex
+
+	flushQ chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	log *log.Logger
+}
+
+type pendingMessages struct {
+	msgs []store.Message
+	ttl  time.Duration
+}
+
+func newWriteBehind(c store.MessageCache, interval time.Duration, size int, l *log.Logger) *writeBehind {
+	w := &writeBehind{
+		MessageCache: c,
+		interval:     interval,
+		size:         size,
+		pending:      make(map[string]*pendingMessages),
+		flushQ:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		log:          l,
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// AddMessageCache buffers a message to be written to a room's message cache.
+func (w *writeBehind) AddMessageCache(roomID string, m store.Message, ttl time.Duration) error {
+	w.mut.Lock()
+	p, ok := w.pending[roomID]
+	if !ok {
+		p = &pendingMessages{}
+		w.pending[roomID] = p
+	}
+	p.msgs = append(p.msgs, m)
+	p.ttl = ttl
+	w.n++
+	full := w.n >= w.size
+	w.mut.Unlock()
+
+	if full {
+		select {
+		case w.flushQ <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// AddMessageCacheBatch writes messages to a room's message cache right
+// away after its buffered messages so that errors are returned to callers.
+func (w *writeBehind) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error {
+	w.flushMut.Lock()
+	defer w.flushMut.Unlock()
+
+	w.flushRoom(roomID)
+	return w.MessageCache.AddMessageCacheBatch(roomID, msgs, ttl)
+}
+
+// GetMessageCache flushes a room's buffered messages and retrieves its
+// messages.
+func (w *writeBehind) GetMessageCache(roomID string) ([]store.Message, error) {
+	w.flush(roomID)
+	return w.MessageCache.GetMessageCache(roomID)
+}
+
+// GetMessageCachePage flushes a room's buffered messages and retrieves a
+// page of its messages.
+func (w *writeBehind) GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error) {
+	w.flush(roomID)
+	return w.MessageCache.GetMessageCachePage(roomID, before, limit)
+}
+
+// ClearMessageCache discards a room's buffered messages and clears its
+// message cache.
+func (w *writeBehind) ClearMessageCache(roomID string) error {
+	w.flushMut.Lock()
+	defer w.flushMut.Unlock()
+
+	w.mut.Lock()
+	if p, ok := w.pending[roomID]; ok {
+		w.n -= len(p.msgs)
+		delete(w.pending, roomID)
+	}
+	w.mut.Unlock()
+
+	return w.MessageCache.ClearMessageCache(roomID)
+}
+
+// Close stops the background flushes and writes all buffered messages.
+func (w *writeBehind) Close() {
+	close(w.done)
+	w.wg.Wait()
+	w.flushAll()
+}
+
+// run flushes buffered messages every interval or when the buffer is full.
+func (w *writeBehind) run() {
+	defer w.wg.Done()
+
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			w.flushAll()
+		case <-w.flushQ:
+			w.flushAll()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// flush writes a room's buffered messages.
+func (w *writeBehind) flush(roomID string) {
+	w.flushMut.Lock()
+	w.flushRoom(roomID)
+	w.flushMut.Unlock()
+}
+
+// flushAll writes the buffered messages of all rooms.
+func (w *writeBehind) flushAll() {
+	w.flushMut.Lock()
+	defer w.flushMut.Unlock()
+
+	w.mut.Lock()
+	pending := w.pending
+	w.pending = make(map[string]*pendingMessages)
+	w.n = 0
+	w.mut.Unlock()
+
+	for roomID, p := range pending {
+		w.write(roomID, p)
+	}
+}
+
+// flushRoom writes a room's buffered messages. It should be called with
+// flushMut held.
+func (w *writeBehind) flushRoom(roomID string) {
+	w.mut.Lock()
+	p, ok := w.pending[roomID]
+	if ok {
+		w.n -= len(p.msgs)
+		delete(w.pending, roomID)
+	}
+	w.mut.Unlock()
+
+	if ok {
+		w.write(roomID, p)
+	}
+}
+
+func (w *writeBehind) write(roomID string, p *pendingMessages) {
+	if err := w.MessageCache.AddMessageCacheBatch(roomID, p.msgs, p.ttl); err != nil {
+		w.log.Printf("error writing %d buffered messages in %s: %v", len(p.msgs), roomID, err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package i18n translates the app's text (templates, system messages, and
+// API errors) with message catalogs. A catalog is a JSON file per language
+// (eg: de.json) that maps English text, or its format string (eg: "%s
+// joined"), to the translation. Text that isn't in a catalog is left in
+// English.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/knadh/stuffbin"
+)
+
+// Source is the language of the text in the app, which needs no catalog.
+const Source = "en"
+
+// Catalog maps English text to its translation.
+type Catalog map[string]string
+
+// I18n holds the catalogs of the available languages.
+type I18n struct {
+	def      string
+	catalogs map[string]Catalog
+	mut      sync.RWMutex
+}
+
+// New returns an I18n with the given catalogs by language code. def is the
+// language used when a request doesn't ask for an available one.
+func New(def string, catalogs map[string]Catalog) (*I18n, error) {
+	i := &I18n{def: Source}
+	if err := i.Set(def, catalogs); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Set replaces the default language and the catalogs.
+func (i *I18n) Set(def string, catalogs map[string]Catalog) error {
+	if catalogs == nil {
+		catalogs = make(map[string]Catalog)
+	}
+	if def == "" {
+		def = Source
+	}
+	def = normalize(def)
+	if _, ok := catalogs[def]; !ok && def != Source {
+		return fmt.Errorf("no catalog for the default language '%s'", def)
+	}
+
+	i.mut.Lock()
+	i.def = def
+	i.catalogs = catalogs
+	i.mut.Unlock()
+	return nil
+}
+
+// LoadFS reads the catalogs (<lang>.json) in a directory of a file system.
+func LoadFS(fs stuffbin.FileSystem, dir string) (map[string]Catalog, error) {
+	files, err := fs.Glob(path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]Catalog, len(files))
+	for _, f := range files {
+		b, err := fs.Read(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", f, err)
+		}
+		var c Catalog
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", f, err)
+		}
+		out[normalize(strings.TrimSuffix(path.Base(f), ".json"))] = c
+	}
+	return out, nil
+}
+
+// Default returns the default language.
+func (i *I18n) Default() string {
+	if i == nil {
+		return Source
+	}
+	i.mut.RLock()
+	defer i.mut.RUnlock()
+	return i.def
+}
+
+// Langs returns the available languages.
+func (i *I18n) Langs() []string {
+	out := []string{Source}
+	if i == nil {
+		return out
+	}
+	i.mut.RLock()
+	for l := range i.catalogs {
+		if l != Source {
+			out = append(out, l)
+		}
+	}
+	i.mut.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// Has checks if a language is available.
+func (i *I18n) Has(lang string) bool {
+	lang = normalize(lang)
+	if lang == Source {
+		return true
+	}
+	if i == nil {
+		return false
+	}
+	i.mut.RLock()
+	defer i.mut.RUnlock()
+	_, ok := i.catalogs[lang]
+	return ok
+}
+
+// T translates text to a language. If args are given, the translation is
+// a format string that they're applied to.
+func (i *I18n) T(lang, text string, args ...interface{}) string {
+	if i != nil {
+		i.mut.RLock()
+		if t, ok := i.catalogs[normalize(lang)][text]; ok && t != "" {
+			text = t
+		}
+		i.mut.RUnlock()
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// Match returns the available language that best matches an
+// Accept-Language header, or the default language. A regional variant
+// (eg: pt-BR) matches its base language (pt) if it's not available.
+func (i *I18n) Match(header string) string {
+	type pref struct {
+		lang string
+		q    float64
+	}
+	var prefs []pref
+	for _, p := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(p), ";")
+		l := strings.TrimSpace(parts[0])
+		if l == "" || l == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, a := range parts[1:] {
+			a = strings.TrimSpace(a)
+			if strings.HasPrefix(a, "q=") {
+				if v, err := strconv.ParseFloat(a[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, pref{l, q})
+		}
+	}
+	sort.SliceStable(prefs, func(a, b int) bool { return prefs[a].q > prefs[b].q })
+
+	for _, p := range prefs {
+		l := normalize(p.lang)
+		if i.Has(l) {
+			return l
+		}
+		if n := strings.IndexByte(l, '-'); n > 0 && i.Has(l[:n]) {
+			return l[:n]
+		}
+	}
+	return i.Default()
+}
+
+// Lang returns a translator for a language that's used in templates,
+// eg: {{ .L.T "Create room" }}.
+func (i *I18n) Lang(lang string) *Lang {
+	return &Lang{i: i, code: lang}
+}
+
+// Lang translates text to a language.
+type Lang struct {
+	i    *I18n
+	code string
+}
+
+// Code returns the language code.
+func (l *Lang) Code() string {
+	return l.code
+}
+
+// T translates text. See I18n.T.
+func (l *Lang) T(text string, args ...interface{}) string {
+	return l.i.T(l.code, text, args...)
+}
+
+// normalize normalizes a language tag, eg: pt_br to pt-BR.
+func normalize(lang string) string {
+	parts := strings.Split(strings.Replace(strings.TrimSpace(lang), "_", "-", -1), "-")
+	parts[0] = strings.ToLower(parts[0])
+	for n := 1; n < len(parts); n++ {
+		parts[n] = strings.ToUpper(parts[n])
+	}
+	return strings.Join(parts, "-")
+}
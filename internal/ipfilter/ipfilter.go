@@ -0,0 +1,203 @@
+// Package ipfilter blocks client IPs by CIDR deny lists and DNS blocklists
+// (DNSBL), eg: to keep known abusive networks off public instances. An ASN
+// can be blocked by denying the prefixes it announces.
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of DNSBL results cached before expired results are swept.
+const maxCached = 10000
+
+// Config represents the IP filter configuration.
+type Config struct {
+	// CIDRs (or single IPs) that are always allowed and aren't checked
+	// against Deny and the DNSBLs.
+	Allow []string `koanf:"allow"`
+
+	// CIDRs (or single IPs) that are denied. "0.0.0.0/0" and "::/0" deny
+	// everything that's not allowed.
+	Deny []string `koanf:"deny"`
+
+	// DNSBL zones, eg: "zen.spamhaus.org". An IP is denied if it's listed in
+	// any of them. Lookups that fail or time out allow the IP.
+	DNSBL         []string      `koanf:"dnsbl"`
+	DNSBLTimeout  time.Duration `koanf:"dnsbl_timeout"`
+	DNSBLCacheTTL time.Duration `koanf:"dnsbl_cache_ttl"`
+}
+
+// Filter checks client IPs against the allow and deny lists and DNSBLs.
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	dnsbl []string
+
+	timeout  time.Duration
+	cacheTTL time.Duration
+	resolver *net.Resolver
+
+	// Cached DNSBL results by IP.
+	cache map[string]result
+	mut   sync.Mutex
+}
+
+type result struct {
+	zone    string
+	expires time.Time
+}
+
+// New returns a new Filter. It returns nil if there are no lists or DNSBLs
+// configured, which Check treats as "always allowed".
+func New(cfg Config) (*Filter, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 && len(cfg.DNSBL) == 0 {
+		return nil, nil
+	}
+
+	allow, err := ParseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := ParseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DNSBLTimeout <= 0 {
+		cfg.DNSBLTimeout = time.Second
+	}
+	if cfg.DNSBLCacheTTL <= 0 {
+		cfg.DNSBLCacheTTL = time.Hour
+	}
+	return &Filter{
+		allow:    allow,
+		deny:     deny,
+		dnsbl:    cfg.DNSBL,
+		timeout:  cfg.DNSBLTimeout,
+		cacheTTL: cfg.DNSBLCacheTTL,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]result),
+	}, nil
+}
+
+// Check checks if an IP is allowed. If it's denied, it returns the reason,
+// which is the matching CIDR or DNSBL zone. Invalid IPs are allowed as they
+// can't be matched.
+func (f *Filter) Check(addr string) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return true, ""
+	}
+
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true, ""
+		}
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false, n.String()
+		}
+	}
+	if zone := f.lookupDNSBL(ip); zone != "" {
+		return false, zone
+	}
+	return true, ""
+}
+
+// lookupDNSBL returns the first DNSBL zone that lists the IP, or an empty
+// string if it isn't listed.
+func (f *Filter) lookupDNSBL(ip net.IP) string {
+	if len(f.dnsbl) == 0 {
+		return ""
+	}
+
+	key := ip.String()
+	now := time.Now()
+	f.mut.Lock()
+	if r, ok := f.cache[key]; ok && now.Before(r.expires) {
+		f.mut.Unlock()
+		return r.zone
+	}
+	f.mut.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	zone := ""
+	q := reverseIP(ip)
+	for _, z := range f.dnsbl {
+		// Listed IPs resolve to an address (127.0.0.x). Errors, including
+		// NXDOMAIN for IPs that aren't listed, allow the IP.
+		addrs, err := f.resolver.LookupHost(ctx, q+"."+z)
+		if err == nil && len(addrs) > 0 {
+			zone = z
+			break
+		}
+	}
+
+	f.mut.Lock()
+	if len(f.cache) >= maxCached {
+		for k, r := range f.cache {
+			if now.After(r.expires) {
+				delete(f.cache, k)
+			}
+		}
+	}
+	if len(f.cache) < maxCached {
+		f.cache[key] = result{zone: zone, expires: now.Add(f.cacheTTL)}
+	}
+	f.mut.Unlock()
+	return zone
+}
+
+// reverseIP returns the DNSBL query name of an IP: the reversed octets of
+// an IPv4 address or the reversed nibbles of an IPv6 address.
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const hex = "0123456789abcdef"
+	ip = ip.To16()
+	out := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		out = append(out, string(hex[ip[i]&0xf]), string(hex[ip[i]>>4]))
+	}
+	return strings.Join(out, ".")
+}
+
+// ParseCIDRs parses a list of CIDRs and single IPs.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", s)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
@@ -0,0 +1,316 @@
+// Package notify dispatches notifications about room events to external
+// channels (webhooks, email, Telegram). Channels are configured globally
+// and rooms opt in to them. Each channel renders the event with its own
+// templates and retries failed deliveries.
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// Types of events that can be notified.
+const (
+	EventMessage  = "message"
+	EventPeerJoin = "peer.join"
+)
+
+// Channel types.
+const (
+	TypeWebhook  = "webhook"
+	TypeEmail    = "email"
+	TypeTelegram = "telegram"
+)
+
+const (
+	// Number of notifications waiting to be delivered beyond which
+	// notifications are dropped.
+	queueSize = 1000
+
+	// Number of concurrent deliveries.
+	numWorkers = 2
+
+	defaultSubject = `[niltalk] {{ or .RoomName .RoomID }}`
+	defaultBody    = `{{ if eq .Type "message" }}{{ .Handle }}: {{ .Message }}` +
+		`{{ else if eq .Type "peer.join" }}{{ .Handle }} joined{{ end }}`
+)
+
+// Event represents a room event that's notified. It's the context of the
+// channel templates.
+type Event struct {
+	Type     string    `json:"type"`
+	RoomID   string    `json:"room_id"`
+	RoomName string    `json:"room_name"`
+	Handle   string    `json:"handle,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Notification is a rendered event delivered to a channel.
+type Notification struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Event   Event  `json:"event"`
+}
+
+// Sender delivers notifications to a channel.
+type Sender interface {
+	Send(n Notification) error
+}
+
+// Config represents the config of a notification channel.
+type Config struct {
+	// webhook | email | telegram
+	Type string `koanf:"type"`
+
+	// Events to notify. All events are notified if it's empty.
+	Events []string `koanf:"events"`
+
+	// Notify events in all rooms instead of rooms that opt in.
+	AllRooms bool `koanf:"all_rooms"`
+
+	// Go templates for the subject and the body with Event as the context.
+	Subject  string `koanf:"subject"`
+	Template string `koanf:"template"`
+
+	// Failed deliveries are retried with exponential backoff.
+	Retries       int           `koanf:"retries"`
+	RetryInterval time.Duration `koanf:"retry_interval"`
+
+	// Webhook URL that notifications are POSTed to as JSON.
+	URL string `koanf:"url"`
+
+	// Telegram bot and chat.
+	BotToken string `koanf:"bot_token"`
+	ChatID   string `koanf:"chat_id"`
+
+	// SMTP server (host:port) and the email addresses.
+	SMTPAddr     string   `koanf:"smtp_addr"`
+	SMTPUsername string   `koanf:"smtp_username"`
+	SMTPPassword string   `koanf:"smtp_password"`
+	From         string   `koanf:"from"`
+	To           []string `koanf:"to"`
+}
+
+type channel struct {
+	name    string
+	cfg     Config
+	sender  Sender
+	subject *template.Template
+	body    *template.Template
+	events  map[string]bool
+}
+
+type job struct {
+	ch *channel
+	ev Event
+}
+
+// Dispatcher delivers events to the configured channels in the background.
+type Dispatcher struct {
+	channels map[string]*channel
+	names    []string
+	q        chan job
+	log      *log.Logger
+}
+
+// New returns a new Dispatcher with the channels configured by name and
+// starts the delivery workers.
+func New(cfgs map[string]Config, l *log.Logger) (*Dispatcher, error) {
+	d := &Dispatcher{
+		channels: make(map[string]*channel, len(cfgs)),
+		q:        make(chan job, queueSize),
+		log:      l,
+	}
+
+	for name, cfg := range cfgs {
+		ch, err := newChannel(name, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("notification channel '%s': %v", name, err)
+		}
+		d.channels[name] = ch
+		d.names = append(d.names, name)
+	}
+	sort.Strings(d.names)
+
+	for i := 0; i < numWorkers; i++ {
+		go d.run()
+	}
+	return d, nil
+}
+
+// Validate checks the channel configs without starting a dispatcher.
+func Validate(cfgs map[string]Config) error {
+	names := make([]string, 0, len(cfgs))
+	for name := range cfgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := newChannel(name, cfgs[name]); err != nil {
+			return fmt.Errorf("notification channel '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Channels returns the names of the configured channels.
+func (d *Dispatcher) Channels() []string {
+	if d == nil {
+		return nil
+	}
+	return d.names
+}
+
+// Has checks if a channel is configured.
+func (d *Dispatcher) Has(name string) bool {
+	if d == nil {
+		return false
+	}
+	_, ok := d.channels[name]
+	return ok
+}
+
+// Dispatch queues an event for delivery to the given channels that a room
+// opted in to and to the channels that notify all rooms. It doesn't block
+// and drops the event if the queue is full. It's a no-op on a nil
+// Dispatcher.
+func (d *Dispatcher) Dispatch(channels []string, e Event) {
+	if d == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for _, ch := range d.channels {
+		if !ch.wants(channels, e.Type) {
+			continue
+		}
+
+		select {
+		case d.q <- job{ch: ch, ev: e}:
+		default:
+			d.log.Printf("notification queue full. dropping %s to %s", e.Type, ch.name)
+		}
+	}
+}
+
+// run delivers queued events. This should be invoked as a goroutine.
+func (d *Dispatcher) run() {
+	for j := range d.q {
+		n, err := j.ch.render(j.ev)
+		if err != nil {
+			d.log.Printf("error rendering notification for %s: %v", j.ch.name, err)
+			continue
+		}
+		if err := j.ch.send(n); err != nil {
+			d.log.Printf("error sending notification to %s: %v", j.ch.name, err)
+		}
+	}
+}
+
+func newChannel(name string, cfg Config) (*channel, error) {
+	var (
+		s   Sender
+		err error
+	)
+	switch cfg.Type {
+	case TypeWebhook:
+		s, err = newWebhook(cfg)
+	case TypeEmail:
+		s, err = newEmail(cfg)
+	case TypeTelegram:
+		s, err = newTelegram(cfg)
+	default:
+		err = fmt.Errorf("unknown type '%s'", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Subject == "" {
+		cfg.Subject = defaultSubject
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultBody
+	}
+	subject, err := template.New("subject").Parse(cfg.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject template: %v", err)
+	}
+	body, err := template.New("body").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+
+	events := make(map[string]bool, len(cfg.Events))
+	for _, e := range cfg.Events {
+		events[e] = true
+	}
+
+	return &channel{
+		name:    name,
+		cfg:     cfg,
+		sender:  s,
+		subject: subject,
+		body:    body,
+		events:  events,
+	}, nil
+}
+
+// wants checks if the channel notifies an event type in a room that opted
+// in to the given channels.
+func (c *channel) wants(channels []string, typ string) bool {
+	if len(c.events) > 0 && !c.events[typ] {
+		return false
+	}
+	if c.cfg.AllRooms {
+		return true
+	}
+	for _, n := range channels {
+		if n == c.name {
+			return true
+		}
+	}
+	return false
+}
+
+// render renders an event with the channel's templates.
+func (c *channel) render(e Event) (Notification, error) {
+	var subject, body bytes.Buffer
+	if err := c.subject.Execute(&subject, e); err != nil {
+		return Notification{}, err
+	}
+	if err := c.body.Execute(&body, e); err != nil {
+		return Notification{}, err
+	}
+	return Notification{Subject: subject.String(), Body: body.String(), Event: e}, nil
+}
+
+// send delivers a notification retrying failures with exponential backoff.
+func (c *channel) send(n Notification) error {
+	var (
+		err  error
+		wait = c.cfg.RetryInterval
+	)
+	for i := 0; i <= c.cfg.Retries; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = c.sender.Send(n); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhook POSTs notifications to a URL as JSON.
+type webhook struct {
+	url string
+}
+
+func newWebhook(cfg Config) (*webhook, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	return &webhook{url: cfg.URL}, nil
+}
+
+func (w *webhook) Send(n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// telegram sends notifications to a chat with the Telegram bot API.
+type telegram struct {
+	url    string
+	chatID string
+}
+
+func newTelegram(cfg Config) (*telegram, error) {
+	if cfg.BotToken == "" || cfg.ChatID == "" {
+		return nil, errors.New("bot_token and chat_id are required")
+	}
+	return &telegram{
+		url:    "https://api.telegram.org/bot" + cfg.BotToken + "/sendMessage",
+		chatID: cfg.ChatID,
+	}, nil
+}
+
+func (t *telegram) Send(n Notification) error {
+	resp, err := httpClient.PostForm(t.url, url.Values{
+		"chat_id": {t.chatID},
+		"text":    {n.Subject + "\n\n" + n.Body},
+	})
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// email sends notifications with SMTP.
+type email struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func newEmail(cfg Config) (*email, error) {
+	if cfg.SMTPAddr == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, errors.New("smtp_addr, from, and to are required")
+	}
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp_addr: %v", err)
+	}
+
+	e := &email{addr: cfg.SMTPAddr, from: cfg.From, to: cfg.To}
+	if cfg.SMTPUsername != "" {
+		e.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return e, nil
+}
+
+func (e *email) Send(n Notification) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", stripNewlines(n.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.Event.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(n.Body)
+	return smtp.SendMail(e.addr, e.auth, e.from, e.to, b.Bytes())
+}
+
+// stripNewlines prevents header injection from templates with user input.
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// checkResponse closes a response and returns an error for non-2xx statuses.
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+// Package passwd implements configurable password policies and hashing
+// with bcrypt or argon2id.
+package passwd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported hashing algorithms.
+const (
+	AlgoBcrypt   = "bcrypt"
+	AlgoArgon2id = "argon2id"
+)
+
+// ErrMismatch indicates that a password doesn't match its hash.
+var ErrMismatch = errors.New("incorrect password")
+
+// Reasons a password falls below the policy.
+const (
+	WeakLength  = "length"
+	WeakEntropy = "entropy"
+	WeakHash    = "hash"
+)
+
+// Config represents the password hashing and policy configuration.
+type Config struct {
+	Algorithm  string `koanf:"algorithm"`
+	BcryptCost int    `koanf:"bcrypt_cost"`
+
+	// argon2id parameters. Memory is in KiB.
+	Argon2Time    uint32 `koanf:"argon2_time"`
+	Argon2Memory  uint32 `koanf:"argon2_memory"`
+	Argon2Threads uint8  `koanf:"argon2_threads"`
+
+	MinLength int `koanf:"min_length"`
+	MaxLength int `koanf:"max_length"`
+
+	// Minimum estimated entropy in bits. 0 disables the check.
+	MinEntropy float64 `koanf:"min_entropy"`
+}
+
+// Passwd hashes and validates passwords.
+type Passwd struct {
+	cfg Config
+}
+
+// New returns a new instance of Passwd.
+func New(cfg Config) (*Passwd, error) {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = AlgoBcrypt
+	}
+	switch cfg.Algorithm {
+	case AlgoBcrypt:
+		if cfg.BcryptCost == 0 {
+			cfg.BcryptCost = 8
+		}
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt_cost should be %d - %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case AlgoArgon2id:
+		if cfg.Argon2Time == 0 || cfg.Argon2Memory == 0 || cfg.Argon2Threads == 0 {
+			return nil, errors.New("argon2_time, argon2_memory, and argon2_threads should be > 0")
+		}
+	default:
+		return nil, fmt.Errorf("unknown password algorithm: %s", cfg.Algorithm)
+	}
+
+	if cfg.MinLength == 0 {
+		cfg.MinLength = 6
+	}
+	if cfg.MaxLength == 0 {
+		cfg.MaxLength = 100
+	}
+	if cfg.MinLength > cfg.MaxLength {
+		return nil, errors.New("min_length should be <= max_length")
+	}
+	return &Passwd{cfg: cfg}, nil
+}
+
+// MinLength returns the minimum permitted password length.
+func (p *Passwd) MinLength() int {
+	return p.cfg.MinLength
+}
+
+// MaxLength returns the maximum permitted password length.
+func (p *Passwd) MaxLength() int {
+	return p.cfg.MaxLength
+}
+
+// Validate checks a password against the policy.
+func (p *Passwd) Validate(pwd string) error {
+	if len(pwd) < p.cfg.MinLength || len(pwd) > p.cfg.MaxLength {
+		return fmt.Errorf("invalid password (%d - %d chars)", p.cfg.MinLength, p.cfg.MaxLength)
+	}
+	if p.cfg.MinEntropy > 0 && Entropy(pwd) < p.cfg.MinEntropy {
+		return errors.New("password is too weak. Use a longer password with a mix of letters, numbers, and symbols")
+	}
+	return nil
+}
+
+// Hash hashes a password with the configured algorithm.
+func (p *Passwd) Hash(pwd string) ([]byte, error) {
+	if p.cfg.Algorithm == AlgoBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(pwd), p.cfg.BcryptCost)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	h := argon2.IDKey([]byte(pwd), salt, p.cfg.Argon2Time, p.cfg.Argon2Memory, p.cfg.Argon2Threads, 32)
+
+	// PHC string format.
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.cfg.Argon2Memory, p.cfg.Argon2Time, p.cfg.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(h))), nil
+}
+
+// Compare compares a password with a hash. The algorithm is inferred from
+// the hash so that existing hashes continue to work when the configured
+// algorithm is changed.
+func Compare(hash []byte, pwd string) error {
+	if !strings.HasPrefix(string(hash), "$argon2id$") {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(pwd)); err != nil {
+			return ErrMismatch
+		}
+		return nil
+	}
+
+	var (
+		v       int
+		m, t    uint32
+		threads uint8
+	)
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &v); err != nil {
+		return errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &threads); err != nil {
+		return errors.New("invalid argon2id hash")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errors.New("invalid argon2id hash")
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return errors.New("invalid argon2id hash")
+	}
+
+	got := argon2.IDKey([]byte(pwd), salt, t, m, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Audit checks a password's length, estimated entropy, and hash against
+// the policy and returns the reasons it falls below it. The plaintext isn't
+// required so that existing passwords can be audited when the policy
+// changes. A hash is weak if it uses a different algorithm or cheaper
+// parameters than the ones configured.
+func (p *Passwd) Audit(length int, entropy float64, hash []byte) []string {
+	var out []string
+	if length < p.cfg.MinLength {
+		out = append(out, WeakLength)
+	}
+	if p.cfg.MinEntropy > 0 && entropy < p.cfg.MinEntropy {
+		out = append(out, WeakEntropy)
+	}
+	if p.weakHash(hash) {
+		out = append(out, WeakHash)
+	}
+	return out
+}
+
+// weakHash checks if a hash uses a different algorithm or cheaper
+// parameters than the ones configured.
+func (p *Passwd) weakHash(hash []byte) bool {
+	if !strings.HasPrefix(string(hash), "$argon2id$") {
+		if p.cfg.Algorithm != AlgoBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost < p.cfg.BcryptCost
+	}
+	if p.cfg.Algorithm != AlgoArgon2id {
+		return true
+	}
+
+	var m, t uint32
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return true
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d", &m, &t); err != nil {
+		return true
+	}
+	return m < p.cfg.Argon2Memory || t < p.cfg.Argon2Time
+}
+
+// Entropy returns a rough estimate of a password's entropy in bits based on
+// its length and the character classes used in it.
+func Entropy(pwd string) float64 {
+	var lower, upper, digit, other bool
+	for _, c := range pwd {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(len([]rune(pwd))) * math.Log2(float64(pool))
+}
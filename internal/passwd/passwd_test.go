@@ -0,0 +1,121 @@
+package passwd
+
+import (
+	"strings"
+	"testing"
+)
+
+// Cheap argon2id parameters to keep the tests fast.
+var argonCfg = Config{Algorithm: AlgoArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+
+func TestHashCompare(t *testing.T) {
+	for _, cfg := range []Config{{Algorithm: AlgoBcrypt, BcryptCost: 4}, argonCfg} {
+		p, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := p.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Compare(hash, "correct horse"); err != nil {
+			t.Errorf("%s: expected the password to match: %v", cfg.Algorithm, err)
+		}
+		if err := Compare(hash, "correct horsE"); err != ErrMismatch {
+			t.Errorf("%s: expected a mismatch, got %v", cfg.Algorithm, err)
+		}
+
+		// Hashes are salted.
+		other, _ := p.Hash("correct horse")
+		if string(other) == string(hash) {
+			t.Errorf("%s: expected hashes of the same password to differ", cfg.Algorithm)
+		}
+	}
+}
+
+func TestCompareInvalidHash(t *testing.T) {
+	for _, h := range []string{"", "$argon2id$v=19$m=64", "$argon2id$v=19$m=64,t=1,p=1$!!$!!"} {
+		if err := Compare([]byte(h), "password"); err == nil {
+			t.Errorf("expected an error comparing with %q", h)
+		}
+	}
+}
+
+// TestRehash checks that hashes made with another algorithm or cheaper
+// parameters still verify, but are audited as weak so that they're
+// rehashed.
+func TestRehash(t *testing.T) {
+	old, _ := New(Config{Algorithm: AlgoBcrypt, BcryptCost: 4})
+	hash, err := old.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weak := old.Audit(13, 60, hash); len(weak) != 0 {
+		t.Fatalf("expected the hash to meet its own policy, got %v", weak)
+	}
+
+	// Higher cost.
+	costlier, _ := New(Config{Algorithm: AlgoBcrypt, BcryptCost: 5})
+	if weak := costlier.Audit(13, 60, hash); len(weak) != 1 || weak[0] != WeakHash {
+		t.Errorf("expected the cheaper bcrypt hash to be weak, got %v", weak)
+	}
+
+	// Another algorithm.
+	argon, _ := New(argonCfg)
+	if weak := argon.Audit(13, 60, hash); len(weak) != 1 || weak[0] != WeakHash {
+		t.Errorf("expected the bcrypt hash to be weak for argon2id, got %v", weak)
+	}
+	if err := Compare(hash, "correct horse"); err != nil {
+		t.Errorf("expected the old hash to verify after the algorithm changed: %v", err)
+	}
+
+	// Cheaper argon2id parameters.
+	ahash, _ := argon.Hash("correct horse")
+	if weak := argon.Audit(13, 60, ahash); len(weak) != 0 {
+		t.Errorf("expected the argon2id hash to meet its own policy, got %v", weak)
+	}
+	stronger := argonCfg
+	stronger.Argon2Memory = 128
+	p, _ := New(stronger)
+	if weak := p.Audit(13, 60, ahash); len(weak) != 1 || weak[0] != WeakHash {
+		t.Errorf("expected the cheaper argon2id hash to be weak, got %v", weak)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	p, _ := New(Config{BcryptCost: 4, MinLength: 8, MinEntropy: 40})
+	hash, _ := p.Hash("x")
+
+	weak := p.Audit(4, 10, hash)
+	if strings.Join(weak, ",") != WeakLength+","+WeakEntropy {
+		t.Errorf("expected length and entropy weaknesses, got %v", weak)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p, _ := New(Config{BcryptCost: 4, MinLength: 6, MaxLength: 20, MinEntropy: 40})
+	for pwd, ok := range map[string]bool{
+		"abc":                          false,
+		"aaaaaaa":                      false,
+		"Tr0ub4dor&3":                  true,
+		"correct horse battery staple": false,
+	} {
+		if err := p.Validate(pwd); (err == nil) != ok {
+			t.Errorf("Validate(%q): expected ok=%v, got %v", pwd, ok, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, cfg := range []Config{
+		{Algorithm: "md5"},
+		{Algorithm: AlgoBcrypt, BcryptCost: 100},
+		{Algorithm: AlgoArgon2id},
+		{MinLength: 10, MaxLength: 5},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package pdf writes simple, text-only PDF documents, eg: exports of chat
+// histories. It uses the standard Helvetica fonts that every PDF reader
+// has, so documents don't embed fonts and can only represent the
+// characters of the WinAnsi (Latin-1) encoding. Other characters are
+// replaced with "?".
+package pdf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 page size and margins in points.
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+	margin     = 50.0
+
+	// Leading (line height) as a factor of the font size.
+	leading = 1.35
+)
+
+// Style represents the style of a block of text.
+type Style struct {
+	// Font size in points.
+	Size float64
+
+	Bold bool
+
+	// Gray level of the text from 0 (black) to 1 (white).
+	Gray float64
+}
+
+// Doc represents a PDF document being written. Text flows from the top of
+// the first page and new pages are added as needed.
+type Doc struct {
+	pages []*bytes.Buffer
+
+	// Vertical position of the next line on the current page.
+	y float64
+}
+
+// New returns a new, empty document.
+func New() *Doc {
+	d := &Doc{}
+	d.addPage()
+	return d
+}
+
+// Text writes a block of text in the given style. The text is wrapped to
+// the width of the page and newlines start new lines.
+func (d *Doc) Text(s string, st Style) {
+	lh := st.Size * leading
+	for _, line := range d.wrap(s, st) {
+		if d.y-lh < margin {
+			d.addPage()
+		}
+		d.y -= lh
+
+		font := "F1"
+		if st.Bold {
+			font = "F2"
+		}
+		fmt.Fprintf(d.page(), "BT /%s %.2f Tf %.2f g %.2f %.2f Td (%s) Tj ET\n",
+			font, st.Size, st.Gray, margin, d.y, escape(line))
+	}
+}
+
+// Space adds vertical space of h points.
+func (d *Doc) Space(h float64) {
+	d.y -= h
+}
+
+// WriteTo writes the document to w. Pages are numbered in their footers.
+func (d *Doc) WriteTo(w io.Writer) (int64, error) {
+	var (
+		bw   = bufio.NewWriter(w)
+		cw   = &countWriter{w: bw}
+		offs []int64
+	)
+	obj := func(body string) {
+		offs = append(offs, cw.n)
+		fmt.Fprintf(cw, "%d 0 obj\n%s\nendobj\n", len(offs), body)
+	}
+
+	// Objects 1 - 4 are the catalog, the page tree, and the fonts. Each
+	// page is followed by its content stream.
+	fmt.Fprint(cw, "%PDF-1.4\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+i*2)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, p := range d.pages {
+		fmt.Fprintf(p, "BT /F1 8 Tf 0.5 g %.2f %.2f Td (%d / %d) Tj ET\n",
+			pageWidth-margin-30, margin/2, i+1, len(d.pages))
+
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+i*2))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.Len(), p.Bytes()))
+	}
+
+	xref := cw.n
+	fmt.Fprintf(cw, "xref\n0 %d\n0000000000 65535 f \n", len(offs)+1)
+	for _, o := range offs {
+		fmt.Fprintf(cw, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(cw, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offs)+1, xref)
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+func (d *Doc) addPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - margin
+}
+
+func (d *Doc) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// wrap breaks text into lines that fit the width of the page. Words longer
+// than a line are broken.
+func (d *Doc) wrap(s string, st Style) []string {
+	var (
+		maxW = pageWidth - margin*2
+		out  []string
+	)
+	for _, para := range strings.Split(encode(s), "\n") {
+		var (
+			line string
+			w    float64
+		)
+		for _, word := range strings.Split(para, " ") {
+			ww := width(word, st)
+			sw := width(" ", st)
+
+			// Break words that don't fit on a line of their own.
+			for ww > maxW {
+				if line != "" {
+					out = append(out, line)
+					line, w = "", 0
+				}
+				n := fit(word, maxW, st)
+				out = append(out, word[:n])
+				word = word[n:]
+				ww = width(word, st)
+			}
+
+			switch {
+			case line == "":
+				line, w = word, ww
+			case w+sw+ww <= maxW:
+				line += " " + word
+				w += sw + ww
+			default:
+				out = append(out, line)
+				line, w = word, ww
+			}
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// fit returns the number of bytes of an encoded word that fit in width w.
+func fit(word string, w float64, st Style) int {
+	n := 0
+	for n < len(word) && width(word[:n+1], st) <= w {
+		n++
+	}
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// width returns the width of encoded text in points.
+func width(s string, st Style) float64 {
+	var w float64
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 32 && c <= 126 {
+			w += float64(helveticaWidths[c-32])
+		} else {
+			w += 556
+		}
+	}
+
+	// Bold glyphs are slightly wider. Overestimating wraps lines early
+	// instead of overflowing the page.
+	if st.Bold {
+		w *= 1.1
+	}
+	return w * st.Size / 1000
+}
+
+// encode converts text to WinAnsi (Latin-1) bytes. Characters that can't be
+// represented are replaced with "?" and control characters other than
+// newlines are dropped.
+func encode(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		r, n := utf8.DecodeRuneInString(s)
+		s = s[n:]
+		switch {
+		case r == '\n':
+			b.WriteByte('\n')
+		case r == '\t':
+			b.WriteByte(' ')
+		case r < 32 || (r >= 127 && r < 160):
+		case r < 256:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// escape escapes the delimiters of a PDF string literal.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`, "\r", "").Replace(s)
+}
+
+// countWriter counts the bytes written for the cross-reference table and
+// records the first error.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// helveticaWidths are the widths of the printable ASCII characters (32 -
+// 126) in Helvetica in thousandths of the font size.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Queue is an admission queue that admits requests at a fixed rate. Requests
+// that can't be admitted immediately wait in the queue for up to a timeout.
+// Requests arriving when the queue is full are turned away immediately.
+type Queue struct {
+	limiter *Limiter
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// NewQueue returns a new admission queue. It returns nil if the rate
+// limit is disabled, which Admit treats as "always admitted".
+func NewQueue(c Config, size int, timeout time.Duration) *Queue {
+	l := New(c)
+	if l == nil {
+		return nil
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &Queue{
+		limiter: l,
+		slots:   make(chan struct{}, size),
+		timeout: timeout,
+	}
+}
+
+// Admit blocks until the request is admitted or the queue timeout expires
+// and reports whether the request was admitted.
+func (q *Queue) Admit() bool {
+	if q == nil {
+		return true
+	}
+
+	// Take a place in the queue.
+	select {
+	case q.slots <- struct{}{}:
+		defer func() { <-q.slots }()
+	default:
+		return false
+	}
+
+	// Wait for a token, but not past the timeout.
+	deadline := time.Now().Add(q.timeout)
+	for !q.limiter.Allow("") {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		if d := q.limiter.RetryAfter(); d < wait {
+			wait = d
+		}
+		time.Sleep(wait)
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(Config{Requests: 1, Interval: 50 * time.Millisecond}, 1, time.Second)
+	if !q.Admit() {
+		t.Fatal("expected the first request to be admitted immediately")
+	}
+
+	// The next request waits for a token.
+	start := time.Now()
+	if !q.Admit() {
+		t.Fatal("expected the queued request to be admitted")
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("expected the queued request to wait for a token, waited %v", d)
+	}
+
+	// Requests that can't get a token before the timeout are turned away.
+	q = NewQueue(Config{Requests: 1, Interval: time.Hour}, 1, 10*time.Millisecond)
+	q.Admit()
+	if q.Admit() {
+		t.Error("expected the request to time out")
+	}
+}
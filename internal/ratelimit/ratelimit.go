@@ -0,0 +1,149 @@
+// Package ratelimit implements a simple in-memory, keyed token bucket
+// rate limiter.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Config represents a rate limit of N requests per interval. A bucket holds
+// up to N tokens and is refilled at N tokens per interval.
+type Config struct {
+	Requests int           `koanf:"requests"`
+	Interval time.Duration `koanf:"interval"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a keyed token bucket rate limiter. A Limiter with a rate of 0
+// is disabled and allows all requests.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mut       sync.Mutex
+}
+
+// New returns a new Limiter. It returns nil if the limit is disabled
+// (0 requests), which Allow treats as "always allowed".
+func New(c Config) *Limiter {
+	if c.Requests <= 0 || c.Interval <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:      float64(c.Requests) / c.Interval.Seconds(),
+		burst:     float64(c.Requests),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// NewReloadable returns a new Limiter whose limit can be changed with
+// SetConfig. Unlike New, it's never nil and allows all requests while the
+// limit is disabled.
+func NewReloadable(c Config) *Limiter {
+	l := &Limiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+	l.SetConfig(c)
+	return l
+}
+
+// SetConfig changes the limit. Existing buckets are capped at the new
+// burst. A limit with 0 requests disables the limiter.
+func (l *Limiter) SetConfig(c Config) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if c.Requests <= 0 || c.Interval <= 0 {
+		l.rate, l.burst = 0, 0
+		l.buckets = make(map[string]*bucket)
+		return
+	}
+	l.rate = float64(c.Requests) / c.Interval.Seconds()
+	l.burst = float64(c.Requests)
+	for _, b := range l.buckets {
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+}
+
+// Allow consumes a token from the given key's bucket and reports whether
+// the request is permitted.
+func (l *Limiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+// AllowN consumes n tokens from the given key's bucket if they're all
+// available and reports whether the request is permitted.
+func (l *Limiter) AllowN(key string, n int) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill the bucket for the time elapsed since the last request.
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// RetryAfter returns the approximate time after which a token becomes
+// available in an empty bucket.
+func (l *Limiter) RetryAfter() time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / l.rate)
+}
+
+// sweep deletes buckets that would have been refilled completely by now
+// so that the map doesn't grow unbounded. It runs at most once a minute.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
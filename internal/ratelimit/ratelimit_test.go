@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowBurst(t *testing.T) {
+	l := New(Config{Requests: 3, Interval: time.Hour})
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("expected request %d within the burst to be allowed", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("expected a request over the burst to be denied")
+	}
+
+	// Keys have their own buckets.
+	if !l.Allow("b") {
+		t.Error("expected a request for another key to be allowed")
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l := New(Config{Requests: 2, Interval: 100 * time.Millisecond})
+	l.Allow("a")
+	l.Allow("a")
+	if l.Allow("a") {
+		t.Fatal("expected the bucket to be empty")
+	}
+
+	// A token is refilled every 50ms.
+	time.Sleep(60 * time.Millisecond)
+	if !l.Allow("a") {
+		t.Error("expected a token to be refilled")
+	}
+	if l.Allow("a") {
+		t.Error("expected only one token to be refilled")
+	}
+
+	// The bucket doesn't fill beyond the burst.
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("expected request %d after a full refill to be allowed", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("expected the bucket to be capped at the burst")
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	l := New(Config{Requests: 5, Interval: time.Hour})
+	if !l.AllowN("a", 4) {
+		t.Fatal("expected 4 of 5 tokens to be allowed")
+	}
+	if l.AllowN("a", 2) {
+		t.Error("expected 2 tokens to be denied with 1 left")
+	}
+
+	// A denied request doesn't consume tokens.
+	if !l.AllowN("a", 1) {
+		t.Error("expected the remaining token to be allowed")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l := New(Config{})
+	if l != nil {
+		t.Fatal("expected a disabled limiter to be nil")
+	}
+	for i := 0; i < 100; i++ {
+		if !l.Allow("a") {
+			t.Fatal("expected a nil limiter to allow all requests")
+		}
+	}
+	if l.RetryAfter() != 0 {
+		t.Error("expected a nil limiter to have no retry period")
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	l := NewReloadable(Config{})
+	for i := 0; i < 10; i++ {
+		if !l.Allow("a") {
+			t.Fatal("expected a disabled reloadable limiter to allow all requests")
+		}
+	}
+
+	l.SetConfig(Config{Requests: 4, Interval: time.Hour})
+	l.Allow("a")
+
+	// Shrinking the limit caps existing buckets.
+	l.SetConfig(Config{Requests: 1, Interval: time.Hour})
+	if !l.Allow("a") {
+		t.Fatal("expected a token in the capped bucket")
+	}
+	if l.Allow("a") {
+		t.Error("expected the bucket to be capped at the new burst")
+	}
+
+	l.SetConfig(Config{})
+	if !l.Allow("a") {
+		t.Error("expected the limiter to be disabled")
+	}
+}
@@ -0,0 +1,61 @@
+// Package totp implements validation of time-based one-time passwords
+// (RFC 6238) as generated by common authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	step   = 30
+	digits = 6
+
+	// Number of steps before and after the current one that are accepted
+	// to allow for clock drift.
+	skew = 1
+)
+
+// Validate checks a code against a base32 encoded secret at time t.
+func Validate(secret, code string, t time.Time) (bool, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return false, err
+	}
+
+	n := t.Unix() / step
+	for i := int64(-skew); i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(generate(key, n+i)), []byte(code)) == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decodeSecret decodes a base32 secret. Padding, spaces, and case are
+// ignored.
+func decodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(strings.TrimRight(s, "="), " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+// generate generates the code for the given step counter.
+func generate(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	// Dynamic truncation.
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, v%1000000)
+}
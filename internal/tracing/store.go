@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/region"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Store wraps a store and traces its operations. The store interfaces don't
+// carry request contexts, so store spans are the roots of their own traces
+// and are tagged with the room ID to correlate them with requests.
+type Store struct {
+	st region.Backend
+}
+
+// WrapStore returns st wrapped with tracing.
+func WrapStore(st region.Backend) *Store {
+	return &Store{st: st}
+}
+
+func start(op, roomID string) trace.Span {
+	_, span := Tracer.Start(context.Background(), "store."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("room.id", roomID)))
+	return span
+}
+
+// AddRoom adds a room to the store.
+func (s *Store) AddRoom(r store.Room, ttl time.Duration) (err error) {
+	span := start("AddRoom", r.ID)
+	defer func() { End(span, err) }()
+	return s.st.AddRoom(r, ttl)
+}
+
+// UpdateRoom updates a room in the store.
+func (s *Store) UpdateRoom(r store.Room) (err error) {
+	span := start("UpdateRoom", r.ID)
+	defer func() { End(span, err) }()
+	return s.st.UpdateRoom(r)
+}
+
+// GetRoom gets a room from the store.
+func (s *Store) GetRoom(id string) (out store.Room, err error) {
+	span := start("GetRoom", id)
+	defer func() { End(span, err) }()
+	return s.st.GetRoom(id)
+}
+
+// ExtendRoomTTL extends a room's TTL.
+func (s *Store) ExtendRoomTTL(id string, ttl time.Duration) (err error) {
+	span := start("ExtendRoomTTL", id)
+	defer func() { End(span, err) }()
+	return s.st.ExtendRoomTTL(id, ttl)
+}
+
+// RoomExists checks if a room exists.
+func (s *Store) RoomExists(id string) (ok bool, err error) {
+	span := start("RoomExists", id)
+	defer func() { End(span, err) }()
+	return s.st.RoomExists(id)
+}
+
+// RemoveRoom removes a room.
+func (s *Store) RemoveRoom(id string) (err error) {
+	span := start("RemoveRoom", id)
+	defer func() { End(span, err) }()
+	return s.st.RemoveRoom(id)
+}
+
+// GetRooms retrieves all the rooms.
+func (s *Store) GetRooms() (out []store.Room, err error) {
+	span := start("GetRooms", "")
+	defer func() { End(span, err) }()
+	return s.st.GetRooms()
+}
+
+// AddSession adds a session to a room.
+func (s *Store) AddSession(sess store.Sess, roomID string, ttl time.Duration) (err error) {
+	span := start("AddSession", roomID)
+	defer func() { End(span, err) }()
+	return s.st.AddSession(sess, roomID, ttl)
+}
+
+// GetSession gets a session.
+func (s *Store) GetSession(sessID, roomID string) (out store.Sess, err error) {
+	span := start("GetSession", roomID)
+	defer func() { End(span, err) }()
+	return s.st.GetSession(sessID, roomID)
+}
+
+// GetSessions gets the sessions of a room.
+func (s *Store) GetSessions(roomID string) (out []store.Sess, err error) {
+	span := start("GetSessions", roomID)
+	defer func() { End(span, err) }()
+	return s.st.GetSessions(roomID)
+}
+
+// RemoveSession removes a session.
+func (s *Store) RemoveSession(sessID, roomID string) (err error) {
+	span := start("RemoveSession", roomID)
+	defer func() { End(span, err) }()
+	return s.st.RemoveSession(sessID, roomID)
+}
+
+// ClearSessions removes the sessions of a room.
+func (s *Store) ClearSessions(roomID string) (err error) {
+	span := start("ClearSessions", roomID)
+	defer func() { End(span, err) }()
+	return s.st.ClearSessions(roomID)
+}
+
+// AddMessageCache adds a message to a room's message cache.
+func (s *Store) AddMessageCache(roomID string, m store.Message, ttl time.Duration) (err error) {
+	span := start("AddMessageCache", roomID)
+	defer func() { End(span, err) }()
+	return s.st.AddMessageCache(roomID, m, ttl)
+}
+
+// AddMessageCacheBatch adds messages to a room's message cache.
+func (s *Store) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) (err error) {
+	span := start("AddMessageCacheBatch", roomID)
+	span.SetAttributes(attribute.Int("messages", len(msgs)))
+	defer func() { End(span, err) }()
+	return s.st.AddMessageCacheBatch(roomID, msgs, ttl)
+}
+
+// GetMessageCache gets a room's message cache.
+func (s *Store) GetMessageCache(roomID string) (out []store.Message, err error) {
+	span := start("GetMessageCache", roomID)
+	defer func() {
+		span.SetAttributes(attribute.Int("messages", len(out)))
+		End(span, err)
+	}()
+	return s.st.GetMessageCache(roomID)
+}
+
+// GetMessageCachePage gets a page of a room's message cache.
+func (s *Store) GetMessageCachePage(roomID string, before int64, limit int) (out []store.Message, next int64, err error) {
+	span := start("GetMessageCachePage", roomID)
+	defer func() {
+		span.SetAttributes(attribute.Int("messages", len(out)))
+		End(span, err)
+	}()
+	return s.st.GetMessageCachePage(roomID, before, limit)
+}
+
+// ClearMessageCache clears a room's message cache.
+func (s *Store) ClearMessageCache(roomID string) (err error) {
+	span := start("ClearMessageCache", roomID)
+	defer func() { End(span, err) }()
+	return s.st.ClearMessageCache(roomID)
+}
+
+// Ping checks if the store is reachable.
+func (s *Store) Ping() (err error) {
+	span := start("Ping", "")
+	defer func() { End(span, err) }()
+	return s.st.Ping()
+}
+
+// Close closes the wrapped store if it persists to disk.
+func (s *Store) Close() error {
+	if c, ok := s.st.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
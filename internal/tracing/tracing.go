@@ -0,0 +1,151 @@
+// Package tracing instruments the app with OpenTelemetry spans and exports
+// them to an OTLP (HTTP) collector. When tracing is disabled, the global
+// no-op tracer is used and spans cost next to nothing.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer creates the app's spans.
+var Tracer = otel.Tracer("github.com/knadh/niltalk")
+
+// Config represents the tracing configuration.
+type Config struct {
+	Enabled bool `koanf:"enabled"`
+
+	// OTLP HTTP collector address (host:port) and URL path.
+	Endpoint string `koanf:"endpoint"`
+	URLPath  string `koanf:"url_path"`
+
+	// Send spans over plain HTTP instead of HTTPS.
+	Insecure bool `koanf:"insecure"`
+
+	// Headers sent to the collector, eg: for authentication.
+	Headers map[string]string `koanf:"headers"`
+
+	ServiceName string `koanf:"service_name"`
+
+	// Fraction of traces sampled (0 - 1). Traces that are sampled by the
+	// caller (traceparent header) are always sampled.
+	SampleRatio float64 `koanf:"sample_ratio"`
+}
+
+// Init sets up the global tracer provider that exports spans to the
+// collector. It returns a function that flushes pending spans on shutdown.
+func Init(cfg Config) (func(context.Context) error, error) {
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "niltalk"
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.Endpoint),
+		otlptracehttp.WithTimeout(time.Second * 10),
+	}
+	if cfg.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(cfg.URLPath))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+
+	// The exporter connects lazily, so an unreachable collector doesn't
+	// prevent the app from starting.
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// Validate checks the config of enabled tracing.
+func (cfg Config) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Endpoint == "" {
+		return errors.New("tracing.endpoint is empty")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return errors.New("tracing.sample_ratio should be 0 - 1")
+	}
+	return nil
+}
+
+// Middleware is an HTTP middleware that traces requests. Spans are named
+// after the matched route and continue the caller's trace if the request
+// carries a traceparent header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+			))
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		// The route and its params are available after routing.
+		if rc := chi.RouteContext(r.Context()); rc != nil {
+			if p := rc.RoutePattern(); p != "" {
+				span.SetName(r.Method + " " + p)
+				span.SetAttributes(attribute.String("http.route", p))
+			}
+			if id := rc.URLParam("roomID"); id != "" {
+				span.SetAttributes(attribute.String("room.id", id))
+			}
+		}
+
+		status := ww.Status()
+		if status != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", status))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// End ends a span and records err, if any, on it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
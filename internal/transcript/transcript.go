@@ -0,0 +1,135 @@
+// Package transcript generates room transcripts (exports) signed with an
+// instance key so that they can be proven to be unmodified later.
+package transcript
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// ErrBadSignature indicates that a transcript doesn't match its signature.
+var ErrBadSignature = errors.New("signature verification failed")
+
+// Transcript represents the exported messages of a room.
+type Transcript struct {
+	RoomID     string          `json:"room_id"`
+	RoomName   string          `json:"room_name"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Messages   []store.Message `json:"messages"`
+
+	// Participants' handles and IDs are replaced with pseudonyms.
+	Anonymized bool `json:"anonymized,omitempty"`
+}
+
+// signed is the envelope of a signed transcript. The signature is over the
+// exact bytes of the transcript, which is retained as-is.
+type signed struct {
+	Transcript json.RawMessage `json:"transcript"`
+	Key        string          `json:"key,omitempty"`
+	Signature  string          `json:"signature,omitempty"`
+}
+
+// Signer signs transcripts with an ed25519 instance key.
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+// NewSigner returns a Signer given a base64 encoded 32 byte ed25519 seed.
+// If the seed is empty, a Signer that produces unsigned transcripts
+// is returned.
+func NewSigner(seed string) (*Signer, error) {
+	if seed == "" {
+		return &Signer{}, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signing key: %v", err)
+	}
+	if len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key should be %d bytes", ed25519.SeedSize)
+	}
+	return &Signer{key: ed25519.NewKeyFromSeed(b)}, nil
+}
+
+// Enabled returns true if the signer has a key.
+func (s *Signer) Enabled() bool {
+	return s.key != nil
+}
+
+// PublicKey returns the base64 encoded public key of the signer.
+func (s *Signer) PublicKey() string {
+	if s.key == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// Sign returns the base64 encoded detached signature of arbitrary export
+// data. It returns an empty string if signing isn't enabled.
+func (s *Signer) Sign(b []byte) string {
+	if s.key == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, b))
+}
+
+// Marshal returns the JSON encoded transcript with an embedded signature.
+func (s *Signer) Marshal(t Transcript) ([]byte, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(signed{
+		Transcript: b,
+		Key:        s.PublicKey(),
+		Signature:  s.Sign(b),
+	})
+}
+
+// Verify verifies the embedded signature of a JSON transcript generated by
+// Marshal against the signer's key and returns the transcript.
+func (s *Signer) Verify(b []byte) (Transcript, error) {
+	var (
+		out Transcript
+		doc signed
+	)
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return out, fmt.Errorf("error parsing transcript: %v", err)
+	}
+	if doc.Signature == "" {
+		return out, errors.New("transcript is not signed")
+	}
+	if err := s.VerifyDetached(doc.Transcript, doc.Signature); err != nil {
+		return out, err
+	}
+
+	if err := json.Unmarshal(doc.Transcript, &out); err != nil {
+		return out, fmt.Errorf("error parsing transcript: %v", err)
+	}
+	return out, nil
+}
+
+// VerifyDetached verifies the base64 encoded detached signature of arbitrary
+// export data against the signer's key.
+func (s *Signer) VerifyDetached(b []byte, sig string) error {
+	if s.key == nil {
+		return errors.New("no signing key configured")
+	}
+
+	sb, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(s.key.Public().(ed25519.PublicKey), b, sb) {
+		return ErrBadSignature
+	}
+	return nil
+}
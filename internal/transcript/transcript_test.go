@@ -0,0 +1,119 @@
+package transcript
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+var (
+	seedA = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	seedB = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func newTranscript() Transcript {
+	return Transcript{
+		RoomID:     "room1",
+		RoomName:   "Standup",
+		ExportedAt: time.Date(2026, 10, 17, 5, 30, 0, 0, time.UTC),
+		Messages: []store.Message{
+			{ID: "m1", PeerHandle: "alice", Message: "hello"},
+			{ID: "m2", PeerHandle: "bob", Message: "hi"},
+		},
+	}
+}
+
+func TestMarshalVerify(t *testing.T) {
+	s, err := NewSigner(seedA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := s.Marshal(newTranscript())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := s.Verify(b)
+	if err != nil {
+		t.Fatalf("expected the transcript to verify: %v", err)
+	}
+	if tr.RoomID != "room1" || len(tr.Messages) != 2 || tr.Messages[1].Message != "hi" {
+		t.Errorf("unexpected transcript: %+v", tr)
+	}
+
+	// The key is embedded.
+	var doc signed
+	json.Unmarshal(b, &doc)
+	if doc.Key != s.PublicKey() {
+		t.Errorf("expected the public key %s, got %s", s.PublicKey(), doc.Key)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	s, _ := NewSigner(seedA)
+	b, _ := s.Marshal(newTranscript())
+
+	tampered := bytes.Replace(b, []byte("hello"), []byte("hellO"), 1)
+	if _, err := s.Verify(tampered); err != ErrBadSignature {
+		t.Errorf("expected a modified transcript to fail verification, got %v", err)
+	}
+
+	// Signed by another key.
+	other, _ := NewSigner(seedB)
+	if _, err := other.Verify(b); err != ErrBadSignature {
+		t.Errorf("expected verification with another key to fail, got %v", err)
+	}
+
+	for _, in := range [][]byte{[]byte("not json"), []byte(`{"transcript":{}}`)} {
+		if _, err := s.Verify(in); err == nil {
+			t.Errorf("expected %s to fail verification", in)
+		}
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	s, err := NewSigner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled() || s.PublicKey() != "" || s.Sign([]byte("x")) != "" {
+		t.Error("expected a signer without a key to be disabled")
+	}
+
+	b, err := s.Marshal(newTranscript())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := NewSigner(seedA)
+	if _, err := signer.Verify(b); err == nil {
+		t.Error("expected an unsigned transcript to fail verification")
+	}
+}
+
+func TestVerifyDetached(t *testing.T) {
+	s, _ := NewSigner(seedA)
+	data := []byte("room,handle,message\n")
+	sig := s.Sign(data)
+
+	if err := s.VerifyDetached(data, sig); err != nil {
+		t.Errorf("expected the detached signature to verify: %v", err)
+	}
+	if err := s.VerifyDetached(append(data, 'x'), sig); err != ErrBadSignature {
+		t.Errorf("expected modified data to fail verification, got %v", err)
+	}
+	if err := s.VerifyDetached(data, "!!"); err != ErrBadSignature {
+		t.Errorf("expected an undecodable signature to fail verification, got %v", err)
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	for _, seed := range []string{"!!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := NewSigner(seed); err == nil {
+			t.Errorf("expected an error for seed %q", seed)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package turn issues time-limited credentials for a TURN server (eg:
+// coturn) with the TURN REST API scheme, so that peers that can't connect
+// to each other directly can relay WebRTC media through it. The credentials
+// are derived from a secret shared with the TURN server
+// (static-auth-secret in coturn) and aren't stored anywhere.
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config represents the TURN configuration.
+type Config struct {
+	// TURN / STUN server URLs, eg: turn:turn.example.com:3478?transport=udp.
+	URLs []string `koanf:"urls"`
+
+	// Secret shared with the TURN server.
+	Secret string `koanf:"secret"`
+
+	// Validity of issued credentials.
+	TTL time.Duration `koanf:"ttl"`
+}
+
+// Credentials represents TURN credentials in the shape of a WebRTC
+// RTCIceServer.
+type Credentials struct {
+	URLs       []string  `json:"urls"`
+	Username   string    `json:"username"`
+	Credential string    `json:"credential"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// TURN issues TURN credentials.
+type TURN struct {
+	cfg Config
+}
+
+// New returns a new instance of TURN. It returns nil if no URLs are
+// configured.
+func New(cfg Config) (*TURN, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, nil
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("secret is required")
+	}
+	for _, u := range cfg.URLs {
+		if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") && !strings.HasPrefix(u, "stun:") {
+			return nil, fmt.Errorf("invalid url: %s", u)
+		}
+	}
+
+	if cfg.TTL == 0 {
+		cfg.TTL = time.Hour * 12
+	}
+	if cfg.TTL < time.Minute {
+		return nil, errors.New("ttl should be >= 1m")
+	}
+	return &TURN{cfg: cfg}, nil
+}
+
+// Credentials issues credentials for a user (eg: a session) that expire
+// after the TTL. The username is "expiry:user" and the credential is the
+// base64 encoded HMAC-SHA1 of the username keyed with the shared secret.
+func (t *TURN) Credentials(user string) Credentials {
+	exp := time.Now().Add(t.cfg.TTL)
+	name := strconv.FormatInt(exp.Unix(), 10) + ":" + user
+
+	h := hmac.New(sha1.New, []byte(t.cfg.Secret))
+	h.Write([]byte(name))
+
+	return Credentials{
+		URLs:       t.cfg.URLs,
+		Username:   name,
+		Credential: base64.StdEncoding.EncodeToString(h.Sum(nil)),
+		ExpiresAt:  exp,
+	}
+}
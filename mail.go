@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/ratelimit"
+)
+
+// smtpCfg represents the SMTP server that room transcripts are emailed
+// with. Transcript emails are disabled if the address is empty.
+type smtpCfg struct {
+	Addr     string `koanf:"addr"`
+	Username string `koanf:"username"`
+	Password string `koanf:"password"`
+	From     string `koanf:"from"`
+
+	// Domains of the addresses that transcripts can be emailed to. Rooms
+	// are created anonymously, so the server would otherwise email
+	// anything posted in them to any address.
+	AllowedDomains []string `koanf:"allowed_domains"`
+
+	// Emails sent by the instance and per room.
+	RateLimit     ratelimit.Config `koanf:"rate_limit"`
+	RoomRateLimit ratelimit.Config `koanf:"room_rate_limit"`
+}
+
+// validate checks that the settings required to send emails are set.
+func (c smtpCfg) validate() error {
+	if c.Addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("invalid smtp.addr: %v", err)
+	}
+	if c.From == "" {
+		return errors.New("smtp.from is required")
+	}
+	if len(c.AllowedDomains) == 0 {
+		return errors.New("smtp.allowed_domains is required")
+	}
+	for _, d := range c.AllowedDomains {
+		if d == "" || strings.ContainsAny(d, "@ ") {
+			return fmt.Errorf("invalid domain in smtp.allowed_domains: %s", d)
+		}
+	}
+	return nil
+}
+
+// transcriptMailer emails the transcripts of rooms to their owners when
+// the rooms are removed. It implements hub.Archiver.
+type transcriptMailer struct {
+	app     *App
+	cfg     smtpCfg
+	auth    smtp.Auth
+	domains map[string]bool
+	log     *log.Logger
+
+	// Emails sent by the instance ("") and by room ID.
+	limiter     *ratelimit.Limiter
+	roomLimiter *ratelimit.Limiter
+}
+
+// newTranscriptMailer returns a transcriptMailer. It returns nil if SMTP
+// isn't configured.
+func newTranscriptMailer(c smtpCfg, app *App) (*transcriptMailer, error) {
+	if err := c.validate(); err != nil || c.Addr == "" {
+		return nil, err
+	}
+
+	m := &transcriptMailer{
+		app:         app,
+		cfg:         c,
+		domains:     make(map[string]bool, len(c.AllowedDomains)),
+		log:         app.logger,
+		limiter:     ratelimit.New(c.RateLimit),
+		roomLimiter: ratelimit.New(c.RoomRateLimit),
+	}
+	for _, d := range c.AllowedDomains {
+		m.domains[strings.ToLower(d)] = true
+	}
+	if c.Username != "" {
+		host, _, _ := net.SplitHostPort(c.Addr)
+		m.auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return m, nil
+}
+
+// AllowRecipient checks if the address is on one of the allowed domains.
+func (m *transcriptMailer) AllowRecipient(addr string) bool {
+	i := strings.LastIndex(addr, "@")
+	return i >= 0 && m.domains[strings.ToLower(addr[i+1:])]
+}
+
+// ArchiveRoom emails a room's transcript as an HTML attachment in the
+// background. Transcripts over the instance's or the room's rate limit, or
+// to addresses that are no longer allowed, are dropped.
+func (m *transcriptMailer) ArchiveRoom(a hub.RoomArchive) {
+	if !m.AllowRecipient(a.Email) {
+		m.log.Printf("not emailing transcript of %s: recipient not allowed", a.RoomID)
+		return
+	}
+	if !m.roomLimiter.Allow(a.RoomID) || !m.limiter.Allow("") {
+		m.log.Printf("not emailing transcript of %s: rate limited", a.RoomID)
+		m.app.hub.Audit.Record("room.transcript_email_limited", "", a.RoomID, nil)
+		return
+	}
+
+	go func() {
+		if err := m.send(a); err != nil {
+			m.log.Printf("error emailing transcript of %s: %v", a.RoomID, err)
+			return
+		}
+		m.app.hub.Audit.Record("room.transcript_email", "", a.RoomID, map[string]interface{}{
+			"reason":   a.Reason,
+			"messages": len(a.Messages),
+		})
+	}()
+}
+
+func (m *transcriptMailer) send(a hub.RoomArchive) error {
+	lang := a.Language
+	if lang == "" {
+		lang = translator.Default()
+	}
+	loc := time.UTC
+	if l, err := time.LoadLocation(a.Timezone); a.Timezone != "" && err == nil {
+		loc = l
+	}
+
+	// The transcript is rendered with the templates of the room's vhost.
+	var (
+		vh  = m.app.vhostByID(a.Tenant)
+		t   = newFormattedTranscript(a.RoomID, a.RoomName, a.Messages, loc, false)
+		att bytes.Buffer
+	)
+	if err := renderHTMLTranscript(&att, m.app, vh, lang, t); err != nil {
+		return fmt.Errorf("error rendering transcript: %v", err)
+	}
+
+	name := "#" + a.RoomID
+	if a.RoomName != "" {
+		name = fmt.Sprintf("%s (#%s)", a.RoomName, a.RoomID)
+	}
+	closed := a.ClosedAt.In(loc).Format("Jan 02, 2006 15:04:05 MST")
+	body := translator.T(lang, "The room %s expired on %s. Its transcript is attached.", name, closed)
+	if a.Reason == hub.TypeRoomDispose {
+		body = translator.T(lang, "The room %s was disposed of on %s. Its transcript is attached.", name, closed)
+	}
+
+	msg, err := m.compose(a.Email, translator.T(lang, "Transcript of %s", name), body,
+		fmt.Sprintf("niltalk-%s.html", a.RoomID), att.Bytes())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.cfg.Addr, m.auth, m.cfg.From, []string{a.Email}, msg)
+}
+
+// compose composes a multipart email with a plain text body and an HTML
+// attachment.
+func (m *transcriptMailer) compose(to, subject, body, filename string, att []byte) ([]byte, error) {
+	var (
+		b  bytes.Buffer
+		mw = multipart.NewWriter(&b)
+	)
+
+	// Addresses were validated. Subjects may have the room's name, so
+	// newlines are stripped to prevent header injection.
+	fmt.Fprintf(&b, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8",
+		strings.NewReplacer("\r", " ", "\n", " ").Replace("[niltalk] "+subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	p, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.Write([]byte(body + "\r\n"))
+
+	p, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, filename)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Base64 lines are limited to 76 characters.
+	enc := base64.StdEncoding.EncodeToString(att)
+	for len(enc) > 76 {
+		p.Write([]byte(enc[:76] + "\r\n"))
+		enc = enc[76:]
+	}
+	p.Write([]byte(enc + "\r\n"))
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
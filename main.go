@@ -4,17 +4,22 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/go-chi/cors"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,27 +29,100 @@ import (
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
+	"github.com/knadh/niltalk/internal/audit"
+	"github.com/knadh/niltalk/internal/captcha"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/i18n"
+	"github.com/knadh/niltalk/internal/ipfilter"
+	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/internal/passwd"
+	"github.com/knadh/niltalk/internal/ratelimit"
+	"github.com/knadh/niltalk/internal/tracing"
+	"github.com/knadh/niltalk/internal/transcript"
+	"github.com/knadh/niltalk/internal/turn"
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/bolt"
+	"github.com/knadh/niltalk/store/lock"
+	"github.com/knadh/niltalk/store/mem"
 	"github.com/knadh/niltalk/store/redis"
+	"github.com/knadh/niltalk/store/region"
+	"github.com/knadh/niltalk/store/sqlite"
 	"github.com/knadh/stuffbin"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
 	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 	ko     = koanf.New(".")
 
+	// Translations of templates, system messages, and API errors. Text is
+	// left in English until the catalogs are loaded.
+	translator *i18n.I18n
+
 	// Version of the build injected at build time.
 	buildString = "unknown"
 )
 
+// storeBackend is a store that also caches messages (store.MessageCache).
+// The cache methods are listed as both interfaces have Ping().
+type storeBackend interface {
+	store.Store
+	AddMessageCache(roomID string, m store.Message, ttl time.Duration) error
+	AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error
+	GetMessageCache(roomID string) ([]store.Message, error)
+	GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error)
+	ClearMessageCache(roomID string) error
+}
+
 // App is the global app context that's passed around.
 type App struct {
-	hub    *hub.Hub
-	cfg    *hub.Config
-	tpl    *template.Template
-	fs     stuffbin.FileSystem
-	logger *log.Logger
+	hub     *hub.Hub
+	wsQueue *ratelimit.Queue
+	cfg     *hub.Config
+	captcha *captcha.Captcha
+	turn    *turn.TURN
+	passwd  *passwd.Passwd
+	signer  *transcript.Signer
+	tpl     *template.Template
+	fs      stuffbin.FileSystem
+	logger  *log.Logger
+
+	// Public routes that are enabled.
+	routes *routeToggles
+
+	// Data residency regions that rooms can be created in.
+	regions []string
+
+	// Room presets by name.
+	presets map[string]roomPreset
+
+	// Virtual hosts by host and the default vhost that serves other hosts.
+	vhosts       map[string]*vhost
+	defaultVhost *vhost
+
+	// Rate limiters for batch messages by session, logins by IP, and room
+	// creation by IP and globally. Their limits are updated when the config
+	// is reloaded.
+	batchLimiter        *ratelimit.Limiter
+	loginLimiter        *ratelimit.Limiter
+	roomCreateIPLimiter *ratelimit.Limiter
+	roomCreateLimiter   *ratelimit.Limiter
+
+	// Static files, compiled templates, and the IP blocklist, which are
+	// replaced when the config is reloaded. Guarded by mut.
+	mut       sync.RWMutex
+	blocklist *ipfilter.Filter
+
+	// Content hashes of the static files by path. Guarded by mut.
+	assets map[string]string
+
+	// Networks of reverse proxies whose real IP headers are honoured.
+	trustedProxies []*net.IPNet
+
+	// Flushes pending trace spans.
+	stopTracing func(context.Context) error
 }
 
 func loadConfig() {
@@ -59,6 +137,8 @@ func loadConfig() {
 	f.Bool("new-config", false, "generate sample config file")
 	f.String("static-dir", "", "(optional) path to directory with static files")
 	f.Bool("version", false, "Show build version")
+	f.String("verify", "", "Verify the signature of an exported transcript file and exit")
+	f.Bool("check-config", false, "Validate the config and exit")
 	f.Parse(os.Args[1:])
 
 	// Display version.
@@ -77,36 +157,55 @@ func loadConfig() {
 		os.Exit(0)
 	}
 
-	// Read the config files.
+	// Read the config files and env flags.
 	cFiles, _ := f.GetStringSlice("config")
-	for _, f := range cFiles {
+	if err := loadConfigFiles(ko, cFiles); err != nil {
+		if os.IsNotExist(err) {
+			logger.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
+		}
+		logger.Fatalf("error loadng config from file: %v.", err)
+	}
+
+	// Merge command line flags into config.
+	ko.Load(posflag.Provider(f, ".", ko), nil)
+}
+
+// loadConfigFiles loads the given config files in order into k and merges
+// env flags (NILTALK_*) into it.
+func loadConfigFiles(k *koanf.Koanf, files []string) error {
+	for _, f := range files {
 		logger.Printf("reading config: %s", f)
-		if err := ko.Load(file.Provider(f), toml.Parser()); err != nil {
-			if os.IsNotExist(err) {
-				logger.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
-			}
-			logger.Fatalf("error loadng config from file: %v.", err)
+		if err := k.Load(file.Provider(f), toml.Parser()); err != nil {
+			return err
 		}
 	}
 
-	// Merge env flags into config.
-	if err := ko.Load(env.Provider("NILTALK_", ".", func(s string) string {
+	if err := k.Load(env.Provider("NILTALK_", ".", func(s string) string {
 		return strings.Replace(strings.ToLower(
 			strings.TrimPrefix(s, "NILTALK_")), "__", ".", -1)
 	}), nil); err != nil {
 		logger.Printf("error loading env config: %v", err)
 	}
-
-	// Merge command line flags into config.
-	ko.Load(posflag.Provider(f, ".", ko), nil)
+	return nil
 }
 
 // initFS initializes the stuffbin embedded static filesystem.
-func initFS(staticDir string) stuffbin.FileSystem {
+func initFS(dirs ...string) stuffbin.FileSystem {
+	fs, err := newFS(dirs...)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return fs
+}
+
+// newFS returns the stuffbin embedded static filesystem with the files in
+// the given directories (theme or static directories) merged over it in
+// order. Empty dirs are skipped.
+func newFS(dirs ...string) (stuffbin.FileSystem, error) {
 	// Get self executable path to initialise stuffed FS.
 	exe, err := os.Executable()
 	if err != nil {
-		log.Fatalf("error getting executable path: %v", err)
+		return nil, fmt.Errorf("error getting executable path: %v", err)
 	}
 
 	// Read stuffed data from self.
@@ -119,43 +218,148 @@ func initFS(staticDir string) stuffbin.FileSystem {
 			// and the rest of the arguments are paths to embed.
 			fs, err = stuffbin.NewLocalFS("./",
 				"./static/templates",
+				"./static/i18n",
 				"./static/static:/static",
 				"config.toml.sample")
 			if err != nil {
-				log.Fatalf("error falling back to local filesystem: %v", err)
+				return nil, fmt.Errorf("error falling back to local filesystem: %v", err)
 			}
 		} else {
-			log.Fatalf("error reading stuffed binary: %v", err)
+			return nil, fmt.Errorf("error reading stuffed binary: %v", err)
 		}
 	}
 
-	// Optional static directory to override files.
-	if staticDir != "" {
-		logger.Printf("loading static files from: %v", staticDir)
-		fStatic, err := stuffbin.NewLocalFS("/",
-			filepath.Join(staticDir, "/templates")+":/static/templates",
-			filepath.Join(staticDir, "/static")+":/static",
-		)
+	// Optional directories to override files. Their sub-directories are
+	// optional so that a theme can replace only some of the files, falling
+	// back to the embedded ones for the rest.
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		logger.Printf("loading static files from: %v", dir)
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("failed reading static directory: %v", err)
+		}
+
+		var paths []string
+		for _, d := range []string{"templates", "static", "i18n"} {
+			if _, err := os.Stat(filepath.Join(dir, d)); err != nil {
+				continue
+			}
+			target := "/static/" + d
+			if d == "static" {
+				target = "/static"
+			}
+			paths = append(paths, filepath.Join(dir, d)+":"+target)
+		}
+		if len(paths) == 0 {
+			continue
+		}
+
+		fStatic, err := stuffbin.NewLocalFS("/", paths...)
 		if err != nil {
-			logger.Fatalf("failed reading static directory: %s: %v", staticDir, err)
+			return nil, fmt.Errorf("failed reading static directory: %s: %v", dir, err)
 		}
 		if err := fs.Merge(fStatic); err != nil {
-			logger.Fatalf("error merging static directory: %s: %v", staticDir, err)
+			return nil, fmt.Errorf("error merging static directory: %s: %v", dir, err)
 		}
 	}
-	return fs
+	return fs, nil
+}
+
+// initStore initializes the store backend selected in the config under
+// the given key, eg: "store" or "store.regions.eu".
+func initStore(key string) (storeBackend, error) {
+	switch typ := ko.String(key + ".type"); typ {
+	case "", "redis":
+		var cfg redis.Config
+		if err := ko.Unmarshal(key, &cfg); err != nil {
+			return nil, fmt.Errorf("error unmarshalling '%s' config: %v", key, err)
+		}
+		return redis.New(cfg)
+
+	case "sqlite":
+		var cfg sqlite.Config
+		if err := ko.Unmarshal(key+".sqlite", &cfg); err != nil {
+			return nil, fmt.Errorf("error unmarshalling '%s.sqlite' config: %v", key, err)
+		}
+		return sqlite.New(cfg, logger)
+
+	case "memory":
+		var cfg mem.Config
+		if err := ko.Unmarshal(key+".memory", &cfg); err != nil {
+			return nil, fmt.Errorf("error unmarshalling '%s.memory' config: %v", key, err)
+		}
+		return mem.New(cfg, logger)
+
+	case "bolt":
+		var cfg bolt.Config
+		if err := ko.Unmarshal(key+".bolt", &cfg); err != nil {
+			return nil, fmt.Errorf("error unmarshalling '%s.bolt' config: %v", key, err)
+		}
+		return bolt.New(cfg, logger)
+
+	default:
+		return nil, fmt.Errorf("unknown store type '%s' in '%s'", typ, key)
+	}
+}
+
+// initRegionStores wraps the default store with a region router if region
+// specific stores are configured under "store.regions".
+func initRegionStores(def storeBackend) (storeBackend, []string, error) {
+	names := ko.MapKeys("store.regions")
+	if len(names) == 0 {
+		return def, nil, nil
+	}
+
+	regions := make(map[string]region.Backend, len(names))
+	for _, n := range names {
+		st, err := initStore("store.regions." + n)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error initializing region '%s': %v", n, err)
+		}
+		regions[n] = st
+	}
+
+	r := region.New(def, regions)
+	return r, r.Regions(), nil
 }
 
-// Catch OS interrupts and respond accordingly.
+// Catch OS interrupts and respond accordingly. SIGHUP reloads the config.
 // This is not fool proof as http keeps listening while
 // existing rooms are shut down.
-func catchInterrupts() {
+func catchInterrupts(app *App) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP)
 	go func() {
 		for sig := range c {
-			// Shutdown.
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(app); err != nil {
+					logger.Printf("error reloading config: %v", err)
+					continue
+				}
+				app.hub.Audit.Record("config.reload", "", "", nil)
+				logger.Println("reloaded config")
+				continue
+			}
+
+			// Shutdown. Disconnect peers with jittered reconnect hints
+			// so that they don't all reconnect at once on restart.
 			logger.Printf("shutting down: %v", sig)
+			app.hub.Shutdown()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			if err := app.stopTracing(ctx); err != nil {
+				logger.Printf("error flushing traces: %v", err)
+			}
+			cancel()
+
+			// Flush stores that persist to disk.
+			if c, ok := app.hub.Store.(io.Closer); ok {
+				if err := c.Close(); err != nil {
+					logger.Printf("error closing store: %v", err)
+				}
+			}
 			os.Exit(0)
 		}
 	}()
@@ -177,35 +381,286 @@ func newConfigFile() error {
 	return ioutil.WriteFile("config.toml", b, 0644)
 }
 
+// verifyTranscript verifies the signature of an exported transcript file
+// against the configured instance key.
+func verifyTranscript(path string, s *transcript.Signer) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	t, err := s.Verify(b)
+	if err != nil {
+		return err
+	}
+	logger.Printf("transcript OK: room %s, %d messages, exported at %s",
+		t.RoomID, len(t.Messages), t.ExportedAt.Format(time.RFC3339))
+	return nil
+}
+
 func main() {
 	// Load configuration from files.
 	loadConfig()
 
+	// Validate the config, reporting all the errors at once.
+	err := validateConfig(ko)
+	if errs, ok := err.(configErrors); ok {
+		for _, e := range errs {
+			logger.Printf("config: %v", e)
+		}
+	}
+	if ko.Bool("check-config") {
+		if err != nil {
+			os.Exit(1)
+		}
+		logger.Println("config is valid")
+		os.Exit(0)
+	}
+	if err != nil {
+		logger.Fatal("invalid config. Run with --check-config to validate changes.")
+	}
+
+	// Initialize the export signer.
+	signer, err := transcript.NewSigner(ko.String("export.signing_key"))
+	if err != nil {
+		logger.Fatalf("error initializing export signer: %v", err)
+	}
+
+	// Verify a transcript and exit.
+	if path := ko.String("verify"); path != "" {
+		if err := verifyTranscript(path, signer); err != nil {
+			logger.Fatalf("%s: %v", path, err)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize global app context.
 	app := &App{
 		logger: logger,
-		fs:     initFS(ko.String("static-dir")),
+		signer: signer,
 	}
 	if err := ko.Unmarshal("app", &app.cfg); err != nil {
 		logger.Fatalf("error unmarshalling 'app' config: %v", err)
 	}
 
-	minTime := time.Duration(3) * time.Second
-	if app.cfg.RoomAge < minTime || app.cfg.WSTimeout < minTime {
-		logger.Fatal("app.websocket_timeout and app.roomage should be > 3s")
+	// The theme's files are overridden by --static-dir.
+	app.fs = initFS(app.cfg.ThemeDir, ko.String("static-dir"))
+	app.assets = hashAssets(app.fs)
+
+	app.cfg.RootPath = strings.TrimRight(app.cfg.RootPath, "/")
+	if app.cfg.MaxRoomAge < app.cfg.RoomAge {
+		app.cfg.MaxRoomAge = app.cfg.RoomAge
 	}
+	upgrader.EnableCompression = app.cfg.WSCompression
 
-	// Initialize store.
-	var storeCfg redis.Config
-	if err := ko.Unmarshal("store", &storeCfg); err != nil {
-		logger.Fatalf("error unmarshalling 'store' config: %v", err)
+	// Without a secret, IP hashes (and the IP bans that rely on them) don't
+	// carry over to restarts or other instances.
+	if app.cfg.IPHashSecret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			logger.Fatalf("error generating IP hash secret: %v", err)
+		}
+		app.cfg.IPHashSecret = string(b)
+		logger.Println("app.ip_hash_secret is empty. IP bans won't survive restarts")
+	}
+
+	app.trustedProxies, err = ipfilter.ParseCIDRs(app.cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatalf("error in app.trusted_proxies: %v", err)
+	}
+	if len(app.cfg.RealIPHeaders) > 0 && len(app.trustedProxies) == 0 {
+		logger.Println("app.real_ip_headers are ignored as app.trusted_proxies is empty")
+	}
+	co, err := checkOrigin(app)
+	if err != nil {
+		logger.Fatalf("error in app.websocket_allowed_origins: %v", err)
+	}
+	upgrader.CheckOrigin = co
+
+	app.presets, err = loadPresets(ko, app.cfg)
+	if err != nil {
+		logger.Fatalf("error initializing room presets: %v", err)
 	}
 
-	store, err := redis.New(storeCfg)
+	// Virtual hosts.
+	vhosts, err := loadVhosts(ko, app.cfg, app.presets)
+	if err != nil {
+		logger.Fatalf("error initializing vhosts: %v", err)
+	}
+	app.defaultVhost = &vhost{cfg: app.cfg}
+	app.vhosts = make(map[string]*vhost)
+	for _, vh := range vhosts {
+		for _, h := range vh.Hosts {
+			app.vhosts[h] = vh
+		}
+	}
+
+	routes, err := newRouteToggles(app.cfg.DisabledRoutes)
+	if err != nil {
+		logger.Fatalf("error in app.disabled_routes: %v", err)
+	}
+	app.routes = routes
+
+	// Initialize room creation abuse protection.
+	var captchaCfg captcha.Config
+	if err := ko.Unmarshal("captcha", &captchaCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'captcha' config: %v", err)
+	}
+	cpt, err := captcha.New(captchaCfg)
+	if err != nil {
+		logger.Fatalf("error initializing captcha: %v", err)
+	}
+	app.captcha = cpt
+
+	// Initialize the TURN relay credentials.
+	var turnCfg turn.Config
+	if err := ko.Unmarshal("turn", &turnCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'turn' config: %v", err)
+	}
+	tr, err := turn.New(turnCfg)
+	if err != nil {
+		logger.Fatalf("error initializing turn: %v", err)
+	}
+	app.turn = tr
+
+	// Initialize the password policy.
+	var pwdCfg passwd.Config
+	if err := ko.Unmarshal("password", &pwdCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'password' config: %v", err)
+	}
+	pwd, err := passwd.New(pwdCfg)
+	if err != nil {
+		logger.Fatalf("error initializing password policy: %v", err)
+	}
+	app.passwd = pwd
+
+	// Initialize rate limits.
+	var rlCfg rateLimitCfg
+	if err := ko.Unmarshal("ratelimit", &rlCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'ratelimit' config: %v", err)
+	}
+
+	app.batchLimiter = ratelimit.NewReloadable(rlCfg.MessageBatch)
+	app.loginLimiter = ratelimit.NewReloadable(rlCfg.LoginIP)
+	app.roomCreateIPLimiter = ratelimit.NewReloadable(rlCfg.RoomCreateIP)
+	app.roomCreateLimiter = ratelimit.NewReloadable(rlCfg.RoomCreateGlobal)
+
+	ws := rlCfg.WSUpgrade
+	app.wsQueue = ratelimit.NewQueue(ratelimit.Config{Requests: ws.Requests, Interval: ws.Interval},
+		ws.QueueSize, ws.QueueTimeout)
+
+	// IP blocklist.
+	var blCfg ipfilter.Config
+	if err := ko.Unmarshal("blocklist", &blCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'blocklist' config: %v", err)
+	}
+	app.blocklist, err = ipfilter.New(blCfg)
+	if err != nil {
+		logger.Fatalf("error initializing IP blocklist: %v", err)
+	}
+
+	// Initialize store.
+	st, err := initStore("store")
 	if err != nil {
 		log.Fatalf("error initializing store: %v", err)
 	}
-	app.hub = hub.NewHub(app.cfg, store, logger)
+	// Locks are held in the default store.
+	locker, ok := st.(lock.Locker)
+	if !ok {
+		locker = lock.NewLocal()
+	}
+	// So are counters.
+	counter, _ := st.(store.Counter)
+	st, app.regions, err = initRegionStores(st)
+	if err != nil {
+		log.Fatalf("error initializing store: %v", err)
+	}
+
+	// Tracing.
+	var traceCfg tracing.Config
+	if err := ko.Unmarshal("tracing", &traceCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'tracing' config: %v", err)
+	}
+	app.stopTracing, err = tracing.Init(traceCfg)
+	if err != nil {
+		logger.Fatalf("error initializing tracing: %v", err)
+	}
+	if traceCfg.Enabled {
+		st = tracing.WrapStore(st)
+	}
+
+	// Chat messages are only persisted if history is enabled.
+	var msgCache store.MessageCache
+	if app.cfg.History {
+		msgCache = st
+	}
+	app.hub = hub.NewHub(app.cfg, st, msgCache, logger)
+	app.hub.Locker = locker
+	app.hub.Counter = counter
+	app.hub.Tenants = make(map[string]hub.Tenant, len(vhosts))
+	for _, vh := range vhosts {
+		app.hub.Tenants[vh.ID] = vh.tenant()
+	}
+
+	al, err := audit.New(app.cfg.AuditLog, logger)
+	if err != nil {
+		logger.Fatalf("error opening audit log: %v", err)
+	}
+	app.hub.Audit = al
+
+	ap, err := hub.NewAgeApprover(app.cfg.RoomAgeApproval, app.cfg.RoomAgeWebhook)
+	if err != nil {
+		logger.Fatalf("error initializing room age approvals: %v", err)
+	}
+	app.hub.AgeApprover = ap
+
+	// Message filters.
+	var filterCfg hub.FilterConfig
+	if err := ko.Unmarshal("filters", &filterCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'filters' config: %v", err)
+	}
+	filters, err := hub.NewFilters(filterCfg)
+	if err != nil {
+		logger.Fatalf("error initializing message filters: %v", err)
+	}
+	app.hub.Filters = filters
+
+	// Notification channels.
+	var notifyCfg map[string]notify.Config
+	if err := ko.Unmarshal("notifications", &notifyCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'notifications' config: %v", err)
+	}
+	if len(notifyCfg) > 0 {
+		nd, err := notify.New(notifyCfg, logger)
+		if err != nil {
+			logger.Fatalf("error initializing notifications: %v", err)
+		}
+		app.hub.Notify = nd
+	}
+
+	// Transcript emails.
+	var smtpConf smtpCfg
+	if err := ko.Unmarshal("smtp", &smtpConf); err != nil {
+		logger.Fatalf("error unmarshalling 'smtp' config: %v", err)
+	}
+	mailer, err := newTranscriptMailer(smtpConf, app)
+	if err != nil {
+		logger.Fatalf("error initializing smtp: %v", err)
+	}
+	if mailer != nil {
+		app.hub.Archiver = mailer
+	}
+
+	// Load language catalogs.
+	cats, err := i18n.LoadFS(app.fs, "/static/i18n")
+	if err != nil {
+		logger.Fatalf("error loading language catalogs: %v", err)
+	}
+	translator, err = i18n.New(app.cfg.Language, cats)
+	if err != nil {
+		logger.Fatalf("error in app.language: %v", err)
+	}
+	app.hub.I18n = translator
 
 	// Compile static templates.
 	tpl, err := stuffbin.ParseTemplatesGlob(nil, app.fs, "/static/templates/*.html")
@@ -213,9 +668,37 @@ func main() {
 		logger.Fatalf("error compiling templates: %v", err)
 	}
 	app.tpl = tpl
+	for _, vh := range vhosts {
+		if vh.fs, vh.tpl, err = vh.loadTemplates(); err != nil {
+			logger.Fatal(err)
+		}
+		vh.assets = hashAssets(vh.fs)
+	}
+
+	catchInterrupts(app)
+
+	// Security headers.
+	var secConf securityCfg
+	if err := ko.Unmarshal("security", &secConf); err != nil {
+		logger.Fatalf("error unmarshalling 'security' config: %v", err)
+	}
+	if err := secConf.validate(); err != nil {
+		logger.Fatal(err)
+	}
 
 	// Register HTTP routes.
 	r := chi.NewRouter()
+	if app.cfg.AccessLog {
+		r.Use(accessLog(app))
+	}
+	r.Use(recoverPanic(app))
+	r.Use(securityHeaders(secConf, app.cfg.RootURL))
+	if app.cfg.HTTPCompression {
+		r.Use(compress(app.cfg.HTTPCompressionLvl))
+	}
+	if traceCfg.Enabled {
+		r.Use(tracing.Middleware)
+	}
 
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -232,26 +715,94 @@ func main() {
 	}))
 
 	r.Get("/", wrap(handleIndex, app, 0))
-	r.Get("/ws/{roomID}", wrap(handleWS, app, hasAuth|hasRoom))
+	r.With(blockIP(app)).Get("/ws/{roomID}", wrap(handleWS, app, hasAuth|hasRoom|hasCSRF))
 
 	// API.
-	r.Post("/api/rooms/{roomID}/login", wrap(handleLogin, app, hasRoom))
-	r.Delete("/api/rooms/{roomID}/login", wrap(handleLogout, app, hasAuth|hasRoom))
-	r.Post("/api/rooms", wrap(handleCreateRoom, app, 0))
+	r.With(toggle(app, routeLogin), rateLimit(app, app.loginLimiter, nil), blockIP(app)).
+		Post("/api/rooms/{roomID}/login", wrap(handleLogin, app, hasAuth|hasRoom|hasCSRF))
+	r.Delete("/api/rooms/{roomID}/login", wrap(handleLogout, app, hasAuth|hasRoom|hasCSRF))
+	r.With(toggle(app, routeHistory)).
+		Get("/api/rooms/{roomID}/history", wrap(handleChatHistory, app, hasAuth|hasRoom))
+	r.With(toggle(app, routeMessages)).
+		Post("/api/rooms/{roomID}/messages:batch", wrap(handlePostMessages, app, hasAuth|hasRoom|hasCSRF))
+	r.Get("/api/rooms/{roomID}/sessions/mine", wrap(handleGetMySessions, app, hasAuth|hasRoom))
+	r.Get("/api/rooms/{roomID}/sessions/link", wrap(handleGetDeviceLink, app, hasAuth|hasRoom))
+	r.Delete("/api/rooms/{roomID}/sessions/mine/{sessID}", wrap(handleRevokeMySession, app, hasAuth|hasRoom|hasCSRF))
+	r.Put("/api/rooms/{roomID}/age", wrap(handleSetRoomAge, app, hasAuth|hasRoom|hasCSRF))
+	r.Put("/api/rooms/{roomID}/scheme", wrap(handleSetScheme, app, hasAuth|hasRoom|hasCSRF))
+	r.Get("/api/rooms/{roomID}/turn", wrap(handleTURNCredentials, app, hasAuth|hasRoom))
+	r.Delete("/api/rooms/{roomID}", wrap(handleDisposeRoom, app, hasAuth|hasRoom|hasCSRF))
+	r.Get("/api/rooms/{roomID}/settings", wrap(handleGetRoomSettings, app, hasAuth|hasRoom))
+	r.Put("/api/rooms/{roomID}/settings", wrap(handleUpdateRoomSettings, app, hasAuth|hasRoom|hasCSRF))
+	r.Put("/api/rooms/{roomID}/password", wrap(handleSetOwnerRoomPassword, app, hasAuth|hasRoom|hasCSRF))
+	r.Delete("/api/rooms/{roomID}/peers/{peerID}/data", wrap(handlePurgePeerData, app, hasAuth|hasRoom|hasCSRF))
+	r.Get("/api/rooms/{roomID}/stats", wrap(handleGetRoomStats, app, hasAuth|hasRoom))
+	r.Get("/api/rooms/{roomID}/connections", wrap(handleGetConnections, app, hasAuth|hasRoom))
+	r.Get("/api/rooms/{roomID}/bans", wrap(handleGetBans, app, hasAuth|hasRoom))
+	r.Post("/api/rooms/{roomID}/bans", wrap(handleBanPeer, app, hasAuth|hasRoom|hasCSRF))
+	r.Delete("/api/rooms/{roomID}/bans/{banID}", wrap(handleUnbanPeer, app, hasAuth|hasRoom|hasCSRF))
+	r.With(toggle(app, routeRoomCreate),
+		rateLimit(app, app.roomCreateIPLimiter, app.roomCreateLimiter), blockIP(app)).
+		Post("/api/rooms", wrap(handleCreateRoom, app, hasCSRF))
+	r.Get("/api/challenge", wrap(handleGetChallenge, app, 0))
+	r.Get("/api/status", wrap(handleGetStatus, app, 0))
+	if app.cfg.PublicStats {
+		r.Get("/api/stats", wrap(handleGetInstanceStats, app, 0))
+		r.Get("/stats", wrap(handleStatsPage, app, 0))
+	}
+	r.Get("/healthz", wrap(handleHealthz, app, 0))
+	r.Get("/readyz", wrap(handleReadyz, app, 0))
+
+	// Admin API.
+	r.Get("/api/admin/features", wrap(handleGetFeatures, app, isAdmin))
+	r.Get("/api/admin/routes", wrap(handleGetRoutes, app, isAdmin))
+	r.Put("/api/admin/routes/{route}", wrap(handleUpdateRoute, app, isAdmin))
+	r.Put("/api/admin/features/{feature}", wrap(handleUpdateFeature, app, isAdmin))
+	r.Get("/api/admin/tenants", wrap(handleGetTenants, app, isAdmin))
+	r.Put("/api/admin/tenants/{tenant}/defaults", wrap(handleUpdateTenantDefaults, app, isAdmin))
+	r.Get("/api/admin/rooms/{roomID}/verify", wrap(handleVerifyRoomChain, app, isAdmin))
+	r.Get("/api/admin/rooms/{roomID}/debug", wrap(handleGetRoomDebug, app, isAdmin))
+	r.Post("/api/admin/rooms/{roomID}/import", wrap(handleImportTranscript, app, isAdmin))
+	r.Post("/api/admin/rooms/{roomID}/operator", wrap(handleJoinAsOperator, app, isAdmin|hasRoom))
+	r.Get("/api/admin/metrics", wrap(handleGetMetrics, app, isAdmin))
+	r.Get("/api/admin/runtime", wrap(handleGetRuntime, app, isAdmin))
+	r.Get("/api/admin/debug/pprof/{profile}", wrap(handlePprof, app, isAdmin))
+	r.Post("/api/admin/debug/pprof/symbol", wrap(handlePprof, app, isAdmin))
+	r.Get("/api/admin/search", wrap(handleSearchMessages, app, isAdmin))
+	r.Get("/api/admin/audit", wrap(handleGetAuditLog, app, isAdmin))
+	r.Get("/api/admin/passwords/weak", wrap(handleGetWeakPasswords, app, isAdmin))
+	r.Put("/api/admin/rooms/{roomID}/password", wrap(handleSetRoomPassword, app, isAdmin))
+	r.Post("/api/admin/announcements", wrap(handleAnnounce, app, isAdmin))
 
 	// Views.
-	r.Get("/r/{roomID}", wrap(handleRoomPage, app, hasAuth|hasRoom))
-	r.Get("/static/*", func(w http.ResponseWriter, r *http.Request) {
-		app.fs.FileServer().ServeHTTP(w, r)
-	})
+	r.With(allowEmbed(secConf)).Get("/r/{roomID}", wrap(handleRoomPage, app, hasAuth|hasRoom))
+	r.Get("/r/{roomID}/qr.png", wrap(handleRoomQR, app, hasRoom))
+	r.Get("/status", wrap(handleStatusPage, app, 0))
+	r.Get("/static/*", handleStatic(app))
 
 	// Start the app.
+	var tlsConf tlsCfg
+	if err := ko.Unmarshal("tls", &tlsConf); err != nil {
+		logger.Fatalf("error unmarshalling 'tls' config: %v", err)
+	}
+
+	// Mount the app at the root path. The mux redirects the bare path
+	// (eg: /chat) to the path with a trailing slash.
+	var handler http.Handler = r
+	if app.cfg.RootPath != "" {
+		mux := http.NewServeMux()
+		mux.Handle(app.cfg.RootPath+"/", http.StripPrefix(app.cfg.RootPath, r))
+		handler = mux
+	}
+
 	srv := &http.Server{
 		Addr:    ko.String("app.address"),
-		Handler: r,
+		Handler: handler,
+	}
+	if app.cfg.HTTP2Cleartext && (tlsConf.Mode == "" || tlsConf.Mode == tlsNone) {
+		srv.Handler = h2c.NewHandler(handler, &http2.Server{})
 	}
-	logger.Printf("starting server on %v", ko.String("app.address"))
-	if err := srv.ListenAndServe(); err != nil {
+	if err := listenAndServe(srv, tlsConf); err != nil {
 		logger.Fatalf("couldn't start server: %v", err)
 	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/ratelimit"
+)
+
+// rateLimitCfg represents the HTTP rate limit configuration.
+type rateLimitCfg struct {
+	RoomCreateIP     ratelimit.Config `koanf:"room_create_ip"`
+	RoomCreateGlobal ratelimit.Config `koanf:"room_create_global"`
+	LoginIP          ratelimit.Config `koanf:"login_ip"`
+	MessageBatch     ratelimit.Config `koanf:"message_batch"`
+	WSUpgrade        struct {
+		Requests     int           `koanf:"requests"`
+		Interval     time.Duration `koanf:"interval"`
+		QueueSize    int           `koanf:"queue_size"`
+		QueueTimeout time.Duration `koanf:"queue_timeout"`
+	} `koanf:"ws_upgrade"`
+}
+
+// rateLimit is a middleware that limits requests per client IP and
+// globally across all clients. Either of the limiters can be nil.
+func rateLimit(app *App, perIP, global *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := perIP
+			ok := perIP.Allow(clientIP(r, app))
+			if ok {
+				l = global
+				ok = global.Allow("")
+			}
+
+			if !ok {
+				secs := int(math.Ceil(l.RetryAfter().Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				respondJSON(w, nil, errors.New("too many requests. Try again later"), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// accessLog is a middleware that logs requests (method, path, status,
+// latency, room ID and client IP) as key=value pairs.
+func accessLog(app *App) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				t  = time.Now()
+				ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			)
+			next.ServeHTTP(ww, r)
+
+			// Websocket upgrades are written to the hijacked connection.
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+				if websocket.IsWebSocketUpgrade(r) {
+					status = http.StatusSwitchingProtocols
+				}
+			}
+
+			// URL params are available after routing.
+			room := ""
+			if rc := chi.RouteContext(r.Context()); rc != nil {
+				room = rc.URLParam("roomID")
+			}
+			app.logger.Printf("access method=%s path=%q status=%d latency=%s bytes=%d room=%q ip=%s",
+				r.Method, r.URL.Path, status, time.Since(t).Round(time.Microsecond),
+				ww.BytesWritten(), room, clientIP(r, app))
+		})
+	}
+}
+
+// recoverPanic is a middleware that recovers from panics in handlers, logs
+// them with their stack, and responds with a JSON 500 instead of dropping
+// the connection.
+func recoverPanic(app *App) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rv := recover()
+				if rv == nil {
+					return
+				}
+				// Handlers abort responses with this panic deliberately.
+				if rv == http.ErrAbortHandler {
+					panic(rv)
+				}
+
+				app.logger.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rv, debug.Stack())
+				respondJSON(w, nil, errors.New("internal server error"), http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// blockIP is a middleware that rejects requests from client IPs that are
+// denied by the IP blocklist.
+func blockIP(app *App) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app.mut.RLock()
+			f := app.blocklist
+			app.mut.RUnlock()
+
+			ip := clientIP(r, app)
+			if ok, reason := f.Check(ip); !ok {
+				app.hub.Audit.Record("ip.blocked", "", chi.URLParam(r, "roomID"), map[string]interface{}{
+					"ip":     ip,
+					"reason": reason,
+					"path":   r.URL.Path,
+				})
+				respondJSON(w, nil, errors.New("access from your network is not allowed"), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP address of the client making the request. If the
+// request is from a trusted proxy and real IP headers (eg: X-Forwarded-For)
+// are configured, the IP is derived from the first one that's present.
+func clientIP(r *http.Request, app *App) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !app.isTrustedProxy(remote) {
+		return remote
+	}
+
+	for _, h := range app.cfg.RealIPHeaders {
+		v := strings.Join(r.Header[http.CanonicalHeaderKey(h)], ",")
+		if v == "" {
+			continue
+		}
+
+		// X-Forwarded-For is a list of hops that each proxy appends the
+		// address it received the request from to. The client is the last
+		// hop that's not a trusted proxy.
+		hops := strings.Split(v, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(hops[i])
+			if net.ParseIP(ip) == nil {
+				break
+			}
+			if i == 0 || !app.isTrustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+	return remote
+}
+
+// userAgent returns the client's user agent truncated to a sane length.
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > 200 {
+		ua = ua[:200]
+	}
+	return ua
+}
+
+// clientCountry returns the country code of the client's IP address from
+// the geolocation header set by trusted proxies, if it's configured.
+func clientCountry(r *http.Request, app *App) string {
+	if app.cfg.GeoHeader == "" {
+		return ""
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !app.isTrustedProxy(remote) {
+		return ""
+	}
+
+	c := strings.ToUpper(strings.TrimSpace(r.Header.Get(app.cfg.GeoHeader)))
+	if len(c) != 2 {
+		return ""
+	}
+	return c
+}
+
+// isTrustedProxy checks if an IP belongs to a trusted proxy whose real IP
+// headers are honoured.
+func (app *App) isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range app.trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
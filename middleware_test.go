@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/ipfilter"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ipfilter.ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		cfg:            &hub.Config{RealIPHeaders: []string{"X-Forwarded-For", "X-Real-IP"}},
+		trustedProxies: proxies,
+	}
+
+	for _, c := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		ip      string
+	}{
+		{"direct", "1.2.3.4:1000", nil, "1.2.3.4"},
+		{"untrusted proxy", "1.2.3.4:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"trusted proxy", "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"trusted proxy without header", "10.0.0.1:1000", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "5.6.7.8, 192.168.1.1, 10.0.0.2"}, "5.6.7.8"},
+		{"spoofed first hop", "10.0.0.1:1000",
+			map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"all hops trusted", "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"invalid hop", "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "5.6.7.8, junk"}, "10.0.0.1"},
+		{"second header", "10.0.0.1:1000", map[string]string{"X-Real-IP": "5.6.7.8"}, "5.6.7.8"},
+		{"ipv6", "[2001:db8::1]:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		if ip := clientIP(r, app); ip != c.ip {
+			t.Errorf("%s: expected %s, got %s", c.name, c.ip, ip)
+		}
+	}
+}
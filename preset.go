@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/store"
+)
+
+// roomPreset represents a room template ([presets.<name>]) that pre-fills
+// the options of rooms created with it, eg: for standups or incidents.
+type roomPreset struct {
+	// Default name (topic) of the room.
+	Name string `koanf:"name" json:"name,omitempty"`
+
+	// Inactivity period after which the room expires.
+	Age time.Duration `koanf:"age" json:"age,omitempty"`
+
+	NoLogging      bool `koanf:"no_logging" json:"no_logging,omitempty"`
+	RetentionHours int  `koanf:"retention_hours" json:"retention_hours,omitempty"`
+	ReplayMessages int  `koanf:"replay_messages" json:"replay_messages,omitempty"`
+
+	// Welcome messages sent to peers when they first join.
+	Welcome []string `koanf:"welcome" json:"welcome,omitempty"`
+
+	// Only the owner and speakers can post.
+	ReadOnly bool `koanf:"read_only" json:"read_only,omitempty"`
+}
+
+// loadPresets reads and validates the room presets in k.
+func loadPresets(k *koanf.Koanf, cfg *hub.Config) (map[string]roomPreset, error) {
+	out := make(map[string]roomPreset)
+	for _, name := range k.MapKeys("presets") {
+		var p roomPreset
+		if err := k.Unmarshal("presets."+name, &p); err != nil {
+			return nil, fmt.Errorf("error unmarshalling 'presets.%s' config: %v", name, err)
+		}
+		if err := p.validate(cfg); err != nil {
+			return nil, fmt.Errorf("presets.%s: %v", name, err)
+		}
+		out[name] = p
+	}
+	return out, nil
+}
+
+// validate checks the preset's options against the limits in the config.
+func (p roomPreset) validate(cfg *hub.Config) error {
+	maxAge := cfg.MaxRoomAge
+	if maxAge < cfg.RoomAge {
+		maxAge = cfg.RoomAge
+	}
+
+	if p.Name != "" && (len(p.Name) < 3 || len(p.Name) > 100) {
+		return errors.New("name should be 3 - 100 chars")
+	}
+	if p.Age != 0 && (p.Age < 3*time.Second || p.Age > maxAge) {
+		return errors.New("age should be 3s - app.max_room_age")
+	}
+	if !hub.ValidRetention(p.RetentionHours) {
+		return hub.ErrInvalidRetention
+	}
+	if p.ReplayMessages < 0 || p.ReplayMessages > cfg.MaxReplayMessages {
+		return fmt.Errorf("replay_messages should be 0 - %d", cfg.MaxReplayMessages)
+	}
+	return hub.ValidateWelcome(p.Welcome, cfg.MaxMessageLen)
+}
+
+// presetNames returns the sorted names of the room presets.
+func presetNames(presets map[string]roomPreset) []string {
+	out := make([]string, 0, len(presets))
+	for name := range presets {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// apply fills in the room's name and options that weren't set in the
+// request with the preset's. Logging can only be turned off and read-only
+// mode turned on by either.
+func (p roomPreset) apply(name string, opts *store.RoomOpts) string {
+	if name == "" {
+		name = p.Name
+	}
+	if opts.Age == 0 {
+		opts.Age = p.Age
+	}
+	if opts.RetentionHours == 0 {
+		opts.RetentionHours = p.RetentionHours
+	}
+	if opts.ReplayMessages == 0 {
+		opts.ReplayMessages = p.ReplayMessages
+	}
+	if len(opts.Welcome) == 0 {
+		opts.Welcome = p.Welcome
+	}
+	opts.NoLogging = opts.NoLogging || p.NoLogging
+	opts.ReadOnly = opts.ReadOnly || p.ReadOnly
+	return name
+}
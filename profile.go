@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Number of rooms with the most peers listed in the runtime stats.
+const maxRuntimeRooms = 50
+
+// bootTime is the time the app started.
+var bootTime = time.Now()
+
+type runtimeRoom struct {
+	ID    string `json:"id"`
+	Peers int    `json:"peers"`
+}
+
+type runtimeStats struct {
+	GoVersion  string        `json:"go_version"`
+	Uptime     string        `json:"uptime"`
+	Goroutines int           `json:"goroutines"`
+	Rooms      int           `json:"rooms"`
+	Peers      int           `json:"peers"`
+	TopRooms   []runtimeRoom `json:"top_rooms"`
+
+	// Memory stats in bytes.
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapObjects uint64 `json:"heap_objects"`
+	Sys         uint64 `json:"sys"`
+	NumGC       uint32 `json:"num_gc"`
+	LastGCPause string `json:"last_gc_pause"`
+}
+
+// handleGetRuntime returns the runtime stats of the instance (goroutines,
+// memory, and rooms with the most peers) for diagnosing leaks.
+func handleGetRuntime(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+		m   runtime.MemStats
+	)
+	runtime.ReadMemStats(&m)
+
+	out := runtimeStats{
+		GoVersion:   runtime.Version(),
+		Uptime:      time.Since(bootTime).Round(time.Second).String(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   m.HeapAlloc,
+		HeapInuse:   m.HeapInuse,
+		HeapObjects: m.HeapObjects,
+		Sys:         m.Sys,
+		NumGC:       m.NumGC,
+		LastGCPause: time.Duration(m.PauseNs[(m.NumGC+255)%256]).String(),
+		TopRooms:    []runtimeRoom{},
+	}
+
+	for id, n := range app.hub.RoomPeers() {
+		out.Rooms++
+		out.Peers += n
+		out.TopRooms = append(out.TopRooms, runtimeRoom{ID: id, Peers: n})
+	}
+	sort.Slice(out.TopRooms, func(i, j int) bool {
+		return out.TopRooms[i].Peers > out.TopRooms[j].Peers
+	})
+	if len(out.TopRooms) > maxRuntimeRooms {
+		out.TopRooms = out.TopRooms[:maxRuntimeRooms]
+	}
+
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// handlePprof serves the net/http/pprof profiles, eg:
+// /api/admin/debug/pprof/heap, /goroutine?debug=2, and /profile?seconds=30.
+// The profiles can be downloaded with the admin token and inspected with
+// `go tool pprof`.
+func handlePprof(w http.ResponseWriter, r *http.Request) {
+	switch name := chi.URLParam(r, "profile"); name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/store/lock"
+)
+
+// handlePurgePeerData purges all the data stored for a peer in a room (their
+// sessions and messages) to fulfil a deletion request. It can be requested
+// by the peer, the room's owner, or with the admin token by the instance's
+// operators, in which case the request isn't subject to CSRF checks.
+func handlePurgePeerData(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx    = r.Context().Value("ctx").(*reqCtx)
+		app    = ctx.app
+		room   = ctx.room
+		peerID = chi.URLParam(r, "peerID")
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+
+	actor := "admin"
+	if !hasAdminToken(r, app) {
+		if ctx.sess.ID != "" && hub.SessionKey(ctx.sess.ID) == peerID {
+			actor = ctx.sess.Handle
+		} else if h, ok := roomOwner(r, ctx); ok {
+			actor = h
+		} else {
+			respondJSON(w, nil, errors.New("only the peer, the room's owner or an admin can do this"), http.StatusForbidden)
+			return
+		}
+	}
+
+	res, err := room.PurgePeer(peerID)
+	if err != nil {
+		switch err {
+		case hub.ErrPeerNotFound:
+			respondJSON(w, nil, err, http.StatusNotFound)
+			return
+		case lock.ErrLocked:
+			respondJSON(w, nil, errors.New("the history is being updated. Try again"), http.StatusConflict)
+			return
+		}
+		app.logger.Printf("error purging peer data: %v", err)
+		respondJSON(w, nil, errors.New("error purging data"), http.StatusInternalServerError)
+		return
+	}
+
+	// The peer is recorded by their session key and not their handle.
+	app.hub.Audit.Record("peer.purge", actor, room.ID, map[string]interface{}{
+		"peer":     peerID,
+		"sessions": res.Sessions,
+		"messages": res.Messages,
+	})
+	respondJSON(w, res, nil, http.StatusOK)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Sizes (px) of room QR codes.
+const (
+	qrSize    = 256
+	qrMinSize = 128
+	qrMaxSize = 1024
+)
+
+// handleRoomQR renders a QR code (PNG) of a room's URL so that mobile users
+// can join by scanning it. The size can be set with ?size=.
+func handleRoomQR(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return
+	}
+
+	size := qrSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < qrMinSize || n > qrMaxSize {
+			respondJSON(w, nil, errors.New("invalid size"), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	b, err := qrcode.Encode(ctx.vhost.cfg.RootURL+"/r/"+room.ID, qrcode.Medium, size)
+	if err != nil {
+		app.logger.Printf("error generating QR code: %v", err)
+		respondJSON(w, nil, errors.New("error generating QR code"), http.StatusInternalServerError)
+		return
+	}
+
+	// Room URLs don't change, but rooms expire.
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(b)
+}
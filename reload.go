@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/i18n"
+	"github.com/knadh/niltalk/internal/ipfilter"
+	"github.com/knadh/stuffbin"
+)
+
+// reloadConfig re-reads the config files on SIGHUP and applies the settings
+// that can be changed without restarting: templates, static files, and
+// language catalogs (from --static-dir and vhosts' static_dir), HTTP rate
+// limits, message filters, and the IP blocklist.
+// Peers stay connected. Everything is validated before anything is applied,
+// so an invalid config leaves the running config unchanged. Other settings
+// need a restart.
+func reloadConfig(app *App) error {
+	k := koanf.New(".")
+	if err := loadConfigFiles(k, ko.Strings("config")); err != nil {
+		return fmt.Errorf("error loading config: %v", err)
+	}
+	if err := validateConfig(k); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	var rlCfg rateLimitCfg
+	if err := k.Unmarshal("ratelimit", &rlCfg); err != nil {
+		return fmt.Errorf("error unmarshalling 'ratelimit' config: %v", err)
+	}
+
+	var filterCfg hub.FilterConfig
+	if err := k.Unmarshal("filters", &filterCfg); err != nil {
+		return fmt.Errorf("error unmarshalling 'filters' config: %v", err)
+	}
+	filters, err := hub.NewFilters(filterCfg)
+	if err != nil {
+		return fmt.Errorf("error initializing message filters: %v", err)
+	}
+
+	var blCfg ipfilter.Config
+	if err := k.Unmarshal("blocklist", &blCfg); err != nil {
+		return fmt.Errorf("error unmarshalling 'blocklist' config: %v", err)
+	}
+	blocklist, err := ipfilter.New(blCfg)
+	if err != nil {
+		return fmt.Errorf("error initializing IP blocklist: %v", err)
+	}
+
+	fs, err := newFS(app.cfg.ThemeDir, ko.String("static-dir"))
+	if err != nil {
+		return err
+	}
+	tpl, err := stuffbin.ParseTemplatesGlob(nil, fs, "/static/templates/*.html")
+	if err != nil {
+		return fmt.Errorf("error compiling templates: %v", err)
+	}
+	cats, err := i18n.LoadFS(fs, "/static/i18n")
+	if err != nil {
+		return fmt.Errorf("error loading language catalogs: %v", err)
+	}
+	if _, err := i18n.New(app.cfg.Language, cats); err != nil {
+		return fmt.Errorf("error in app.language: %v", err)
+	}
+	assets := hashAssets(fs)
+
+	// Vhosts' static directories. Changes to the vhosts themselves need a
+	// restart.
+	type vhostFiles struct {
+		fs     stuffbin.FileSystem
+		tpl    *template.Template
+		assets map[string]string
+	}
+	vhFiles := make(map[*vhost]vhostFiles)
+	for _, vh := range app.vhosts {
+		if _, ok := vhFiles[vh]; ok {
+			continue
+		}
+		fs, tpl, err := vh.loadTemplates()
+		if err != nil {
+			return err
+		}
+		vhFiles[vh] = vhostFiles{fs, tpl, hashAssets(fs)}
+	}
+
+	// Apply.
+	app.batchLimiter.SetConfig(rlCfg.MessageBatch)
+	app.loginLimiter.SetConfig(rlCfg.LoginIP)
+	app.roomCreateIPLimiter.SetConfig(rlCfg.RoomCreateIP)
+	app.roomCreateLimiter.SetConfig(rlCfg.RoomCreateGlobal)
+	app.hub.SetFilters(filters)
+	translator.Set(app.cfg.Language, cats)
+
+	app.mut.Lock()
+	app.blocklist = blocklist
+	app.fs = fs
+	app.tpl = tpl
+	app.assets = assets
+	for vh, f := range vhFiles {
+		vh.fs, vh.tpl, vh.assets = f.fs, f.tpl, f.assets
+	}
+	app.mut.Unlock()
+	return nil
+}
+
+// templates returns the compiled templates of a vhost.
+func (app *App) templates(vh *vhost) *template.Template {
+	app.mut.RLock()
+	defer app.mut.RUnlock()
+	if vh != nil && vh.tpl != nil {
+		return vh.tpl
+	}
+	return app.tpl
+}
+
+// files returns the static file system of a vhost.
+func (app *App) files(vh *vhost) stuffbin.FileSystem {
+	app.mut.RLock()
+	defer app.mut.RUnlock()
+	if vh != nil && vh.fs != nil {
+		return vh.fs
+	}
+	return app.fs
+}
+
+// assetHashes returns the content hashes of the static files of a vhost.
+func (app *App) assetHashes(vh *vhost) map[string]string {
+	app.mut.RLock()
+	defer app.mut.RUnlock()
+	if vh != nil && vh.fs != nil {
+		return vh.assets
+	}
+	return app.assets
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi"
+)
+
+// Public routes that can be disabled at runtime, eg: to stop a spam wave
+// by turning off room creation.
+const (
+	routeRoomCreate = "room.create"
+	routeLogin      = "room.login"
+	routeHistory    = "history"
+	routeExport     = "export"
+	routeMessages   = "messages.batch"
+)
+
+var toggleRoutes = []string{
+	routeRoomCreate,
+	routeLogin,
+	routeHistory,
+	routeExport,
+	routeMessages,
+}
+
+// errRouteDisabled is returned by requests to a disabled route.
+type errRouteDisabled struct {
+	Route string `json:"route"`
+}
+
+func (e errRouteDisabled) Error() string {
+	return fmt.Sprintf("%s is currently disabled. Try again later", e.Route)
+}
+
+// routeToggles holds the public routes that are enabled.
+type routeToggles struct {
+	disabled map[string]bool
+	mut      sync.RWMutex
+}
+
+// newRouteToggles returns the route toggles with the given routes disabled.
+func newRouteToggles(disabled []string) (*routeToggles, error) {
+	t := &routeToggles{disabled: make(map[string]bool)}
+	for _, r := range disabled {
+		if !isToggleRoute(r) {
+			return nil, fmt.Errorf("unknown route: %s", r)
+		}
+		t.disabled[r] = true
+	}
+	return t, nil
+}
+
+// enabled checks if a route is enabled.
+func (t *routeToggles) enabled(route string) bool {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+	return !t.disabled[route]
+}
+
+// set enables or disables a route.
+func (t *routeToggles) set(route string, enabled bool) {
+	t.mut.Lock()
+	t.disabled[route] = !enabled
+	t.mut.Unlock()
+}
+
+// getAll returns the state of all toggleable routes.
+func (t *routeToggles) getAll() map[string]bool {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	out := make(map[string]bool, len(toggleRoutes))
+	for _, r := range toggleRoutes {
+		out[r] = !t.disabled[r]
+	}
+	return out
+}
+
+// check responds with an error and returns false if the route is disabled.
+func (t *routeToggles) check(route string, w http.ResponseWriter) bool {
+	if t.enabled(route) {
+		return true
+	}
+	err := errRouteDisabled{Route: route}
+	respondJSON(w, err, err, http.StatusServiceUnavailable)
+	return false
+}
+
+// isToggleRoute checks if a route can be toggled.
+func isToggleRoute(route string) bool {
+	for _, r := range toggleRoutes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// toggle is a middleware that rejects requests to the route if it's
+// disabled.
+func toggle(app *App, route string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.routes.check(route, w) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleGetRoutes returns the state of the toggleable public routes.
+func handleGetRoutes(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+	respondJSON(w, app.routes.getAll(), nil, http.StatusOK)
+}
+
+// handleUpdateRoute enables or disables a public route. The change applies
+// immediately.
+func handleUpdateRoute(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx   = r.Context().Value("ctx").(*reqCtx)
+		app   = ctx.app
+		route = chi.URLParam(r, "route")
+	)
+
+	if !isToggleRoute(route) {
+		respondJSON(w, nil, errors.New("unknown route"), http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	app.routes.set(route, req.Enabled)
+	app.hub.Audit.Record("route.toggle", "admin", "", map[string]interface{}{
+		"route":   route,
+		"enabled": req.Enabled,
+	})
+	app.logger.Printf("route %s enabled: %v", route, req.Enabled)
+	respondJSON(w, app.routes.getAll(), nil, http.StatusOK)
+}
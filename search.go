@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/store"
+)
+
+const (
+	searchPerPage    = 50
+	searchMaxPerPage = 200
+)
+
+// searchHit is a message that matched a search along with its room.
+type searchHit struct {
+	RoomID   string        `json:"room_id"`
+	RoomName string        `json:"room_name"`
+	Message  store.Message `json:"message"`
+}
+
+// searchResp is a page of search results.
+type searchResp struct {
+	Total   int         `json:"total"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Results []searchHit `json:"results"`
+}
+
+// handleSearchMessages searches the messages of all rooms, eg: to find the
+// room an abusive message was posted in. Results are sorted newest first.
+//
+// Query params: q (text in the message or handle), room (one or more room
+// IDs), peer (handle), mention (mentioned handle), from and to (YYYY-MM-DD,
+// UTC), page, and per_page.
+func handleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+		q   = r.URL.Query()
+
+		text    = strings.ToLower(strings.TrimSpace(q.Get("q")))
+		peer    = strings.ToLower(strings.TrimSpace(q.Get("peer")))
+		mention = strings.TrimSpace(q.Get("mention"))
+	)
+
+	if app.hub.MsgCache == nil {
+		respondJSON(w, nil, hub.ErrHistoryDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	_, from, to, err := historyWindow(r, time.UTC)
+	if err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		respondJSON(w, nil, errors.New("invalid page"), http.StatusBadRequest)
+		return
+	}
+	perPage, err := queryInt(q.Get("per_page"), searchPerPage)
+	if err != nil || perPage < 1 || perPage > searchMaxPerPage {
+		respondJSON(w, nil, errors.New("invalid per_page (1 - 200)"), http.StatusBadRequest)
+		return
+	}
+
+	rooms, err := app.hub.Store.GetRooms()
+	if err != nil {
+		app.logger.Printf("error fetching rooms: %v", err)
+		respondJSON(w, nil, errors.New("error fetching rooms"), http.StatusInternalServerError)
+		return
+	}
+
+	// Optional room filter.
+	roomIDs := make(map[string]bool)
+	for _, id := range q["room"] {
+		roomIDs[id] = true
+	}
+
+	hits := []searchHit{}
+	for _, room := range rooms {
+		if len(roomIDs) > 0 && !roomIDs[room.ID] {
+			continue
+		}
+
+		msgs, err := app.hub.MsgCache.GetMessageCache(room.ID)
+		if err != nil {
+			app.logger.Printf("error fetching message cache: %v", err)
+			respondJSON(w, nil, errors.New("error fetching history"), http.StatusInternalServerError)
+			return
+		}
+
+		for _, m := range filterMessages(msgs, from, to) {
+			if peer != "" && strings.ToLower(m.PeerHandle) != peer {
+				continue
+			}
+			if mention != "" && !mentions(m, mention) {
+				continue
+			}
+			if text != "" &&
+				!strings.Contains(strings.ToLower(m.Message), text) &&
+				!strings.Contains(strings.ToLower(m.PeerHandle), text) {
+				continue
+			}
+			hits = append(hits, searchHit{RoomID: room.ID, RoomName: room.Name, Message: m})
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Message.Timestamp.After(hits[j].Message.Timestamp)
+	})
+
+	app.hub.Audit.Record("admin.search", "admin", "", map[string]interface{}{
+		"q":       q.Get("q"),
+		"rooms":   q["room"],
+		"peer":    q.Get("peer"),
+		"mention": q.Get("mention"),
+	})
+
+	out := searchResp{Total: len(hits), Page: page, PerPage: perPage, Results: []searchHit{}}
+	if start := (page - 1) * perPage; start < len(hits) {
+		end := start + perPage
+		if end > len(hits) {
+			end = len(hits)
+		}
+		out.Results = hits[start:end]
+	}
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// queryInt parses an integer query param. It returns the default if the
+// param is empty.
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// securityCfg represents the security headers sent with responses. Empty
+// settings disable their headers.
+type securityCfg struct {
+	// Content-Security-Policy without frame-ancestors, which is derived
+	// from FrameOptions and EmbedOrigins.
+	CSP string `koanf:"content_security_policy"`
+
+	// X-Frame-Options: DENY or SAMEORIGIN.
+	FrameOptions string `koanf:"frame_options"`
+
+	ReferrerPolicy string `koanf:"referrer_policy"`
+
+	// Strict-Transport-Security max-age. It's only sent over HTTPS.
+	HSTSMaxAge            time.Duration `koanf:"hsts_max_age"`
+	HSTSIncludeSubdomains bool          `koanf:"hsts_include_subdomains"`
+
+	// Origins (scheme://host[:port]) of other sites that can embed room
+	// pages in iframes.
+	EmbedOrigins []string `koanf:"embed_origins"`
+}
+
+// validate checks the frame options and the embed origins.
+func (c securityCfg) validate() error {
+	switch strings.ToUpper(c.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return errors.New("security.frame_options should be DENY or SAMEORIGIN")
+	}
+	if strings.Contains(strings.ToLower(c.CSP), "frame-ancestors") {
+		return errors.New("security.content_security_policy shouldn't have frame-ancestors. It's derived from security.frame_options")
+	}
+	for _, o := range c.EmbedOrigins {
+		if !strings.HasPrefix(o, "https://") && !strings.HasPrefix(o, "http://") {
+			return fmt.Errorf("invalid origin in security.embed_origins: %s", o)
+		}
+	}
+	return nil
+}
+
+// csp returns the Content-Security-Policy with frame-ancestors for pages
+// that can be embedded by the embed origins or not.
+func (c securityCfg) csp(embed bool) string {
+	var fa string
+	switch strings.ToUpper(c.FrameOptions) {
+	case "DENY":
+		fa = "'none'"
+	case "SAMEORIGIN":
+		fa = "'self'"
+	}
+	if embed {
+		fa = strings.TrimSpace(strings.Join(append([]string{"'self'"}, c.EmbedOrigins...), " "))
+	}
+
+	csp := strings.TrimRight(strings.TrimSpace(c.CSP), ";")
+	if fa == "" {
+		return csp
+	}
+	if csp == "" {
+		return "frame-ancestors " + fa
+	}
+	return csp + "; frame-ancestors " + fa
+}
+
+// securityHeaders is a middleware that sets the security headers on all
+// responses. HSTS is only sent on requests over TLS or when the root URL
+// is HTTPS, eg: behind a TLS terminating proxy.
+func securityHeaders(c securityCfg, rootURL string) func(http.Handler) http.Handler {
+	var (
+		csp  = c.csp(false)
+		fo   = strings.ToUpper(c.FrameOptions)
+		hsts string
+	)
+	if c.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int(c.HSTSMaxAge.Seconds()))
+		if c.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	https := strings.HasPrefix(rootURL, "https://")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			if csp != "" {
+				h.Set("Content-Security-Policy", csp)
+			}
+			if fo != "" {
+				h.Set("X-Frame-Options", fo)
+			}
+			if c.ReferrerPolicy != "" {
+				h.Set("Referrer-Policy", c.ReferrerPolicy)
+			}
+			if hsts != "" && (r.TLS != nil || https) {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowEmbed is a middleware that relaxes the framing headers set by
+// securityHeaders so that the embed origins can embed a page in iframes.
+// X-Frame-Options can't list origins and is dropped in favour of
+// frame-ancestors. It's a no-op if there are no embed origins.
+func allowEmbed(c securityCfg) func(http.Handler) http.Handler {
+	csp := c.csp(true)
+
+	return func(next http.Handler) http.Handler {
+		if len(c.EmbedOrigins) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Del("X-Frame-Options")
+			w.Header().Set("Content-Security-Policy", csp)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
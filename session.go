@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// csrfHeader is the header in which clients send the CSRF token.
+const csrfHeader = "X-CSRF-Token"
+
+// newCookie returns a cookie with the security attributes from the config.
+func newCookie(app *App, name, value string, maxAge int) *http.Cookie {
+	ck := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     app.cfg.RootPath + "/",
+		MaxAge:   maxAge,
+		Secure:   app.cfg.CookieSecure,
+		HttpOnly: true,
+	}
+
+	switch strings.ToLower(app.cfg.CookieSameSite) {
+	case "strict":
+		ck.SameSite = http.SameSiteStrictMode
+	case "none":
+		ck.SameSite = http.SameSiteNoneMode
+	default:
+		ck.SameSite = http.SameSiteLaxMode
+	}
+	return ck
+}
+
+// csrfToken returns the CSRF token of the client, setting a new one as a
+// cookie if there isn't one. The token is rendered into pages and has to be
+// sent back in the X-CSRF-Token header (double submit) with state changing
+// requests.
+func csrfToken(w http.ResponseWriter, r *http.Request, app *App) string {
+	if ck, _ := r.Cookie(app.cfg.SessionCookie + "_csrf"); ck != nil && len(ck.Value) == 32 {
+		return ck.Value
+	}
+
+	tk, err := hub.GenerateGUID(32)
+	if err != nil {
+		app.logger.Printf("error generating CSRF token: %v", err)
+		return ""
+	}
+	http.SetCookie(w, newCookie(app, app.cfg.SessionCookie+"_csrf", tk, 0))
+	return tk
+}
+
+// checkCSRF validates the CSRF token sent with a request against the CSRF
+// cookie. Websocket upgrade requests can't set headers, so the token is also
+// accepted as a query param.
+func checkCSRF(r *http.Request, app *App) bool {
+	if !app.cfg.CSRF {
+		return true
+	}
+
+	ck, _ := r.Cookie(app.cfg.SessionCookie + "_csrf")
+	if ck == nil || ck.Value == "" {
+		return false
+	}
+
+	tk := r.Header.Get(csrfHeader)
+	if tk == "" {
+		tk = r.URL.Query().Get("csrf")
+	}
+	return subtle.ConstantTimeCompare([]byte(tk), []byte(ck.Value)) == 1
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// roomOwner returns the handle of the room's owner making the request, who
+// is identified by their session or the owner key in the X-Owner-Key
+// header. ok is false if the request isn't from the owner.
+func roomOwner(r *http.Request, ctx *reqCtx) (string, bool) {
+	if ctx.sess.Owner {
+		return ctx.sess.Handle, true
+	}
+	if ctx.room.IsOwnerKey(r.Header.Get("X-Owner-Key")) {
+		return "owner", true
+	}
+	return "", false
+}
+
+// handleGetRoomSettings returns a room's settings to its owner.
+func handleGetRoomSettings(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if _, ok := roomOwner(r, ctx); !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	respondJSON(w, room.Settings(), nil, http.StatusOK)
+}
+
+// handleUpdateRoomSettings updates a room's settings.
+func handleUpdateRoomSettings(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	actor, ok := roomOwner(r, ctx)
+	if !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	var req hub.RoomSettings
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if err := app.hub.ValidateSettings(req); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+	if err := room.SetSettings(req); err != nil {
+		app.logger.Printf("error updating room settings: %v", err)
+		respondJSON(w, nil, errors.New("error updating settings"), http.StatusInternalServerError)
+		return
+	}
+
+	app.hub.Audit.Record("room.settings", actor, room.ID, map[string]interface{}{
+		"settings": req,
+	})
+	respondJSON(w, room.Settings(), nil, http.StatusOK)
+}
+
+// handleSetOwnerRoomPassword changes or removes a room's password. The
+// other sessions in the room can optionally be revoked so that peers who
+// knew the old password have to log in again.
+func handleSetOwnerRoomPassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	actor, ok := roomOwner(r, ctx)
+	if !ok {
+		respondJSON(w, nil, hub.ErrNotOwner, http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Password       string `json:"password"`
+		Remove         bool   `json:"remove"`
+		RevokeSessions bool   `json:"revoke_sessions"`
+	}
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	if req.Remove {
+		if err := room.RemovePassword(); err != nil {
+			app.logger.Printf("error removing room password: %v", err)
+			respondJSON(w, nil, errors.New("error updating password"), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		if err := app.passwd.Validate(req.Password); err != nil {
+			respondJSON(w, nil, err, http.StatusBadRequest)
+			return
+		}
+		hash, err := app.passwd.Hash(req.Password)
+		if err != nil {
+			app.logger.Printf("error hashing password: %v", err)
+			respondJSON(w, nil, errors.New("error hashing password"), http.StatusInternalServerError)
+			return
+		}
+		if err := room.SetPassword(hash, passwordMeta(req.Password)); err != nil {
+			app.logger.Printf("error updating room password: %v", err)
+			respondJSON(w, nil, errors.New("error updating password"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The owner's own session, if any, is retained.
+	var revoked int
+	if req.RevokeSessions {
+		n, err := room.RevokeSessions(ctx.sess.ID)
+		if err != nil {
+			app.logger.Printf("error revoking room sessions: %v", err)
+			respondJSON(w, nil, errors.New("error revoking sessions"), http.StatusInternalServerError)
+			return
+		}
+		revoked = n
+	}
+
+	app.hub.Audit.Record("room.password", actor, room.ID, map[string]interface{}{
+		"removed":          req.Remove,
+		"revoked_sessions": revoked,
+	})
+	respondJSON(w, struct {
+		HasPassword     bool `json:"has_password"`
+		RevokedSessions int  `json:"revoked_sessions"`
+	}{room.HasPassword(), revoked}, nil, http.StatusOK)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/knadh/stuffbin"
+)
+
+// Cache lifetime of versioned static files (?v=hash). Their URLs change
+// when their content changes.
+const assetMaxAge = 365 * 24 * time.Hour
+
+// hashAssets returns the content hashes of the static files in a file
+// system by path. Templates and language catalogs aren't served as assets.
+func hashAssets(fs stuffbin.FileSystem) map[string]string {
+	if fs == nil {
+		return nil
+	}
+
+	out := make(map[string]string)
+	for _, p := range fs.List() {
+		if !strings.HasPrefix(p, "/static/") ||
+			strings.HasPrefix(p, "/static/templates/") || strings.HasPrefix(p, "/static/i18n/") {
+			continue
+		}
+		b, err := fs.Read(p)
+		if err != nil {
+			continue
+		}
+		h := sha256.Sum256(b)
+		out[p] = hex.EncodeToString(h[:8])
+	}
+	return out
+}
+
+// handleStatic serves the static files of the request's vhost with their
+// content hashes as ETags. Requests for the current version of a file
+// (?v=hash) are cached for assetMaxAge and others are revalidated.
+func handleStatic(app *App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vh := app.vhostFor(r)
+		if h, ok := app.assetHashes(vh)[r.URL.Path]; ok {
+			w.Header().Set("ETag", `"`+h+`"`)
+			if r.URL.Query().Get("v") == h {
+				w.Header().Set("Cache-Control",
+					fmt.Sprintf("public, max-age=%d, immutable", int(assetMaxAge.Seconds())))
+			} else {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+		}
+		app.files(vh).FileServer().ServeHTTP(w, r)
+	}
+}
+
+// Asset returns the URL of a static file, eg: "style.css", with its
+// version so that browsers cache it until it changes.
+func (t tpl) Asset(name string) string {
+	p := "/static/" + name
+	if h, ok := t.assets[p]; ok {
+		return t.Config.RootPath + p + "?v=" + h
+	}
+	return t.Config.RootPath + p
+}
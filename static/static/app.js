@@ -5,6 +5,9 @@ const notifType = {
 };
 const typingDebounceInterval = 3000;
 
+// The browser's timezone, sent as the peer's preference for history dates.
+const browserTimezone = Intl.DateTimeFormat().resolvedOptions().timeZone || "";
+
 Vue.component("expand-link", {
     props: ["link"],
     data: function () {
@@ -49,8 +52,21 @@ var app = new Vue({
         typingTimer: null,
         typingPeers: new Map(),
 
+        // Seconds after which sent messages are burnt (removed). 0 is off.
+        burn: 0,
+
+        // Activity stats of the room shown to the owner.
+        stats: null,
+
+        // Position in a full room's queue. 0 is not queued.
+        queuePosition: 0,
+        queueSize: 0,
+
         // Form fields.
         roomName: "",
+        kiosk: false,
+        region: "",
+        preset: "",
         handle: "",
         password: "",
         message: "",
@@ -78,21 +94,29 @@ var app = new Vue({
     methods: {
         // Handle room creation.
         handleCreateRoom() {
-            fetch("/api/rooms", {
-                method: "post",
-                body: JSON.stringify({
-                    name: this.roomName,
-                    password: this.password
-                }),
-                headers: { "Content-Type": "application/json; charset=utf-8" }
-            })
+            this.getCaptcha()
+                .then(captcha => fetch(window._root + "/api/rooms", {
+                    method: "post",
+                    body: JSON.stringify({
+                        name: this.roomName,
+                        password: this.password,
+                        kiosk: this.kiosk,
+                        region: this.region,
+                        preset: this.preset,
+                        timezone: browserTimezone,
+                        captcha: captcha
+                    }),
+                    headers: { "Content-Type": "application/json; charset=utf-8", "X-CSRF-Token": window._csrf }
+                }))
                 .then(resp => resp.json())
                 .then(resp => {
                     this.toggleBusy();
                     if (resp.error) {
                         this.notify(resp.error, notifType.error);
                     } else {
-                        document.location.replace("/r/" + resp.data.id);
+                        // The owner key lets the creator dispose of the room.
+                        localStorage.setItem("owner:" + resp.data.id, resp.data.owner_key);
+                        document.location.replace(window._root + "/r/" + resp.data.id);
                     }
                 })
                 .catch(err => {
@@ -101,15 +125,61 @@ var app = new Vue({
                 });
         },
 
+        // Get the CAPTCHA response or solve a proof-of-work challenge
+        // depending on what the server requires.
+        getCaptcha() {
+            switch (window._captcha) {
+                case "hcaptcha":
+                    return Promise.resolve(document.querySelector("[name=h-captcha-response]").value);
+                case "recaptcha":
+                    return Promise.resolve(document.querySelector("[name=g-recaptcha-response]").value);
+                case "pow":
+                    this.notify("Verifying ...", notifType.notice, 30000);
+                    return fetch(window._root + "/api/challenge")
+                        .then(resp => resp.json())
+                        .then(resp => this.solvePoW(resp.data.challenge, resp.data.difficulty));
+            }
+            return Promise.resolve("");
+        },
+
+        // Find a nonce such that sha256(challenge:nonce) has the given
+        // number of leading zero bits.
+        async solvePoW(challenge, difficulty) {
+            const enc = new TextEncoder();
+            for (let n = 0; ; n++) {
+                const token = challenge + ":" + n;
+                const h = new Uint8Array(await crypto.subtle.digest("SHA-256", enc.encode(token)));
+
+                let bits = 0;
+                for (let i = 0; i < h.length; i++) {
+                    if (h[i] === 0) {
+                        bits += 8;
+                        continue;
+                    }
+                    bits += Math.clz32(h[i]) - 24;
+                    break;
+                }
+                if (bits >= difficulty) {
+                    return token;
+                }
+            }
+        },
+
         // Login to a room.
         handleLogin() {
             const handle = this.handle.replace(/[^a-z0-9_\-\.@]/ig, "");
 
             this.notify("Logging in", notifType.notice);
-            fetch("/api/rooms/" + _room.id + "/login", {
+            fetch(window._root + "/api/rooms/" + _room.id + "/login", {
                 method: "post",
-                body: JSON.stringify({ handle: handle, password: this.password }),
-                headers: { "Content-Type": "application/json; charset=utf-8" }
+                body: JSON.stringify({
+                    handle: handle,
+                    password: this.password,
+                    timezone: browserTimezone,
+                    owner_key: localStorage.getItem("owner:" + _room.id) || "",
+                    link: new URLSearchParams(location.hash.substring(1)).get("link") || ""
+                }),
+                headers: { "Content-Type": "application/json; charset=utf-8", "X-CSRF-Token": window._csrf }
             })
                 .then(resp => resp.json())
                 .then(resp => {
@@ -160,7 +230,7 @@ var app = new Vue({
         },
 
         handleSendMessage() {
-            Client.sendMessage(Client.MsgType["message"], this.message);
+            Client.sendMessage(Client.MsgType["message"], this.message, this.burn > 0 ? { burn: this.burn } : null);
             this.message = "";
             window.clearTimeout(this.typingTimer);
             this.typingTimer = null;
@@ -170,9 +240,9 @@ var app = new Vue({
             if (!confirm("Logout?")) {
                 return;
             }
-            fetch("/api/rooms/" + _room.id + "/login", {
+            fetch(window._root + "/api/rooms/" + _room.id + "/login", {
                 method: "delete",
-                headers: { "Content-Type": "application/json; charset=utf-8" }
+                headers: { "Content-Type": "application/json; charset=utf-8", "X-CSRF-Token": window._csrf }
             })
                 .then(resp => resp.json())
                 .then(resp => {
@@ -259,6 +329,50 @@ var app = new Vue({
             this.sidebarOn = !this.sidebarOn;
         },
 
+        // Show or hide the room's activity stats (owner).
+        toggleStats() {
+            if (this.stats) {
+                this.stats = null;
+                return;
+            }
+
+            fetch(window._root + "/api/rooms/" + _room.id + "/stats")
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                        return;
+                    }
+                    this.stats = resp.data;
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
+        // Switch between the light and dark colour schemes. The preference
+        // is saved in the peer's session in the room.
+        toggleScheme() {
+            const el = document.documentElement,
+                scheme = el.dataset.scheme === "dark" ? "light" : "dark";
+
+            el.dataset.scheme = scheme;
+            fetch(window._root + "/api/rooms/" + _room.id + "/scheme", {
+                method: "put",
+                body: JSON.stringify({ scheme: scheme }),
+                headers: { "Content-Type": "application/json; charset=utf-8", "X-CSRF-Token": window._csrf }
+            })
+                .then(resp => resp.json())
+                .then(resp => {
+                    if (resp.error) {
+                        this.notify(resp.error, notifType.error);
+                    }
+                })
+                .catch(err => {
+                    this.notify(err, notifType.error);
+                });
+        },
+
         toggleChat() {
             this.chatOn = !this.chatOn;
 
@@ -300,11 +414,37 @@ var app = new Vue({
                     this.toggleChat();
                     break;
 
+                case Client.MsgType["peer.spam"]:
+                    this.notify("You were removed for spamming", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["peer.banned"]:
+                    this.notify("You have been banned from this room", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["peer.idle"]:
+                    this.notify("You were disconnected for inactivity", notifType.error);
+                    this.toggleChat();
+                    break;
+
                 case Client.MsgType["room.full"]:
                     this.notify("Room is full", notifType.error);
                     this.toggleChat();
                     break;
 
+                case Client.MsgType["session.revoked"]:
+                    this.notify("This device has been logged out", notifType.error);
+                    this.toggleChat();
+                    break;
+
+                case Client.MsgType["room.closed"]:
+                    this.notify("Room closed due to inactivity", notifType.error);
+                    this.toggleChat();
+                    this.disposed = true;
+                    break;
+
                 case Client.MsgType["room.dispose"]:
                     this.notify("Room diposed", notifType.error);
                     this.toggleChat();
@@ -319,6 +459,12 @@ var app = new Vue({
         },
 
         onPeerSelf(data) {
+            // The peer has been admitted from the queue.
+            if (this.queuePosition > 0) {
+                this.queuePosition = 0;
+                Client.getPeers();
+            }
+
             this.self = {
                 ...data.data,
                 avatar: this.hashColor(data.data.id)
@@ -333,16 +479,51 @@ var app = new Vue({
             if (typ === Client.MsgType["peer.join"]) {
                 peers.push(peer);
             } else {
-                peers = peers.filter((e) => { return e.id !== peer.id; });
+                // A peer connected from multiple devices leaves when the
+                // last device does, which may not be the one listed.
+                peers = peers.filter((e) => { return e.handle !== peer.handle; });
             }
             this.onPeers(peers);
+        },
 
-            // Notice in the message area;
-            peer.avatar = this.hashColor(peer.id);
+        // Connection quality of a peer changed.
+        onPeerQuality(data) {
+            const d = data.data;
+            this.peers = this.peers.map((p) => {
+                return p.handle === d.handle ? { ...p, quality: d.quality } : p;
+            });
+        },
+
+        // Messages were dropped as the connection couldn't keep up.
+        onMessagesMissed(data) {
+            this.notify(`${data.data.count} message(s) were missed due to a slow connection`, notifType.notice);
+        },
+
+        // Recent messages from the room's history sent on connecting. They're
+        // already on screen when reconnecting.
+        onHistoryReplay(data) {
+            // Messages missed while reconnecting follow the existing ones.
+            if (this.messages.length > 0 && !data.data.resumed) {
+                return;
+            }
+
+            const msgs = data.data.messages.map((m) => {
+                const peer = m.peer_id ? { id: m.peer_id, handle: m.peer_handle, avatar: this.hashColor(m.peer_id) } : null;
+                return { type: m.type, code: m.code, message: m.message, timestamp: m.timestamp, peer: peer, poll: m.poll };
+            });
+            this.messages = this.messages.concat(msgs);
+            this.scrollToNewester();
+        },
+
+        // System messages from the server (peer joins, warnings etc.).
+        onSystem(data) {
+            const d = data.data;
             this.messages.push({
-                type: typ,
-                peer: peer,
-                timestamp: data.timestamp
+                type: Client.MsgType["system"],
+                code: d.code,
+                message: d.message,
+                timestamp: data.timestamp,
+                peer: d.peer_id ? { id: d.peer_id, handle: d.peer_handle, avatar: this.hashColor(d.peer_id) } : null
             });
             this.scrollToNewester();
         },
@@ -382,34 +563,122 @@ var app = new Vue({
             }
 
             this.typingPeers.delete(data.data.peer_id);
-            this.messages.push({
+            const msg = {
                 type: Client.MsgType["message"],
                 timestamp: data.timestamp,
                 message: data.data.message,
+                burn: data.data.burn,
                 peer: {
                     id: data.data.peer_id,
                     handle: data.data.peer_handle,
+                    operator: data.data.peer_operator,
                     avatar: this.hashColor(data.data.peer_id)
                 }
+            };
+            this.messages.push(msg);
+            this.scrollToNewester();
+
+            // Remove burn-after-reading messages once they've been displayed
+            // for their duration.
+            if (msg.burn > 0) {
+                window.setTimeout(() => {
+                    this.messages = this.messages.filter((m) => m !== msg);
+                }, msg.burn * 1000);
+            }
+        },
+
+        // The room is full and the peer is waiting in its queue.
+        onQueuePosition(data) {
+            this.queuePosition = data.data.position;
+            this.queueSize = data.data.size;
+        },
+
+        // A peer has created a poll.
+        onPoll(data) {
+            const d = data.data;
+            this.messages.push({
+                type: Client.MsgType["poll"],
+                timestamp: data.timestamp,
+                poll: { id: d.id, question: d.question, options: d.options, votes: d.votes, closed: d.closed },
+                peer: { id: d.peer_id, handle: d.peer_handle, avatar: this.hashColor(d.peer_id) }
             });
             this.scrollToNewester();
         },
 
+        // The vote counts of a poll have changed or it has been closed.
+        onPollTally(data) {
+            const m = this.messages.find((m) => m.type === Client.MsgType["poll"] && m.poll && m.poll.id === data.data.id);
+            if (!m) {
+                return;
+            }
+            m.poll.votes = data.data.votes;
+            m.poll.closed = data.data.closed;
+        },
+
+        handleVote(m, option) {
+            Client.sendMessage(Client.MsgType["poll.vote"], { id: m.poll.id, option: option });
+            this.$set(m, "voted", true);
+        },
+
+        handleClosePoll(m) {
+            Client.sendMessage(Client.MsgType["poll.close"], { id: m.poll.id });
+        },
+
+        // The peer was mentioned in a message.
+        onMention(data) {
+            if (!document.hasFocus()) {
+                return;
+            }
+            this.beep();
+            this.notify("@" + data.data.peer_handle + ": " + data.data.message, notifType.notice, 5000);
+        },
+
+        // The room's name has changed.
+        onRoomInfo(data) {
+            _room.name = data.data.name;
+            this.pageTitle = data.data.name + " - Niltalk";
+            document.title = this.pageTitle;
+        },
+
+        // The server requires a newer client. Reload to get it.
+        onClientOutdated() {
+            this.notify("The app has been updated. Reloading ...", notifType.notice, 5000);
+            window.setTimeout(() => {
+                document.location.reload(true);
+            }, 3000);
+        },
+
         // Register chat client events.
         initClient() {
             Client.on(Client.MsgType["connect"], this.onConnect);
             Client.on(Client.MsgType["disconnect"], (data) => { this.onDisconnect(Client.MsgType["disconnect"]); });
             Client.on(Client.MsgType["peer.ratelimited"], (data) => { this.onDisconnect(Client.MsgType["peer.ratelimited"]); });
+            Client.on(Client.MsgType["peer.spam"], (data) => { this.onDisconnect(Client.MsgType["peer.spam"]); });
+            Client.on(Client.MsgType["peer.banned"], (data) => { this.onDisconnect(Client.MsgType["peer.banned"]); });
+            Client.on(Client.MsgType["peer.idle"], (data) => { this.onDisconnect(Client.MsgType["peer.idle"]); });
             Client.on(Client.MsgType["room.dispose"], (data) => { this.onDisconnect(Client.MsgType["room.dispose"]); });
             Client.on(Client.MsgType["room.full"], (data) => { this.onDisconnect(Client.MsgType["room.full"]); });
+            Client.on(Client.MsgType["room.closed"], (data) => { this.onDisconnect(Client.MsgType["room.closed"]); });
+            Client.on(Client.MsgType["session.revoked"], (data) => { this.onDisconnect(Client.MsgType["session.revoked"]); });
             Client.on(Client.MsgType["reconnecting"], this.onReconnecting);
 
             Client.on(Client.MsgType["peer.info"], this.onPeerSelf);
             Client.on(Client.MsgType["peer.list"], (data) => { this.onPeers(data.data); });
             Client.on(Client.MsgType["peer.join"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.join"]); });
             Client.on(Client.MsgType["peer.leave"], (data) => { this.onPeerJoinLeave(data, Client.MsgType["peer.leave"]); });
+            Client.on(Client.MsgType["peer.quality"], this.onPeerQuality);
+            Client.on(Client.MsgType["messages.missed"], this.onMessagesMissed);
+            Client.on(Client.MsgType["history.replay"], this.onHistoryReplay);
             Client.on(Client.MsgType["message"], this.onMessage);
+            Client.on(Client.MsgType["mention"], this.onMention);
+            Client.on(Client.MsgType["queue.position"], this.onQueuePosition);
+            Client.on(Client.MsgType["poll"], this.onPoll);
+            Client.on(Client.MsgType["poll.tally"], this.onPollTally);
+            Client.on(Client.MsgType["system"], this.onSystem);
             Client.on(Client.MsgType["typing"], this.onTyping);
+            Client.on(Client.MsgType["notice"], (data) => { this.notify(data.data, notifType.notice); });
+            Client.on(Client.MsgType["client.outdated"], this.onClientOutdated);
+            Client.on(Client.MsgType["room.info"], this.onRoomInfo);
         },
 
         initTimers() {
@@ -5,34 +5,73 @@ var Client = new function () {
 		"reconnecting": "reconnecting",
 		"room.dispose": "room.dispose",
 		"room.full": "room.full",
+		"queue.position": "queue.position",
+		"room.closed": "room.closed",
+		"room.info": "room.info",
 		"message": "message",
+		"message.ack": "message.ack",
+		"mention": "mention",
+		"poll": "poll",
+		"poll.vote": "poll.vote",
+		"poll.close": "poll.close",
+		"poll.tally": "poll.tally",
 		"typing": "typing",
 		"peer.list": "peer.list",
 		"peer.info": "peer.info",
 		"peer.join": "peer.join",
 		"peer.leave": "peer.leave",
 		"peer.ratelimited": "peer.ratelimited",
+		"peer.spam": "peer.spam",
+		"peer.banned": "peer.banned",
+		"peer.idle": "peer.idle",
+		"peer.quality": "peer.quality",
+		"messages.missed": "messages.missed",
+		"history.replay": "history.replay",
 		"notice": "notice",
-		"handle": "handle"
+		"handle": "handle",
+		"client.outdated": "client.outdated",
+		"session.revoked": "session.revoked",
+		"session.resume": "session.resume",
+		"system": "system",
+		"protocol": "protocol"
 	};
 	this.MsgType = MsgType;
 
+	// Protocol version of the client reported to the server.
+	const version = "1.0.0";
+	this.version = version;
+
+	// Highest websocket protocol version the client speaks and the version
+	// negotiated with the server on connect.
+	const maxProtocol = 2;
+	this.protocol = 1;
+
 	var wsURL = null,
 		pingInterval = 5, // seconds
-		reconnectInterval = 4000;
+		reconnectInterval = 4000,
+		maxPending = 50;
 
 	var ws = null,
 		// event hooks
 		triggers = {},
 		ping_timer = null,
 		reconnect_timer = null,
-		peer = { id: null, handle: null };
+		peer = { id: null, handle: null },
+		// Messages sent with client IDs that the server hasn't acknowledged
+		// yet. They're sent again on reconnection.
+		pending = {},
+		msgCount = 0,
+		// Resume token of the connection and the sequence number of the last
+		// message received, to be sent the missed messages on reconnection.
+		resumeToken = null,
+		lastSeq = 0;
 
 
 	// Initialize and connect the websocket.
 	this.init = function (roomID) {
 		wsURL = document.location.protocol.replace(/http(s?):/, "ws$1:") +
-			document.location.host + "/ws/" + roomID;
+			document.location.host + (window._root || "") + "/ws/" + roomID + "?v=" + version + "&proto=" + maxProtocol +
+			"&csrf=" + encodeURIComponent(window._csrf || "");
 	};
 
 	// Peer identification info.
@@ -42,9 +81,16 @@ var Client = new function () {
 
 	// websocket hooks
 	this.connect = function () {
-		ws = new WebSocket(wsURL);
+		var url = wsURL;
+		if (resumeToken) {
+			url += "&resume=" + encodeURIComponent(resumeToken) + "&seq=" + lastSeq;
+			resumeToken = null;
+		}
+
+		ws = new WebSocket(url);
 		ws.onopen = function () {
 			trigger(MsgType["connect"]);
+			resendPending();
 		};
 
 		ws.onmessage = function (e) {
@@ -54,6 +100,16 @@ var Client = new function () {
 			} catch (e) {
 				return null;
 			}
+			if (data.type == MsgType["protocol"]) {
+				self.protocol = data.data.version;
+			}
+			if (data.type == MsgType["message.ack"]) {
+				delete pending[data.data.client_id];
+			}
+			if (data.type == MsgType["session.resume"]) {
+				resumeToken = data.data.token;
+			}
+			trackSeq(data);
 			trigger(data.type, data);
 		};
 
@@ -63,6 +119,21 @@ var Client = new function () {
 		};
 
 		ws.onclose = function (e) {
+			// The server may hint at when to reconnect, eg: on restarts
+			// or when it's overloaded.
+			var hint = /^reconnect:(\d+)$/.exec(e.reason || "");
+			if (hint) {
+				trigger(MsgType["disconnect"]);
+				attemptReconnection(parseInt(hint[1]));
+				return;
+			}
+
+			// The server doesn't speak the client's protocol.
+			if (e.code == 1002) {
+				trigger(MsgType["disconnect"]);
+				return;
+			}
+
 			if (e.code == 1000) {
 				if (e.reason && MsgType.hasOwnProperty(e.reason)) {
 					trigger(e.reason);
@@ -90,8 +161,23 @@ var Client = new function () {
 	};
 
 	// send a message
-	this.sendMessage = function (typ, data) {
-		send({ "type": typ, "data": data });
+	// opts are optional envelope fields, eg: burn.
+	this.sendMessage = function (typ, data, opts) {
+		var m = Object.assign({ "type": typ, "data": data }, opts);
+
+		// Chat messages carry an ID and their send time so that they can be
+		// retried if they aren't acknowledged.
+		if (typ == MsgType["message"]) {
+			m.client_id = Date.now().toString(36) + "-" + (++msgCount) + "-" + Math.random().toString(36).substr(2, 6);
+			m.ts = Date.now();
+
+			var ids = Object.keys(pending);
+			if (ids.length >= maxPending) {
+				delete pending[ids[0]];
+			}
+			pending[m.client_id] = m;
+		}
+		send(m);
 	}
 
 	// ___ private
@@ -110,6 +196,36 @@ var Client = new function () {
 		};
 	}
 
+	// resend messages that weren't acknowledged before the connection dropped.
+	// The server de-duplicates the ones it had already received.
+	function resendPending() {
+		for (var id in pending) {
+			send(pending[id]);
+		}
+	}
+
+	// trackSeq records the sequence number of the last message received.
+	// Polls are numbered in the same sequence as messages.
+	function trackSeq(data) {
+		var seqs = [];
+		switch (data.type) {
+			case MsgType["message"]:
+				seqs = [data.data.seq];
+				break;
+			case MsgType["poll"]:
+				seqs = [data.data.id];
+				break;
+			case MsgType["history.replay"]:
+				seqs = data.data.messages.map(function (m) { return m.seq; });
+				break;
+		}
+		for (var i = 0; i < seqs.length; i++) {
+			if (seqs[i] > lastSeq) {
+				lastSeq = seqs[i];
+			}
+		}
+	}
+
 	// trigger event callbacks
 	function trigger(typ, data) {
 		if (!triggers.hasOwnProperty(typ)) {
@@ -121,12 +237,18 @@ var Client = new function () {
 		}
 	}
 
-	function attemptReconnection() {
-		trigger(MsgType["reconnecting"], reconnectInterval);
+	// Reconnect after the given timeout or the default interval with
+	// random jitter.
+	function attemptReconnection(timeout) {
+		if (!timeout) {
+			timeout = reconnectInterval + Math.floor(Math.random() * reconnectInterval);
+		}
+
+		trigger(MsgType["reconnecting"], timeout);
 		reconnect_timer = setTimeout(function () {
 			reconnect_timer = null;
 			self.connect();
-		}, reconnectInterval);
+		}, timeout);
 	}
 
 	var self = this;
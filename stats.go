@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+// handleGetRoomStats returns the activity stats of a room (messages by
+// hour, peak concurrent peers, most active handles) computed from its
+// history to its peers and owner.
+func handleGetRoomStats(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if _, ok := roomOwner(r, ctx); !ok && ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+	if !room.Capabilities().History {
+		respondJSON(w, nil, hub.ErrHistoryDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	msgs, err := app.hub.MsgCache.GetMessageCache(room.ID)
+	if err != nil {
+		app.logger.Printf("error fetching message cache: %v", err)
+		respondJSON(w, nil, errors.New("error fetching history"), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, hub.ComputeStats(msgs), nil, http.StatusOK)
+}
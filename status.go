@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// incident represents an operator note shown on the status page.
+type incident struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Date        time.Time `json:"date"`
+}
+
+// instanceStatus represents the publicly visible health of the instance.
+type instanceStatus struct {
+	Healthy bool `json:"healthy"`
+	StoreOK bool `json:"store_ok"`
+
+	// Counts are rounded down to the nearest 10 so as to not leak exact
+	// activity on the instance.
+	Rooms int `json:"rooms"`
+	Peers int `json:"peers"`
+
+	Incidents []incident `json:"incidents"`
+}
+
+// instanceStats represents the usage stats of the instance that can be
+// published.
+type instanceStats struct {
+	// Number of rooms ever created. It's nil if the store doesn't keep
+	// counts.
+	RoomsCreated *int64 `json:"rooms_created"`
+
+	ActiveRooms int `json:"active_rooms"`
+	ActivePeers int `json:"active_peers"`
+
+	StartedAt     time.Time `json:"started_at"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// handleStatusPage renders the public instance status page.
+func handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	respondHTML("status", tplData{
+		Title:  "Status",
+		Status: getStatus(app),
+	}, http.StatusOK, w, ctx)
+}
+
+// handleGetStatus returns the public instance status.
+func handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	st := getStatus(app)
+	code := http.StatusOK
+	if !st.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	respondJSON(w, st, nil, code)
+}
+
+// handleStatsPage renders the public usage stats page.
+func handleStatsPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	respondHTML("stats", tplData{
+		Title: "Stats",
+		Stats: getInstanceStats(app),
+	}, http.StatusOK, w, ctx)
+}
+
+// handleGetInstanceStats returns the public usage stats of the instance.
+func handleGetInstanceStats(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	respondJSON(w, getInstanceStats(app), nil, http.StatusOK)
+}
+
+// handleHealthz reports whether the process is alive and serving requests.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleReadyz reports whether the instance is ready to serve traffic, that
+// is, whether its store and message cache are reachable. It responds with
+// 503 and the failing checks otherwise.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+		out = map[string]string{"store": "ok"}
+	)
+
+	ready := true
+	if err := app.hub.Store.Ping(); err != nil {
+		out["store"] = err.Error()
+		ready = false
+	}
+	if app.hub.MsgCache != nil {
+		out["message_cache"] = "ok"
+		if err := app.hub.MsgCache.Ping(); err != nil {
+			out["message_cache"] = err.Error()
+			ready = false
+		}
+	}
+
+	if !ready {
+		app.logger.Printf("readyz: not ready: %v", out)
+		respondJSON(w, out, errors.New("not ready"), http.StatusServiceUnavailable)
+		return
+	}
+	respondJSON(w, out, nil, http.StatusOK)
+}
+
+// getStatus checks the health of the instance and loads incident notes.
+func getStatus(app *App) instanceStatus {
+	err := app.hub.Store.Ping()
+	if err != nil {
+		app.logger.Printf("status: error reaching store: %v", err)
+	}
+
+	rooms, peers := app.hub.Stats()
+	out := instanceStatus{
+		StoreOK:   err == nil,
+		Healthy:   err == nil,
+		Rooms:     rooms - rooms%10,
+		Peers:     peers - peers%10,
+		Incidents: []incident{},
+	}
+
+	if app.cfg.StatusNotesFile != "" {
+		n, err := readIncidents(app.cfg.StatusNotesFile)
+		if err != nil {
+			app.logger.Printf("status: error reading notes: %v", err)
+		} else {
+			out.Incidents = n
+		}
+	}
+	return out
+}
+
+// getInstanceStats collects the usage stats of the instance.
+func getInstanceStats(app *App) instanceStats {
+	rooms, peers := app.hub.Stats()
+	up := time.Since(bootTime)
+	out := instanceStats{
+		ActiveRooms:   rooms,
+		ActivePeers:   peers,
+		StartedAt:     bootTime,
+		Uptime:        up.Round(time.Second).String(),
+		UptimeSeconds: int64(up.Seconds()),
+	}
+
+	if app.hub.Counter != nil {
+		n, err := app.hub.Counter.GetCounter(store.CounterRoomsCreated)
+		if err != nil {
+			app.logger.Printf("stats: error fetching rooms created: %v", err)
+		} else {
+			out.RoomsCreated = &n
+		}
+	}
+	return out
+}
+
+// readIncidents reads the operator-editable incident notes from a JSON file.
+// The file is read on every request so that edits show up instantly.
+func readIncidents(path string) ([]incident, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []incident{}, nil
+		}
+		return nil, err
+	}
+
+	var out []incident
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,480 @@
+// Package bolt implements an embedded key-value store backed by a bbolt
+// database file for deployments that don't want SQL or external services.
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/lock"
+	"go.etcd.io/bbolt"
+)
+
+// Buckets. Sessions and messages are stored in a nested bucket per room.
+var (
+	bucketRooms    = []byte("rooms")
+	bucketSessions = []byte("sessions")
+	bucketMessages = []byte("messages")
+
+	// Expiry (unix nanoseconds) of a room's data in each of the buckets
+	// above, keyed by bucket:roomID. Data without an expiry doesn't expire.
+	bucketExpiry = []byte("expiry")
+
+	// Instance-wide counters (store.Counter) by name.
+	bucketCounters = []byte("counters")
+)
+
+// Config represents the bolt store config structure.
+type Config struct {
+	Path string `koanf:"path"`
+
+	// Interval at which expired data is deleted from the database.
+	CleanupInterval time.Duration `koanf:"cleanup_interval"`
+}
+
+// Bolt represents the bolt store.
+type Bolt struct {
+	cfg *Config
+	db  *bbolt.DB
+	log *log.Logger
+
+	// Locks (lock.Locker) are only held within the process as the
+	// database file can only be opened by one process.
+	*lock.Local
+}
+
+// New returns a new bolt store. It creates the database file if it doesn't
+// exist and starts the expiry cleanup in the background.
+func New(cfg Config, l *log.Logger) (*Bolt, error) {
+	db, err := bbolt.Open(cfg.Path, 0600, &bbolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, b := range [][]byte{bucketRooms, bucketSessions, bucketMessages, bucketExpiry, bucketCounters} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	b := &Bolt{cfg: &cfg, db: db, log: l, Local: lock.NewLocal()}
+	if cfg.CleanupInterval > 0 {
+		go b.runCleanup()
+	}
+	return b, nil
+}
+
+// AddRoom adds a room to the store.
+func (b *Bolt) AddRoom(r store.Room, ttl time.Duration) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketRooms).Put([]byte(r.ID), v); err != nil {
+			return err
+		}
+		return expire(tx, bucketRooms, r.ID, ttl)
+	})
+}
+
+// UpdateRoom updates the properties of an existing room retaining its TTL.
+func (b *Bolt) UpdateRoom(r store.Room) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		var cur store.Room
+		if err := getRoom(tx, r.ID, &cur); err != nil {
+			return err
+		}
+
+		// The creation date is immutable.
+		r.CreatedAt = cur.CreatedAt
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketRooms).Put([]byte(r.ID), v)
+	})
+}
+
+// GetRoom gets a room from the store.
+func (b *Bolt) GetRoom(id string) (store.Room, error) {
+	var out store.Room
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return getRoom(tx, id, &out)
+	})
+	return out, err
+}
+
+// GetRooms retrieves all the rooms in the store.
+func (b *Bolt) GetRooms() ([]store.Room, error) {
+	out := []store.Room{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketRooms).ForEach(func(k, v []byte) error {
+			if expired(tx, bucketRooms, string(k)) {
+				return nil
+			}
+
+			var r store.Room
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			out = append(out, r)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// ExtendRoomTTL extends a room's TTL.
+func (b *Bolt) ExtendRoomTTL(id string, ttl time.Duration) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, bk := range [][]byte{bucketRooms, bucketSessions, bucketMessages} {
+			if err := expire(tx, bk, id, ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RoomExists checks if a room exists in the store.
+func (b *Bolt) RoomExists(id string) (bool, error) {
+	exists := false
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		exists = !expired(tx, bucketRooms, id) && tx.Bucket(bucketRooms).Get([]byte(id)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// RemoveRoom deletes a room from the store.
+func (b *Bolt) RemoveRoom(id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketRooms).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpiry).Delete(expiryKey(bucketRooms, id))
+	})
+}
+
+// AddSession adds a sessionID room to the store.
+func (b *Bolt) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bk, err := tx.Bucket(bucketSessions).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		if err := bk.Put([]byte(s.ID), v); err != nil {
+			return err
+		}
+		return expire(tx, bucketSessions, roomID, ttl)
+	})
+}
+
+// GetSession retrieves a peer session from th store.
+func (b *Bolt) GetSession(sessID, roomID string) (store.Sess, error) {
+	var out store.Sess
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bk := roomBucket(tx, bucketSessions, roomID)
+		if bk == nil {
+			return nil
+		}
+
+		v := bk.Get([]byte(sessID))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &out)
+	})
+	return out, err
+}
+
+// GetSessions retrieves all the peer sessions in a room.
+func (b *Bolt) GetSessions(roomID string) ([]store.Sess, error) {
+	out := []store.Sess{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bk := roomBucket(tx, bucketSessions, roomID)
+		if bk == nil {
+			return nil
+		}
+
+		return bk.ForEach(func(k, v []byte) error {
+			var s store.Sess
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			out = append(out, s)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// RemoveSession deletes a session ID from a room.
+func (b *Bolt) RemoveSession(sessID, roomID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bk := tx.Bucket(bucketSessions).Bucket([]byte(roomID))
+		if bk == nil {
+			return nil
+		}
+		return bk.Delete([]byte(sessID))
+	})
+}
+
+// ClearSessions deletes all the sessions in a room.
+func (b *Bolt) ClearSessions(roomID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return deleteRoomBucket(tx, bucketSessions, roomID)
+	})
+}
+
+// AddMessageCache appends a message to a room's message cache.
+func (b *Bolt) AddMessageCache(roomID string, m store.Message, ttl time.Duration) error {
+	return b.AddMessageCacheBatch(roomID, []store.Message{m}, ttl)
+}
+
+// AddMessageCacheBatch appends messages to a room's message cache in one
+// transaction.
+func (b *Bolt) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bk, err := tx.Bucket(bucketMessages).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			v, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+
+			// Keys are big endian sequence numbers so that messages are
+			// iterated in the order they were added.
+			seq, err := bk.NextSequence()
+			if err != nil {
+				return err
+			}
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, seq)
+			if err := bk.Put(k, v); err != nil {
+				return err
+			}
+		}
+		return expire(tx, bucketMessages, roomID, ttl)
+	})
+}
+
+// GetMessageCache retrieves all the cached messages in a room in the order
+// they were added.
+func (b *Bolt) GetMessageCache(roomID string) ([]store.Message, error) {
+	out := []store.Message{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bk := roomBucket(tx, bucketMessages, roomID)
+		if bk == nil {
+			return nil
+		}
+
+		return bk.ForEach(func(k, v []byte) error {
+			var m store.Message
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			out = append(out, m)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// GetMessageCachePage retrieves a page of cached messages in a room before
+// the cursor, which is the sequence number (key) of a message.
+func (b *Bolt) GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error) {
+	var (
+		out  = []store.Message{}
+		next int64
+	)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bk := roomBucket(tx, bucketMessages, roomID)
+		if bk == nil {
+			return nil
+		}
+
+		// Position the cursor at the last message before the given one.
+		c := bk.Cursor()
+		k, v := c.Last()
+		if before > 0 {
+			seek := make([]byte, 8)
+			binary.BigEndian.PutUint64(seek, uint64(before))
+			if k, _ = c.Seek(seek); k != nil {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Last()
+			}
+		}
+
+		for ; k != nil && len(out) < limit; k, v = c.Prev() {
+			var m store.Message
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			out = append(out, m)
+			next = int64(binary.BigEndian.Uint64(k))
+		}
+		if k == nil {
+			next = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Messages were read newest first.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, next, nil
+}
+
+// ClearMessageCache deletes all the cached messages in a room.
+func (b *Bolt) ClearMessageCache(roomID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return deleteRoomBucket(tx, bucketMessages, roomID)
+	})
+}
+
+// Ping checks if the database is open.
+func (b *Bolt) Ping() error {
+	return b.db.View(func(tx *bbolt.Tx) error { return nil })
+}
+
+// Close closes the database.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// runCleanup periodically deletes expired data. This should be invoked as
+// a goroutine.
+func (b *Bolt) runCleanup() {
+	for range time.Tick(b.cfg.CleanupInterval) {
+		if err := b.cleanup(); err != nil {
+			b.log.Printf("error cleaning up expired data: %v", err)
+		}
+	}
+}
+
+// cleanup deletes expired data.
+func (b *Bolt) cleanup() error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		var (
+			now  = time.Now().UnixNano()
+			keys [][]byte
+		)
+		exp := tx.Bucket(bucketExpiry)
+		if err := exp.ForEach(func(k, v []byte) error {
+			if int64(binary.BigEndian.Uint64(v)) <= now {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			bk, roomID := splitExpiryKey(k)
+			if string(bk) == string(bucketRooms) {
+				if err := tx.Bucket(bucketRooms).Delete([]byte(roomID)); err != nil {
+					return err
+				}
+			} else if err := deleteRoomBucket(tx, bk, roomID); err != nil {
+				return err
+			}
+
+			if err := exp.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getRoom reads a room that hasn't expired into out.
+func getRoom(tx *bbolt.Tx, id string, out *store.Room) error {
+	if expired(tx, bucketRooms, id) {
+		return store.ErrRoomNotFound
+	}
+
+	v := tx.Bucket(bucketRooms).Get([]byte(id))
+	if v == nil {
+		return store.ErrRoomNotFound
+	}
+	return json.Unmarshal(v, out)
+}
+
+// roomBucket returns a room's nested bucket in the given bucket. It returns
+// nil if the bucket doesn't exist or has expired.
+func roomBucket(tx *bbolt.Tx, bucket []byte, roomID string) *bbolt.Bucket {
+	if expired(tx, bucket, roomID) {
+		return nil
+	}
+	return tx.Bucket(bucket).Bucket([]byte(roomID))
+}
+
+// deleteRoomBucket deletes a room's nested bucket in the given bucket.
+func deleteRoomBucket(tx *bbolt.Tx, bucket []byte, roomID string) error {
+	err := tx.Bucket(bucket).DeleteBucket([]byte(roomID))
+	if err == bbolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+// expire sets the expiry of a room's data in a bucket. A TTL of 0 removes
+// any expiry.
+func expire(tx *bbolt.Tx, bucket []byte, roomID string, ttl time.Duration) error {
+	exp := tx.Bucket(bucketExpiry)
+	if ttl <= 0 {
+		return exp.Delete(expiryKey(bucket, roomID))
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(time.Now().Add(ttl).UnixNano()))
+	return exp.Put(expiryKey(bucket, roomID), v)
+}
+
+// expired checks if a room's data in a bucket has expired.
+func expired(tx *bbolt.Tx, bucket []byte, roomID string) bool {
+	v := tx.Bucket(bucketExpiry).Get(expiryKey(bucket, roomID))
+	if v == nil {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(v)) <= time.Now().UnixNano()
+}
+
+func expiryKey(bucket []byte, roomID string) []byte {
+	return []byte(string(bucket) + ":" + roomID)
+}
+
+func splitExpiryKey(k []byte) ([]byte, string) {
+	for i, c := range k {
+		if c == ':' {
+			return k[:i], string(k[i+1:])
+		}
+	}
+	return k, ""
+}
@@ -0,0 +1,36 @@
+package bolt
+
+import (
+	"encoding/binary"
+
+	"go.etcd.io/bbolt"
+)
+
+// IncrCounter increments a counter (store.Counter) and returns its new value.
+func (b *Bolt) IncrCounter(name string) (int64, error) {
+	var n uint64
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bk := tx.Bucket(bucketCounters)
+		if v := bk.Get([]byte(name)); len(v) == 8 {
+			n = binary.BigEndian.Uint64(v)
+		}
+		n++
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, n)
+		return bk.Put([]byte(name), v)
+	})
+	return int64(n), err
+}
+
+// GetCounter returns the value of a counter.
+func (b *Bolt) GetCounter(name string) (int64, error) {
+	var n uint64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(bucketCounters).Get([]byte(name)); len(v) == 8 {
+			n = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return int64(n), err
+}
@@ -0,0 +1,166 @@
+// Package lock implements named locks with leases for mutual exclusion of
+// background jobs (eg: pruning a room's history) across instances that share
+// a store. A lock is held by a random token until it's released or its lease
+// expires, so a crashed instance can't hold a lock forever. Stores that are
+// shared across instances (Redis, SQLite) implement Locker and Local is used
+// for stores that are only accessed by one process.
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLocked indicates that the lock is held by someone else.
+var ErrLocked = errors.New("lock is held by someone else")
+
+// Locker represents a backend that persists locks. The methods return false
+// if the lock is held by someone else or, when renewing, if the lease was
+// lost.
+type Locker interface {
+	// AcquireLock acquires the lock name for the given token if it's free
+	// or its lease has expired.
+	AcquireLock(name, token string, ttl time.Duration) (bool, error)
+
+	// RenewLock extends the lease of a lock held by the token.
+	RenewLock(name, token string, ttl time.Duration) (bool, error)
+
+	// ReleaseLock releases a lock if it's held by the token.
+	ReleaseLock(name, token string) error
+}
+
+// Lease is a lock held by the caller. It's renewed in the background until
+// it's released.
+type Lease struct {
+	Name string
+
+	l     Locker
+	token string
+	lost  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Acquire acquires a lock and renews its lease every third of the ttl until
+// it's released. It returns ErrLocked if the lock is held by someone else.
+func Acquire(l Locker, name string, ttl time.Duration) (*Lease, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := l.AcquireLock(name, token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+
+	ls := &Lease{
+		Name:  name,
+		l:     l,
+		token: token,
+		lost:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go ls.renew(ttl)
+	return ls, nil
+}
+
+// Lost returns a channel that's closed if the lease couldn't be renewed
+// and the lock may have been acquired by someone else. Jobs holding the
+// lock should stop.
+func (ls *Lease) Lost() <-chan struct{} {
+	return ls.lost
+}
+
+// Release stops renewing the lease and releases the lock.
+func (ls *Lease) Release() error {
+	ls.once.Do(func() { close(ls.done) })
+	return ls.l.ReleaseLock(ls.Name, ls.token)
+}
+
+// renew renews the lease until it's released or lost.
+func (ls *Lease) renew(ttl time.Duration) {
+	t := time.NewTicker(ttl / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ls.done:
+			return
+		case <-t.C:
+			if ok, err := ls.l.RenewLock(ls.Name, ls.token, ttl); err != nil || !ok {
+				close(ls.lost)
+				return
+			}
+		}
+	}
+}
+
+// Local is an in-memory Locker for stores that are only accessed by one
+// process.
+type Local struct {
+	locks map[string]localLock
+	mut   sync.Mutex
+}
+
+type localLock struct {
+	token   string
+	expires time.Time
+}
+
+// NewLocal returns a new in-memory Locker.
+func NewLocal() *Local {
+	return &Local{locks: make(map[string]localLock)}
+}
+
+// AcquireLock acquires a lock if it's free or its lease has expired.
+func (l *Local) AcquireLock(name, token string, ttl time.Duration) (bool, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	if c, ok := l.locks[name]; ok && c.expires.After(now) {
+		return false, nil
+	}
+	l.locks[name] = localLock{token: token, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// RenewLock extends the lease of a lock held by the token.
+func (l *Local) RenewLock(name, token string, ttl time.Duration) (bool, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	c, ok := l.locks[name]
+	if !ok || c.token != token || !c.expires.After(now) {
+		return false, nil
+	}
+	l.locks[name] = localLock{token: token, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// ReleaseLock releases a lock if it's held by the token.
+func (l *Local) ReleaseLock(name, token string) error {
+	l.mut.Lock()
+	if c, ok := l.locks[name]; ok && c.token == token {
+		delete(l.locks, name)
+	}
+	l.mut.Unlock()
+	return nil
+}
+
+// newToken returns a random token that identifies a lock's holder.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,429 @@
+// Package mem implements an in-memory store for development and small
+// instances. The data can optionally be snapshotted to a file periodically
+// and reloaded on startup so that a restart doesn't wipe active rooms.
+package mem
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/lock"
+)
+
+// Config represents the memory store config structure.
+type Config struct {
+	// File to snapshot the data to. Snapshots are disabled if it's empty.
+	SnapshotFile string `koanf:"snapshot_file"`
+
+	// Interval at which expired data is deleted and the data is
+	// snapshotted.
+	SnapshotInterval time.Duration `koanf:"snapshot_interval"`
+}
+
+// data is the store's data. It's exported as JSON in snapshots.
+type data struct {
+	Rooms    map[string]store.Room            `json:"rooms"`
+	Sessions map[string]map[string]store.Sess `json:"sessions"`
+	Messages map[string][]store.Message       `json:"messages"`
+
+	// Expiry of a room's data (rooms, sessions, messages) by room ID.
+	// Data without an expiry doesn't expire.
+	Expiry map[string]map[string]time.Time `json:"expiry"`
+
+	// Instance-wide counters (store.Counter) by name.
+	Counters map[string]int64 `json:"counters"`
+}
+
+// Kinds of a room's data that expire independently.
+const (
+	kindRoom     = "room"
+	kindSessions = "sessions"
+	kindMessages = "messages"
+)
+
+// Mem represents the in-memory store.
+type Mem struct {
+	cfg  *Config
+	data data
+	mut  sync.RWMutex
+	log  *log.Logger
+
+	// Locks (lock.Locker) are only held within the process.
+	*lock.Local
+}
+
+// New returns a new memory store. If snapshots are enabled, the last
+// snapshot is loaded and snapshots are taken in the background.
+func New(cfg Config, l *log.Logger) (*Mem, error) {
+	m := &Mem{
+		cfg: &cfg,
+		data: data{
+			Rooms:    make(map[string]store.Room),
+			Sessions: make(map[string]map[string]store.Sess),
+			Messages: make(map[string][]store.Message),
+			Expiry:   make(map[string]map[string]time.Time),
+			Counters: make(map[string]int64),
+		},
+		log:   l,
+		Local: lock.NewLocal(),
+	}
+
+	if cfg.SnapshotFile != "" {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.SnapshotInterval > 0 {
+		go m.runSnapshots()
+	}
+	return m, nil
+}
+
+// AddRoom adds a room to the store.
+func (m *Mem) AddRoom(r store.Room, ttl time.Duration) error {
+	m.mut.Lock()
+	m.data.Rooms[r.ID] = r
+	m.expire(kindRoom, r.ID, ttl)
+	m.mut.Unlock()
+	return nil
+}
+
+// UpdateRoom updates the properties of an existing room retaining its TTL.
+func (m *Mem) UpdateRoom(r store.Room) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	cur, ok := m.data.Rooms[r.ID]
+	if !ok || m.expired(kindRoom, r.ID) {
+		return store.ErrRoomNotFound
+	}
+	r.CreatedAt = cur.CreatedAt
+	m.data.Rooms[r.ID] = r
+	return nil
+}
+
+// GetRoom gets a room from the store.
+func (m *Mem) GetRoom(id string) (store.Room, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	r, ok := m.data.Rooms[id]
+	if !ok || m.expired(kindRoom, id) {
+		return store.Room{}, store.ErrRoomNotFound
+	}
+	return r, nil
+}
+
+// GetRooms retrieves all the rooms in the store.
+func (m *Mem) GetRooms() ([]store.Room, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	out := make([]store.Room, 0, len(m.data.Rooms))
+	for id, r := range m.data.Rooms {
+		if !m.expired(kindRoom, id) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// ExtendRoomTTL extends a room's TTL.
+func (m *Mem) ExtendRoomTTL(id string, ttl time.Duration) error {
+	m.mut.Lock()
+	for _, k := range []string{kindRoom, kindSessions, kindMessages} {
+		m.expire(k, id, ttl)
+	}
+	m.mut.Unlock()
+	return nil
+}
+
+// RoomExists checks if a room exists in the store.
+func (m *Mem) RoomExists(id string) (bool, error) {
+	m.mut.RLock()
+	_, ok := m.data.Rooms[id]
+	ok = ok && !m.expired(kindRoom, id)
+	m.mut.RUnlock()
+	return ok, nil
+}
+
+// RemoveRoom deletes a room from the store.
+func (m *Mem) RemoveRoom(id string) error {
+	m.mut.Lock()
+	delete(m.data.Rooms, id)
+	m.expire(kindRoom, id, 0)
+	m.mut.Unlock()
+	return nil
+}
+
+// AddSession adds a sessionID room to the store.
+func (m *Mem) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	// Discard the expired sessions before adding to them.
+	if m.expired(kindSessions, roomID) {
+		delete(m.data.Sessions, roomID)
+	}
+	if _, ok := m.data.Sessions[roomID]; !ok {
+		m.data.Sessions[roomID] = make(map[string]store.Sess)
+	}
+	m.data.Sessions[roomID][s.ID] = s
+	m.expire(kindSessions, roomID, ttl)
+	return nil
+}
+
+// GetSession retrieves a peer session from th store.
+func (m *Mem) GetSession(sessID, roomID string) (store.Sess, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	if m.expired(kindSessions, roomID) {
+		return store.Sess{}, nil
+	}
+	return m.data.Sessions[roomID][sessID], nil
+}
+
+// GetSessions retrieves all the peer sessions in a room.
+func (m *Mem) GetSessions(roomID string) ([]store.Sess, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	out := []store.Sess{}
+	if m.expired(kindSessions, roomID) {
+		return out, nil
+	}
+	for _, s := range m.data.Sessions[roomID] {
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// RemoveSession deletes a session ID from a room.
+func (m *Mem) RemoveSession(sessID, roomID string) error {
+	m.mut.Lock()
+	delete(m.data.Sessions[roomID], sessID)
+	m.mut.Unlock()
+	return nil
+}
+
+// ClearSessions deletes all the sessions in a room.
+func (m *Mem) ClearSessions(roomID string) error {
+	m.mut.Lock()
+	delete(m.data.Sessions, roomID)
+	m.expire(kindSessions, roomID, 0)
+	m.mut.Unlock()
+	return nil
+}
+
+// AddMessageCache appends a message to a room's message cache.
+func (m *Mem) AddMessageCache(roomID string, msg store.Message, ttl time.Duration) error {
+	return m.AddMessageCacheBatch(roomID, []store.Message{msg}, ttl)
+}
+
+// AddMessageCacheBatch appends messages to a room's message cache.
+func (m *Mem) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error {
+	m.mut.Lock()
+	if m.expired(kindMessages, roomID) {
+		delete(m.data.Messages, roomID)
+	}
+	m.data.Messages[roomID] = append(m.data.Messages[roomID], msgs...)
+	m.expire(kindMessages, roomID, ttl)
+	m.mut.Unlock()
+	return nil
+}
+
+// GetMessageCache retrieves all the cached messages in a room in the order
+// they were added.
+func (m *Mem) GetMessageCache(roomID string) ([]store.Message, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	if m.expired(kindMessages, roomID) {
+		return []store.Message{}, nil
+	}
+	out := make([]store.Message, len(m.data.Messages[roomID]))
+	copy(out, m.data.Messages[roomID])
+	return out, nil
+}
+
+// GetMessageCachePage retrieves a page of cached messages in a room before
+// the cursor, which is the 1-based position of a message in the cache.
+func (m *Mem) GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	if m.expired(kindMessages, roomID) {
+		return []store.Message{}, 0, nil
+	}
+
+	msgs := m.data.Messages[roomID]
+	if before <= 0 || before > int64(len(msgs))+1 {
+		before = int64(len(msgs)) + 1
+	}
+	start := before - int64(limit)
+	if start < 1 {
+		start = 1
+	}
+
+	out := make([]store.Message, before-start)
+	copy(out, msgs[start-1:before-1])
+
+	var next int64
+	if start > 1 {
+		next = start
+	}
+	return out, next, nil
+}
+
+// ClearMessageCache deletes all the cached messages in a room.
+func (m *Mem) ClearMessageCache(roomID string) error {
+	m.mut.Lock()
+	delete(m.data.Messages, roomID)
+	m.expire(kindMessages, roomID, 0)
+	m.mut.Unlock()
+	return nil
+}
+
+// IncrCounter increments a counter (store.Counter) and returns its new value.
+func (m *Mem) IncrCounter(name string) (int64, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	// Snapshots from older versions don't have counters.
+	if m.data.Counters == nil {
+		m.data.Counters = make(map[string]int64)
+	}
+	m.data.Counters[name]++
+	return m.data.Counters[name], nil
+}
+
+// GetCounter returns the value of a counter.
+func (m *Mem) GetCounter(name string) (int64, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	return m.data.Counters[name], nil
+}
+
+// Ping always succeeds as the data is in memory.
+func (m *Mem) Ping() error {
+	return nil
+}
+
+// Close takes a final snapshot if snapshots are enabled.
+func (m *Mem) Close() error {
+	if m.cfg.SnapshotFile == "" {
+		return nil
+	}
+	return m.snapshot()
+}
+
+// runSnapshots periodically deletes expired data and snapshots the store if
+// snapshots are enabled. This should be invoked as a goroutine.
+func (m *Mem) runSnapshots() {
+	for range time.Tick(m.cfg.SnapshotInterval) {
+		if m.cfg.SnapshotFile == "" {
+			m.mut.Lock()
+			m.cleanup()
+			m.mut.Unlock()
+			continue
+		}
+
+		if err := m.snapshot(); err != nil {
+			m.log.Printf("error snapshotting store: %v", err)
+		}
+	}
+}
+
+// snapshot deletes expired data and writes the store's data to the
+// snapshot file. The file is replaced atomically.
+func (m *Mem) snapshot() error {
+	m.mut.Lock()
+	m.cleanup()
+	b, err := json.Marshal(m.data)
+	m.mut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := m.cfg.SnapshotFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cfg.SnapshotFile)
+}
+
+// load loads the snapshot file if it exists.
+func (m *Mem) load() error {
+	b, err := ioutil.ReadFile(m.cfg.SnapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, &m.data); err != nil {
+		return err
+	}
+	m.cleanup()
+	m.log.Printf("loaded %d rooms from snapshot %s", len(m.data.Rooms), m.cfg.SnapshotFile)
+	return nil
+}
+
+// cleanup deletes expired data. It should be invoked with mut held.
+func (m *Mem) cleanup() {
+	now := time.Now()
+	for id, exp := range m.data.Expiry {
+		for k, t := range exp {
+			if t.After(now) {
+				continue
+			}
+
+			switch k {
+			case kindRoom:
+				delete(m.data.Rooms, id)
+			case kindSessions:
+				delete(m.data.Sessions, id)
+			case kindMessages:
+				delete(m.data.Messages, id)
+			}
+			delete(exp, k)
+		}
+		if len(exp) == 0 {
+			delete(m.data.Expiry, id)
+		}
+	}
+}
+
+// expire sets the expiry of a kind of a room's data. A TTL of 0 removes any
+// expiry. It should be invoked with mut held.
+func (m *Mem) expire(kind, roomID string, ttl time.Duration) {
+	if ttl <= 0 {
+		if exp, ok := m.data.Expiry[roomID]; ok {
+			delete(exp, kind)
+			if len(exp) == 0 {
+				delete(m.data.Expiry, roomID)
+			}
+		}
+		return
+	}
+
+	if _, ok := m.data.Expiry[roomID]; !ok {
+		m.data.Expiry[roomID] = make(map[string]time.Time)
+	}
+	m.data.Expiry[roomID][kind] = time.Now().Add(ttl)
+}
+
+// expired checks if a kind of a room's data has expired. It should be
+// invoked with mut held.
+func (m *Mem) expired(kind, roomID string) bool {
+	t, ok := m.data.Expiry[roomID][kind]
+	return ok && !t.After(time.Now())
+}
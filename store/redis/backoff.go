@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// backoff throttles connection attempts to Redis after failures so that
+// requests fail fast during an outage instead of each waiting on a connect
+// timeout, and reconnects once Redis is back.
+type backoff struct {
+	min, max time.Duration
+
+	mut      sync.Mutex
+	failures uint
+	next     time.Time
+	err      error
+}
+
+// dial dials with the given function unless the previous attempts failed
+// and the backoff period since the last one hasn't elapsed.
+func (b *backoff) dial(dial func() (redis.Conn, error)) (redis.Conn, error) {
+	b.mut.Lock()
+	if b.err != nil && time.Now().Before(b.next) {
+		err := b.err
+		b.mut.Unlock()
+		return nil, err
+	}
+	b.mut.Unlock()
+
+	c, err := dial()
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if err != nil {
+		b.err = err
+		b.next = time.Now().Add(b.delay())
+		b.failures++
+		return nil, err
+	}
+	b.failures = 0
+	b.err = nil
+	return c, nil
+}
+
+// delay returns the exponential backoff period for the current number of
+// failures.
+func (b *backoff) delay() time.Duration {
+	d := b.min
+	for i := uint(0); i < b.failures && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	return d
+}
@@ -0,0 +1,31 @@
+package redis
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// IncrCounter increments a counter (store.Counter) and returns its new value.
+func (r *Redis) IncrCounter(name string) (int64, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	return redis.Int64(c.Do("INCR", r.counterKey(name)))
+}
+
+// GetCounter returns the value of a counter.
+func (r *Redis) GetCounter(name string) (int64, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	n, err := redis.Int64(c.Do("GET", r.counterKey(name)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (r *Redis) counterKey(name string) string {
+	return fmt.Sprintf(r.cfg.PrefixCounter, name)
+}
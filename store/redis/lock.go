@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Lock keys are only renewed and deleted by the holder of the token.
+var (
+	renewLock = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseLock = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// AcquireLock acquires a lock (lock.Locker) if the key doesn't exist.
+func (r *Redis) AcquireLock(name, token string, ttl time.Duration) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := redis.String(c.Do("SET", r.lockKey(name), token, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RenewLock extends the lease of a lock held by the token.
+func (r *Redis) RenewLock(name, token string, ttl time.Duration) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	return redis.Bool(renewLock.Do(c, r.lockKey(name), token, ttl.Milliseconds()))
+}
+
+// ReleaseLock releases a lock if it's held by the token.
+func (r *Redis) ReleaseLock(name, token string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := releaseLock.Do(c, r.lockKey(name), token)
+	return err
+}
+
+func (r *Redis) lockKey(name string) string {
+	return fmt.Sprintf(r.cfg.PrefixLock, name)
+}
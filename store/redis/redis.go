@@ -1,7 +1,9 @@
 package redis
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -17,8 +19,18 @@ type Config struct {
 	IdleConns   int           `koanf:"idle_conns"`
 	Timeout     time.Duration `koanf:"timeout"`
 
-	PrefixRoom    string `koanf:"prefix_room"`
-	PrefixSession string `koanf:"prefix_session"`
+	// Backoff between reconnection attempts after Redis becomes
+	// unreachable, doubling from min to max. On startup, connection is
+	// retried for up to ConnectWait.
+	MinBackoff  time.Duration `koanf:"min_backoff"`
+	MaxBackoff  time.Duration `koanf:"max_backoff"`
+	ConnectWait time.Duration `koanf:"connect_wait"`
+
+	PrefixRoom     string `koanf:"prefix_room"`
+	PrefixSession  string `koanf:"prefix_session"`
+	PrefixMessages string `koanf:"prefix_messages"`
+	PrefixLock     string `koanf:"prefix_lock"`
+	PrefixCounter  string `koanf:"prefix_counter"`
 }
 
 // Redis represents the Redis implementation of the Store interface.
@@ -32,35 +44,76 @@ type room struct {
 	Name      string `redis:"name"`
 	Password  []byte `redis:"password"`
 	CreatedAt string `redis:"created_at"`
+	Opts      []byte `redis:"opts"`
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*Redis, error) {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Millisecond * 500
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+	if cfg.PrefixLock == "" {
+		cfg.PrefixLock = "NIL:LOCK:%s"
+	}
+	if cfg.PrefixCounter == "" {
+		cfg.PrefixCounter = "NIL:COUNTER:%s"
+	}
+
+	b := &backoff{min: cfg.MinBackoff, max: cfg.MaxBackoff}
 	pool := &redis.Pool{
 		Wait:      true,
 		MaxActive: cfg.ActiveConns,
 		MaxIdle:   cfg.IdleConns,
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial(
-				"tcp",
-				cfg.Address,
-				redis.DialPassword(cfg.Password),
-				redis.DialConnectTimeout(cfg.Timeout),
-				redis.DialReadTimeout(cfg.Timeout),
-				redis.DialWriteTimeout(cfg.Timeout),
-				redis.DialDatabase(cfg.DB),
-			)
+			return b.dial(func() (redis.Conn, error) {
+				return redis.Dial(
+					"tcp",
+					cfg.Address,
+					redis.DialPassword(cfg.Password),
+					redis.DialConnectTimeout(cfg.Timeout),
+					redis.DialReadTimeout(cfg.Timeout),
+					redis.DialWriteTimeout(cfg.Timeout),
+					redis.DialDatabase(cfg.DB),
+				)
+			})
+		},
+
+		// Discard idle connections that were dropped, eg: when Redis
+		// restarted.
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
 		},
 	}
+	r := &Redis{cfg: &cfg, pool: pool}
 
-	// Test connection.
-	c := pool.Get()
+	// Test connection. Redis may still be starting up.
+	deadline := time.Now().Add(cfg.ConnectWait)
+	for {
+		err := r.Ping()
+		if err == nil {
+			return r, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(b.delay())
+	}
+}
+
+// Ping checks if Redis is reachable.
+func (r *Redis) Ping() error {
+	c := r.pool.Get()
 	defer c.Close()
 
-	if err := c.Err(); err != nil {
-		return nil, err
-	}
-	return &Redis{cfg: &cfg, pool: pool}, nil
+	_, err := c.Do("PING")
+	return err
 }
 
 // AddRoom adds a room to the store.
@@ -68,22 +121,55 @@ func (r *Redis) AddRoom(room store.Room, ttl time.Duration) error {
 	c := r.pool.Get()
 	defer c.Close()
 
+	opts, err := json.Marshal(room.Opts)
+	if err != nil {
+		return err
+	}
+
 	key := fmt.Sprintf(r.cfg.PrefixRoom, room.ID)
 	c.Send("HMSET", key,
 		"name", room.Name,
 		"created_at", room.CreatedAt.Format(time.RFC3339),
-		"password", room.Password)
-	c.Send("EXPIRE", key, int(ttl.Seconds()))
+		"password", room.Password,
+		"opts", opts)
+	expire(c, key, ttl)
 	return c.Flush()
 }
 
+// UpdateRoom updates the properties of an existing room retaining its TTL.
+func (r *Redis) UpdateRoom(room store.Room) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixRoom, room.ID)
+	ok, err := redis.Bool(c.Do("EXISTS", key))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrRoomNotFound
+	}
+
+	opts, err := json.Marshal(room.Opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Do("HMSET", key,
+		"name", room.Name,
+		"password", room.Password,
+		"opts", opts)
+	return err
+}
+
 // ExtendRoomTTL extends a room's TTL.
 func (r *Redis) ExtendRoomTTL(id string, ttl time.Duration) error {
 	c := r.pool.Get()
 	defer c.Close()
 
-	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixRoom, id), int(ttl.Seconds()))
-	c.Send("EXPIRE", fmt.Sprintf(r.cfg.PrefixSession, id), int(ttl.Seconds()))
+	expire(c, fmt.Sprintf(r.cfg.PrefixRoom, id), ttl)
+	expire(c, fmt.Sprintf(r.cfg.PrefixSession, id), ttl)
+	expire(c, fmt.Sprintf(r.cfg.PrefixMessages, id), ttl)
 	return c.Flush()
 }
 
@@ -112,14 +198,68 @@ func (r *Redis) GetRoom(id string) (store.Room, error) {
 	if t.Year() == 1 {
 		return out, store.ErrRoomNotFound
 	}
+
+	var opts store.RoomOpts
+	if len(room.Opts) > 0 {
+		if err := json.Unmarshal(room.Opts, &opts); err != nil {
+			return out, err
+		}
+	}
+
 	return store.Room{
 		ID:        id,
 		Name:      room.Name,
 		Password:  room.Password,
 		CreatedAt: t,
+		Opts:      opts,
 	}, nil
 }
 
+// GetRooms retrieves all the rooms in the store. The keys are iterated with
+// SCAN so that Redis isn't blocked on large instances.
+func (r *Redis) GetRooms() ([]store.Room, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	var (
+		parts  = strings.SplitN(r.cfg.PrefixRoom, "%s", 2)
+		cursor = 0
+		out    = []store.Room{}
+	)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid prefix_room: %s", r.cfg.PrefixRoom)
+	}
+	for {
+		res, err := redis.Values(c.Do("SCAN", cursor, "MATCH", parts[0]+"*"+parts[1], "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(res[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range keys {
+			id := strings.TrimSuffix(strings.TrimPrefix(k, parts[0]), parts[1])
+			room, err := r.GetRoom(id)
+			if err == store.ErrRoomNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, room)
+		}
+
+		if cursor, err = redis.Int(res[0], nil); err != nil {
+			return nil, err
+		}
+		if cursor == 0 {
+			return out, nil
+		}
+	}
+}
+
 // RoomExists checks if a room exists in the store.
 func (r *Redis) RoomExists(id string) (bool, error) {
 	c := r.pool.Get()
@@ -142,13 +282,18 @@ func (r *Redis) RemoveRoom(id string) error {
 }
 
 // AddSession adds a sessionID room to the store.
-func (r *Redis) AddSession(sessID, handle, roomID string, ttl time.Duration) error {
+func (r *Redis) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
 	c := r.pool.Get()
 	defer c.Close()
 
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
 	key := fmt.Sprintf(r.cfg.PrefixSession, roomID)
-	c.Send("HMSET", key, sessID, handle)
-	c.Send("EXPIRE", key, ttl.Seconds)
+	c.Send("HSET", key, s.ID, b)
+	expire(c, key, ttl)
 	return c.Flush()
 }
 
@@ -165,10 +310,35 @@ func (r *Redis) GetSession(sessID, roomID string) (store.Sess, error) {
 		return store.Sess{}, nil
 	}
 
-	return store.Sess{
-		ID:     sessID,
-		Handle: h,
-	}, nil
+	return decodeSess(sessID, h), nil
+}
+
+// GetSessions retrieves all the peer sessions in a room.
+func (r *Redis) GetSessions(roomID string) ([]store.Sess, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	m, err := redis.StringMap(c.Do("HGETALL", fmt.Sprintf(r.cfg.PrefixSession, roomID)))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]store.Sess, 0, len(m))
+	for id, v := range m {
+		out = append(out, decodeSess(id, v))
+	}
+	return out, nil
+}
+
+// decodeSess decodes a session record. Sessions created by older versions
+// only have the handle as the value.
+func decodeSess(id, v string) store.Sess {
+	var s store.Sess
+	if err := json.Unmarshal([]byte(v), &s); err != nil {
+		s = store.Sess{Handle: v}
+	}
+	s.ID = id
+	return s
 }
 
 // RemoveSession deletes a session ID from a room.
@@ -188,3 +358,116 @@ func (r *Redis) ClearSessions(roomID string) error {
 	_, err := redis.Bool(c.Do("DEL", fmt.Sprintf(r.cfg.PrefixSession, roomID)))
 	return err
 }
+
+// AddMessageCache appends a message to a room's message cache.
+func (r *Redis) AddMessageCache(roomID string, m store.Message, ttl time.Duration) error {
+	return r.AddMessageCacheBatch(roomID, []store.Message{m}, ttl)
+}
+
+// AddMessageCacheBatch appends messages to a room's message cache with a
+// single RPUSH.
+func (r *Redis) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf(r.cfg.PrefixMessages, roomID)
+	args := make([]interface{}, 0, len(msgs)+1)
+	args = append(args, key)
+	for _, m := range msgs {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		args = append(args, b)
+	}
+
+	c := r.pool.Get()
+	defer c.Close()
+
+	c.Send("RPUSH", args...)
+	expire(c, key, ttl)
+	return c.Flush()
+}
+
+// GetMessageCache retrieves all the cached messages in a room in the order
+// they were added.
+func (r *Redis) GetMessageCache(roomID string) ([]store.Message, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	res, err := redis.ByteSlices(c.Do("LRANGE", fmt.Sprintf(r.cfg.PrefixMessages, roomID), 0, -1))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	return decodeMessages(res)
+}
+
+// GetMessageCachePage retrieves a page of cached messages in a room before
+// the cursor, which is the 1-based position of a message in the list.
+func (r *Redis) GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error) {
+	c := r.pool.Get()
+	defer c.Close()
+
+	key := fmt.Sprintf(r.cfg.PrefixMessages, roomID)
+	if before <= 0 {
+		n, err := redis.Int64(c.Do("LLEN", key))
+		if err != nil {
+			return nil, 0, err
+		}
+		before = n + 1
+	}
+	if before <= 1 {
+		return []store.Message{}, 0, nil
+	}
+
+	start := before - int64(limit)
+	if start < 1 {
+		start = 1
+	}
+	res, err := redis.ByteSlices(c.Do("LRANGE", key, start-1, before-2))
+	if err != nil && err != redis.ErrNil {
+		return nil, 0, err
+	}
+	out, err := decodeMessages(res)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var next int64
+	if start > 1 {
+		next = start
+	}
+	return out, next, nil
+}
+
+// decodeMessages decodes JSON encoded messages.
+func decodeMessages(res [][]byte) ([]store.Message, error) {
+	out := make([]store.Message, 0, len(res))
+	for _, b := range res {
+		var m store.Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// ClearMessageCache deletes all the cached messages in a room.
+func (r *Redis) ClearMessageCache(roomID string) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("DEL", fmt.Sprintf(r.cfg.PrefixMessages, roomID))
+	return err
+}
+
+// expire queues the expiry of a key. A TTL of 0 removes any expiry on the key.
+func expire(c redis.Conn, key string, ttl time.Duration) {
+	if ttl <= 0 {
+		c.Send("PERSIST", key)
+		return
+	}
+	c.Send("EXPIRE", key, int(ttl.Seconds()))
+}
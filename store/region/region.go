@@ -0,0 +1,306 @@
+// Package region routes the persistence of rooms to region specific stores
+// for data residency, eg: keeping the data of EU rooms in an EU database
+// while one instance serves all rooms.
+package region
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// ErrUnknownRegion indicates that a room was tagged with a region that
+// isn't configured.
+var ErrUnknownRegion = errors.New("unknown region")
+
+// Backend is a store that also caches messages.
+type Backend interface {
+	store.Store
+	AddMessageCache(roomID string, m store.Message, ttl time.Duration) error
+	AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error
+	GetMessageCache(roomID string) ([]store.Message, error)
+	GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error)
+	ClearMessageCache(roomID string) error
+}
+
+// Router routes store operations to the store of a room's region. Rooms
+// without a region are stored in the default store. It implements
+// store.Store and store.MessageCache.
+type Router struct {
+	def     Backend
+	regions map[string]Backend
+	names   []string
+
+	// Stores of rooms by room ID. A room's store is looked up by probing
+	// all the stores the first time it's accessed, eg: after a restart.
+	rooms map[string]Backend
+	mut   sync.RWMutex
+}
+
+// New returns a new Router with the default store and the stores of
+// regions by name.
+func New(def Backend, regions map[string]Backend) *Router {
+	names := make([]string, 0, len(regions))
+	for n := range regions {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return &Router{
+		def:     def,
+		regions: regions,
+		names:   names,
+		rooms:   make(map[string]Backend),
+	}
+}
+
+// Regions returns the names of the configured regions.
+func (r *Router) Regions() []string {
+	return r.names
+}
+
+// AddRoom adds a room to the store of its region.
+func (r *Router) AddRoom(room store.Room, ttl time.Duration) error {
+	b := r.def
+	if room.Opts.Region != "" {
+		var ok bool
+		if b, ok = r.regions[room.Opts.Region]; !ok {
+			return ErrUnknownRegion
+		}
+	}
+
+	if err := b.AddRoom(room, ttl); err != nil {
+		return err
+	}
+
+	r.mut.Lock()
+	r.rooms[room.ID] = b
+	r.mut.Unlock()
+	return nil
+}
+
+// UpdateRoom updates a room in the store of its region.
+func (r *Router) UpdateRoom(room store.Room) error {
+	b, err := r.route(room.ID)
+	if err != nil {
+		return err
+	}
+	return b.UpdateRoom(room)
+}
+
+// GetRoom gets a room from the store of its region.
+func (r *Router) GetRoom(id string) (store.Room, error) {
+	b, err := r.route(id)
+	if err != nil {
+		return store.Room{}, err
+	}
+	return b.GetRoom(id)
+}
+
+// GetRooms retrieves the rooms in all the stores.
+func (r *Router) GetRooms() ([]store.Room, error) {
+	out := []store.Room{}
+	for _, b := range r.all() {
+		rooms, err := b.GetRooms()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rooms...)
+	}
+	return out, nil
+}
+
+// ExtendRoomTTL extends a room's TTL in the store of its region.
+func (r *Router) ExtendRoomTTL(id string, ttl time.Duration) error {
+	b, err := r.route(id)
+	if err != nil {
+		return err
+	}
+	return b.ExtendRoomTTL(id, ttl)
+}
+
+// RoomExists checks if a room exists in any of the stores.
+func (r *Router) RoomExists(id string) (bool, error) {
+	b, err := r.route(id)
+	if err != nil {
+		return false, err
+	}
+	return b.RoomExists(id)
+}
+
+// RemoveRoom deletes a room from the store of its region. The room's
+// route is retained so that its sessions and messages can be cleared.
+func (r *Router) RemoveRoom(id string) error {
+	b, err := r.route(id)
+	if err != nil {
+		return err
+	}
+	return b.RemoveRoom(id)
+}
+
+// AddSession adds a session to the store of the room's region.
+func (r *Router) AddSession(s store.Sess, roomID string, ttl time.Duration) error {
+	b, err := r.route(roomID)
+	if err != nil {
+		return err
+	}
+	return b.AddSession(s, roomID, ttl)
+}
+
+// GetSession retrieves a session from the store of the room's region.
+func (r *Router) GetSession(sessID, roomID string) (store.Sess, error) {
+	b, err := r.route(roomID)
+	if err != nil {
+		return store.Sess{}, err
+	}
+	return b.GetSession(sessID, roomID)
+}
+
+// GetSessions retrieves all the sessions in a room from the store of its
+// region.
+func (r *Router) GetSessions(roomID string) ([]store.Sess, error) {
+	b, err := r.route(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetSessions(roomID)
+}
+
+// RemoveSession deletes a session from the store of the room's region.
+func (r *Router) RemoveSession(sessID, roomID string) error {
+	b, err := r.route(roomID)
+	if err != nil {
+		return err
+	}
+	return b.RemoveSession(sessID, roomID)
+}
+
+// ClearSessions deletes all the sessions in a room from the store of its
+// region.
+func (r *Router) ClearSessions(roomID string) error {
+	b, err := r.route(roomID)
+	if err != nil {
+		return err
+	}
+	return b.ClearSessions(roomID)
+}
+
+// AddMessageCache appends a message to the cache in the room's region.
+func (r *Router) AddMessageCache(roomID string, m store.Message, ttl time.Duration) error {
+	b, err := r.route(roomID)
+	if err != nil {
+		return err
+	}
+	return b.AddMessageCache(roomID, m, ttl)
+}
+
+// AddMessageCacheBatch appends messages to the cache in the room's region.
+func (r *Router) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error {
+	b, err := r.route(roomID)
+	if err != nil {
+		return err
+	}
+	return b.AddMessageCacheBatch(roomID, msgs, ttl)
+}
+
+// GetMessageCache retrieves the cached messages of a room from its region.
+func (r *Router) GetMessageCache(roomID string) ([]store.Message, error) {
+	b, err := r.route(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return b.GetMessageCache(roomID)
+}
+
+// GetMessageCachePage retrieves a page of the cached messages of a room from
+// its region.
+func (r *Router) GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error) {
+	b, err := r.route(roomID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b.GetMessageCachePage(roomID, before, limit)
+}
+
+// ClearMessageCache deletes the cached messages of a room in its region.
+func (r *Router) ClearMessageCache(roomID string) error {
+	b, err := r.route(roomID)
+	if err != nil {
+		return err
+	}
+	return b.ClearMessageCache(roomID)
+}
+
+// Ping checks if all the stores are reachable.
+func (r *Router) Ping() error {
+	if err := r.def.Ping(); err != nil {
+		return err
+	}
+	for _, n := range r.names {
+		if err := r.regions[n].Ping(); err != nil {
+			return fmt.Errorf("region %s: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// Close closes all the stores that can be closed.
+func (r *Router) Close() error {
+	var out error
+	for _, b := range r.all() {
+		if c, ok := b.(io.Closer); ok {
+			if err := c.Close(); err != nil && out == nil {
+				out = err
+			}
+		}
+	}
+	return out
+}
+
+// route returns the store of a room. Unknown rooms are looked up in all
+// the stores. If the room doesn't exist in any of them, the default store
+// is returned.
+func (r *Router) route(roomID string) (Backend, error) {
+	r.mut.RLock()
+	b, ok := r.rooms[roomID]
+	r.mut.RUnlock()
+	if ok {
+		return b, nil
+	}
+
+	var lastErr error
+	for _, b := range r.all() {
+		ok, err := b.RoomExists(roomID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ok {
+			r.mut.Lock()
+			r.rooms[roomID] = b
+			r.mut.Unlock()
+			return b, nil
+		}
+	}
+
+	// The room may exist in a store that's unreachable.
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return r.def, nil
+}
+
+// all returns all the stores starting with the default store.
+func (r *Router) all() []Backend {
+	out := make([]Backend, 0, len(r.names)+1)
+	out = append(out, r.def)
+	for _, n := range r.names {
+		out = append(out, r.regions[n])
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package sqlite
+
+import (
+	"database/sql"
+)
+
+// IncrCounter increments a counter (store.Counter) and returns its new value.
+func (s *SQLite) IncrCounter(name string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO counters (name, value) VALUES (?, 1)
+		ON CONFLICT(name) DO UPDATE SET value = value + 1`, name); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if err := tx.QueryRow(`SELECT value FROM counters WHERE name = ?`, name).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// GetCounter returns the value of a counter.
+func (s *SQLite) GetCounter(name string) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT value FROM counters WHERE name = ?`, name).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
@@ -0,0 +1,36 @@
+package sqlite
+
+import "time"
+
+// AcquireLock acquires a lock (lock.Locker) if it's free or its lease has
+// expired. SQLite has no advisory locks, so locks are rows that are only
+// replaced once they expire.
+func (s *SQLite) AcquireLock(name, token string, ttl time.Duration) (bool, error) {
+	t := now()
+	res, err := s.db.Exec(`INSERT INTO locks (name, token, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET token = excluded.token, expires_at = excluded.expires_at
+		WHERE locks.expires_at <= ?`, name, token, t+int64(ttl), t)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RenewLock extends the lease of a lock held by the token.
+func (s *SQLite) RenewLock(name, token string, ttl time.Duration) (bool, error) {
+	t := now()
+	res, err := s.db.Exec(`UPDATE locks SET expires_at = ?
+		WHERE name = ? AND token = ? AND expires_at > ?`, t+int64(ttl), name, token, t)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseLock releases a lock if it's held by the token.
+func (s *SQLite) ReleaseLock(name, token string) error {
+	_, err := s.db.Exec("DELETE FROM locks WHERE name = ? AND token = ?", name, token)
+	return err
+}
@@ -0,0 +1,522 @@
+// Package sqlite implements a store backed by a single SQLite database file
+// for deployments that don't want to run Redis. It uses a pure Go SQLite
+// implementation and doesn't require cgo.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+
+	// SQLite driver.
+	_ "modernc.org/sqlite"
+)
+
+// Kinds of data that expire. They mirror the keys of the Redis store, which
+// expire independently.
+const (
+	kindRoom     = "room"
+	kindSessions = "sessions"
+	kindMessages = "messages"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS rooms (
+	id         TEXT NOT NULL PRIMARY KEY,
+	name       TEXT NOT NULL DEFAULT '',
+	password   BLOB,
+	created_at TIMESTAMP NOT NULL,
+	opts       TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	room_id TEXT NOT NULL,
+	id      TEXT NOT NULL,
+	data    TEXT NOT NULL,
+	PRIMARY KEY (room_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	pos     INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id TEXT NOT NULL,
+	data    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_messages_room ON messages(room_id, pos);
+
+-- Expiry of a room's data by kind. Data without a row here doesn't expire.
+CREATE TABLE IF NOT EXISTS expiry (
+	kind       TEXT NOT NULL,
+	room_id    TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	PRIMARY KEY (kind, room_id)
+);
+CREATE INDEX IF NOT EXISTS idx_expiry ON expiry(expires_at);
+
+-- Instance-wide counters (store.Counter).
+CREATE TABLE IF NOT EXISTS counters (
+	name  TEXT NOT NULL PRIMARY KEY,
+	value INTEGER NOT NULL DEFAULT 0
+);
+
+-- Locks (lock.Locker) held by a token until they expire.
+CREATE TABLE IF NOT EXISTS locks (
+	name       TEXT NOT NULL PRIMARY KEY,
+	token      TEXT NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+`
+
+// Config represents the SQLite store config structure.
+type Config struct {
+	Path string `koanf:"path"`
+
+	// Interval at which expired data is deleted from the database.
+	CleanupInterval time.Duration `koanf:"cleanup_interval"`
+}
+
+// SQLite represents the SQLite store.
+type SQLite struct {
+	cfg *Config
+	db  *sql.DB
+	log *log.Logger
+}
+
+// New returns a new SQLite store. It creates the database file and the
+// schema if they don't exist and starts the expiry cleanup in the background.
+func New(cfg Config, l *log.Logger) (*SQLite, error) {
+	db, err := sql.Open("sqlite", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only permits one writer at a time.
+	db.SetMaxOpenConns(1)
+	for _, q := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+		schema,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	s := &SQLite{cfg: &cfg, db: db, log: l}
+	if cfg.CleanupInterval > 0 {
+		go s.runCleanup()
+	}
+	return s, nil
+}
+
+// AddRoom adds a room to the store.
+func (s *SQLite) AddRoom(r store.Room, ttl time.Duration) error {
+	opts, err := json.Marshal(r.Opts)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO rooms (id, name, password, created_at, opts)
+		VALUES (?, ?, ?, ?, ?)`, r.ID, r.Name, r.Password, r.CreatedAt.UTC(), string(opts)); err != nil {
+		return err
+	}
+	if err := expire(tx, kindRoom, r.ID, ttl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateRoom updates the properties of an existing room retaining its TTL.
+func (s *SQLite) UpdateRoom(r store.Room) error {
+	opts, err := json.Marshal(r.Opts)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`UPDATE rooms SET name = ?, password = ?, opts = ?
+		WHERE id = ? AND `+alive(kindRoom, "id"), r.Name, r.Password, string(opts), r.ID, now())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrRoomNotFound
+	}
+	return nil
+}
+
+// GetRoom gets a room from the store.
+func (s *SQLite) GetRoom(id string) (store.Room, error) {
+	var (
+		out  = store.Room{ID: id}
+		opts string
+	)
+	err := s.db.QueryRow(`SELECT name, password, created_at, opts FROM rooms
+		WHERE id = ? AND `+alive(kindRoom, "id"), id, now()).
+		Scan(&out.Name, &out.Password, &out.CreatedAt, &opts)
+	if err == sql.ErrNoRows {
+		return out, store.ErrRoomNotFound
+	}
+	if err != nil {
+		return out, err
+	}
+
+	if err := json.Unmarshal([]byte(opts), &out.Opts); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// GetRooms retrieves all the rooms in the store.
+func (s *SQLite) GetRooms() ([]store.Room, error) {
+	rows, err := s.db.Query(`SELECT id, name, password, created_at, opts FROM rooms
+		WHERE `+alive(kindRoom, "id")+` ORDER BY created_at`, now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []store.Room{}
+	for rows.Next() {
+		var (
+			r    store.Room
+			opts string
+		)
+		if err := rows.Scan(&r.ID, &r.Name, &r.Password, &r.CreatedAt, &opts); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(opts), &r.Opts); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// ExtendRoomTTL extends a room's TTL.
+func (s *SQLite) ExtendRoomTTL(id string, ttl time.Duration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, k := range []string{kindRoom, kindSessions, kindMessages} {
+		if err := expire(tx, k, id, ttl); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RoomExists checks if a room exists in the store.
+func (s *SQLite) RoomExists(id string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM rooms WHERE id = ? AND `+alive(kindRoom, "id"), id, now()).Scan(&n)
+	return n > 0, err
+}
+
+// RemoveRoom deletes a room from the store.
+func (s *SQLite) RemoveRoom(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM rooms WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM expiry WHERE kind = ? AND room_id = ?", kindRoom, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddSession adds a sessionID room to the store.
+func (s *SQLite) AddSession(sess store.Sess, roomID string, ttl time.Duration) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT OR REPLACE INTO sessions (room_id, id, data) VALUES (?, ?, ?)",
+		roomID, sess.ID, string(b)); err != nil {
+		return err
+	}
+	if err := expire(tx, kindSessions, roomID, ttl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSession retrieves a peer session from th store.
+func (s *SQLite) GetSession(sessID, roomID string) (store.Sess, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM sessions WHERE room_id = ? AND id = ? AND `+
+		alive(kindSessions, "room_id"), roomID, sessID, now()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return store.Sess{}, nil
+	}
+	if err != nil {
+		return store.Sess{}, err
+	}
+
+	var out store.Sess
+	if err := json.Unmarshal([]byte(data), &out); err != nil {
+		return out, err
+	}
+	out.ID = sessID
+	return out, nil
+}
+
+// GetSessions retrieves all the peer sessions in a room.
+func (s *SQLite) GetSessions(roomID string) ([]store.Sess, error) {
+	rows, err := s.db.Query(`SELECT id, data FROM sessions WHERE room_id = ? AND `+
+		alive(kindSessions, "room_id"), roomID, now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []store.Sess{}
+	for rows.Next() {
+		var (
+			id, data string
+			sess     store.Sess
+		)
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &sess); err != nil {
+			return nil, err
+		}
+		sess.ID = id
+		out = append(out, sess)
+	}
+	return out, rows.Err()
+}
+
+// RemoveSession deletes a session ID from a room.
+func (s *SQLite) RemoveSession(sessID, roomID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE room_id = ? AND id = ?", roomID, sessID)
+	return err
+}
+
+// ClearSessions deletes all the sessions in a room.
+func (s *SQLite) ClearSessions(roomID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE room_id = ?", roomID)
+	return err
+}
+
+// AddMessageCache appends a message to a room's message cache.
+func (s *SQLite) AddMessageCache(roomID string, m store.Message, ttl time.Duration) error {
+	return s.AddMessageCacheBatch(roomID, []store.Message{m}, ttl)
+}
+
+// AddMessageCacheBatch appends messages to a room's message cache in one
+// transaction.
+func (s *SQLite) AddMessageCacheBatch(roomID string, msgs []store.Message, ttl time.Duration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO messages (room_id, data) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, m := range msgs {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(roomID, string(b)); err != nil {
+			return err
+		}
+	}
+	if err := expire(tx, kindMessages, roomID, ttl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetMessageCache retrieves all the cached messages in a room in the order
+// they were added.
+func (s *SQLite) GetMessageCache(roomID string) ([]store.Message, error) {
+	rows, err := s.db.Query(`SELECT data FROM messages WHERE room_id = ? AND `+
+		alive(kindMessages, "room_id")+` ORDER BY pos`, roomID, now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []store.Message{}
+	for rows.Next() {
+		var (
+			data string
+			m    store.Message
+		)
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// GetMessageCachePage retrieves a page of cached messages in a room before
+// the cursor, which is the position (pos) of a message.
+func (s *SQLite) GetMessageCachePage(roomID string, before int64, limit int) ([]store.Message, int64, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+
+	// Fetch one more message than the limit to know if there are more.
+	rows, err := s.db.Query(`SELECT pos, data FROM messages WHERE room_id = ? AND `+
+		alive(kindMessages, "room_id")+` AND pos < ? ORDER BY pos DESC LIMIT ?`,
+		roomID, now(), before, limit+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		out  = []store.Message{}
+		pos  int64
+		more bool
+	)
+	for rows.Next() {
+		if len(out) == limit {
+			more = true
+			break
+		}
+
+		var (
+			data string
+			m    store.Message
+		)
+		if err := rows.Scan(&pos, &data); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Messages were fetched newest first.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	if !more {
+		pos = 0
+	}
+	return out, pos, nil
+}
+
+// ClearMessageCache deletes all the cached messages in a room.
+func (s *SQLite) ClearMessageCache(roomID string) error {
+	_, err := s.db.Exec("DELETE FROM messages WHERE room_id = ?", roomID)
+	return err
+}
+
+// Ping checks if the database is reachable.
+func (s *SQLite) Ping() error {
+	_, err := s.db.Exec("SELECT 1")
+	return err
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// runCleanup periodically deletes expired data. This should be invoked as
+// a goroutine.
+func (s *SQLite) runCleanup() {
+	for range time.Tick(s.cfg.CleanupInterval) {
+		if err := s.cleanup(); err != nil {
+			s.log.Printf("error cleaning up expired data: %v", err)
+		}
+	}
+}
+
+// cleanup deletes expired data.
+func (s *SQLite) cleanup() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t := now()
+	for _, q := range []struct {
+		kind  string
+		query string
+	}{
+		{kindRoom, "DELETE FROM rooms WHERE id IN (SELECT room_id FROM expiry WHERE kind = ? AND expires_at <= ?)"},
+		{kindSessions, "DELETE FROM sessions WHERE room_id IN (SELECT room_id FROM expiry WHERE kind = ? AND expires_at <= ?)"},
+		{kindMessages, "DELETE FROM messages WHERE room_id IN (SELECT room_id FROM expiry WHERE kind = ? AND expires_at <= ?)"},
+	} {
+		if _, err := tx.Exec(q.query, q.kind, t); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM expiry WHERE expires_at <= ?", t); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM locks WHERE expires_at <= ?", t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// expire sets the expiry of a kind of a room's data. A TTL of 0 removes any
+// expiry.
+func expire(tx *sql.Tx, kind, roomID string, ttl time.Duration) error {
+	if ttl <= 0 {
+		_, err := tx.Exec("DELETE FROM expiry WHERE kind = ? AND room_id = ?", kind, roomID)
+		return err
+	}
+
+	_, err := tx.Exec("INSERT OR REPLACE INTO expiry (kind, room_id, expires_at) VALUES (?, ?, ?)",
+		kind, roomID, time.Now().Add(ttl).UnixNano())
+	return err
+}
+
+// alive returns an SQL condition that checks that a kind of data of the room
+// in the given column hasn't expired. It takes the current time (now()) as
+// an argument.
+func alive(kind, col string) string {
+	return "NOT EXISTS (SELECT 1 FROM expiry WHERE kind = '" + kind + "' AND room_id = " + col +
+		" AND expires_at <= ?)"
+}
+
+func now() int64 {
+	return time.Now().UnixNano()
+}
@@ -5,18 +5,66 @@ import (
 	"time"
 )
 
-// Store represents a backend store.
+// Store represents a backend store. A TTL of 0 means that the data
+// doesn't expire.
 type Store interface {
 	AddRoom(r Room, ttl time.Duration) error
+	UpdateRoom(r Room) error
 	GetRoom(id string) (Room, error)
 	ExtendRoomTTL(id string, ttl time.Duration) error
 	RoomExists(id string) (bool, error)
 	RemoveRoom(id string) error
 
-	AddSession(sessID, handle, roomID string, ttl time.Duration) error
+	// GetRooms retrieves all the rooms in the store.
+	GetRooms() ([]Room, error)
+
+	AddSession(s Sess, roomID string, ttl time.Duration) error
 	GetSession(sessID, roomID string) (Sess, error)
+	GetSessions(roomID string) ([]Sess, error)
 	RemoveSession(sessID, roomID string) error
 	ClearSessions(roomID string) error
+
+	// Ping checks if the store is reachable.
+	Ping() error
+}
+
+// Counter represents a backend store that persists instance-wide counters,
+// eg: the number of rooms ever created. Stores that don't implement it don't
+// keep counts.
+type Counter interface {
+	// IncrCounter increments a counter and returns its new value.
+	IncrCounter(name string) (int64, error)
+
+	// GetCounter returns the value of a counter. It's 0 if the counter
+	// doesn't exist.
+	GetCounter(name string) (int64, error)
+}
+
+// Names of counters.
+const (
+	CounterRoomsCreated = "rooms_created"
+)
+
+// MessageCache represents a backend store that persists chat messages for the
+// lifetime of a room.
+type MessageCache interface {
+	AddMessageCache(roomID string, m Message, ttl time.Duration) error
+
+	// AddMessageCacheBatch appends messages to a room's message cache in
+	// one write.
+	AddMessageCacheBatch(roomID string, msgs []Message, ttl time.Duration) error
+	GetMessageCache(roomID string) ([]Message, error)
+
+	// GetMessageCachePage retrieves up to limit messages in a room that were
+	// added before the cursor, in the order they were added, along with the
+	// cursor of the page of older messages. A cursor of 0 starts from the
+	// latest message and a returned cursor of 0 means there are no older
+	// messages.
+	GetMessageCachePage(roomID string, before int64, limit int) ([]Message, int64, error)
+	ClearMessageCache(roomID string) error
+
+	// Ping checks if the cache is reachable.
+	Ping() error
 }
 
 // Room represents the properties of a room in the store.
@@ -25,12 +73,184 @@ type Room struct {
 	Name      string    `json:"name"`
 	Password  []byte    `json:"password"`
 	CreatedAt time.Time `json:"created_at"`
+	Opts      RoomOpts  `json:"opts"`
+}
+
+// RoomOpts represents the optional settings of a room.
+type RoomOpts struct {
+	// Kiosk mode for public venues with anonymous handles and strict
+	// message filtering.
+	Kiosk bool `json:"kiosk"`
+
+	// Persistent rooms don't expire and retain their history.
+	Persistent bool `json:"persistent,omitempty"`
+
+	// Inactivity period after which the room expires if it's not the
+	// global default (app.room_age).
+	Age time.Duration `json:"age,omitempty"`
+
+	// Default timezone (IANA) for the room's history.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Capacity reserved for a scheduled event in the room.
+	Reservation *Reservation `json:"reservation,omitempty"`
+
+	// Time window in which a scheduled room is open. Scheduled rooms don't
+	// expire for inactivity and close at the end of the window.
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	// Region whose store persists the room's data.
+	Region string `json:"region,omitempty"`
+
+	// Virtual host (tenant) the room was created on.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Language (eg: de) that overrides the peers' browser languages.
+	Language string `json:"language,omitempty"`
+
+	// Notification channels the room's events are sent to.
+	Notify []string `json:"notify,omitempty"`
+
+	// Number of recent messages from the history sent to peers when they
+	// connect.
+	ReplayMessages int `json:"replay_messages,omitempty"`
+
+	// Messages aren't written to the message cache.
+	NoLogging bool `json:"no_logging,omitempty"`
+
+	// Hours after which messages are removed from the message cache. 0
+	// retains them for the room's lifetime.
+	RetentionHours int `json:"retention_hours,omitempty"`
+
+	// Private messages (templates) sent to peers when they first join.
+	Welcome []string `json:"welcome,omitempty"`
+
+	// Only the owner and the speakers (handles) can post in read-only
+	// rooms.
+	ReadOnly bool     `json:"read_only,omitempty"`
+	Speakers []string `json:"speakers,omitempty"`
+
+	// SHA256 hash of the key that identifies the room's owner (creator).
+	// It's empty for rooms created before owners were recorded.
+	OwnerKey string `json:"owner_key,omitempty"`
+
+	// Metadata of the room's password for auditing it against the policy.
+	// It's nil for rooms created before it was recorded.
+	PasswordMeta *PasswordMeta `json:"password_meta,omitempty"`
+
+	// Peers banned from the room by its owner.
+	Bans []Ban `json:"bans,omitempty"`
+
+	// Email address the room's transcript is sent to when it expires or
+	// is disposed of.
+	TranscriptEmail string `json:"transcript_email,omitempty"`
+
+	// Hash that the first message in the history's hash chain is chained
+	// to. It's the hash of the last message removed from the start of the
+	// history, eg: by the retention, and empty if none were.
+	ChainAnchor string `json:"chain_anchor,omitempty"`
+}
+
+// Schedule is the time window in which a scheduled room is open.
+type Schedule struct {
+	Opens  time.Time `json:"opens_at"`
+	Closes time.Time `json:"closes_at"`
+}
+
+// Ban represents a peer banned from a room. A peer is matched by their
+// session key, handle, or the hash of their IP address.
+type Ban struct {
+	ID         string    `json:"id"`
+	SessionKey string    `json:"session_key"`
+	Handle     string    `json:"handle"`
+	IPHash     string    `json:"ip_hash,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	By         string    `json:"by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// PasswordMeta is metadata of a room's password that's recorded when it's
+// set so that the password can be audited later without the plaintext.
+type PasswordMeta struct {
+	Length  int       `json:"length"`
+	Entropy float64   `json:"entropy"`
+	SetAt   time.Time `json:"set_at"`
+}
+
+// Reservation represents peer capacity reserved for a room for a period.
+type Reservation struct {
+	Peers int       `json:"peers"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
 }
 
 // Sess represents an authenticated peer session.
 type Sess struct {
 	ID     string `json:"id"`
 	Handle string `json:"name"`
+
+	// Device (user agent) the session was created from.
+	Device    string    `json:"device"`
+	Timezone  string    `json:"timezone"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// End of an operator's support session. nil for regular peers.
+	OperatorUntil *time.Time `json:"operator_until,omitempty"`
+
+	// Session of the room's owner.
+	Owner bool `json:"owner,omitempty"`
+
+	// Colour scheme (light, dark) the peer prefers in the room. Empty is
+	// the instance's default.
+	Scheme string `json:"scheme,omitempty"`
+
+	// Hash of the IP address the session was created from, which is
+	// recorded to enforce bans.
+	IPHash string `json:"ip_hash,omitempty"`
+
+	// Secret device link token shared by the sessions of a peer's devices.
+	// A new device logs in as the peer with it.
+	Link string `json:"link,omitempty"`
+}
+
+// Message represents a chat message in the message cache.
+type Message struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	PeerID     string    `json:"peer_id"`
+	PeerHandle string    `json:"peer_handle"`
+	Message    string    `json:"message"`
+	Seq        uint64    `json:"seq,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+
+	// Code of system messages, eg: peer.join.
+	Code string `json:"code,omitempty"`
+
+	// Handles mentioned (@handle) in the message.
+	Mentions []string `json:"mentions,omitempty"`
+
+	// Poll created in the message or its results.
+	Poll *Poll `json:"poll,omitempty"`
+
+	// Imported from an external transcript.
+	Imported bool `json:"imported,omitempty"`
+
+	// Queued by a client while it was offline and composed at SentAt.
+	Delayed bool       `json:"delayed,omitempty"`
+	SentAt  *time.Time `json:"sent_at,omitempty"`
+
+	// Optional tamper-evident hash chain.
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Poll represents a poll and its vote counts by option.
+type Poll struct {
+	ID       uint64   `json:"id"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	Votes    []int    `json:"votes"`
+	Closed   bool     `json:"closed,omitempty"`
 }
 
 // ErrRoomNotFound indicates that the requested room was not found.
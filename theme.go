@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Colour schemes of the pages.
+const (
+	schemeLight = "light"
+	schemeDark  = "dark"
+)
+
+type reqTheme struct {
+	Scheme string `json:"scheme"`
+}
+
+// validScheme checks if s is a known colour scheme. "" is the instance's
+// default.
+func validScheme(s string) bool {
+	return s == "" || s == schemeLight || s == schemeDark
+}
+
+// pageScheme returns the colour scheme to render a page in: the peer's
+// preference in the room, or the instance's default.
+func pageScheme(ctx *reqCtx) string {
+	if ctx.sess.Scheme != "" {
+		return ctx.sess.Scheme
+	}
+	return ctx.vhost.cfg.ColorScheme
+}
+
+// handleSetScheme sets the peer's colour scheme preference in a room, which
+// is saved in their session.
+func handleSetScheme(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	var req reqTheme
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if !validScheme(req.Scheme) {
+		respondJSON(w, nil, errors.New("unknown colour scheme"), http.StatusBadRequest)
+		return
+	}
+
+	s, err := app.hub.Store.GetSession(ctx.sess.ID, room.ID)
+	if err != nil {
+		app.logger.Printf("error fetching session: %v", err)
+		respondJSON(w, nil, errors.New("error checking session"), http.StatusInternalServerError)
+		return
+	}
+	if s.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+
+	s.Scheme = req.Scheme
+	if err := app.hub.Store.AddSession(s, room.ID, room.TTL()); err != nil {
+		app.logger.Printf("error updating session: %v", err)
+		respondJSON(w, nil, errors.New("error updating session"), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, true, nil, http.StatusOK)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS modes.
+const (
+	tlsNone     = "none"
+	tlsFiles    = "files"
+	tlsAutocert = "autocert"
+)
+
+// tlsCfg represents the native TLS configuration.
+type tlsCfg struct {
+	Mode string `koanf:"mode"`
+
+	// Certificate and key files.
+	CertFile string `koanf:"cert_file"`
+	KeyFile  string `koanf:"key_file"`
+
+	// ACME (Let's Encrypt) autocert.
+	Domains  []string `koanf:"domains"`
+	Email    string   `koanf:"email"`
+	CacheDir string   `koanf:"cache_dir"`
+
+	// Plain HTTP address that serves ACME HTTP-01 challenges and redirects
+	// all other requests to HTTPS in the autocert mode.
+	HTTPAddress string `koanf:"http_address"`
+}
+
+// validate checks that the settings required by the TLS mode are set.
+func (c tlsCfg) validate() error {
+	switch c.Mode {
+	case "", tlsNone:
+	case tlsFiles:
+		if c.CertFile == "" || c.KeyFile == "" {
+			return errors.New("tls.cert_file and tls.key_file are required")
+		}
+	case tlsAutocert:
+		if len(c.Domains) == 0 {
+			return errors.New("tls.domains is required for autocert")
+		}
+	default:
+		return errors.New("unknown tls.mode: " + c.Mode)
+	}
+	return nil
+}
+
+// listenAndServe starts the HTTP server over plain HTTP or TLS depending on
+// the TLS configuration. It blocks until the server stops.
+func listenAndServe(srv *http.Server, c tlsCfg) error {
+	switch c.Mode {
+	case "", tlsNone:
+		logger.Printf("starting server on %v", srv.Addr)
+		return srv.ListenAndServe()
+
+	case tlsFiles:
+		if err := c.validate(); err != nil {
+			return err
+		}
+		logger.Printf("starting TLS server on %v", srv.Addr)
+		return srv.ListenAndServeTLS(c.CertFile, c.KeyFile)
+
+	case tlsAutocert:
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.CacheDir == "" {
+			c.CacheDir = "certs"
+		}
+		if c.HTTPAddress == "" {
+			c.HTTPAddress = ":80"
+		}
+
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.Domains...),
+			Cache:      autocert.DirCache(c.CacheDir),
+			Email:      c.Email,
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+
+		// HTTP-01 challenges are answered over plain HTTP.
+		go func() {
+			logger.Printf("starting ACME HTTP-01 server on %v", c.HTTPAddress)
+			if err := http.ListenAndServe(c.HTTPAddress, m.HTTPHandler(nil)); err != nil {
+				logger.Fatalf("couldn't start ACME HTTP-01 server: %v", err)
+			}
+		}()
+
+		logger.Printf("starting TLS (autocert) server on %v for %v", srv.Addr, c.Domains)
+		return srv.ListenAndServeTLS("", "")
+	}
+
+	return errors.New("unknown tls.mode: " + c.Mode)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/knadh/niltalk/internal/hub"
+)
+
+var errTURNDisabled = errors.New("TURN relay is not configured")
+
+// handleTURNCredentials issues time-limited credentials for the TURN server
+// to a peer so that it can relay WebRTC media (calls, file transfers) when
+// it can't connect to other peers directly. The credentials are bound to
+// the peer's session key as the username is visible to the TURN server and
+// in its logs.
+func handleTURNCredentials(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
+	}
+	if ctx.sess.ID == "" {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return
+	}
+	if app.turn == nil {
+		respondJSON(w, nil, errTURNDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	respondJSON(w, app.turn.Credentials(hub.SessionKey(ctx.sess.ID)), nil, http.StatusOK)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/niltalk/internal/captcha"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/ipfilter"
+	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/internal/passwd"
+	"github.com/knadh/niltalk/internal/tracing"
+	"github.com/knadh/niltalk/internal/transcript"
+	"github.com/knadh/niltalk/internal/turn"
+)
+
+// configErrors is the list of problems found in a config.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// validateConfig checks the config in k for settings that are missing, out
+// of range, or that contradict each other. It returns all the problems found
+// (configErrors) instead of stopping at the first one. Stores and other
+// external services aren't connected to.
+func validateConfig(k *koanf.Koanf) error {
+	var errs configErrors
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var cfg hub.Config
+	if err := k.Unmarshal("app", &cfg); err != nil {
+		return configErrors{fmt.Errorf("error unmarshalling 'app' config: %v", err)}
+	}
+	for _, err := range validateAppConfig(cfg) {
+		add(err)
+	}
+
+	if presets, err := loadPresets(k, &cfg); err != nil {
+		add(err)
+	} else if _, err := loadVhosts(k, &cfg, presets); err != nil {
+		add(err)
+	}
+
+	// Stores.
+	add(validateStoreConfig(k, "store"))
+	for _, n := range k.MapKeys("store.regions") {
+		add(validateStoreConfig(k, "store.regions."+n))
+	}
+
+	// Other sections are validated by the constructors that use them, none
+	// of which have side effects.
+	var captchaCfg captcha.Config
+	if err := k.Unmarshal("captcha", &captchaCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'captcha' config: %v", err))
+	} else if _, err := captcha.New(captchaCfg); err != nil {
+		add(fmt.Errorf("captcha: %v", err))
+	}
+
+	var turnCfg turn.Config
+	if err := k.Unmarshal("turn", &turnCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'turn' config: %v", err))
+	} else if _, err := turn.New(turnCfg); err != nil {
+		add(fmt.Errorf("turn: %v", err))
+	}
+
+	var pwdCfg passwd.Config
+	if err := k.Unmarshal("password", &pwdCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'password' config: %v", err))
+	} else if _, err := passwd.New(pwdCfg); err != nil {
+		add(fmt.Errorf("password: %v", err))
+	}
+
+	var rlCfg rateLimitCfg
+	if err := k.Unmarshal("ratelimit", &rlCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'ratelimit' config: %v", err))
+	}
+
+	var blCfg ipfilter.Config
+	if err := k.Unmarshal("blocklist", &blCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'blocklist' config: %v", err))
+	} else if _, err := ipfilter.New(blCfg); err != nil {
+		add(fmt.Errorf("blocklist: %v", err))
+	}
+
+	var filterCfg hub.FilterConfig
+	if err := k.Unmarshal("filters", &filterCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'filters' config: %v", err))
+	} else if _, err := hub.NewFilters(filterCfg); err != nil {
+		add(fmt.Errorf("filters: %v", err))
+	}
+
+	var notifyCfg map[string]notify.Config
+	if err := k.Unmarshal("notifications", &notifyCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'notifications' config: %v", err))
+	} else {
+		add(notify.Validate(notifyCfg))
+	}
+
+	var secConf securityCfg
+	if err := k.Unmarshal("security", &secConf); err != nil {
+		add(fmt.Errorf("error unmarshalling 'security' config: %v", err))
+	} else {
+		add(secConf.validate())
+	}
+
+	var smtpConf smtpCfg
+	if err := k.Unmarshal("smtp", &smtpConf); err != nil {
+		add(fmt.Errorf("error unmarshalling 'smtp' config: %v", err))
+	} else {
+		add(smtpConf.validate())
+	}
+
+	var traceCfg tracing.Config
+	if err := k.Unmarshal("tracing", &traceCfg); err != nil {
+		add(fmt.Errorf("error unmarshalling 'tracing' config: %v", err))
+	} else {
+		add(traceCfg.Validate())
+	}
+
+	var tlsConf tlsCfg
+	if err := k.Unmarshal("tls", &tlsConf); err != nil {
+		add(fmt.Errorf("error unmarshalling 'tls' config: %v", err))
+	} else {
+		add(tlsConf.validate())
+	}
+
+	if _, err := transcript.NewSigner(k.String("export.signing_key")); err != nil {
+		add(fmt.Errorf("export.signing_key: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateAppConfig checks the [app] config.
+func validateAppConfig(cfg hub.Config) []error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if cfg.Address == "" {
+		add("app.address is empty")
+	} else if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		add("invalid app.address: %v", err)
+	}
+
+	if cfg.RootURL == "" {
+		add("app.root_url is empty")
+	} else if u, err := url.Parse(cfg.RootURL); err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		add("invalid app.root_url: %s", cfg.RootURL)
+	} else if strings.HasSuffix(cfg.RootURL, "/") {
+		add("app.root_url should not end with a slash")
+	} else if p := strings.TrimRight(cfg.RootPath, "/"); u.Path != p {
+		add("the path of app.root_url (%s) should be app.root_path (%s)", u.Path, p)
+	}
+	if cfg.RootPath != "" && !strings.HasPrefix(cfg.RootPath, "/") {
+		add("app.root_path should start with a slash")
+	}
+	if cfg.ThemeDir != "" {
+		if fi, err := os.Stat(cfg.ThemeDir); err != nil || !fi.IsDir() {
+			add("app.theme_dir is not a directory: %s", cfg.ThemeDir)
+		}
+	}
+	if !validScheme(cfg.ColorScheme) {
+		add("unknown app.color_scheme: %s", cfg.ColorScheme)
+	}
+
+	minTime := time.Duration(3) * time.Second
+	if cfg.RoomAge < minTime || cfg.WSTimeout < minTime {
+		add("app.websocket_timeout and app.room_age should be >= 3s")
+	}
+	if cfg.MaxMessageLen <= 0 {
+		add("app.max_message_length should be > 0")
+	}
+	if cfg.RoomIDLen <= 0 {
+		add("app.room_id_length should be > 0")
+	}
+	if cfg.MaxCallPeers < 0 {
+		add("app.max_call_peers should be >= 0")
+	}
+	if cfg.PongTimeout < 0 || cfg.IdleTimeout < 0 || cfg.IdleWarning < 0 {
+		add("app.peer_pong_timeout, app.peer_idle_timeout, and app.peer_idle_warning should be >= 0")
+	}
+	if (cfg.PongTimeout > 0 || cfg.IdleTimeout > 0) && cfg.PeerHeartbeat <= 0 {
+		add("app.peer_pong_timeout and app.peer_idle_timeout need app.peer_heartbeat_interval")
+	}
+	if cfg.IdleTimeout > 0 && cfg.IdleWarning >= cfg.IdleTimeout {
+		add("app.peer_idle_warning should be < app.peer_idle_timeout")
+	}
+	if cfg.ResumeTTL < 0 {
+		add("app.resume_ttl should be >= 0")
+	}
+	if cfg.RoomQueueSize < 0 {
+		add("app.room_queue_size should be >= 0")
+	}
+	if cfg.MaxScheduleAhead < 0 {
+		add("app.max_schedule_ahead should be >= 0")
+	}
+	if cfg.HTTPCompression && (cfg.HTTPCompressionLvl < 1 || cfg.HTTPCompressionLvl > 9) {
+		add("app.http_compression_level should be 1 - 9")
+	}
+	if cfg.WSCompression && (cfg.WSCompressionLvl < 1 || cfg.WSCompressionLvl > 9) {
+		add("app.websocket_compression_level should be 1 - 9")
+	}
+
+	if _, err := ipfilter.ParseCIDRs(cfg.TrustedProxies); err != nil {
+		add("error in app.trusted_proxies: %v", err)
+	}
+	if _, err := checkOrigin(&App{cfg: &cfg}); err != nil {
+		add("error in app.websocket_allowed_origins: %v", err)
+	}
+	if _, err := newRouteToggles(cfg.DisabledRoutes); err != nil {
+		add("error in app.disabled_routes: %v", err)
+	}
+
+	switch cfg.WeakPasswordPolicy {
+	case "", hub.WeakPasswordRotate, hub.WeakPasswordExpire:
+	default:
+		add("unknown app.weak_password_policy: %s", cfg.WeakPasswordPolicy)
+	}
+
+	switch cfg.SlowPeerPolicy {
+	case "", hub.SlowPeerDisconnect, hub.SlowPeerDropOldest, hub.SlowPeerDropNewest:
+	default:
+		add("unknown app.slow_peer_policy: %s", cfg.SlowPeerPolicy)
+	}
+
+	switch cfg.SpamAction {
+	case "", hub.SpamNone, hub.SpamMute, hub.SpamKick:
+	default:
+		add("unknown app.spam_action: %s", cfg.SpamAction)
+	}
+
+	switch cfg.PersistentRooms {
+	case "", hub.PersistentDisabled, hub.PersistentAdmin, hub.PersistentAll:
+	default:
+		add("unknown app.persistent_rooms: %s", cfg.PersistentRooms)
+	}
+
+	switch cfg.RoomAutoTitle {
+	case "", "none", hub.AutoTitleFirstMessage:
+	case hub.AutoTitleWebhook:
+		if cfg.RoomTitleWebhook == "" {
+			add("app.room_title_webhook is required when app.room_auto_title is webhook")
+		}
+	default:
+		add("unknown app.room_auto_title: %s", cfg.RoomAutoTitle)
+	}
+
+	if _, err := hub.NewAgeApprover(cfg.RoomAgeApproval, cfg.RoomAgeWebhook); err != nil {
+		add("error in app.room_age_approval: %v", err)
+	}
+
+	switch strings.ToLower(cfg.CookieSameSite) {
+	case "", "lax", "strict":
+	case "none":
+		// Browsers drop SameSite=None cookies that aren't Secure.
+		if !cfg.CookieSecure {
+			add("app.cookie_samesite = none requires app.cookie_secure")
+		}
+	default:
+		add("unknown app.cookie_samesite: %s", cfg.CookieSameSite)
+	}
+	if cfg.SessionCookie == "" {
+		add("app.session_cookie is empty")
+	}
+
+	// Operators join via the admin API, which is disabled without a token.
+	if cfg.AdminTOTPSecret != "" && cfg.AdminToken == "" {
+		add("app.admin_totp_secret requires app.admin_token")
+	}
+	if cfg.HistoryHashChain && !cfg.History {
+		add("app.history_hash_chain requires app.history")
+	}
+	return errs
+}
+
+// validateStoreConfig checks the config of the store under the given key,
+// eg: "store" or "store.regions.eu".
+func validateStoreConfig(k *koanf.Koanf, key string) error {
+	switch typ := k.String(key + ".type"); typ {
+	case "", "redis":
+		if k.String(key+".address") == "" {
+			return fmt.Errorf("%s.address is required for the redis store", key)
+		}
+	case "sqlite", "bolt":
+		if k.String(key+"."+typ+".path") == "" {
+			return fmt.Errorf("%s.%s.path is required for the %s store", key, typ, typ)
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("unknown store type '%s' in '%s'", typ, key)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/stuffbin"
+)
+
+// vhostCfg represents the config of a virtual host ([vhosts.<id>]).
+type vhostCfg struct {
+	Hosts           []string `koanf:"hosts"`
+	Name            string   `koanf:"name"`
+	RootURL         string   `koanf:"root_url"`
+	StaticDir       string   `koanf:"static_dir"`
+	MaxRooms        int      `koanf:"max_rooms"`
+	MaxPeersPerRoom int      `koanf:"max_peers_per_room"`
+
+	// Presets ([presets.<name>]) that can be picked on the vhost. All of
+	// them if it's empty.
+	Presets []string `koanf:"presets"`
+
+	// Features enabled for all the vhost's rooms regardless of their
+	// rollouts.
+	Features []string `koanf:"features"`
+
+	// Options of the vhost's rooms that aren't set in the request or its
+	// preset.
+	RoomDefaults roomPreset `koanf:"room_defaults"`
+}
+
+// vhost is a logical instance of the app that's served from the same process
+// on a set of hosts (the request's Host header). Its rooms are kept apart
+// from the rooms of other vhosts. Requests to other hosts are served by the
+// default vhost (ID "") with the global config.
+type vhost struct {
+	ID    string
+	Hosts []string
+
+	// App config with the vhost's overrides.
+	cfg *hub.Config
+
+	// Optional static files and templates that replace the default ones.
+	// They're nil if there's no static_dir. Guarded by app.mut.
+	staticDir string
+	fs        stuffbin.FileSystem
+	tpl       *template.Template
+	assets    map[string]string
+
+	// Maximum number of active rooms. 0 is unlimited.
+	maxRooms int
+
+	// Presets that can be picked on the vhost (all if it's empty) and the
+	// features enabled for its rooms.
+	presets  []string
+	features []string
+
+	// Defaults of the options of the vhost's rooms. Guarded by app.mut as
+	// they can be changed via the admin API.
+	defaults roomPreset
+}
+
+// loadVhosts reads the virtual hosts in k and applies their overrides to a
+// copy of the app config.
+func loadVhosts(k *koanf.Koanf, base *hub.Config, presets map[string]roomPreset) ([]*vhost, error) {
+	ids := k.MapKeys("vhosts")
+	sort.Strings(ids)
+
+	var (
+		out   = make([]*vhost, 0, len(ids))
+		hosts = make(map[string]string)
+	)
+	for _, id := range ids {
+		var c vhostCfg
+		if err := k.Unmarshal("vhosts."+id, &c); err != nil {
+			return nil, fmt.Errorf("error unmarshalling 'vhosts.%s' config: %v", id, err)
+		}
+		if len(c.Hosts) == 0 {
+			return nil, fmt.Errorf("vhosts.%s.hosts is empty", id)
+		}
+		if c.MaxRooms < 0 || c.MaxPeersPerRoom < 0 {
+			return nil, fmt.Errorf("vhosts.%s limits should be >= 0", id)
+		}
+		if c.RootURL != "" {
+			if u, err := url.Parse(c.RootURL); err != nil || u.Host == "" || strings.HasSuffix(c.RootURL, "/") {
+				return nil, fmt.Errorf("invalid vhosts.%s.root_url: %s", id, c.RootURL)
+			}
+		}
+
+		for _, p := range c.Presets {
+			if _, ok := presets[p]; !ok {
+				return nil, fmt.Errorf("unknown preset in vhosts.%s.presets: %s", id, p)
+			}
+		}
+
+		vh := &vhost{ID: id, staticDir: c.StaticDir, maxRooms: c.MaxRooms,
+			presets: c.Presets, features: c.Features, defaults: c.RoomDefaults}
+		for _, h := range c.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hosts[h]; ok {
+				return nil, fmt.Errorf("host %s is in both vhosts.%s and vhosts.%s", h, other, id)
+			}
+			hosts[h] = id
+			vh.Hosts = append(vh.Hosts, h)
+		}
+
+		cfg := *base
+		if c.Name != "" {
+			cfg.Name = c.Name
+		}
+		if c.RootURL != "" {
+			cfg.RootURL = c.RootURL
+		} else {
+			// The first host with the scheme and path of the default
+			// root URL.
+			scheme := "http"
+			if u, err := url.Parse(base.RootURL); err == nil && u.Scheme != "" {
+				scheme = u.Scheme
+			}
+			cfg.RootURL = scheme + "://" + vh.Hosts[0] + strings.TrimRight(base.RootPath, "/")
+		}
+		if c.MaxRooms > 0 {
+			cfg.MaxRooms = c.MaxRooms
+		}
+		if c.MaxPeersPerRoom > 0 {
+			cfg.MaxPeersPerRoom = c.MaxPeersPerRoom
+		}
+		vh.cfg = &cfg
+
+		if err := c.RoomDefaults.validate(vh.cfg); err != nil {
+			return nil, fmt.Errorf("vhosts.%s.room_defaults: %v", id, err)
+		}
+		out = append(out, vh)
+	}
+	return out, nil
+}
+
+// tenant returns the hub settings of the vhost's rooms.
+func (vh *vhost) tenant() hub.Tenant {
+	return hub.Tenant{
+		RootURL:         vh.cfg.RootURL,
+		MaxRooms:        vh.maxRooms,
+		MaxPeersPerRoom: vh.cfg.MaxPeersPerRoom,
+		Features:        vh.features,
+	}
+}
+
+// hasPreset checks if a preset can be picked on the vhost.
+func (vh *vhost) hasPreset(name string) bool {
+	if len(vh.presets) == 0 {
+		return true
+	}
+	for _, p := range vh.presets {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// presetNames returns the sorted names of the presets that can be picked on
+// the vhost.
+func (vh *vhost) presetNames(presets map[string]roomPreset) []string {
+	if len(vh.presets) == 0 {
+		return presetNames(presets)
+	}
+	out := append([]string{}, vh.presets...)
+	sort.Strings(out)
+	return out
+}
+
+// roomDefaults returns the defaults of the options of a vhost's rooms.
+func (app *App) roomDefaults(vh *vhost) roomPreset {
+	app.mut.RLock()
+	defer app.mut.RUnlock()
+	return vh.defaults
+}
+
+// setRoomDefaults changes the defaults of the options of a vhost's rooms.
+// They apply to rooms created after the change.
+func (app *App) setRoomDefaults(vh *vhost, p roomPreset) {
+	app.mut.Lock()
+	vh.defaults = p
+	app.mut.Unlock()
+}
+
+// loadTemplates loads the vhost's static files and compiles its templates
+// if it has a static directory.
+func (vh *vhost) loadTemplates() (stuffbin.FileSystem, *template.Template, error) {
+	if vh.staticDir == "" {
+		return nil, nil, nil
+	}
+	fs, err := newFS(vh.cfg.ThemeDir, vh.staticDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("vhost %s: %v", vh.ID, err)
+	}
+	tpl, err := stuffbin.ParseTemplatesGlob(nil, fs, "/static/templates/*.html")
+	if err != nil {
+		return nil, nil, fmt.Errorf("vhost %s: error compiling templates: %v", vh.ID, err)
+	}
+	return fs, tpl, nil
+}
+
+// vhostFor returns the vhost that serves the request's host.
+func (app *App) vhostFor(r *http.Request) *vhost {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if vh, ok := app.vhosts[strings.ToLower(host)]; ok {
+		return vh
+	}
+	return app.defaultVhost
+}
+
+// tenantVhost returns the vhost with the given ID (tenant) or nil if
+// there's none.
+func (app *App) tenantVhost(id string) *vhost {
+	for _, vh := range app.vhosts {
+		if vh.ID == id {
+			return vh
+		}
+	}
+	return nil
+}
+
+// vhostByID returns the vhost with the given ID (tenant), or the default
+// vhost.
+func (app *App) vhostByID(id string) *vhost {
+	if vh := app.tenantVhost(id); vh != nil {
+		return vh
+	}
+	return app.defaultVhost
+}